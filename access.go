@@ -0,0 +1,25 @@
+package kmap
+
+// WithAccessOrder makes the OrderedMap keep its entries in access order instead of insertion order:
+// reading a key (Get, GetAny, GetOrDefault) or setting it again moves it to the back, so the front is the least
+// recently used entry. With PopFront, or WithEvictToFit and a limit, the map is a ready-made LRU cache.
+// Reads then take the write lock. It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithAccessOrder() *OrderedMap[K, V] {
+	m.Lock()
+	m.accessOrder = true
+	m.Unlock()
+	return m
+}
+
+// touch returns the value of key and moves it to the back, see WithAccessOrder
+func (m *OrderedMap[K, V]) touch(key K) (value V, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	element, ok := m.kv[key]
+	if !ok {
+		return value, false
+	}
+	m.ll.MoveToBack(element)
+	m.stats.hit(key)
+	return element.Value, true
+}
@@ -0,0 +1,106 @@
+package kmap
+
+// Accessor reads and changes a map whose write lock is already held, see WithLock.
+// It must not be used once the callback it was given to returns.
+type Accessor[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	// Set follows the rules of the map Set, size limit included
+	Set(key K, value V) error
+	Delete(key K) bool
+	Len() int
+	// Range calls f for each entry, f may set entries or delete the current one
+	Range(f func(key K, value V) bool)
+}
+
+// WithLock calls fn with the write lock held, the Accessor it receives operates on the locked data
+// so several steps (check a key, update another, delete a third) happen atomically.
+// fn must only use the Accessor, calling methods of the map would deadlock.
+func (c *SafeMap[K, V]) WithLock(fn func(tx Accessor[K, V])) {
+	c.Lock()
+	defer c.unlock()
+	fn(lockedMap[K, V]{c})
+}
+
+// lockedMap is the Accessor of a SafeMap locked by WithLock
+type lockedMap[K comparable, V any] struct {
+	c *SafeMap[K, V]
+}
+
+func (l lockedMap[K, V]) Get(key K) (v V, ok bool) {
+	i, ok := l.c.items[key]
+	ok = ok && i.live()
+	if ok {
+		v = l.c.value(i)
+	}
+	return v, ok
+}
+
+func (l lockedMap[K, V]) Set(key K, value V) error {
+	return l.c.set(key, value)
+}
+
+func (l lockedMap[K, V]) Delete(key K) bool {
+	return l.c.remove(key)
+}
+
+func (l lockedMap[K, V]) Len() int {
+	return len(l.c.items)
+}
+
+func (l lockedMap[K, V]) Range(f func(key K, value V) bool) {
+	now := nowNano()
+	for k, i := range l.c.items {
+		if i.expired(now) {
+			continue
+		}
+		if !f(k, l.c.value(i)) {
+			return
+		}
+	}
+}
+
+// WithLock calls fn with the write lock held, the Accessor it receives operates on the locked data
+// so several steps (check a key, update another, delete a third) happen atomically.
+// fn must only use the Accessor, calling methods of the map would deadlock.
+func (m *OrderedMap[K, V]) WithLock(fn func(tx Accessor[K, V])) {
+	m.Lock()
+	defer m.unlock()
+	fn(lockedOrderedMap[K, V]{m})
+}
+
+// lockedOrderedMap is the Accessor of an OrderedMap locked by WithLock
+type lockedOrderedMap[K comparable, V any] struct {
+	m *OrderedMap[K, V]
+}
+
+func (l lockedOrderedMap[K, V]) Get(key K) (v V, ok bool) {
+	element, ok := l.m.kv[key]
+	if ok {
+		v = element.Value
+	}
+	return v, ok
+}
+
+func (l lockedOrderedMap[K, V]) Set(key K, value V) error {
+	return l.m.set(key, value)
+}
+
+func (l lockedOrderedMap[K, V]) Delete(key K) bool {
+	return l.m.remove(key)
+}
+
+func (l lockedOrderedMap[K, V]) Len() int {
+	return len(l.m.kv)
+}
+
+// Range iterates in order, entries appended by f are visited too
+func (l lockedOrderedMap[K, V]) Range(f func(key K, value V) bool) {
+	for el := l.m.ll.Front(); el != nil; {
+		// f may remove el, which clears its links
+		next := el.Next()
+		if !f(el.Key, el.Value) {
+			return
+		}
+		el = next
+	}
+}
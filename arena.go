@@ -0,0 +1,113 @@
+package kmap
+
+// arenaChunkSize is the size of the chunks values are appended to, larger values get a chunk of their own
+const arenaChunkSize = 1 << 20
+
+// arena keeps serialized values in a few large byte chunks, see WithArena
+type arena struct {
+	enc    Encoding
+	chunks [][]byte
+	// live and garbage count the bytes of current and replaced values
+	live    int
+	garbage int
+}
+
+// arenaSlot locates a value in an arena
+type arenaSlot struct {
+	// chunk is the index of the chunk plus one, 0 when the value is not in an arena
+	chunk  uint32
+	off, n uint32
+}
+
+// put appends data and returns its slot
+func (a *arena) put(data []byte) arenaSlot {
+	last := len(a.chunks) - 1
+	if last < 0 || cap(a.chunks[last])-len(a.chunks[last]) < len(data) {
+		size := arenaChunkSize
+		if len(data) > size {
+			size = len(data)
+		}
+		a.chunks = append(a.chunks, make([]byte, 0, size))
+		last++
+	}
+	off := len(a.chunks[last])
+	a.chunks[last] = append(a.chunks[last], data...)
+	a.live += len(data)
+	return arenaSlot{chunk: uint32(last + 1), off: uint32(off), n: uint32(len(data))}
+}
+
+func (a *arena) get(s arenaSlot) []byte {
+	return a.chunks[s.chunk-1][s.off : s.off+s.n]
+}
+
+// free records that the value in s is no longer used, its bytes are reclaimed by the next compaction
+func (a *arena) free(s arenaSlot) {
+	a.live -= int(s.n)
+	a.garbage += int(s.n)
+}
+
+// WithArena makes the SafeMap keep its values serialized in large byte chunks, decoded on every read,
+// so the garbage collector sees a handful of big allocations instead of the pointers of millions of values,
+// cutting GC pauses for multi-GB caches. Values are serialized with enc, EncodingJSON by default,
+// and must round-trip through it. Reads are slower and allocate the decoded value, and the bytes of replaced
+// values are reclaimed by compacting the chunks once they exceed the live ones.
+// Spilled values (see WithOverflow) stay on disk, the size accounting is unchanged.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithArena(enc ...Encoding) *SafeMap[K, V] {
+	a := &arena{enc: EncodingJSON}
+	if len(enc) > 0 {
+		a.enc = enc[0]
+	}
+	c.Lock()
+	c.arena = a
+	c.Unlock()
+	return c
+}
+
+// toArena serializes the value of i into the arena, the write lock must be held
+func (c *SafeMap[K, V]) toArena(i item[V]) (item[V], error) {
+	data, err := marshalValue(c.arena.enc, i.Value)
+	if err != nil {
+		return i, err
+	}
+	return item[V]{Size: i.Size, rev: i.rev, expires: i.expires, ttl: i.ttl, slot: c.arena.put(data)}, nil
+}
+
+// fromArena decodes the value of i, the lock must be held
+func (c *SafeMap[K, V]) fromArena(i item[V]) V {
+	var v V
+	unmarshalValue(c.arena.enc, c.arena.get(i.slot), &v)
+	return v
+}
+
+// compactArena copies the live values to new chunks once replaced ones take more room, the write lock must be held
+func (c *SafeMap[K, V]) compactArena() {
+	if c.arena.garbage < arenaChunkSize || c.arena.garbage < c.arena.live {
+		return
+	}
+	c.own()
+	old := c.arena
+	c.arena = &arena{enc: old.enc}
+	for k, i := range c.items {
+		if i.slot.chunk != 0 {
+			i.slot = c.arena.put(old.get(i.slot))
+			c.items[k] = i
+		}
+	}
+}
+
+// arenaLoaded moves loaded values to the arena, the write lock must be held
+func (c *SafeMap[K, V]) arenaLoaded() error {
+	c.own()
+	for k, i := range c.items {
+		if i.spill != "" || i.slot.chunk != 0 {
+			continue
+		}
+		i, err := c.toArena(i)
+		if err != nil {
+			return err
+		}
+		c.items[k] = i
+	}
+	return nil
+}
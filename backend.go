@@ -0,0 +1,447 @@
+package kmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Record is an encoded entry exchanged with a PersistBackend.
+// Keys are encoded so that any comparable key type survives the round trip,
+// values are JSON unless the backend asks for another Encoding (see FileBackend).
+type Record struct {
+	Key   string
+	Value []byte
+	Size  int
+	// Expires is the Unix nanosecond at which the entry expires, 0 for never, see SetWithTTL.
+	// FileBackend and SQLBackend store it, other backends may drop it.
+	Expires int64
+}
+
+// SnapshotInfo holds the map level metadata stored alongside a snapshot
+type SnapshotInfo struct {
+	Size  int
+	Limit int
+	Count int64
+	// Expiring is set when some records have an expiry, so file backends store it
+	Expiring bool
+}
+
+// PersistBackend is a storage for the entries of a map.
+// Put, Get and Delete work on single entries (write-through backends mirror every mutation with them),
+// Snapshot replaces the whole content at once and Scan reads it back, in snapshot order when the backend can.
+type PersistBackend interface {
+	Put(rec Record) error
+	Get(key string) (Record, bool, error)
+	Delete(key string) error
+	Snapshot(info SnapshotInfo, entries func(yield func(Record) error) error) error
+	Scan(fn func(Record) error) (SnapshotInfo, error)
+}
+
+// encodedBackend is implemented by backends storing values in another encoding than JSON
+type encodedBackend interface {
+	encoding() Encoding
+}
+
+// backendEncoding returns the encoding of the values exchanged with b
+func backendEncoding(b PersistBackend) Encoding {
+	if eb, ok := b.(encodedBackend); ok {
+		return eb.encoding()
+	}
+	return EncodingJSON
+}
+
+// fileSource is implemented by backends storing kmap files,
+// maps read them with the typed loader so every historical format keeps loading
+type fileSource interface {
+	open() (io.ReadCloser, error)
+}
+
+// FileBackend is the default PersistBackend, storing a snapshot in a single kmap file.
+// Snapshot and Scan stream the whole file, Put, Get and Delete rewrite or scan it entirely and are only meant for occasional use.
+type FileBackend struct {
+	mu   sync.Mutex
+	path string
+	opts SaveOptions
+}
+
+// NewFileBackend returns a backend storing snapshots in the file at path with the given options.
+// Record values are serialized with opts.Encoding.
+func NewFileBackend(path string, opts SaveOptions) *FileBackend {
+	return &FileBackend{path: path, opts: opts}
+}
+
+func (b *FileBackend) encoding() Encoding {
+	return b.opts.Encoding
+}
+
+// Snapshot replaces the file with the given entries
+func (b *FileBackend) Snapshot(info SnapshotInfo, entries func(yield func(Record) error) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.write(info, entries)
+}
+
+func (b *FileBackend) write(info SnapshotInfo, entries func(yield func(Record) error) error) error {
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+
+	hdr := fileHeader{
+		Size:  info.Size,
+		Limit: info.Limit,
+		Count: info.Count,
+	}
+	if info.Expiring {
+		hdr.Flags |= flagExpiry
+	}
+	var buf bytes.Buffer
+	err := writeSnapshot(&buf, b.opts, hdr, func(emit func(key string, value []byte, size int, expires int64) error) error {
+		return entries(func(rec Record) error {
+			return emit(rec.Key, rec.Value, rec.Size, rec.Expires)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeLocked(b.path, buf.Bytes(), b.opts.LockTimeout)
+}
+
+// Scan streams the entries of the file to fn, in the order they were saved.
+// v1 binary files hold typed entries and can only be read by LoadFromFile.
+func (b *FileBackend) Scan(fn func(Record) error) (SnapshotInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.scan(fn)
+}
+
+func (b *FileBackend) scan(fn func(Record) error) (SnapshotInfo, error) {
+	file, err := openLocked(b.path, os.O_RDONLY, b.opts.LockTimeout)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer file.Close()
+
+	br, hdr, closeFn, err := openSnapshot(file)
+	defer closeFn()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	switch {
+	case hdr.Version == versionV2:
+		err = scanV2(br, &hdr, func(key string, value []byte, size int, expires int64) error {
+			if encodingOf(hdr.Flags) != b.opts.Encoding {
+				return ErrEncodingMismatch
+			}
+			return fn(Record{Key: key, Value: value, Size: size, Expires: expires})
+		})
+	case hdr.json && b.opts.Encoding != EncodingJSON:
+		err = ErrEncodingMismatch
+	case hdr.json:
+		var entries []fileEntry[string, json.RawMessage]
+		entries, err = readJSONV1[string, json.RawMessage](br, &hdr)
+		for _, e := range entries {
+			if err != nil {
+				break
+			}
+			err = fn(Record{Key: e.Key, Value: e.Value, Size: e.Size})
+		}
+	default:
+		err = ErrUnsupportedVersion
+	}
+	if err == nil && hdr.Flags&flagDelta != 0 {
+		err = ErrDeltaFile
+	}
+	return SnapshotInfo{Size: hdr.Size, Limit: hdr.Limit, Count: hdr.Count}, err
+}
+
+// Put stores a single entry, rewriting the whole file
+func (b *FileBackend) Put(rec Record) error {
+	return b.update(func(records []Record) []Record {
+		for i := range records {
+			if records[i].Key == rec.Key {
+				records[i] = rec
+				return records
+			}
+		}
+		return append(records, rec)
+	})
+}
+
+// Delete removes a single entry, rewriting the whole file
+func (b *FileBackend) Delete(key string) error {
+	return b.update(func(records []Record) []Record {
+		for i := range records {
+			if records[i].Key == key {
+				return append(records[:i], records[i+1:]...)
+			}
+		}
+		return records
+	})
+}
+
+// Get looks up a single entry by scanning the file
+func (b *FileBackend) Get(key string) (Record, bool, error) {
+	var found Record
+	var ok bool
+	_, err := b.Scan(func(rec Record) error {
+		if rec.Key == key {
+			found, ok = rec, true
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return found, ok, err
+}
+
+// update applies fn to every record of the file and writes the result back
+func (b *FileBackend) update(fn func([]Record) []Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []Record
+	info, err := b.scan(func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	records = fn(records)
+	info.Count = int64(len(records))
+	info.Size = 0
+	info.Expiring = false
+	for _, rec := range records {
+		info.Size += rec.Size
+		info.Expiring = info.Expiring || rec.Expires != 0
+	}
+	return b.write(info, func(yield func(Record) error) error {
+		for _, rec := range records {
+			if err := yield(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *FileBackend) open() (io.ReadCloser, error) {
+	return openLocked(b.path, os.O_RDONLY, b.opts.LockTimeout)
+}
+
+// WithBackend mirrors every Set, Delete and Flush of the SafeMap into b (write-through), so b is always a durable copy
+// of the map that LoadFromBackend can rebuild it from at startup. A Set fails without changing the map when b.Put fails.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithBackend(b PersistBackend) *SafeMap[K, V] {
+	c.Lock()
+	c.backend = b
+	c.Unlock()
+	return c
+}
+
+// putRecord encodes and stores a single entry in b, expiring at the Unix nanosecond expires or never when 0
+func putRecord[K comparable, V any](b PersistBackend, key K, value V, size int, expires int64) error {
+	k, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	v, err := marshalValue(backendEncoding(b), value)
+	if err != nil {
+		return err
+	}
+	return b.Put(Record{Key: k, Value: v, Size: size, Expires: expires})
+}
+
+// deleteRecord removes a single entry from b
+func deleteRecord[K comparable](b PersistBackend, key K) error {
+	k, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return b.Delete(k)
+}
+
+// clearBackend replaces the content of b with an empty snapshot
+func clearBackend(b PersistBackend, limit int) error {
+	return b.Snapshot(SnapshotInfo{Limit: limit}, func(yield func(Record) error) error {
+		return nil
+	})
+}
+
+// SaveToBackend writes a snapshot of the SafeMap to b
+func (m *SafeMap[K, V]) SaveToBackend(b PersistBackend) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	info := SnapshotInfo{
+		Size:     m.size,
+		Limit:    m.limit,
+		Count:    int64(len(m.items)),
+		Expiring: m.expiring(),
+	}
+	enc := backendEncoding(b)
+	err := b.Snapshot(info, func(yield func(Record) error) error {
+		return m.eachRecord(enc, yield)
+	})
+	if err != nil {
+		return err
+	}
+	m.resetDirty()
+	return nil
+}
+
+// eachRecord encodes every entry of the SafeMap with enc, the lock must be held
+func (m *SafeMap[K, V]) eachRecord(enc Encoding, yield func(Record) error) error {
+	for k, v := range m.items {
+		key, err := encodeKey(k)
+		if err != nil {
+			return err
+		}
+		value, err := marshalValue(enc, m.value(v))
+		if err != nil {
+			return err
+		}
+		if err := yield(Record{Key: key, Value: value, Size: v.Size, Expires: v.expires}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFromBackend replaces the content of the SafeMap with the snapshot stored in b
+func (m *SafeMap[K, V]) LoadFromBackend(b PersistBackend) error {
+	if fs, ok := b.(fileSource); ok {
+		r, err := fs.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return m.LoadFrom(r)
+	}
+
+	entries, info, err := scanBackend[K, V](b)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	defer m.resetDirty()
+
+	m.hooks.reload()
+	m.dropClean()
+	m.releaseAll()
+	m.size = info.Size
+	m.limit = info.Limit
+	m.items = make(map[K]item[V], len(entries))
+	now := nowNano()
+	for _, e := range entries {
+		if i, ok := loadedItem(e, now); ok {
+			m.items[e.Key] = i
+		} else {
+			m.size -= e.Size
+		}
+	}
+	return m.spillLoaded()
+}
+
+// SaveToBackend writes a snapshot of the OrderedMap to b, in order
+func (m *OrderedMap[K, V]) SaveToBackend(b PersistBackend) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	info := SnapshotInfo{
+		Size:  m.size,
+		Limit: m.limit,
+		Count: int64(len(m.kv)),
+	}
+	enc := backendEncoding(b)
+	return b.Snapshot(info, func(yield func(Record) error) error {
+		return m.eachRecord(enc, yield)
+	})
+}
+
+// eachRecord encodes every entry of the OrderedMap in order with enc, the lock must be held
+func (m *OrderedMap[K, V]) eachRecord(enc Encoding, yield func(Record) error) error {
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		key, err := encodeKey(el.Key)
+		if err != nil {
+			return err
+		}
+		value, err := marshalValue(enc, el.Value)
+		if err != nil {
+			return err
+		}
+		if err := yield(Record{Key: key, Value: value, Size: el.size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFromBackend replaces the content of the OrderedMap with the snapshot stored in b, in the order b returns it
+func (m *OrderedMap[K, V]) LoadFromBackend(b PersistBackend) error {
+	if fs, ok := b.(fileSource); ok {
+		r, err := fs.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return m.LoadFrom(r)
+	}
+
+	entries, info, err := scanBackend[K, V](b)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.kv = make(map[K]*Element[K, V], len(entries))
+	m.ll = list[K, V]{}
+	m.size = info.Size
+	m.limit = info.Limit
+	for _, e := range entries {
+		if old, ok := m.kv[e.Key]; ok {
+			m.ll.Remove(old)
+		}
+		el := m.ll.PushBack(e.Key, e.Value)
+		el.size = e.Size
+		m.kv[e.Key] = el
+	}
+	return nil
+}
+
+// scanBackend reads and decodes every record of b
+func scanBackend[K comparable, V any](b PersistBackend) ([]fileEntry[K, V], SnapshotInfo, error) {
+	var entries []fileEntry[K, V]
+	enc := backendEncoding(b)
+	info, err := b.Scan(func(rec Record) error {
+		e, err := decodeRecord[K, V](enc, rec)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, info, err
+}
+
+// decodeRecord decodes the key and the value of a record serialized with enc
+func decodeRecord[K comparable, V any](enc Encoding, rec Record) (fileEntry[K, V], error) {
+	k, err := decodeKey[K](rec.Key)
+	if err != nil {
+		return fileEntry[K, V]{}, err
+	}
+	e := fileEntry[K, V]{Key: k, Size: rec.Size, Expires: rec.Expires}
+	err = unmarshalValue(enc, rec.Value, &e.Value)
+	return e, err
+}
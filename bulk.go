@@ -0,0 +1,229 @@
+package kmap
+
+// Pair is a key and its value, used where the order of entries matters
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// Entry is a key and its value read from a map, as returned by Entries, Slice or GetRange or passed to the less function of Sort. It converts to a Pair with Pair[K, V](e).
+type Entry[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// SetMany inserts all entries under a single lock, much faster than calling Set in a loop when warming up a map.
+// The total size is validated first: when the entries do not fit, nothing is inserted and ErrLargeData or
+// ErrLimitExceeded is returned (unless WithEvictToFit is set, other entries are then evicted to make room).
+// With a backend, a failing write stops the insertion and the entries already written are kept.
+func (c *SafeMap[K, V]) SetMany(entries map[K]V) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	c.Lock()
+	defer c.unlock()
+	return c.apply(entries, nil)
+}
+
+// apply sets entries and removes deleted keys, validating the size of the result first, see SetMany.
+// The keys of entries and deleted must be distinct. The write lock must be held.
+func (c *SafeMap[K, V]) apply(entries map[K]V, deleted map[K]bool) error {
+	measure := c.limit > 0 || c.overflowDir != ""
+	items := make(map[K]item[V], len(entries))
+	batch, need := 0, 0
+	for k, v := range entries {
+		i := item[V]{Value: v}
+		if measure {
+			i.Size = c.valueSize(v)
+		}
+		if c.shouldSpill(i.Size) {
+			// Spilled later, once the batch is known to fit
+			continue
+		}
+		if c.limit <= 0 {
+			i.Size = 0
+		} else if i.Size > c.limit {
+			c.log.warn("kmap: value rejected", "key", k, "size", i.Size, "limit", c.limit, "error", ErrLargeData)
+			return ErrLargeData
+		}
+		items[k] = i
+		batch += i.Size
+		need += i.Size
+		if old, ok := c.items[k]; ok {
+			// The previous value is replaced, it does not need room
+			need -= old.Size
+		}
+	}
+	for k := range deleted {
+		need -= c.items[k].Size
+	}
+
+	if c.limit > 0 && c.size+need > c.limit {
+		if !c.evictToFitSet || batch > c.limit {
+			c.log.warn("kmap: batch rejected", "entries", len(entries), "size", batch, "limit", c.limit, "error", ErrLimitExceeded)
+			return ErrLimitExceeded
+		}
+		c.evictToFit(need, func(k K) bool {
+			_, ok := entries[k]
+			return ok || deleted[k]
+		})
+	}
+
+	for k := range deleted {
+		c.remove(k)
+	}
+	for k, value := range entries {
+		i, ok := items[k]
+		if !ok {
+			spilled, err := c.spill(value)
+			if err != nil {
+				return err
+			}
+			i = spilled
+		}
+		if err := c.store(k, i, value, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMany inserts all entries under a single lock, new keys are appended in no particular order, see SetPairs to choose it.
+// The total size is validated first: when the entries do not fit, nothing is inserted and ErrLargeData or
+// ErrLimitExceeded is returned (unless WithEvictToFit is set, other entries are then evicted to make room).
+func (m *OrderedMap[K, V]) SetMany(entries map[K]V) error {
+	pairs := make([]Pair[K, V], 0, len(entries))
+	for k, v := range entries {
+		pairs = append(pairs, Pair[K, V]{Key: k, Value: v})
+	}
+	return m.SetPairs(pairs)
+}
+
+// SetPairs inserts all pairs under a single lock, new keys are appended in the order of pairs
+// and a key present several times takes its last value.
+// The total size is validated first: when the pairs do not fit, nothing is inserted and ErrLargeData or
+// ErrLimitExceeded is returned (unless WithEvictToFit is set, other entries are then evicted to make room).
+func (m *OrderedMap[K, V]) SetPairs(pairs []Pair[K, V]) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	changes := make([]change[K, V], len(pairs))
+	for i, p := range pairs {
+		changes[i] = change[K, V]{key: p.Key, value: p.Value}
+	}
+	m.Lock()
+	defer m.unlock()
+	return m.apply(changes)
+}
+
+// change is a staged Set, or a Delete when del is true
+type change[K comparable, V any] struct {
+	key   K
+	value V
+	del   bool
+}
+
+// apply performs changes in order, validating the size of the result first, see SetPairs. The write lock must be held.
+func (m *OrderedMap[K, V]) apply(changes []change[K, V]) error {
+	sizes := make([]int, len(changes))
+	if m.limit > 0 {
+		last := make(map[K]int, len(changes))
+		for i, ch := range changes {
+			if !ch.del {
+				sizes[i] = m.valueSize(ch.value)
+				if sizes[i] > m.limit {
+					return ErrLargeData
+				}
+			}
+			last[ch.key] = i
+		}
+		batch, need := 0, 0
+		for k, i := range last {
+			batch += sizes[i]
+			need += sizes[i]
+			if old, ok := m.kv[k]; ok {
+				// The previous value is replaced or deleted, it does not need room
+				need -= old.size
+			}
+		}
+		if m.size+need > m.limit {
+			if !m.evictToFitSet || batch > m.limit {
+				return ErrLimitExceeded
+			}
+			m.evictToFit(need, func(k K) bool {
+				_, ok := last[k]
+				return ok
+			})
+		}
+	}
+
+	for i, ch := range changes {
+		if ch.del {
+			m.remove(ch.key)
+		} else {
+			m.put(ch.key, ch.value, sizes[i])
+		}
+	}
+	return nil
+}
+
+// SetFromMap imports a plain Go map, it is SetMany for code converting from built-in maps
+func (c *SafeMap[K, V]) SetFromMap(src map[K]V) error {
+	return c.SetMany(src)
+}
+
+// ToMap returns a copy of the map as a plain Go map
+func (c *SafeMap[K, V]) ToMap() map[K]V {
+	c.RLock()
+	defer c.RUnlock()
+	dst := make(map[K]V, len(c.items))
+	now := nowNano()
+	for k, i := range c.items {
+		if !i.expired(now) {
+			dst[k] = c.value(i)
+		}
+	}
+	return dst
+}
+
+// Entries returns the keys with their values, in no particular order, read under a single lock acquisition:
+// unlike calling Keys then Get for each key, it never sees a key deleted in between.
+func (c *SafeMap[K, V]) Entries() []Entry[K, V] {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make([]Entry[K, V], 0, len(c.items))
+	now := nowNano()
+	for k, i := range c.items {
+		if !i.expired(now) {
+			entries = append(entries, Entry[K, V]{Key: k, Value: c.value(i)})
+		}
+	}
+	return entries
+}
+
+// SetFromMap imports a plain Go map, it is SetMany for code converting from built-in maps
+func (m *OrderedMap[K, V]) SetFromMap(src map[K]V) error {
+	return m.SetMany(src)
+}
+
+// ToMap returns a copy of the map as a plain Go map, losing the order of the keys
+func (m *OrderedMap[K, V]) ToMap() map[K]V {
+	m.RLock()
+	defer m.RUnlock()
+	dst := make(map[K]V, len(m.kv))
+	for k, el := range m.kv {
+		dst[k] = el.Value
+	}
+	return dst
+}
+
+// Entries returns the keys with their values in order, read under a single lock acquisition, see SafeMap.Entries
+func (m *OrderedMap[K, V]) Entries() []Entry[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	entries := make([]Entry[K, V], 0, len(m.kv))
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, Entry[K, V]{Key: el.Key, Value: el.Value})
+	}
+	return entries
+}
@@ -0,0 +1,872 @@
+package kmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal CBOR (RFC 8949) support for EncodingCBOR.
+// Values are encoded by reflection following the rules of encoding/json (tags, omitempty, json.Marshaler...),
+// except that byte slices become byte strings instead of base64 and time.Time uses the standard date/time tag.
+// They are decoded by transcoding to JSON, so loading behaves exactly like EncodingJSON.
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborIndefinite is the additional information of indefinite length items, and of the break stop code
+const cborIndefinite = 31
+
+// cborSelfDescribed is the tag starting documents written by kmap (RFC 8949 section 3.4.6)
+const cborSelfDescribed = 55799
+
+var (
+	errCBORType     = errors.New("unexpected cbor type")
+	timeType        = reflect.TypeOf(time.Time{})
+	jsonMarshaler   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	cborFieldsCache sync.Map // reflect.Type -> []cborField
+)
+
+// appendCBORHead appends the initial byte of an item of the given major type and its argument
+func appendCBORHead(dst []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+}
+
+func appendCBORInt(dst []byte, v int64) []byte {
+	if v < 0 {
+		return appendCBORHead(dst, cborNegInt, uint64(-1-v))
+	}
+	return appendCBORHead(dst, cborUint, uint64(v))
+}
+
+func appendCBORText(dst []byte, s string) []byte {
+	return append(appendCBORHead(dst, cborText, uint64(len(s))), s...)
+}
+
+func appendCBORFloat(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, cborSimple<<5|27), math.Float64bits(f))
+}
+
+func appendCBORBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, 0xf5)
+	}
+	return append(dst, 0xf4)
+}
+
+const cborNull = 0xf6
+
+// marshalCBOR encodes v following the rules of encoding/json
+func marshalCBOR(v any) ([]byte, error) {
+	return appendCBORValue(nil, reflect.ValueOf(v), 0)
+}
+
+func appendCBORValue(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	if !v.IsValid() {
+		return append(dst, cborNull), nil
+	}
+	if depth > maxDocDepth {
+		return nil, errDocDepth
+	}
+	t := v.Type()
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return append(dst, cborNull), nil
+	}
+
+	switch {
+	case t == timeType:
+		// Tag 0 is a RFC 3339 date/time string, as time.Time is in JSON
+		ts := v.Interface().(time.Time).Format(time.RFC3339Nano)
+		return appendCBORText(append(dst, 0xc0), ts), nil
+	case t.Implements(jsonMarshaler):
+		data, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return appendCBORFromJSON(dst, data)
+	case t.Implements(textMarshaler):
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return appendCBORText(dst, string(text)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return appendCBORBool(dst, v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendCBORInt(dst, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendCBORHead(dst, cborUint, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, &json.UnsupportedValueError{Value: v, Str: strconv.FormatFloat(f, 'g', -1, 64)}
+		}
+		return appendCBORFloat(dst, f), nil
+	case reflect.String:
+		return appendCBORText(dst, v.String()), nil
+	case reflect.Pointer, reflect.Interface:
+		return appendCBORValue(dst, v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(dst, cborNull), nil
+		}
+		if elem := reflect.PointerTo(t.Elem()); t.Elem().Kind() == reflect.Uint8 && !elem.Implements(jsonMarshaler) && !elem.Implements(textMarshaler) {
+			return append(appendCBORHead(dst, cborBytes, uint64(v.Len())), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		dst = appendCBORHead(dst, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if dst, err = appendCBORValue(dst, v.Index(i), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(dst, cborNull), nil
+		}
+		return appendCBORMap(dst, v, depth)
+	case reflect.Struct:
+		return appendCBORStruct(dst, v, depth)
+	}
+	return nil, &json.UnsupportedTypeError{Type: t}
+}
+
+// appendCBORMap writes a map with its keys converted to strings and sorted, as encoding/json does
+func appendCBORMap(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k := iter.Key()
+		var key string
+		switch {
+		case k.Kind() == reflect.String:
+			key = k.String()
+		case k.Type().Implements(textMarshaler):
+			if k.Kind() == reflect.Pointer && k.IsNil() {
+				continue
+			}
+			text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			key = string(text)
+		case k.CanInt():
+			key = strconv.FormatInt(k.Int(), 10)
+		case k.CanUint():
+			key = strconv.FormatUint(k.Uint(), 10)
+		default:
+			return nil, &json.UnsupportedTypeError{Type: v.Type()}
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	dst = appendCBORHead(dst, cborMap, uint64(len(entries)))
+	for _, e := range entries {
+		dst = appendCBORText(dst, e.key)
+		var err error
+		if dst, err = appendCBORValue(dst, e.value, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+func appendCBORStruct(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	type present struct {
+		field *cborField
+		value reflect.Value
+	}
+	fields := cborFields(v.Type())
+	values := make([]present, 0, len(fields))
+	for i := range fields {
+		f := &fields[i]
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		values = append(values, present{f, fv})
+	}
+
+	dst = appendCBORHead(dst, cborMap, uint64(len(values)))
+	for _, p := range values {
+		dst = appendCBORText(dst, p.field.name)
+		var err error
+		if p.field.quoted {
+			// ",string" stores scalars as their JSON text
+			var data []byte
+			if data, err = json.Marshal(p.value.Interface()); err != nil {
+				return nil, err
+			}
+			dst = appendCBORText(dst, string(data))
+			continue
+		}
+		if dst, err = appendCBORValue(dst, p.value, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// appendCBORFromJSON converts a JSON value, for types implementing json.Marshaler
+func appendCBORFromJSON(dst []byte, data []byte) ([]byte, error) {
+	v, err := parseJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return appendCBORParsed(dst, v), nil
+}
+
+func appendCBORParsed(dst []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, cborNull)
+	case bool:
+		return appendCBORBool(dst, v)
+	case string:
+		return appendCBORText(dst, v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendCBORInt(dst, i)
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return appendCBORHead(dst, cborUint, u)
+		}
+		f, _ := v.Float64()
+		return appendCBORFloat(dst, f)
+	case []any:
+		dst = appendCBORHead(dst, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			dst = appendCBORParsed(dst, elem)
+		}
+		return dst
+	case jsonObject:
+		dst = appendCBORHead(dst, cborMap, uint64(len(v)))
+		for _, f := range v {
+			dst = appendCBORParsed(appendCBORText(dst, f.key), f.value)
+		}
+		return dst
+	}
+	return dst
+}
+
+// cborField is a struct field as encoding/json sees it
+type cborField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	quoted    bool
+	tagged    bool
+}
+
+// cborFields lists the fields of t encoded by encoding/json, embedded structs included
+func cborFields(t reflect.Type) []cborField {
+	if f, ok := cborFieldsCache.Load(t); ok {
+		return f.([]cborField)
+	}
+	var all []cborField
+	collectCBORFields(t, nil, map[reflect.Type]bool{}, &all)
+
+	// Like encoding/json, the shallowest field wins, then the tagged one, ambiguous names are dropped
+	byName := map[string][]int{}
+	for i, f := range all {
+		byName[f.name] = append(byName[f.name], i)
+	}
+	fields := make([]cborField, 0, len(all))
+	for i, f := range all {
+		if dominantField(all, byName[f.name]) == i {
+			fields = append(fields, f)
+		}
+	}
+	cborFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectCBORFields(t reflect.Type, index []int, visited map[reflect.Type]bool, out *[]cborField) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		idx := append(append([]int(nil), index...), i)
+
+		// Unlike encoding/json, fields promoted from unexported embedded structs are skipped:
+		// reflect cannot hand out their values through Interface
+		if !sf.IsExported() {
+			continue
+		}
+		if ft := sf.Type; sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectCBORFields(ft, idx, visited, out)
+				continue
+			}
+		}
+
+		f := cborField{name: name, index: idx, tagged: name != ""}
+		if name == "" {
+			f.name = sf.Name
+		}
+		for opts != "" {
+			var opt string
+			opt, opts, _ = strings.Cut(opts, ",")
+			switch opt {
+			case "omitempty":
+				f.omitEmpty = true
+			case "string":
+				switch sf.Type.Kind() {
+				case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+					reflect.Float32, reflect.Float64, reflect.String:
+					f.quoted = true
+				}
+			}
+		}
+		*out = append(*out, f)
+	}
+	visited[t] = false
+}
+
+// dominantField returns the index of the field used among candidates of the same name, -1 if ambiguous
+func dominantField(all []cborField, candidates []int) int {
+	best := candidates[0]
+	ambiguous := false
+	for _, c := range candidates[1:] {
+		switch {
+		case len(all[c].index) < len(all[best].index):
+			best, ambiguous = c, false
+		case len(all[c].index) > len(all[best].index):
+		case all[c].tagged && !all[best].tagged:
+			best, ambiguous = c, false
+		case all[c].tagged == all[best].tagged:
+			ambiguous = true
+		}
+	}
+	if ambiguous {
+		return -1
+	}
+	return best
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, reporting false instead of panicking on nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// cborToJSON transcodes a single CBOR item to JSON
+func cborToJSON(data []byte) ([]byte, error) {
+	d := newCBORDecoder(bufio.NewReader(bytes.NewReader(data)))
+	return d.appendJSON(nil, 0)
+}
+
+type cborEncoder struct {
+	w       *bufio.Writer
+	scratch []byte
+	err     error
+}
+
+func newCBOREncoder(w io.Writer) *cborEncoder {
+	e := &cborEncoder{w: bufio.NewWriter(w)}
+	e.write(appendCBORHead(nil, cborTag, cborSelfDescribed))
+	return e
+}
+
+func (e *cborEncoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *cborEncoder) mapHeader(n int) {
+	e.scratch = appendCBORHead(e.scratch[:0], cborMap, uint64(n))
+	e.write(e.scratch)
+}
+
+func (e *cborEncoder) arrayHeader(n int) {
+	e.scratch = appendCBORHead(e.scratch[:0], cborArray, uint64(n))
+	e.write(e.scratch)
+}
+
+func (e *cborEncoder) string(s string) {
+	e.scratch = appendCBORHead(e.scratch[:0], cborText, uint64(len(s)))
+	e.write(e.scratch)
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *cborEncoder) int(v int64) {
+	e.scratch = appendCBORInt(e.scratch[:0], v)
+	e.write(e.scratch)
+}
+
+func (e *cborEncoder) bool(v bool) {
+	e.write(appendCBORBool(e.scratch[:0], v))
+}
+
+// value writes a value serialized by marshalCBOR as is
+func (e *cborEncoder) value(data []byte) {
+	e.write(data)
+}
+
+func (e *cborEncoder) flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// peekReader is needed to detect the end of indefinite length items
+type peekReader interface {
+	byteReader
+	Peek(n int) ([]byte, error)
+}
+
+type cborDecoder struct {
+	r   peekReader
+	buf [8]byte
+	// raw records the bytes read while capturing a value, see value
+	raw       []byte
+	capturing bool
+}
+
+func newCBORDecoder(r io.Reader) *cborDecoder {
+	br, ok := r.(peekReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &cborDecoder{r: br}
+}
+
+func (d *cborDecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil && d.capturing {
+		d.raw = append(d.raw, b)
+	}
+	return b, err
+}
+
+func (d *cborDecoder) readFull(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidFormat, n)
+	}
+	data, err := readFull(d.r, int(n))
+	if err == nil && d.capturing {
+		d.raw = append(d.raw, data...)
+	}
+	return data, err
+}
+
+// head reads the initial byte and the argument of the next item, skipping the self-described tag.
+// The argument of floats is their bits, info is cborIndefinite for indefinite lengths and the break code.
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		major, info = b>>5, b&0x1f
+		switch {
+		case info < 24:
+			arg = uint64(info)
+		case info <= 27:
+			n := 1 << (info - 24)
+			if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+				return 0, 0, 0, err
+			}
+			if d.capturing {
+				d.raw = append(d.raw, d.buf[:n]...)
+			}
+			for _, c := range d.buf[:n] {
+				arg = arg<<8 | uint64(c)
+			}
+		case info == cborIndefinite && major != cborUint && major != cborNegInt && major != cborTag:
+		default:
+			return 0, 0, 0, fmt.Errorf("%w: reserved additional information %d", errCBORType, info)
+		}
+		if major == cborTag && arg == cborSelfDescribed {
+			arg = 0
+			continue
+		}
+		return major, info, arg, nil
+	}
+}
+
+func (d *cborDecoder) expect(want byte, what string) (uint64, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != want || info == cborIndefinite {
+		return 0, fmt.Errorf("%w: expected definite %s, got major type %d", errCBORType, what, major)
+	}
+	return arg, nil
+}
+
+func (d *cborDecoder) mapHeader() (int, error) {
+	n, err := d.expect(cborMap, "map")
+	if n > math.MaxInt32 {
+		return 0, ErrInvalidFormat
+	}
+	return int(n), err
+}
+
+func (d *cborDecoder) arrayHeader() (int, error) {
+	n, err := d.expect(cborArray, "array")
+	if n > math.MaxInt32 {
+		return 0, ErrInvalidFormat
+	}
+	return int(n), err
+}
+
+func (d *cborDecoder) string() (string, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	if major != cborText && major != cborBytes {
+		return "", fmt.Errorf("%w: expected string, got major type %d", errCBORType, major)
+	}
+	s, err := d.readString(major, info, arg)
+	return string(s), err
+}
+
+// readString reads the content of a byte or text string, joining the chunks of indefinite ones
+func (d *cborDecoder) readString(major, info byte, arg uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		return d.readFull(arg)
+	}
+	var s []byte
+	for {
+		m, i, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m == cborSimple && i == cborIndefinite {
+			return s, nil
+		}
+		if m != major || i == cborIndefinite {
+			return nil, fmt.Errorf("%w: bad string chunk", errCBORType)
+		}
+		chunk, err := d.readFull(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+func (d *cborDecoder) int() (int64, error) {
+	major, _, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if (major == cborUint || major == cborNegInt) && arg > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: integer overflows int64", ErrInvalidFormat)
+	}
+	switch major {
+	case cborUint:
+		return int64(arg), nil
+	case cborNegInt:
+		return -1 - int64(arg), nil
+	}
+	return 0, fmt.Errorf("%w: expected integer, got major type %d", errCBORType, major)
+}
+
+func (d *cborDecoder) bool() (bool, error) {
+	major, info, _, err := d.head()
+	if err != nil {
+		return false, err
+	}
+	if major == cborSimple && (info == 20 || info == 21) {
+		return info == 21, nil
+	}
+	return false, fmt.Errorf("%w: expected bool", errCBORType)
+}
+
+// value returns the raw bytes of the next item
+func (d *cborDecoder) value() ([]byte, error) {
+	d.raw, d.capturing = d.raw[:0], true
+	err := d.skip()
+	d.capturing = false
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), d.raw...), nil
+}
+
+func (d *cborDecoder) skip() error {
+	return d.skipItem(0)
+}
+
+func (d *cborDecoder) skipItem(depth int) error {
+	if depth > maxDocDepth {
+		return errDocDepth
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		_, err = d.readString(major, info, arg)
+		return err
+	case cborArray, cborMap:
+		items := arg
+		if major == cborMap {
+			items *= 2
+		}
+		for i := uint64(0); info == cborIndefinite || i < items; i++ {
+			if info == cborIndefinite && d.atBreak() {
+				_, _, _, err = d.head()
+				return err
+			}
+			if err := d.skipItem(depth + 1); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return d.skipItem(depth + 1)
+	case cborSimple:
+		if info == cborIndefinite {
+			return fmt.Errorf("%w: unexpected break", errCBORType)
+		}
+	}
+	return nil
+}
+
+// atBreak reports whether the next byte is the break stop code of an indefinite length item
+func (d *cborDecoder) atBreak() bool {
+	b, err := d.r.Peek(1)
+	return err == nil && b[0] == 0xff
+}
+
+// appendJSON transcodes the next item to JSON: byte strings become base64 strings as []byte in JSON,
+// date/time tags become RFC 3339 strings as time.Time in JSON
+func (d *cborDecoder) appendJSON(dst []byte, depth int) ([]byte, error) {
+	if depth > maxDocDepth {
+		return nil, errDocDepth
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return strconv.AppendUint(dst, arg, 10), nil
+	case cborNegInt:
+		if arg <= math.MaxInt64 {
+			return strconv.AppendInt(dst, -1-int64(arg), 10), nil
+		}
+		n := new(big.Int).SetUint64(arg)
+		return append(dst, n.Add(n, big.NewInt(1)).Neg(n).String()...), nil
+	case cborBytes:
+		s, err := d.readString(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONString(dst, base64.StdEncoding.EncodeToString(s)), nil
+	case cborText:
+		s, err := d.readString(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONString(dst, string(s)), nil
+	case cborArray:
+		dst = append(dst, '[')
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.atBreak() {
+				d.head()
+				break
+			}
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if dst, err = d.appendJSON(dst, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, ']'), nil
+	case cborMap:
+		dst = append(dst, '{')
+		for i := uint64(0); info == cborIndefinite || i < arg; i++ {
+			if info == cborIndefinite && d.atBreak() {
+				d.head()
+				break
+			}
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			start := len(dst)
+			if dst, err = d.appendJSON(dst, depth+1); err != nil {
+				return nil, err
+			}
+			if dst, err = quoteJSONKey(dst, start); err != nil {
+				return nil, err
+			}
+			dst = append(dst, ':')
+			if dst, err = d.appendJSON(dst, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, '}'), nil
+	case cborTag:
+		return d.appendTagJSON(dst, arg, depth)
+	}
+
+	switch info {
+	case 20:
+		return append(dst, "false"...), nil
+	case 21:
+		return append(dst, "true"...), nil
+	case 22, 23:
+		return append(dst, "null"...), nil
+	case 25:
+		return appendJSONFloat(dst, halfToFloat(uint16(arg)), 32)
+	case 26:
+		return appendJSONFloat(dst, float64(math.Float32frombits(uint32(arg))), 32)
+	case 27:
+		return appendJSONFloat(dst, math.Float64frombits(arg), 64)
+	}
+	return nil, fmt.Errorf("%w: simple value %d", errCBORType, arg)
+}
+
+// appendTagJSON transcodes the content of a tag: date/times and bignums are converted, other tags are ignored
+func (d *cborDecoder) appendTagJSON(dst []byte, tag uint64, depth int) ([]byte, error) {
+	switch tag {
+	case 1:
+		content, err := d.appendJSON(nil, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		epoch, err := strconv.ParseFloat(string(content), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad epoch date/time", errCBORType)
+		}
+		sec, frac := math.Modf(epoch)
+		t := time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC()
+		return appendJSONString(dst, t.Format(time.RFC3339Nano)), nil
+	case 2, 3:
+		major, info, arg, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborBytes {
+			return nil, fmt.Errorf("%w: bignum content", errCBORType)
+		}
+		s, err := d.readString(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		n := new(big.Int).SetBytes(s)
+		if tag == 3 {
+			n.Add(n, big.NewInt(1)).Neg(n)
+		}
+		return append(dst, n.String()...), nil
+	}
+	return d.appendJSON(dst, depth+1)
+}
+
+// halfToFloat converts an IEEE 754 half precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,140 @@
+package kmap
+
+// DefaultChangeBuffer is the number of changes a stream holds for its reader unless WithChangeBuffer says otherwise
+const DefaultChangeBuffer = 1024
+
+// Change is a mutation reported by Changes, Seq increases by one with each change of the map
+type Change[K comparable, V any] struct {
+	Seq uint64
+	Event[K, V]
+}
+
+// BufferPolicy selects what a stream does when its reader falls behind and the buffer is full, see WithChangeBuffer
+type BufferPolicy uint8
+
+const (
+	// BufferDrop discards the new changes until there is room again, the reader sees a gap in Seq
+	BufferDrop BufferPolicy = iota
+	// BufferClose closes the stream, the reader should then reload the map and call Changes again
+	BufferClose
+)
+
+// stream is a channel returned by Changes
+type stream[K comparable, V any] struct {
+	ch     chan Change[K, V]
+	policy BufferPolicy
+}
+
+// publish sends ch to every stream without blocking, the write lock must be held.
+// Sending under the lock keeps the streams in the order of Seq.
+func (h *hooks[K, V]) publish(ch Change[K, V]) {
+	kept := h.streams[:0]
+	for _, s := range h.streams {
+		select {
+		case s.ch <- ch:
+		default:
+			if s.policy == BufferClose {
+				close(s.ch)
+				continue
+			}
+		}
+		kept = append(kept, s)
+	}
+	h.streams = kept
+}
+
+// reload closes the streams with BufferClose after the content of the map was loaded, the write lock must be held.
+// Loads are not reported as changes, so their readers must reload the map like when they fall behind.
+func (h *hooks[K, V]) reload() {
+	kept := h.streams[:0]
+	for _, s := range h.streams {
+		if s.policy == BufferClose {
+			close(s.ch)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	h.streams = kept
+}
+
+// subscribe returns a new stream with the policy of WithChangeBuffer, the write lock must be held
+func (h *hooks[K, V]) subscribe() chan Change[K, V] {
+	return h.subscribeWith(h.bufferPolicy)
+}
+
+// subscribeWith returns a new stream with policy, the write lock must be held
+func (h *hooks[K, V]) subscribeWith(policy BufferPolicy) chan Change[K, V] {
+	size := h.bufferSize
+	if size <= 0 {
+		size = DefaultChangeBuffer
+	}
+	s := &stream[K, V]{ch: make(chan Change[K, V], size), policy: policy}
+	h.streams = append(h.streams, s)
+	return s.ch
+}
+
+// unsubscribe closes the stream ch if it is still open, the write lock must be held
+func (h *hooks[K, V]) unsubscribe(ch <-chan Change[K, V]) {
+	for i, s := range h.streams {
+		if (<-chan Change[K, V])(s.ch) == ch {
+			close(s.ch)
+			h.streams = append(h.streams[:i], h.streams[i+1:]...)
+			return
+		}
+	}
+}
+
+// WithChangeBuffer sets the number of changes the streams returned by Changes hold for their reader,
+// and what they do when it is full (BufferDrop when omitted). It applies to the streams created afterwards.
+func (c *SafeMap[K, V]) WithChangeBuffer(size int, policy ...BufferPolicy) *SafeMap[K, V] {
+	c.Lock()
+	c.hooks.bufferSize = size
+	if len(policy) > 0 {
+		c.hooks.bufferPolicy = policy[0]
+	}
+	c.Unlock()
+	return c
+}
+
+// Changes returns a stream of every change made to the SafeMap from now on, in order, so external systems
+// can be kept in sync. Values loaded from a file or a backend are not reported: the streams with BufferClose
+// are closed instead, so their readers reload the map. Changes are never waited for:
+// a reader falling behind loses them according to the policy of WithChangeBuffer. CloseChanges ends the stream.
+func (c *SafeMap[K, V]) Changes() <-chan Change[K, V] {
+	c.Lock()
+	defer c.Unlock()
+	return c.hooks.subscribe()
+}
+
+// CloseChanges ends a stream returned by Changes and closes its channel
+func (c *SafeMap[K, V]) CloseChanges(ch <-chan Change[K, V]) {
+	c.Lock()
+	c.hooks.unsubscribe(ch)
+	c.Unlock()
+}
+
+// WithChangeBuffer sets the number of changes the streams returned by Changes hold for their reader,
+// and what they do when it is full (BufferDrop when omitted). It applies to the streams created afterwards.
+func (m *OrderedMap[K, V]) WithChangeBuffer(size int, policy ...BufferPolicy) *OrderedMap[K, V] {
+	m.Lock()
+	m.hooks.bufferSize = size
+	if len(policy) > 0 {
+		m.hooks.bufferPolicy = policy[0]
+	}
+	m.Unlock()
+	return m
+}
+
+// Changes returns a stream of every change made to the OrderedMap from now on, in order, see SafeMap.Changes
+func (m *OrderedMap[K, V]) Changes() <-chan Change[K, V] {
+	m.Lock()
+	defer m.Unlock()
+	return m.hooks.subscribe()
+}
+
+// CloseChanges ends a stream returned by Changes and closes its channel
+func (m *OrderedMap[K, V]) CloseChanges(ch <-chan Change[K, V]) {
+	m.Lock()
+	m.hooks.unsubscribe(ch)
+	m.Unlock()
+}
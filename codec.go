@@ -0,0 +1,102 @@
+package kmap
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// encodeKey converts a key to a string that decodeKey can turn back into the same key.
+// Keys implementing encoding.TextMarshaler or encoding.BinaryMarshaler use those methods,
+// basic kinds are formatted with strconv, and everything else (structs, arrays) falls back to JSON.
+func encodeKey[K comparable](key K) (string, error) {
+	switch k := any(key).(type) {
+	case string:
+		return k, nil
+	case encoding.TextMarshaler:
+		b, err := k.MarshalText()
+		return string(b), err
+	case encoding.BinaryMarshaler:
+		b, err := k.MarshalBinary()
+		return base64.StdEncoding.EncodeToString(b), err
+	}
+
+	rv := reflect.ValueOf(any(key))
+	if !rv.IsValid() {
+		return "null", nil
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()), nil
+	case reflect.Complex64, reflect.Complex128:
+		return strconv.FormatComplex(rv.Complex(), 'g', -1, rv.Type().Bits()), nil
+	case reflect.Pointer, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return "", fmt.Errorf("kmap: cannot persist key of type %T", key)
+	default:
+		b, err := json.Marshal(key)
+		return string(b), err
+	}
+}
+
+// decodeKey is the inverse of encodeKey
+func decodeKey[K comparable](s string) (K, error) {
+	var key K
+	switch k := any(&key).(type) {
+	case *string:
+		*k = s
+		return key, nil
+	case encoding.TextUnmarshaler:
+		if _, ok := any(key).(encoding.TextMarshaler); ok {
+			return key, k.UnmarshalText([]byte(s))
+		}
+	case encoding.BinaryUnmarshaler:
+		if _, ok := any(key).(encoding.BinaryMarshaler); ok {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return key, err
+			}
+			return key, k.UnmarshalBinary(b)
+		}
+	}
+
+	rv := reflect.ValueOf(&key).Elem()
+	var err error
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, rv.Type().Bits())
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, rv.Type().Bits())
+		rv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, rv.Type().Bits())
+		rv.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		var c complex128
+		c, err = strconv.ParseComplex(s, rv.Type().Bits())
+		rv.SetComplex(c)
+	default:
+		err = json.Unmarshal([]byte(s), &key)
+	}
+	return key, err
+}
@@ -0,0 +1,64 @@
+package kmap
+
+import "context"
+
+// GetOrComputeCtx is GetOrComputeErr for loaders that take a context: fn receives ctx so request deadlines and
+// cancellation reach it, and nothing is computed when ctx is already done. Failed computations are not stored.
+func (c *SafeMap[K, V]) GetOrComputeCtx(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (V, error) {
+	if err := ctx.Err(); err != nil {
+		if v, ok := c.Get(key); ok {
+			return v, nil
+		}
+		return *new(V), err
+	}
+	return c.GetOrComputeErr(key, func() (V, error) { return fn(ctx) })
+}
+
+// WatchWhereCtx is WatchWhere ending the subscription once ctx is done
+func (c *SafeMap[K, V]) WatchWhereCtx(ctx context.Context, pred func(K) bool, fn func(Event[K, V])) {
+	stop := c.WatchWhere(pred, fn)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+}
+
+// ChangesCtx is Changes closing the stream once ctx is done
+func (c *SafeMap[K, V]) ChangesCtx(ctx context.Context) <-chan Change[K, V] {
+	ch := c.Changes()
+	go func() {
+		<-ctx.Done()
+		c.CloseChanges(ch)
+	}()
+	return ch
+}
+
+// GetOrComputeCtx is GetOrComputeErr for loaders that take a context, see SafeMap.GetOrComputeCtx
+func (m *OrderedMap[K, V]) GetOrComputeCtx(ctx context.Context, key K, fn func(ctx context.Context) (V, error)) (V, error) {
+	if err := ctx.Err(); err != nil {
+		if v, ok := m.Get(key); ok {
+			return v, nil
+		}
+		return *new(V), err
+	}
+	return m.GetOrComputeErr(key, func() (V, error) { return fn(ctx) })
+}
+
+// WatchWhereCtx is WatchWhere ending the subscription once ctx is done
+func (m *OrderedMap[K, V]) WatchWhereCtx(ctx context.Context, pred func(K) bool, fn func(Event[K, V])) {
+	stop := m.WatchWhere(pred, fn)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+}
+
+// ChangesCtx is Changes closing the stream once ctx is done
+func (m *OrderedMap[K, V]) ChangesCtx(ctx context.Context) <-chan Change[K, V] {
+	ch := m.Changes()
+	go func() {
+		<-ctx.Done()
+		m.CloseChanges(ch)
+	}()
+	return ch
+}
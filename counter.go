@@ -0,0 +1,135 @@
+package kmap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// counterShards is the number of independently locked parts of a CounterMap
+const counterShards = 64
+
+type counterShard[K comparable] struct {
+	sync.RWMutex
+	counters map[K]*atomic.Int64
+}
+
+// CounterMap counts occurrences per key for request counting and metrics aggregation under heavy concurrency.
+// Keys are spread over shards with their own lock, and existing counters are incremented atomically
+// under a shared read lock, so goroutines only wait for each other when they create keys of the same shard.
+type CounterMap[K comparable] struct {
+	shards [counterShards]counterShard[K]
+	// hasher replaces hashKey when set, see WithHasher
+	hasher func(K) uint64
+}
+
+func NewCounter[K comparable]() *CounterMap[K] {
+	c := &CounterMap[K]{}
+	for i := range c.shards {
+		c.shards[i].counters = make(map[K]*atomic.Int64)
+	}
+	return c
+}
+
+// WithHasher replaces the hash of keys used to spread them over the shards, see SafeMap.WithHasher.
+// It should be called right after NewCounter, before the map is used.
+func (c *CounterMap[K]) WithHasher(hash func(K) uint64) *CounterMap[K] {
+	c.hasher = hash
+	return c
+}
+
+func (c *CounterMap[K]) shard(key K) *counterShard[K] {
+	if c.hasher != nil {
+		return &c.shards[c.hasher(key)%counterShards]
+	}
+	return &c.shards[hashKey(key)%counterShards]
+}
+
+// Incr adds one to the counter of key and returns its new value
+func (c *CounterMap[K]) Incr(key K) int64 {
+	return c.Add(key, 1)
+}
+
+// Add adds delta to the counter of key, created at 0 when missing, and returns its new value
+func (c *CounterMap[K]) Add(key K, delta int64) int64 {
+	s := c.shard(key)
+	s.RLock()
+	counter, ok := s.counters[key]
+	if ok {
+		n := counter.Add(delta)
+		s.RUnlock()
+		return n
+	}
+	s.RUnlock()
+
+	s.Lock()
+	counter, ok = s.counters[key]
+	if !ok {
+		counter = new(atomic.Int64)
+		s.counters[key] = counter
+	}
+	n := counter.Add(delta)
+	s.Unlock()
+	return n
+}
+
+// Get returns the counter of key, 0 when missing
+func (c *CounterMap[K]) Get(key K) int64 {
+	s := c.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	if counter, ok := s.counters[key]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// Delete removes the counter of key
+func (c *CounterMap[K]) Delete(key K) {
+	s := c.shard(key)
+	s.Lock()
+	delete(s.counters, key)
+	s.Unlock()
+}
+
+// Len returns the number of counters
+func (c *CounterMap[K]) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		n += len(s.counters)
+		s.RUnlock()
+	}
+	return n
+}
+
+// Snapshot returns the value of every counter. Shards are read one after the other,
+// so increments made meanwhile may be included for some keys and not for others.
+func (c *CounterMap[K]) Snapshot() map[K]int64 {
+	snapshot := make(map[K]int64)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for k, counter := range s.counters {
+			snapshot[k] = counter.Load()
+		}
+		s.RUnlock()
+	}
+	return snapshot
+}
+
+// Reset removes every counter and returns their last values, so each increment is reported by exactly one
+// Reset, for instance when metrics are flushed at regular intervals
+func (c *CounterMap[K]) Reset() map[K]int64 {
+	snapshot := make(map[K]int64)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		for k, counter := range s.counters {
+			snapshot[k] = counter.Load()
+		}
+		s.counters = make(map[K]*atomic.Int64)
+		s.Unlock()
+	}
+	return snapshot
+}
@@ -0,0 +1,172 @@
+package kmap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrNoBaseSnapshot = errors.New("no base snapshot, save or load the full map before saving a delta")
+	ErrDeltaFile      = errors.New("file is a delta, apply it on top of a snapshot with ApplyDeltaFromFile")
+	ErrNotDelta       = errors.New("file is not a delta")
+)
+
+// SaveDeltaToFile writes only the entries set or deleted since the last save (full or delta) of the SafeMap.
+// A full save or load with SaveToFile/LoadFromFile must have happened first to establish the base snapshot,
+// the original state is then restored by loading the base and applying every delta in order with ApplyDeltaFromFile.
+func (m *SafeMap[K, V]) SaveDeltaToFile(path string) error {
+	return m.SaveDeltaToFileWithOptions(path, SaveOptions{})
+}
+
+// SaveDeltaToFileWithOptions is SaveDeltaToFile with the specified options
+func (m *SafeMap[K, V]) SaveDeltaToFileWithOptions(path string, opts SaveOptions) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	restore, err := m.saveDeltaTo(&buf, opts)
+	if err != nil {
+		return err
+	}
+	if err := writeLocked(path, buf.Bytes(), opts.LockTimeout); err != nil {
+		restore()
+		return err
+	}
+	return nil
+}
+
+// SaveDeltaTo writes the changes since the last save of the SafeMap to w
+func (m *SafeMap[K, V]) SaveDeltaTo(w io.Writer, opts SaveOptions) error {
+	_, err := m.saveDeltaTo(w, opts)
+	return err
+}
+
+// saveDeltaTo is SaveDeltaTo, restore puts back the changes written when w was a buffer which could not be stored
+func (m *SafeMap[K, V]) saveDeltaTo(w io.Writer, opts SaveOptions) (restore func(), err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	m.dirtyMu.Lock()
+	dirty, flushed := m.dirty, m.flushed
+	m.dirtyMu.Unlock()
+	if dirty == nil {
+		return nil, ErrNoBaseSnapshot
+	}
+
+	hdr := fileHeader{
+		Flags: flagDelta,
+		Size:  m.size,
+		Limit: m.limit,
+	}
+	if flushed {
+		hdr.Flags |= flagReset
+	}
+	changed := make([]K, 0, len(dirty))
+	for k := range dirty {
+		if _, ok := m.items[k]; ok {
+			changed = append(changed, k)
+			continue
+		}
+		key, err := encodeKey(k)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Deleted = append(hdr.Deleted, key)
+	}
+	hdr.Count = int64(len(changed))
+
+	for _, k := range changed {
+		if m.items[k].expires != 0 {
+			hdr.Flags |= flagExpiry
+			break
+		}
+	}
+	err = writeSnapshot(w, opts, hdr, func(emit func(key string, value []byte, size int, expires int64) error) error {
+		for _, k := range changed {
+			v := m.items[k]
+			key, err := encodeKey(k)
+			if err != nil {
+				return err
+			}
+			value, err := marshalValue(opts.Encoding, m.value(v))
+			if err != nil {
+				return err
+			}
+			if err := emit(key, value, v.Size, v.expires); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.resetDirty(), nil
+}
+
+// ApplyDeltaFromFile applies a delta written by SaveDeltaToFile on top of the current content of the SafeMap
+func (m *SafeMap[K, V]) ApplyDeltaFromFile(path string) error {
+	file, err := openLocked(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return m.ApplyDeltaFrom(file)
+}
+
+// ApplyDeltaFrom applies a delta read from r on top of the current content of the SafeMap
+func (m *SafeMap[K, V]) ApplyDeltaFrom(r io.Reader) error {
+	hdr, entries, err := readSnapshot[K, V](r)
+	if err != nil {
+		return err
+	}
+	if hdr.Flags&flagDelta == 0 {
+		return ErrNotDelta
+	}
+	deleted := make([]K, 0, len(hdr.Deleted))
+	for _, s := range hdr.Deleted {
+		k, err := decodeKey[K](s)
+		if err != nil {
+			return err
+		}
+		deleted = append(deleted, k)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	defer m.resetDirty()
+	m.hooks.reload()
+
+	if hdr.Flags&flagReset != 0 {
+		m.dropClean()
+		m.releaseAll()
+		m.items = make(map[K]item[V], len(entries))
+		m.size = 0
+	}
+	m.own()
+	for _, k := range deleted {
+		if i, ok := m.items[k]; ok {
+			m.size -= i.Size
+			m.release(i)
+			delete(m.items, k)
+		}
+	}
+	now := nowNano()
+	for _, e := range entries {
+		if i, ok := m.items[e.Key]; ok {
+			m.size -= i.Size
+			m.release(i)
+			delete(m.items, e.Key)
+		}
+		if i, ok := loadedItem(e, now); ok {
+			m.items[e.Key] = i
+			m.size += e.Size
+		}
+	}
+	m.limit = hdr.Limit
+	return m.spillLoaded()
+}
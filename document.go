@@ -0,0 +1,378 @@
+package kmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Document encodings (msgpack, CBOR) store the whole file as a single self-describing value
+// that any implementation of the encoding can read without knowing kmap:
+//
+//	{
+//	  "format": "kmap", "version": 2, "created_at": <unix ns>, "size": <bytes>, "limit": <bytes>,
+//	  "delta": <bool>, "reset": <bool>,                         only in delta files
+//	  "entries": [{"key": <encoded key>, "value": <value>, "size": <bytes>}, ...],
+//	  "deleted": [<encoded key>, ...]                            only in delta files
+//	}
+//
+// Values are written natively (maps, arrays, numbers...) following the rules of encoding/json,
+// so struct tags and json.Marshaler are honoured the same way as with EncodingJSON.
+
+// docEncoder writes the primitives of a document encoding, the first error is kept and returned by flush
+type docEncoder interface {
+	mapHeader(n int)
+	arrayHeader(n int)
+	string(s string)
+	int(v int64)
+	bool(v bool)
+	// value writes a value serialized by marshalValue
+	value(data []byte)
+	flush() error
+}
+
+// docDecoder reads the primitives of a document encoding
+type docDecoder interface {
+	mapHeader() (int, error)
+	arrayHeader() (int, error)
+	string() (string, error)
+	int() (int64, error)
+	bool() (bool, error)
+	// value reads the next value in the form unmarshalValue expects
+	value() ([]byte, error)
+	skip() error
+}
+
+// maxDocDepth bounds the nesting of decoded values
+const maxDocDepth = 1000
+
+var errDocDepth = errors.New("value nested too deeply")
+
+func newDocEncoder(enc Encoding, w io.Writer) docEncoder {
+	if enc == EncodingCBOR {
+		return newCBOREncoder(w)
+	}
+	return newMsgpackEncoder(w)
+}
+
+func newDocDecoder(enc Encoding, r io.Reader) docDecoder {
+	if enc == EncodingCBOR {
+		return newCBORDecoder(r)
+	}
+	return newMsgpackDecoder(r)
+}
+
+// sniffDocument detects the encoding of a document from its first bytes:
+// the CBOR self-described tag written by kmap, a CBOR map or a msgpack map
+func sniffDocument(head []byte) (Encoding, bool) {
+	if len(head) >= 3 && head[0] == 0xd9 && head[1] == 0xd9 && head[2] == 0xf7 {
+		return EncodingCBOR, true
+	}
+	if b := head[0]; b >= 0xa0 && b <= 0xbb || b == 0xbf {
+		return EncodingCBOR, true
+	}
+	if b := head[0]; b&0xf0 == 0x80 || b == 0xde || b == 0xdf {
+		return EncodingMsgpack, true
+	}
+	return 0, false
+}
+
+// writeDocument writes a snapshot as a document, see above
+func writeDocument(e docEncoder, hdr fileHeader, entries snapshotWriter) error {
+	delta := hdr.Flags&flagDelta != 0
+	fields := 6
+	if delta {
+		fields += 3
+	}
+	e.mapHeader(fields)
+	e.string("format")
+	e.string("kmap")
+	e.string("version")
+	e.int(int64(versionV2))
+	e.string("created_at")
+	e.int(hdr.CreatedAt)
+	e.string("size")
+	e.int(int64(hdr.Size))
+	e.string("limit")
+	e.int(int64(hdr.Limit))
+	if delta {
+		e.string("delta")
+		e.bool(true)
+		e.string("reset")
+		e.bool(hdr.Flags&flagReset != 0)
+	}
+
+	e.string("entries")
+	e.arrayHeader(int(hdr.Count))
+	var written int64
+	err := entries(func(key string, value []byte, size int, expires int64) error {
+		written++
+		if expires != 0 {
+			e.mapHeader(4)
+		} else {
+			e.mapHeader(3)
+		}
+		e.string("key")
+		e.string(key)
+		e.string("value")
+		e.value(value)
+		e.string("size")
+		e.int(int64(size))
+		if expires != 0 {
+			e.string("expires")
+			e.int(expires)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if written != hdr.Count {
+		return errors.New("entry count changed while saving")
+	}
+
+	if delta {
+		e.string("deleted")
+		e.arrayHeader(len(hdr.Deleted))
+		for _, key := range hdr.Deleted {
+			e.string(key)
+		}
+	}
+	return e.flush()
+}
+
+// scanDocument reads a document, filling hdr and streaming the entries to fn.
+// When fn is nil, only the header is read: it stops at the start of the entries.
+// Fields may come in any order and unknown ones are skipped, so documents written by other tools load too.
+func scanDocument(d docDecoder, hdr *fileHeader, fn func(key string, value []byte, size int, expires int64) error) error {
+	n, err := d.mapHeader()
+	if err != nil {
+		return err
+	}
+	hdr.Limit = -1
+	var isKmap bool
+	for i := 0; i < n; i++ {
+		name, err := d.string()
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "format":
+			format, err := d.string()
+			if err != nil {
+				return err
+			}
+			isKmap = format == "kmap"
+		case "version":
+			version, err := d.int()
+			if err != nil {
+				return err
+			}
+			if version != int64(versionV2) {
+				return ErrUnsupportedVersion
+			}
+		case "created_at":
+			hdr.CreatedAt, err = d.int()
+		case "size":
+			var size int64
+			size, err = d.int()
+			hdr.Size = int(size)
+		case "limit":
+			var limit int64
+			limit, err = d.int()
+			hdr.Limit = int(limit)
+		case "delta":
+			var delta bool
+			if delta, err = d.bool(); delta {
+				hdr.Flags |= flagDelta
+			}
+		case "reset":
+			var reset bool
+			if reset, err = d.bool(); reset {
+				hdr.Flags |= flagReset
+			}
+		case "entries":
+			var count int
+			if count, err = d.arrayHeader(); err != nil {
+				return err
+			}
+			hdr.Count = int64(count)
+			if fn == nil && isKmap {
+				return nil
+			}
+			for j := 0; j < count; j++ {
+				if err := scanDocumentEntry(d, fn); err != nil {
+					return err
+				}
+			}
+		case "deleted":
+			var count int
+			if count, err = d.arrayHeader(); err != nil {
+				return err
+			}
+			hdr.Deleted = make([]string, 0, min64(int64(count), 1<<16))
+			for j := 0; j < count; j++ {
+				key, err := d.string()
+				if err != nil {
+					return err
+				}
+				hdr.Deleted = append(hdr.Deleted, key)
+			}
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !isKmap {
+		return ErrInvalidFormat
+	}
+	return nil
+}
+
+func scanDocumentEntry(d docDecoder, fn func(key string, value []byte, size int, expires int64) error) error {
+	n, err := d.mapHeader()
+	if err != nil {
+		return err
+	}
+	var key string
+	var value []byte
+	var size, expires int64
+	var hasKey bool
+	for i := 0; i < n; i++ {
+		name, err := d.string()
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "key":
+			key, err = d.string()
+			hasKey = true
+		case "value":
+			value, err = d.value()
+		case "size":
+			size, err = d.int()
+		case "expires":
+			expires, err = d.int()
+		default:
+			err = d.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !hasKey || value == nil {
+		return fmt.Errorf("%w: entry without key or value", ErrInvalidFormat)
+	}
+	if fn == nil {
+		return nil
+	}
+	return fn(key, value, int(size), expires)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// jsonObject is a JSON object keeping the order of its fields
+type jsonObject []jsonField
+
+type jsonField struct {
+	key   string
+	value any
+}
+
+// parseJSON decodes a single JSON value into nil, bool, string, json.Number, []any or jsonObject
+func parseJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return parseJSONValue(dec, 0)
+}
+
+func parseJSONValue(dec *json.Decoder, depth int) (any, error) {
+	if depth > maxDocDepth {
+		return nil, errDocDepth
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	if delim == '[' {
+		arr := []any{}
+		for dec.More() {
+			v, err := parseJSONValue(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	obj := jsonObject{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseJSONValue(dec, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, jsonField{key: tok.(string), value: v})
+	}
+	_, err = dec.Token()
+	return obj, err
+}
+
+func appendJSONString(dst []byte, s string) []byte {
+	b, _ := json.Marshal(s)
+	return append(dst, b...)
+}
+
+func appendJSONFloat(dst []byte, f float64, bits int) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%w: %v is not representable in JSON", ErrInvalidFormat, f)
+	}
+	return strconv.AppendFloat(dst, f, 'g', -1, bits), nil
+}
+
+// quoteJSONKey makes the JSON value written at dst[start:] usable as an object key: strings are kept, numbers are quoted
+func quoteJSONKey(dst []byte, start int) ([]byte, error) {
+	key := dst[start:]
+	switch {
+	case len(key) > 0 && key[0] == '"':
+		return dst, nil
+	case len(key) > 0 && (key[0] == '-' || key[0] >= '0' && key[0] <= '9'):
+		quoted := appendJSONString(nil, string(key))
+		return append(dst[:start], quoted...), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported map key %s", ErrInvalidFormat, key)
+}
+
+// readFull reads n bytes, growing the buffer as data arrives so a corrupted length cannot allocate gigabytes upfront
+func readFull(r io.Reader, n int) ([]byte, error) {
+	if n <= 1<<16 {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,146 @@
+package kmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DumpOptions configures Dump
+type DumpOptions struct {
+	// MaxValueLen truncates the printed values to this many bytes, 80 by default, negative prints them whole
+	MaxValueLen int
+	// Limit stops after this many entries, all of them when 0
+	Limit int
+	// Sorted orders the entries of a SafeMap by their printed key, they are in no particular order otherwise.
+	// OrderedMap entries are always in order.
+	Sorted bool
+}
+
+// stringLimit is the number of entries printed by String
+const stringLimit = 20
+
+// dumpEntry is an entry as printed by Dump
+type dumpEntry struct {
+	key, value, meta string
+}
+
+// dumpText prints v for Dump, quoting strings so empty and blank ones are visible, truncated to max bytes
+func dumpText(v any, max int) string {
+	var s string
+	if str, ok := v.(string); ok {
+		s = strconv.Quote(str)
+	} else {
+		s = fmt.Sprintf("%+v", v)
+	}
+	if max >= 0 && len(s) > max {
+		s = s[:max] + fmt.Sprintf("...(%d bytes)", len(s))
+	}
+	return s
+}
+
+// writeDump writes the header then the entries, followed by how many were left out
+func writeDump(w io.Writer, header string, entries []dumpEntry, total int) error {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	buf.WriteByte('\n')
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "  %s = %s  (%s)\n", e.key, e.value, e.meta)
+	}
+	if more := total - len(entries); more > 0 {
+		fmt.Fprintf(&buf, "  ... %d more\n", more)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// dumpLimit returns the printed size limit of a map
+func dumpLimit(limit int) string {
+	if limit <= 0 {
+		return "none"
+	}
+	return strconv.Itoa(limit) + "B"
+}
+
+// Dump pretty-prints the SafeMap to w for debugging: its length, size and limit, then each entry with its size,
+// its revision (see GetWithRevision) and the time left before it expires when it has a TTL. Long values are truncated.
+func (c *SafeMap[K, V]) Dump(w io.Writer, opts DumpOptions) error {
+	if opts.MaxValueLen == 0 {
+		opts.MaxValueLen = 80
+	}
+	c.RLock()
+	header := fmt.Sprintf("SafeMap len=%d size=%dB limit=%s", len(c.items), c.size, dumpLimit(c.limit))
+	entries := make([]dumpEntry, 0, len(c.items))
+	now := nowNano()
+	for k, i := range c.items {
+		if opts.Limit > 0 && !opts.Sorted && len(entries) == opts.Limit {
+			break
+		}
+		v := c.value(i)
+		size := i.Size
+		if c.limit <= 0 {
+			size = c.valueSize(v)
+		}
+		meta := fmt.Sprintf("size=%dB rev=%d", size, i.rev)
+		switch {
+		case i.expired(now):
+			meta += " expired"
+		case i.expires != 0:
+			meta += " ttl=" + time.Duration(i.expires-now).Round(time.Millisecond).String()
+		}
+		if i.spill != "" {
+			meta += " spilled"
+		}
+		entries = append(entries, dumpEntry{key: dumpText(k, -1), value: dumpText(v, opts.MaxValueLen), meta: meta})
+	}
+	total := len(c.items)
+	c.RUnlock()
+
+	if opts.Sorted {
+		sort.Slice(entries, func(a, b int) bool { return entries[a].key < entries[b].key })
+		if opts.Limit > 0 && len(entries) > opts.Limit {
+			entries = entries[:opts.Limit]
+		}
+	}
+	return writeDump(w, header, entries, total)
+}
+
+// String prints the first entries of the SafeMap sorted by key, see Dump
+func (c *SafeMap[K, V]) String() string {
+	var buf bytes.Buffer
+	c.Dump(&buf, DumpOptions{Limit: stringLimit, Sorted: true})
+	return buf.String()
+}
+
+// Dump pretty-prints the OrderedMap to w in order for debugging, see SafeMap.Dump
+func (m *OrderedMap[K, V]) Dump(w io.Writer, opts DumpOptions) error {
+	if opts.MaxValueLen == 0 {
+		opts.MaxValueLen = 80
+	}
+	m.RLock()
+	header := fmt.Sprintf("OrderedMap len=%d size=%dB limit=%s", len(m.kv), m.size, dumpLimit(m.limit))
+	entries := make([]dumpEntry, 0, len(m.kv))
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		if opts.Limit > 0 && len(entries) == opts.Limit {
+			break
+		}
+		entries = append(entries, dumpEntry{
+			key:   dumpText(el.Key, -1),
+			value: dumpText(el.Value, opts.MaxValueLen),
+			meta:  fmt.Sprintf("size=%dB rev=%d", m.elementSize(el), el.rev),
+		})
+	}
+	total := len(m.kv)
+	m.RUnlock()
+	return writeDump(w, header, entries, total)
+}
+
+// String prints the first entries of the OrderedMap in order, see Dump
+func (m *OrderedMap[K, V]) String() string {
+	var buf bytes.Buffer
+	m.Dump(&buf, DumpOptions{Limit: stringLimit})
+	return buf.String()
+}
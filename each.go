@@ -0,0 +1,73 @@
+package kmap
+
+// EachKey calls fn for each key while holding the read lock, without allocating, until fn returns false.
+// fn must be quick and must not call methods of the map: writers wait for it, and taking the lock again can deadlock.
+// Use Range to call methods of the map, or to do slow work per entry.
+func (c *SafeMap[K, V]) EachKey(fn func(key K) bool) {
+	c.RLock()
+	defer c.RUnlock()
+	now := nowNano()
+	for k, i := range c.items {
+		if !i.expired(now) && !fn(k) {
+			return
+		}
+	}
+}
+
+// EachValue calls fn for each value while holding the read lock until fn returns false, see EachKey.
+// Values read back from disk or from an arena are still decoded.
+func (c *SafeMap[K, V]) EachValue(fn func(value V) bool) {
+	c.RLock()
+	defer c.RUnlock()
+	now := nowNano()
+	for _, i := range c.items {
+		if !i.expired(now) && !fn(c.value(i)) {
+			return
+		}
+	}
+}
+
+// AppendKeys appends the keys to dst and returns the extended slice, so callers can reuse a buffer across calls
+func (c *SafeMap[K, V]) AppendKeys(dst []K) []K {
+	c.RLock()
+	defer c.RUnlock()
+	now := nowNano()
+	for k, i := range c.items {
+		if !i.expired(now) {
+			dst = append(dst, k)
+		}
+	}
+	return dst
+}
+
+// EachKey calls fn for each key in order while holding the read lock, until fn returns false, see SafeMap.EachKey
+func (m *OrderedMap[K, V]) EachKey(fn func(key K) bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		if !fn(el.Key) {
+			return
+		}
+	}
+}
+
+// EachValue calls fn for each value in order while holding the read lock, until fn returns false, see SafeMap.EachKey
+func (m *OrderedMap[K, V]) EachValue(fn func(value V) bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		if !fn(el.Value) {
+			return
+		}
+	}
+}
+
+// AppendKeys appends the keys in order to dst and returns the extended slice, see SafeMap.AppendKeys
+func (m *OrderedMap[K, V]) AppendKeys(dst []K) []K {
+	m.RLock()
+	defer m.RUnlock()
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		dst = append(dst, el.Key)
+	}
+	return dst
+}
@@ -0,0 +1,226 @@
+package kmap
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Encoding selects how values are serialized when a map is saved.
+// It is recorded in the file header, loaders pick the right decoder whatever the options they were given.
+type Encoding uint8
+
+const (
+	// EncodingJSON is the default, values are readable by any tool but lose some Go types (ints in any, unexported fields...)
+	EncodingJSON Encoding = iota
+	// EncodingGob serializes values with encoding/gob, preserving Go types such as nested structs and time.Time
+	// and usually faster on large structs. Concrete types stored in interface values must be registered with gob.Register.
+	EncodingGob
+	// EncodingMsgpack writes the whole file as a single MessagePack document that any msgpack library can read,
+	// for analytics pipelines and other languages. Values are converted from their JSON form, with the same fidelity.
+	EncodingMsgpack
+	// EncodingCBOR writes the whole file as a single CBOR (RFC 8949) document, compact and standard like msgpack,
+	// but byte slices are stored as binary instead of base64 and time.Time with the standard date/time tag.
+	EncodingCBOR
+)
+
+// The encoding is stored in the second byte of the header flags
+const (
+	flagEncodingShift = 8
+	flagEncodingMask  = uint32(0xff) << flagEncodingShift
+)
+
+// Marshaler is implemented by values with their own binary encoding, such as gogo/protobuf or vtprotobuf messages.
+// With EncodingJSON and EncodingGob such values are saved with Marshal and loaded with Unmarshal instead of being
+// converted, which keeps unknown fields and is much smaller. Messages of google.golang.org/protobuf can implement
+// both methods by calling proto.Marshal and proto.Unmarshal.
+//
+// Values implementing encoding.BinaryMarshaler and encoding.BinaryUnmarshaler (time.Time, netip.Addr, custom IDs...)
+// are persisted the same way with MarshalBinary, so they round-trip exactly.
+type Marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// Unmarshaler is the counterpart of Marshaler
+type Unmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Tags starting the values written with their own methods, see marshalNative.
+// Neither can start a JSON or gob value.
+const (
+	nativeValueTag = 0x00 // Marshaler
+	binaryValueTag = 0x01 // encoding.BinaryMarshaler
+)
+
+var (
+	marshalerType         = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType       = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+var (
+	ErrUnknownEncoding  = errors.New("unknown value encoding")
+	ErrEncodingMismatch = errors.New("file encoding differs from the backend encoding")
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingJSON:
+		return "json"
+	case EncodingGob:
+		return "gob"
+	case EncodingMsgpack:
+		return "msgpack"
+	case EncodingCBOR:
+		return "cbor"
+	}
+	return fmt.Sprintf("Encoding(%d)", uint8(e))
+}
+
+func (e Encoding) valid() bool {
+	return e <= EncodingCBOR
+}
+
+// document reports whether e writes the whole file as a single document instead of the kmap binary layout, see writeDocument
+func (e Encoding) document() bool {
+	return e == EncodingMsgpack || e == EncodingCBOR
+}
+
+// flags returns the header flags recording e
+func (e Encoding) flags() uint32 {
+	return uint32(e) << flagEncodingShift
+}
+
+// encodingOf returns the encoding recorded in header flags
+func encodingOf(flags uint32) Encoding {
+	return Encoding((flags & flagEncodingMask) >> flagEncodingShift)
+}
+
+// marshalValue serializes a single value with enc
+func marshalValue[V any](enc Encoding, v V) ([]byte, error) {
+	if !enc.document() {
+		if data, ok, err := marshalNative(v); ok {
+			return data, err
+		}
+	}
+	switch enc {
+	case EncodingJSON, EncodingMsgpack:
+		return json.Marshal(v)
+	case EncodingGob:
+		var buf bytes.Buffer
+		// Encoding a pointer keeps interface values typed, so V = any round-trips
+		if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingCBOR:
+		return marshalCBOR(v)
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// unmarshalValue decodes a single value serialized by marshalValue with enc.
+// Like in marshalValue, document encodings never tag values: their first byte may equal a tag (CBOR 0 and 1).
+func unmarshalValue[V any](enc Encoding, data []byte, v *V) error {
+	if !enc.document() && isNativeValue(data) {
+		return unmarshalNative(data[0], data[1:], v)
+	}
+	switch enc {
+	case EncodingJSON, EncodingMsgpack:
+		return json.Unmarshal(data, v)
+	case EncodingGob:
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	case EncodingCBOR:
+		data, err := cborToJSON(data)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	return ErrUnknownEncoding
+}
+
+// nativeTag returns the tag of the methods V is persisted with, when it implements both directions of Marshaler
+// or encoding.BinaryMarshaler, on the value or its pointer. Interface types are excluded,
+// the loader could not know which concrete type to unmarshal into.
+func nativeTag[V any]() (byte, bool) {
+	t := reflect.TypeOf((*V)(nil)).Elem()
+	if t.Kind() == reflect.Interface {
+		return 0, false
+	}
+	// Methods are called on the pointer, which also has the value methods
+	target := t
+	if t.Kind() != reflect.Pointer {
+		target = reflect.PointerTo(t)
+	}
+	switch {
+	case target.Implements(marshalerType) && target.Implements(unmarshalerType):
+		return nativeValueTag, true
+	case target.Implements(binaryMarshalerType) && target.Implements(binaryUnmarshalerType):
+		return binaryValueTag, true
+	}
+	return 0, false
+}
+
+// isNativeValue reports whether data was written by marshalNative
+func isNativeValue(data []byte) bool {
+	return len(data) > 0 && (data[0] == nativeValueTag || data[0] == binaryValueTag)
+}
+
+// marshalNative encodes v with its own methods, see nativeTag. Nil pointers are left to the encoding.
+func marshalNative[V any](v V) ([]byte, bool, error) {
+	tag, ok := nativeTag[V]()
+	if !ok {
+		return nil, false, nil
+	}
+	var target any = &v
+	if rv := reflect.ValueOf(&v).Elem(); rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, false, nil
+		}
+		target = v
+	}
+
+	var data []byte
+	var err error
+	if tag == nativeValueTag {
+		data, err = target.(Marshaler).Marshal()
+	} else {
+		data, err = target.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	return append([]byte{tag}, data...), true, nil
+}
+
+// unmarshalNative decodes a value written by marshalNative with the given tag, allocating it when V is a pointer
+func unmarshalNative[V any](tag byte, data []byte, v *V) error {
+	var target any = v
+	commit := func() {}
+	if rv := reflect.ValueOf(v).Elem(); rv.Kind() == reflect.Pointer {
+		elem := reflect.New(rv.Type().Elem())
+		target = elem.Interface()
+		commit = func() { rv.Set(elem) }
+	}
+
+	var err error
+	if u, ok := target.(Unmarshaler); ok && tag == nativeValueTag {
+		err = u.Unmarshal(data)
+	} else if u, ok := target.(encoding.BinaryUnmarshaler); ok && tag == binaryValueTag {
+		err = u.UnmarshalBinary(data)
+	} else {
+		return fmt.Errorf("%w: value written by its own methods but %T cannot unmarshal it", ErrInvalidFormat, *v)
+	}
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
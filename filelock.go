@@ -0,0 +1,116 @@
+package kmap
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLockTimeout is returned when another process holds the lock of a file for longer than SaveOptions.LockTimeout
+var ErrLockTimeout = errors.New("timed out waiting for the lock of the file")
+
+// lockPoll is how often a busy lock is tried again
+const lockPoll = 10 * time.Millisecond
+
+// openLocked opens path with flag and takes its advisory lock, exclusive when the file is opened for writing
+// and shared otherwise, waiting at most timeout for it (forever when 0). The lock is released when the file is closed.
+// Locks are only taken on Unix, so other processes using kmap never read or write a file being written.
+func openLocked(path string, flag int, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	exclusive := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLockFile(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return f, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			f.Close()
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// writeLocked replaces the file at path with data under its exclusive lock, see openLocked.
+// data is written to a new file renamed over path, so a crash in the middle of the write leaves the previous file whole.
+func writeLocked(path string, data []byte, timeout time.Duration) error {
+	if !fileLocks {
+		return replaceFile(path, data)
+	}
+	for {
+		f, err := openLocked(path, os.O_RDWR|os.O_CREATE, timeout)
+		if err != nil {
+			return err
+		}
+		// The lock is taken on the file at path when it was opened, another writer may have replaced it since
+		same, err := sameFile(f, path)
+		if err == nil && same {
+			err = replaceFile(path, data)
+		}
+		f.Close()
+		if err != nil || same {
+			return err
+		}
+	}
+}
+
+// replaceFile writes data to a temporary file next to path, syncs it and renames it over path
+func replaceFile(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes data to a new synced file next to path and returns its name, to be renamed over path
+func writeTemp(path string, data []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// sameFile reports whether f is still the file at path
+func sameFile(f *os.File, path string) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pi), nil
+}
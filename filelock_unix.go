@@ -0,0 +1,25 @@
+//go:build unix
+
+package kmap
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileLocks tells whether tryLockFile locks files on this platform
+const fileLocks = true
+
+// tryLockFile takes the flock of f without waiting, ok is false when another open file holds it
+func tryLockFile(f *os.File, exclusive bool) (ok bool, err error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,524 @@
+package kmap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// File format versions understood by the loader.
+//
+//   - v1 JSON: the original SafeMap format, a single JSON object without header
+//   - v1 binary: the original OrderedMap format, header followed by typed entries
+//   - v2: the format written today by both map types, see writeSnapshot, or a document (see writeDocument)
+const (
+	versionV1 = uint32(1)
+	versionV2 = uint32(2)
+)
+
+// Header flags
+const (
+	// flagDelta marks a file written by SaveDeltaToFile, holding changes and tombstones instead of a full snapshot
+	flagDelta = uint32(1 << 0)
+	// flagReset marks a delta starting with a Flush, existing entries are dropped before applying it
+	flagReset = uint32(1 << 1)
+	// flagExpiry marks entries followed by their expiry time, written when the map holds entries set with a TTL
+	flagExpiry = uint32(1 << 2)
+)
+
+var (
+	ErrInvalidFormat      = errors.New("invalid file format")
+	ErrUnsupportedVersion = errors.New("unsupported file version")
+	ErrChecksumMismatch   = errors.New("file checksum mismatch")
+)
+
+// fileHeader holds the map level metadata stored at the start of a file
+type fileHeader struct {
+	Version    uint32
+	Flags      uint32
+	CreatedAt  int64
+	Size       int
+	Limit      int
+	Count      int64
+	Compressed bool
+	json       bool
+	// doc is set for files written by a document encoding, the encoding is in Flags
+	doc bool
+	// Deleted holds the tombstones of a delta file
+	Deleted []string
+}
+
+// fileEntry is a decoded entry, in the order it was stored
+type fileEntry[K comparable, V any] struct {
+	Key   K
+	Value V
+	Size  int
+	// Expires is the Unix nanosecond at which the entry expires, 0 for never, see SetWithTTL
+	Expires int64
+}
+
+// snapshotWriter is implemented by the map types to stream their entries to writeSnapshot
+type snapshotWriter func(emit func(key string, value []byte, size int, expires int64) error) error
+
+// writeSnapshot writes a v2 file to w, in the kmap binary layout (see writeBinarySnapshot)
+// or as a document for document encodings, optionally gzip compressed.
+func writeSnapshot(w io.Writer, opts SaveOptions, hdr fileHeader, entries snapshotWriter) error {
+	if !opts.Encoding.valid() {
+		return ErrUnknownEncoding
+	}
+	var gzipWriter *gzip.Writer
+	if opts.Compress {
+		level := opts.CompressLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var err error
+		gzipWriter, err = gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		w = gzipWriter
+	}
+
+	if hdr.CreatedAt == 0 {
+		hdr.CreatedAt = time.Now().UnixNano()
+	}
+
+	var err error
+	if opts.Encoding.document() {
+		err = writeDocument(newDocEncoder(opts.Encoding, w), hdr, entries)
+	} else {
+		hdr.Flags |= opts.Encoding.flags()
+		err = writeBinarySnapshot(w, hdr, entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	if gzipWriter != nil {
+		return gzipWriter.Close()
+	}
+	return nil
+}
+
+// writeBinarySnapshot writes the kmap binary layout:
+//
+//	magic u32 | version u32 | flags u32 | createdAt i64 | size i64 | limit i64 | count i64
+//	count x (key string | value bytes | size i64 | expires i64)    expires only when flagExpiry is set
+//	deleted i64 | deleted x (key string)          only when flagDelta is set
+//	crc32 u32 of everything above
+func writeBinarySnapshot(w io.Writer, hdr fileHeader, entries snapshotWriter) error {
+	crc := crc32.NewIEEE()
+	cw := io.MultiWriter(w, crc)
+	for _, v := range []interface{}{magicNumber, versionV2, hdr.Flags, hdr.CreatedAt, hdr.Size, hdr.Limit, hdr.Count} {
+		if err := writeBinary(cw, v); err != nil {
+			return err
+		}
+	}
+
+	var written int64
+	err := entries(func(key string, value []byte, size int, expires int64) error {
+		written++
+		if err := writeBinary(cw, key); err != nil {
+			return err
+		}
+		if err := writeBinary(cw, value); err != nil {
+			return err
+		}
+		if err := writeBinary(cw, size); err != nil {
+			return err
+		}
+		if hdr.Flags&flagExpiry != 0 {
+			return writeBinary(cw, expires)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if written != hdr.Count {
+		return errors.New("entry count changed while saving")
+	}
+	if hdr.Flags&flagDelta != 0 {
+		if err := writeBinary(cw, int64(len(hdr.Deleted))); err != nil {
+			return err
+		}
+		for _, key := range hdr.Deleted {
+			if err := writeBinary(cw, key); err != nil {
+				return err
+			}
+		}
+	}
+	return writeBinary(w, crc.Sum32())
+}
+
+// FileInfo describes a file written by SaveToFile, as returned by ReadFileInfo
+type FileInfo struct {
+	// Version is the file format version
+	Version int
+	// Compressed reports whether the file is gzip compressed
+	Compressed bool
+	// Count is the number of entries stored in the file
+	Count int64
+	// Size is the total tracked size of the entries in bytes
+	Size int
+	// Limit is the size limit of the saved map in bytes, -1 when unlimited
+	Limit int
+	// CreatedAt is when the file was written, zero for v1 files which did not record it
+	CreatedAt time.Time
+	// Delta reports whether the file holds changes written by SaveDeltaToFile rather than a full snapshot
+	Delta bool
+	// Encoding is how values are serialized, always EncodingJSON for v1 files
+	Encoding Encoding
+}
+
+// ReadFileInfo reads the metadata of a file written by SaveToFile without loading its entries.
+// Only the header is decoded, except for v1 JSON files which have no header and must be parsed entirely.
+func ReadFileInfo(path string) (FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer file.Close()
+
+	br, hdr, closeFn, err := openSnapshot(file)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer closeFn()
+
+	switch {
+	case hdr.Version == versionV2:
+		err = readHeaderV2(br, &hdr)
+	case hdr.Version == versionV1 && !hdr.json:
+		err = readHeaderV1(br, &hdr)
+	default:
+		_, err = readJSONV1[string, json.RawMessage](br, &hdr)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info := FileInfo{
+		Version:    int(hdr.Version),
+		Compressed: hdr.Compressed,
+		Count:      hdr.Count,
+		Size:       hdr.Size,
+		Limit:      hdr.Limit,
+		Delta:      hdr.Flags&flagDelta != 0,
+		Encoding:   encodingOf(hdr.Flags),
+	}
+	if hdr.CreatedAt != 0 {
+		info.CreatedAt = time.Unix(0, hdr.CreatedAt)
+	}
+	return info, nil
+}
+
+// ValidateFile reads a file written by SaveToFile end to end and reports the first problem found:
+// a bad header, a truncated or malformed entry, a checksum mismatch or trailing garbage.
+// Entries are checked one at a time and discarded, the map is never built.
+// v1 binary files carry typed entries without checksum, only their header can be validated.
+func ValidateFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	br, hdr, closeFn, err := openSnapshot(file)
+	defer closeFn()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case hdr.Version == versionV2:
+		var total int
+		err = scanV2(br, &hdr, func(key string, value []byte, size int, expires int64) error {
+			if encodingOf(hdr.Flags) == EncodingJSON && !isNativeValue(value) && !json.Valid(value) {
+				return fmt.Errorf("%w: malformed value for key %q", ErrInvalidFormat, key)
+			}
+			if size < 0 {
+				return fmt.Errorf("%w: negative size for key %q", ErrInvalidFormat, key)
+			}
+			total += size
+			return nil
+		})
+		if err == nil && hdr.Flags&flagDelta == 0 && total != hdr.Size {
+			err = fmt.Errorf("%w: entry sizes add up to %d, header says %d", ErrInvalidFormat, total, hdr.Size)
+		}
+	case hdr.json:
+		_, err = readJSONV1[string, json.RawMessage](br, &hdr)
+	default:
+		return readHeaderV1(br, &hdr)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	// Reading until EOF also makes gzip verify its own checksum
+	n, err := io.Copy(io.Discard, br)
+	if err != nil {
+		return err
+	}
+	if n > 0 && !hdr.json {
+		return fmt.Errorf("%w: %d bytes of trailing data", ErrInvalidFormat, n)
+	}
+	return nil
+}
+
+// openSnapshot unwraps gzip compression and detects the format version of r.
+// The returned reader is positioned at the very start of the (decompressed) file.
+func openSnapshot(r io.Reader) (*bufio.Reader, fileHeader, func() error, error) {
+	var hdr fileHeader
+	closeFn := func() error { return nil }
+	br := bufio.NewReader(r)
+	if sig, _ := br.Peek(2); len(sig) == 2 && sig[0] == 0x1f && sig[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, hdr, closeFn, err
+		}
+		closeFn = gzipReader.Close
+		br = bufio.NewReader(gzipReader)
+		hdr.Compressed = true
+	}
+
+	head, err := br.Peek(8)
+	if len(head) == 0 {
+		if err == nil || err == io.EOF {
+			err = ErrInvalidFormat
+		}
+		return nil, hdr, closeFn, err
+	}
+
+	if len(head) == 8 && binary.LittleEndian.Uint32(head) == magicNumber {
+		hdr.Version = binary.LittleEndian.Uint32(head[4:])
+		if hdr.Version != versionV1 && hdr.Version != versionV2 {
+			return nil, hdr, closeFn, ErrUnsupportedVersion
+		}
+		return br, hdr, closeFn, nil
+	}
+
+	if head[0] == '{' {
+		hdr.Version = versionV1
+		hdr.json = true
+		return br, hdr, closeFn, nil
+	}
+
+	if enc, ok := sniffDocument(head); ok {
+		hdr.Version = versionV2
+		hdr.Flags = enc.flags()
+		hdr.doc = true
+		return br, hdr, closeFn, nil
+	}
+	return nil, hdr, closeFn, ErrInvalidFormat
+}
+
+// readSnapshot detects the format of r (optionally gzip compressed) and decodes all its entries
+func readSnapshot[K comparable, V any](r io.Reader) (fileHeader, []fileEntry[K, V], error) {
+	br, hdr, closeFn, err := openSnapshot(r)
+	defer closeFn()
+	if err != nil {
+		return hdr, nil, err
+	}
+
+	var entries []fileEntry[K, V]
+	switch {
+	case hdr.Version == versionV2:
+		entries, err = readV2[K, V](br, &hdr)
+	case hdr.json:
+		entries, err = readJSONV1[K, V](br, &hdr)
+	default:
+		entries, err = readBinaryV1[K, V](br, &hdr)
+	}
+	return hdr, entries, err
+}
+
+// readHeaderV2 reads the fixed size header written by writeSnapshot, or the header fields of a document
+func readHeaderV2(r io.Reader, hdr *fileHeader) error {
+	if hdr.doc {
+		return scanDocument(newDocDecoder(encodingOf(hdr.Flags), r), hdr, nil)
+	}
+	var magic, ver uint32
+	for _, v := range []interface{}{&magic, &ver, &hdr.Flags, &hdr.CreatedAt, &hdr.Size, &hdr.Limit, &hdr.Count} {
+		if err := readBinary(r, v); err != nil {
+			return err
+		}
+	}
+	if hdr.Count < 0 {
+		return ErrInvalidFormat
+	}
+	if !encodingOf(hdr.Flags).valid() {
+		return ErrUnknownEncoding
+	}
+	return nil
+}
+
+// readV2 reads a file written by writeSnapshot and verifies its checksum
+func readV2[K comparable, V any](r io.Reader, hdr *fileHeader) ([]fileEntry[K, V], error) {
+	var entries []fileEntry[K, V]
+	err := scanV2(r, hdr, func(keyStr string, value []byte, size int, expires int64) error {
+		if entries == nil {
+			entries = make([]fileEntry[K, V], 0, min64(hdr.Count, 1<<16))
+		}
+		k, err := decodeKey[K](keyStr)
+		if err != nil {
+			return err
+		}
+		e := fileEntry[K, V]{Key: k, Size: size, Expires: expires}
+		if err := unmarshalValue(encodingOf(hdr.Flags), value, &e.Value); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// scanV2 streams the raw entries of a v2 file to fn, then verifies the checksum
+func scanV2(r io.Reader, hdr *fileHeader, fn func(key string, value []byte, size int, expires int64) error) error {
+	if hdr.doc {
+		return scanDocument(newDocDecoder(encodingOf(hdr.Flags), r), hdr, fn)
+	}
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	if err := readHeaderV2(tr, hdr); err != nil {
+		return err
+	}
+
+	for i := int64(0); i < hdr.Count; i++ {
+		var key string
+		var value []byte
+		var size int
+		var expires int64
+		if err := readBinary(tr, &key); err != nil {
+			return err
+		}
+		if err := readBinary(tr, &value); err != nil {
+			return err
+		}
+		if err := readBinary(tr, &size); err != nil {
+			return err
+		}
+		if hdr.Flags&flagExpiry != 0 {
+			if err := readBinary(tr, &expires); err != nil {
+				return err
+			}
+		}
+		if err := fn(key, value, size, expires); err != nil {
+			return err
+		}
+	}
+
+	if hdr.Flags&flagDelta != 0 {
+		var deleted int64
+		if err := readBinary(tr, &deleted); err != nil {
+			return err
+		}
+		if deleted < 0 {
+			return ErrInvalidFormat
+		}
+		hdr.Deleted = make([]string, 0, min64(deleted, 1<<16))
+		for i := int64(0); i < deleted; i++ {
+			var key string
+			if err := readBinary(tr, &key); err != nil {
+				return err
+			}
+			hdr.Deleted = append(hdr.Deleted, key)
+		}
+	}
+
+	sum := crc.Sum32()
+	var stored uint32
+	if err := readBinary(r, &stored); err != nil {
+		return err
+	}
+	if stored != sum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// readHeaderV1 reads the header of the original OrderedMap binary format
+func readHeaderV1(r io.Reader, hdr *fileHeader) error {
+	var magic, ver uint32
+	for _, v := range []interface{}{&magic, &ver, &hdr.Size, &hdr.Limit, &hdr.Count} {
+		if err := readBinary(r, v); err != nil {
+			return err
+		}
+	}
+	if hdr.Count < 0 {
+		return ErrInvalidFormat
+	}
+	return nil
+}
+
+// readBinaryV1 reads the original OrderedMap binary format
+func readBinaryV1[K comparable, V any](r io.Reader, hdr *fileHeader) ([]fileEntry[K, V], error) {
+	if err := readHeaderV1(r, hdr); err != nil {
+		return nil, err
+	}
+
+	entries := make([]fileEntry[K, V], 0, min64(hdr.Count, 1<<16))
+	for i := int64(0); i < hdr.Count; i++ {
+		var e fileEntry[K, V]
+		if err := readBinary(r, &e.Key); err != nil {
+			return nil, err
+		}
+		// v1 had no []byte case, byte slices went through the JSON wrapper
+		if b, ok := any(&e.Value).(*[]byte); ok {
+			if err := readWrapped(r, b); err != nil {
+				return nil, err
+			}
+		} else if err := readBinary(r, &e.Value); err != nil {
+			return nil, err
+		}
+		if err := readBinary(r, &e.Size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readJSONV1 reads the original SafeMap JSON format
+func readJSONV1[K comparable, V any](r io.Reader, hdr *fileHeader) ([]fileEntry[K, V], error) {
+	var data mapData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	hdr.Size = data.Size
+	hdr.Limit = data.Limit
+	hdr.Count = int64(len(data.Items))
+
+	entries := make([]fileEntry[K, V], 0, len(data.Items))
+	for kStr, item := range data.Items {
+		k, err := decodeKey[K](kStr)
+		if err != nil {
+			return nil, err
+		}
+		e := fileEntry[K, V]{Key: k, Size: item.Size}
+		if err := json.Unmarshal(item.Value, &e.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
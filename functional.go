@@ -0,0 +1,240 @@
+package kmap
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Reduce folds the entries of the SafeMap into an accumulator, starting from initial.
+// Entries are read from a consistent copy taken under the lock, see Range.
+func Reduce[K comparable, V any, A any](m *SafeMap[K, V], initial A, fn func(acc A, key K, value V) A) A {
+	acc := initial
+	m.Range(func(key K, value V) bool {
+		acc = fn(acc, key, value)
+		return true
+	})
+	return acc
+}
+
+// ReduceOrdered is Reduce for an OrderedMap, entries are folded in order
+func ReduceOrdered[K comparable, V any, A any](m *OrderedMap[K, V], initial A, fn func(acc A, key K, value V) A) A {
+	acc := initial
+	m.Range(func(key K, value V) bool {
+		acc = fn(acc, key, value)
+		return true
+	})
+	return acc
+}
+
+// Partition splits the SafeMap into the entries matching pred and the others, returned as new maps
+// with the same limit. Entries keep their TTL, expired ones are left out. The map itself is not changed.
+func (c *SafeMap[K, V]) Partition(pred func(key K, value V) bool) (match, rest *SafeMap[K, V]) {
+	c.RLock()
+	defer c.RUnlock()
+	match, rest = c.newLike(0), c.newLike(0)
+	now := nowNano()
+	for k, i := range c.items {
+		if i.expired(now) {
+			continue
+		}
+		v := c.value(i)
+		dst := rest
+		if pred(k, v) {
+			dst = match
+		}
+		dst.items[k] = item[V]{Value: v, Size: i.Size, expires: i.expires, ttl: i.ttl}
+		dst.size += i.Size
+	}
+	return match, rest
+}
+
+// GroupBy groups the values of the SafeMap by the key keyFn returns for each entry, in no particular order
+func GroupBy[K comparable, V any, G comparable](m *SafeMap[K, V], keyFn func(key K, value V) G) map[G][]V {
+	groups := make(map[G][]V)
+	m.Range(func(key K, value V) bool {
+		g := keyFn(key, value)
+		groups[g] = append(groups[g], value)
+		return true
+	})
+	return groups
+}
+
+// scan calls fn for each entry of a snapshot of the SafeMap until it returns false, without copying the entries.
+// fn runs without the lock held and may use the map.
+func (c *SafeMap[K, V]) scan(fn func(key K, value V) bool) {
+	s := c.Snapshot()
+	now := nowNano()
+	for k, i := range s.items {
+		if i.expired(now) {
+			continue
+		}
+		if !fn(k, s.value(i)) {
+			return
+		}
+	}
+}
+
+// Any reports whether pred is true for at least one entry, stopping at the first one
+func (c *SafeMap[K, V]) Any(pred func(key K, value V) bool) bool {
+	found := false
+	c.scan(func(key K, value V) bool {
+		found = pred(key, value)
+		return !found
+	})
+	return found
+}
+
+// All reports whether pred is true for every entry, stopping at the first false, it is true for an empty map
+func (c *SafeMap[K, V]) All(pred func(key K, value V) bool) bool {
+	all := true
+	c.scan(func(key K, value V) bool {
+		all = pred(key, value)
+		return all
+	})
+	return all
+}
+
+// CountIf returns the number of entries pred is true for
+func (c *SafeMap[K, V]) CountIf(pred func(key K, value V) bool) int {
+	n := 0
+	c.scan(func(key K, value V) bool {
+		if pred(key, value) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// Any reports whether pred is true for at least one entry, stopping at the first one.
+// pred runs with the read lock held, like Range.
+func (m *OrderedMap[K, V]) Any(pred func(key K, value V) bool) bool {
+	found := false
+	m.Range(func(key K, value V) bool {
+		found = pred(key, value)
+		return !found
+	})
+	return found
+}
+
+// All reports whether pred is true for every entry, stopping at the first false, it is true for an empty map.
+// pred runs with the read lock held, like Range.
+func (m *OrderedMap[K, V]) All(pred func(key K, value V) bool) bool {
+	all := true
+	m.Range(func(key K, value V) bool {
+		all = pred(key, value)
+		return all
+	})
+	return all
+}
+
+// CountIf returns the number of entries pred is true for, pred runs with the read lock held, like Range
+func (m *OrderedMap[K, V]) CountIf(pred func(key K, value V) bool) int {
+	n := 0
+	m.Range(func(key K, value V) bool {
+		if pred(key, value) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// Find returns an entry pred is true for, any of them when several match
+func (c *SafeMap[K, V]) Find(pred func(key K, value V) bool) (key K, value V, found bool) {
+	c.scan(func(k K, v V) bool {
+		if pred(k, v) {
+			key, value, found = k, v, true
+		}
+		return !found
+	})
+	return key, value, found
+}
+
+// Find returns the first entry in order pred is true for, pred runs with the read lock held, like Range
+func (m *OrderedMap[K, V]) Find(pred func(key K, value V) bool) (key K, value V, found bool) {
+	m.Range(func(k K, v V) bool {
+		if pred(k, v) {
+			key, value, found = k, v, true
+		}
+		return !found
+	})
+	return key, value, found
+}
+
+// ParallelMapValues returns a new SafeMap, without limit, holding the values of m transformed by fn.
+// fn runs on a snapshot of m (see Snapshot) without the lock held, on up to workers goroutines at once,
+// GOMAXPROCS when workers <= 0, so it must be safe for concurrent use. It is meant for batch processing of big maps.
+func ParallelMapValues[K comparable, V any, R any](m *SafeMap[K, V], workers int, fn func(key K, value V) R) *SafeMap[K, R] {
+	entries := m.Snapshot().Entries()
+	results := make([]R, len(entries))
+	parallelChunks(len(entries), workers, func(lo, hi int) {
+		for j := lo; j < hi; j++ {
+			results[j] = fn(entries[j].Key, entries[j].Value)
+		}
+	})
+	dst := New[K, R]()
+	for j, e := range entries {
+		dst.items[e.Key] = item[R]{Value: results[j]}
+	}
+	return dst
+}
+
+// ParallelFilter returns a new SafeMap with the limit of m holding the entries pred is true for,
+// with their TTL. Expired entries are left out.
+// pred runs like the function of ParallelMapValues, on up to workers goroutines at once.
+func ParallelFilter[K comparable, V any](m *SafeMap[K, V], workers int, pred func(key K, value V) bool) *SafeMap[K, V] {
+	s := m.Snapshot()
+	s.RLock()
+	// The snapshot has the limit and accounting settings of m, reading them from m would need its lock
+	dst := s.newLike(0)
+	entries := make([]Pair[K, item[V]], 0, len(s.items))
+	now := nowNano()
+	for k, i := range s.items {
+		if !i.expired(now) {
+			entries = append(entries, Pair[K, item[V]]{Key: k, Value: item[V]{Value: s.value(i), Size: i.Size, expires: i.expires, ttl: i.ttl}})
+		}
+	}
+	s.RUnlock()
+	keep := make([]bool, len(entries))
+	parallelChunks(len(entries), workers, func(lo, hi int) {
+		for j := lo; j < hi; j++ {
+			keep[j] = pred(entries[j].Key, entries[j].Value.Value)
+		}
+	})
+	for j, e := range entries {
+		if keep[j] {
+			dst.items[e.Key] = e.Value
+			dst.size += e.Value.Size
+		}
+	}
+	return dst
+}
+
+// parallelChunks splits [0, n) into contiguous chunks and calls fn for each of them on up to workers goroutines
+func parallelChunks(n, workers int, fn func(lo, hi int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for lo := 0; lo < n; lo += chunk {
+		hi := lo + chunk
+		if hi > n {
+			hi = n
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			fn(lo, hi)
+		}(lo, hi)
+	}
+	wg.Wait()
+}
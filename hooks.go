@@ -0,0 +1,236 @@
+package kmap
+
+import "strings"
+
+// EventKind is the kind of a change reported to watchers, see WatchWhere
+type EventKind uint8
+
+const (
+	EventSet EventKind = iota
+	EventDelete
+	EventFlush
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
+// Event is a change of a map, Value is zero for EventDelete and Key and Value are zero for EventFlush
+type Event[K comparable, V any] struct {
+	Kind  EventKind
+	Key   K
+	Value V
+}
+
+// watcher is a subscription of WatchWhere
+type watcher[K comparable, V any] struct {
+	id    uint64
+	match func(K) bool
+	fn    func(Event[K, V])
+}
+
+// hooks holds the listeners of a map and the changes not reported yet, it is guarded by the lock of the map
+type hooks[K comparable, V any] struct {
+	onSet    []func(key K, value V)
+	onDelete []func(key K)
+	onFlush  []func()
+	watchers []watcher[K, V]
+	lastID   uint64
+	pending  []Event[K, V]
+
+	// seq numbers the changes of the map, see Changes
+	seq     uint64
+	streams []*stream[K, V]
+	// bufferSize and bufferPolicy configure new streams, see WithChangeBuffer
+	bufferSize   int
+	bufferPolicy BufferPolicy
+}
+
+// active reports whether any listener is registered
+func (h *hooks[K, V]) active() bool {
+	return len(h.onSet) > 0 || len(h.onDelete) > 0 || len(h.onFlush) > 0 || len(h.watchers) > 0
+}
+
+// record queues a change, the write lock must be held
+func (h *hooks[K, V]) record(kind EventKind, key K, value V) {
+	h.seq++
+	e := Event[K, V]{Kind: kind, Key: key, Value: value}
+	if len(h.streams) > 0 {
+		h.publish(Change[K, V]{Seq: h.seq, Event: e})
+	}
+	if h.active() {
+		h.pending = append(h.pending, e)
+	}
+}
+
+// take returns the queued changes with a copy of the listeners, the write lock must be held
+func (h *hooks[K, V]) take() (hooks[K, V], bool) {
+	if len(h.pending) == 0 {
+		return hooks[K, V]{}, false
+	}
+	taken := hooks[K, V]{onSet: h.onSet, onDelete: h.onDelete, onFlush: h.onFlush, watchers: h.watchers, pending: h.pending}
+	h.pending = nil
+	return taken, true
+}
+
+// watch adds a watcher and returns its id, the write lock must be held
+func (h *hooks[K, V]) watch(match func(K) bool, fn func(Event[K, V])) uint64 {
+	h.lastID++
+	h.watchers = append(h.watchers, watcher[K, V]{id: h.lastID, match: match, fn: fn})
+	return h.lastID
+}
+
+// unwatch removes the watcher id, the write lock must be held.
+// The slice is copied since changes being reported may still iterate the previous one.
+func (h *hooks[K, V]) unwatch(id uint64) {
+	watchers := make([]watcher[K, V], 0, len(h.watchers))
+	for _, w := range h.watchers {
+		if w.id != id {
+			watchers = append(watchers, w)
+		}
+	}
+	h.watchers = watchers
+}
+
+// emit calls the listeners for each change, in order, without any lock held
+func (h hooks[K, V]) emit() {
+	for _, e := range h.pending {
+		switch e.Kind {
+		case EventSet:
+			for _, fn := range h.onSet {
+				fn(e.Key, e.Value)
+			}
+		case EventDelete:
+			for _, fn := range h.onDelete {
+				fn(e.Key)
+			}
+		case EventFlush:
+			for _, fn := range h.onFlush {
+				fn()
+			}
+		}
+		for _, w := range h.watchers {
+			if e.Kind == EventFlush || w.match(e.Key) {
+				w.fn(e)
+			}
+		}
+	}
+}
+
+// OnSet registers fn to be called after a key is set, by Set or any other method changing values
+// (SetMany, Update, Txn, Merge...). Listeners run after the lock is released, in the goroutine that made the change,
+// and receive a copy of the value: they may use the map. Values loaded from a file or a backend are not reported.
+func (c *SafeMap[K, V]) OnSet(fn func(key K, value V)) *SafeMap[K, V] {
+	c.Lock()
+	c.hooks.onSet = append(c.hooks.onSet, fn)
+	c.Unlock()
+	return c
+}
+
+// OnDelete registers fn to be called after a key is removed, by Delete, DeleteAll, GetAndDelete or an eviction,
+// see OnSet for when listeners run.
+func (c *SafeMap[K, V]) OnDelete(fn func(key K)) *SafeMap[K, V] {
+	c.Lock()
+	c.hooks.onDelete = append(c.hooks.onDelete, fn)
+	c.Unlock()
+	return c
+}
+
+// OnFlush registers fn to be called after Flush or Clear, see OnSet for when listeners run
+func (c *SafeMap[K, V]) OnFlush(fn func()) *SafeMap[K, V] {
+	c.Lock()
+	c.hooks.onFlush = append(c.hooks.onFlush, fn)
+	c.Unlock()
+	return c
+}
+
+// unlock releases the write lock, then reports the changes made while it was held to the listeners
+func (c *SafeMap[K, V]) unlock() {
+	h, ok := c.hooks.take()
+	c.Unlock()
+	if ok {
+		h.emit()
+	}
+}
+
+// OnSet registers fn to be called after a key is set, by Set or any other method changing values
+// (SetPairs, Update, Txn...). Listeners run after the lock is released, in the goroutine that made the change,
+// and receive a copy of the value: they may use the map. Values loaded from a file or a backend are not reported.
+func (m *OrderedMap[K, V]) OnSet(fn func(key K, value V)) *OrderedMap[K, V] {
+	m.Lock()
+	m.hooks.onSet = append(m.hooks.onSet, fn)
+	m.Unlock()
+	return m
+}
+
+// OnDelete registers fn to be called after a key is removed, by Delete, DeleteAll, GetAndDelete or an eviction,
+// see OnSet for when listeners run.
+func (m *OrderedMap[K, V]) OnDelete(fn func(key K)) *OrderedMap[K, V] {
+	m.Lock()
+	m.hooks.onDelete = append(m.hooks.onDelete, fn)
+	m.Unlock()
+	return m
+}
+
+// OnFlush registers fn to be called after Flush or Clear, see OnSet for when listeners run
+func (m *OrderedMap[K, V]) OnFlush(fn func()) *OrderedMap[K, V] {
+	m.Lock()
+	m.hooks.onFlush = append(m.hooks.onFlush, fn)
+	m.Unlock()
+	return m
+}
+
+// unlock releases the write lock, then reports the changes made while it was held to the listeners
+func (m *OrderedMap[K, V]) unlock() {
+	h, ok := m.hooks.take()
+	m.Unlock()
+	if ok {
+		h.emit()
+	}
+}
+
+// WatchWhere calls fn with every change of a key matching pred, and on Flush or Clear,
+// so a whole namespace of keys is observed with one subscription. See OnSet for when fn runs.
+// The returned function ends the subscription.
+func (c *SafeMap[K, V]) WatchWhere(pred func(K) bool, fn func(Event[K, V])) (stop func()) {
+	c.Lock()
+	id := c.hooks.watch(pred, fn)
+	c.Unlock()
+	return func() {
+		c.Lock()
+		c.hooks.unwatch(id)
+		c.Unlock()
+	}
+}
+
+// WatchWhere calls fn with every change of a key matching pred, and on Flush or Clear,
+// so a whole namespace of keys is observed with one subscription. See OnSet for when fn runs.
+// The returned function ends the subscription.
+func (m *OrderedMap[K, V]) WatchWhere(pred func(K) bool, fn func(Event[K, V])) (stop func()) {
+	m.Lock()
+	id := m.hooks.watch(pred, fn)
+	m.Unlock()
+	return func() {
+		m.Lock()
+		m.hooks.unwatch(id)
+		m.Unlock()
+	}
+}
+
+// WatchPrefix is WatchWhere for the keys of c starting with prefix
+func WatchPrefix[V any](c *SafeMap[string, V], prefix string, fn func(Event[string, V])) (stop func()) {
+	return c.WatchWhere(func(key string) bool { return strings.HasPrefix(key, prefix) }, fn)
+}
+
+// WatchPrefixOrdered is WatchPrefix for an OrderedMap
+func WatchPrefixOrdered[V any](m *OrderedMap[string, V], prefix string, fn func(Event[string, V])) (stop func()) {
+	return m.WatchWhere(func(key string) bool { return strings.HasPrefix(key, prefix) }, fn)
+}
@@ -0,0 +1,197 @@
+package kmap
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// AdminOptions configures the admin handler of a map, see SafeMap.Handler
+type AdminOptions struct {
+	// Path is the file written by POST save and read by POST load, both answer 404 when it is empty
+	Path string
+	// Save configures POST save
+	Save SaveOptions
+}
+
+// admin is what the admin handler needs from a map, keys are encoded like in saved files
+type admin struct {
+	stats func() map[string]any
+	keys  func() ([]string, error)
+	get   func(key string) (any, bool, error)
+	del   func(key string) (bool, error)
+	save  func(path string, opts SaveOptions) error
+	load  func(path string) error
+}
+
+// Handler returns an http.Handler exposing the SafeMap as JSON, to debug production caches from an internal admin mux.
+// Routes are matched on the last element of the path, so it can be mounted under any prefix:
+//
+//	GET    stats                       {"len", "size", "limit", "cleanup"}
+//	GET    keys?offset=0&limit=100     {"total", "keys"}, keys sorted
+//	GET    key?key=k                   {"key", "value"}, 404 when missing
+//	DELETE key?key=k                   204, 404 when missing
+//	POST   save, POST load             204, writes or reads AdminOptions.Path
+//
+// Keys are given and returned encoded like in saved files, as is for string keys.
+// The handler has no authentication, it must not be exposed publicly.
+func (c *SafeMap[K, V]) Handler(opts ...AdminOptions) http.Handler {
+	return newAdminHandler(admin{
+		stats: func() map[string]any {
+			return map[string]any{"len": c.Len(), "size": c.Size(), "limit": c.Limit(), "cleanup": c.CleanupStats()}
+		},
+		keys: func() ([]string, error) {
+			keys, err := encodeKeys(c.Keys())
+			sort.Strings(keys)
+			return keys, err
+		},
+		get: func(key string) (any, bool, error) {
+			k, err := decodeKey[K](key)
+			if err != nil {
+				return nil, false, err
+			}
+			v, ok := c.Get(k)
+			return v, ok, nil
+		},
+		del: func(key string) (bool, error) {
+			k, err := decodeKey[K](key)
+			if err != nil {
+				return false, err
+			}
+			_, ok := c.GetAndDelete(k)
+			return ok, nil
+		},
+		save: c.SaveToFileWithOptions,
+		load: c.LoadFromFile,
+	}, opts...)
+}
+
+// Handler returns an http.Handler exposing the OrderedMap as JSON, keys are listed in order, see SafeMap.Handler
+func (m *OrderedMap[K, V]) Handler(opts ...AdminOptions) http.Handler {
+	return newAdminHandler(admin{
+		stats: func() map[string]any {
+			return map[string]any{"len": m.Len(), "size": m.Size(), "limit": m.Limit()}
+		},
+		keys: func() ([]string, error) {
+			return encodeKeys(m.Keys())
+		},
+		get: func(key string) (any, bool, error) {
+			k, err := decodeKey[K](key)
+			if err != nil {
+				return nil, false, err
+			}
+			v, ok := m.Get(k)
+			return v, ok, nil
+		},
+		del: func(key string) (bool, error) {
+			k, err := decodeKey[K](key)
+			if err != nil {
+				return false, err
+			}
+			return m.Delete(k), nil
+		},
+		save: m.SaveToFileWithOptions,
+		load: m.LoadFromFile,
+	}, opts...)
+}
+
+func encodeKeys[K comparable](keys []K) ([]string, error) {
+	encoded := make([]string, len(keys))
+	for i, k := range keys {
+		s, err := encodeKey(k)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = s
+	}
+	return encoded, nil
+}
+
+func newAdminHandler(a admin, opts ...AdminOptions) http.Handler {
+	var o AdminOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := path.Base(r.URL.Path)
+		switch {
+		case route == "stats" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, a.stats())
+		case route == "keys" && r.Method == http.MethodGet:
+			keys, err := a.keys()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"total": len(keys), "keys": page(keys, r)})
+		case route == "key" && r.Method == http.MethodGet:
+			key := r.URL.Query().Get("key")
+			v, ok, err := a.get(key)
+			switch {
+			case err != nil:
+				writeError(w, http.StatusBadRequest, err)
+			case !ok:
+				http.NotFound(w, r)
+			default:
+				writeJSON(w, http.StatusOK, map[string]any{"key": key, "value": v})
+			}
+		case route == "key" && r.Method == http.MethodDelete:
+			ok, err := a.del(r.URL.Query().Get("key"))
+			switch {
+			case err != nil:
+				writeError(w, http.StatusBadRequest, err)
+			case !ok:
+				http.NotFound(w, r)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case (route == "save" || route == "load") && r.Method == http.MethodPost:
+			if o.Path == "" {
+				http.NotFound(w, r)
+				return
+			}
+			var err error
+			if route == "save" {
+				err = a.save(o.Path, o.Save)
+			} else {
+				err = a.load(o.Path)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// page returns the items selected by the offset and limit query parameters, 100 items by default
+func page[T any](items []T, r *http.Request) []T {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if offset < 0 || offset >= len(items) {
+		return items[:0]
+	}
+	items = items[offset:]
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,72 @@
+package kmap
+
+import (
+	"sync"
+	"time"
+)
+
+// idleTracker records the last access of each key once enabled, it is safe to use under the read lock of the map
+type idleTracker[K comparable] struct {
+	// timeout is the idle duration after which the janitor removes a key, in nanoseconds, 0 when disabled
+	timeout int64
+	mu      sync.Mutex
+	last    map[K]int64
+}
+
+func (t *idleTracker[K]) access(key K) {
+	if t.timeout == 0 {
+		return
+	}
+	now := nowNano()
+	t.mu.Lock()
+	t.last[key] = now
+	t.mu.Unlock()
+}
+
+func (t *idleTracker[K]) forget(key K) {
+	if t.timeout == 0 {
+		return
+	}
+	t.mu.Lock()
+	delete(t.last, key)
+	t.mu.Unlock()
+}
+
+func (t *idleTracker[K]) reset() {
+	if t.timeout == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.last = make(map[K]int64)
+	t.mu.Unlock()
+}
+
+// idle reports whether key was not accessed for the timeout at now.
+// Keys never seen, loaded from a file for instance, start being tracked.
+func (t *idleTracker[K]) idle(key K, now int64) bool {
+	if t.timeout == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, ok := t.last[key]
+	if !ok {
+		t.last[key] = now
+		return false
+	}
+	return now-last >= t.timeout
+}
+
+// WithIdleTimeout makes the janitor (see StartJanitor) remove the entries neither set nor read for d,
+// whatever their TTL, so maps without a size limit reclaim the memory of forgotten keys.
+// Reads are Get, GetAny, GetAll, GetStale and GetWithRevision, Has does not count.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithIdleTimeout(d time.Duration) *SafeMap[K, V] {
+	c.Lock()
+	c.idle.mu.Lock()
+	c.idle.timeout = int64(d)
+	c.idle.last = make(map[K]int64, len(c.items))
+	c.idle.mu.Unlock()
+	c.Unlock()
+	return c
+}
@@ -0,0 +1,96 @@
+package kmap
+
+import "sync"
+
+// interner keeps a single copy of each string stored in a map, counting the keys and values using it
+type interner struct {
+	mu   sync.Mutex
+	refs map[string]internRef
+}
+
+type internRef struct {
+	s string
+	n int
+}
+
+// intern returns the shared copy of s, recording one more user
+func (in *interner) intern(s string) string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ref, ok := in.refs[s]
+	if !ok {
+		ref.s = s
+	}
+	ref.n++
+	in.refs[s] = ref
+	return ref.s
+}
+
+// release records one less user of s, its copy is dropped with the last one.
+// Strings which were not interned, loaded from a file for instance, are ignored.
+func (in *interner) release(s string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ref, ok := in.refs[s]
+	if !ok {
+		return
+	}
+	if ref.n--; ref.n <= 0 {
+		delete(in.refs, s)
+		return
+	}
+	in.refs[s] = ref
+}
+
+func (in *interner) reset() {
+	in.mu.Lock()
+	in.refs = make(map[string]internRef)
+	in.mu.Unlock()
+}
+
+// len returns the number of distinct strings interned
+func (in *interner) len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.refs)
+}
+
+// internAny interns v when it holds a string, whether the type is string or an interface
+func internAny[T any](in *interner, v T) T {
+	if s, ok := any(v).(string); ok {
+		if t, ok := any(in.intern(s)).(T); ok {
+			return t
+		}
+		in.release(s)
+	}
+	return v
+}
+
+// releaseAny releases v when it holds a string, see internAny
+func releaseAny[T any](in *interner, v T) {
+	if s, ok := any(v).(string); ok {
+		in.release(s)
+	}
+}
+
+// WithInterning makes the SafeMap keep a single copy of identical string keys and values, user agents or country codes
+// for instance, which can cut the memory of maps caching many duplicates. It applies when K or V is string,
+// or an interface holding strings, to the entries set from now on. The size accounting (see Size) is unchanged,
+// each entry still counts for its full size. See InternedStrings.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithInterning() *SafeMap[K, V] {
+	c.Lock()
+	c.interner = &interner{refs: make(map[string]internRef)}
+	c.Unlock()
+	return c
+}
+
+// InternedStrings returns the number of distinct strings shared by the keys and values, 0 without WithInterning
+func (c *SafeMap[K, V]) InternedStrings() int {
+	c.RLock()
+	defer c.RUnlock()
+	if c.interner == nil {
+		return 0
+	}
+	return c.interner.len()
+}
@@ -0,0 +1,374 @@
+package kmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Operations and statuses of the IPC protocol, see ServeIPC
+const (
+	ipcGet byte = iota + 1
+	ipcSet
+	ipcDelete
+	ipcKeys
+	ipcWatch
+)
+
+const (
+	ipcOK byte = iota
+	ipcNotFound
+	ipcError
+)
+
+// ipcMaxFrame bounds the frames read from a connection, so a garbage length does not allocate gigabytes
+const ipcMaxFrame = 64 << 20
+
+var ErrIPCFrame = errors.New("ipc frame too large or malformed")
+
+// ServeIPC serves the SafeMap to the clients connecting to l until l is closed, with a minimal binary protocol
+// cheap to speak from sidecars and short-lived scripts on the same host. l is meant to be a Unix socket,
+// net.Listen("unix", path), whose permissions restrict who can connect. See IPCClient for a Go client.
+//
+// Every message is a frame: a big-endian uint32 length then as many bytes, made of an operation or status byte
+// followed by fields, each a big-endian uint32 length then its bytes. Keys are encoded like in snapshot files
+// (strings are kept as is), values are JSON. Requests and their responses:
+//
+//	1 Get    key          ->  0 value | 1 (missing)
+//	2 Set    key value    ->  0 | 2 message
+//	3 Delete key          ->  0 | 1 (missing)
+//	4 Keys                ->  0 key...
+//	5 Watch               ->  0 kind key value, for each change until the connection is closed,
+//	                          kind being "set", "delete" or "flush"
+//
+// Any request may be answered by 2 message when it fails. Watch takes over the connection.
+// Like http.Serve, it always returns a non-nil error, the one of l.Accept.
+func (c *SafeMap[K, V]) ServeIPC(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveIPC(conn)
+	}
+}
+
+// serveIPC answers the requests of conn until it is closed
+func (c *SafeMap[K, V]) serveIPC(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		op, fields, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if op == ipcWatch {
+			c.watchIPC(conn, w)
+			return
+		}
+		status, reply := c.ipcRequest(op, fields)
+		if writeFrame(w, status, reply...) != nil {
+			return
+		}
+		if r.Buffered() == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// ipcRequest performs a request other than Watch and returns its response
+func (c *SafeMap[K, V]) ipcRequest(op byte, fields [][]byte) (status byte, reply [][]byte) {
+	fail := func(err error) (byte, [][]byte) {
+		return ipcError, [][]byte{[]byte(err.Error())}
+	}
+	if op == ipcKeys {
+		keys, err := encodeKeys(c.Keys())
+		if err != nil {
+			return fail(err)
+		}
+		reply = make([][]byte, len(keys))
+		for i, k := range keys {
+			reply[i] = []byte(k)
+		}
+		return ipcOK, reply
+	}
+
+	if len(fields) == 0 || (op == ipcSet) != (len(fields) == 2) || len(fields) > 2 {
+		return fail(ErrIPCFrame)
+	}
+	key, err := decodeKey[K](string(fields[0]))
+	if err != nil {
+		return fail(err)
+	}
+	switch op {
+	case ipcGet:
+		v, ok := c.Get(key)
+		if !ok {
+			return ipcNotFound, nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fail(err)
+		}
+		return ipcOK, [][]byte{data}
+	case ipcSet:
+		var v V
+		if err := json.Unmarshal(fields[1], &v); err != nil {
+			return fail(err)
+		}
+		if err := c.Set(key, v); err != nil {
+			return fail(err)
+		}
+		return ipcOK, nil
+	case ipcDelete:
+		if _, ok := c.GetAndDelete(key); !ok {
+			return ipcNotFound, nil
+		}
+		return ipcOK, nil
+	}
+	return fail(ErrIPCFrame)
+}
+
+// watchIPC sends the changes of the map to conn until it is closed
+func (c *SafeMap[K, V]) watchIPC(conn net.Conn, w *bufio.Writer) {
+	changes := c.Changes()
+	go func() {
+		// Watchers send nothing more, the read returns once they are gone
+		io.Copy(io.Discard, conn)
+		c.CloseChanges(changes)
+	}()
+	// Acknowledging the request tells the client that no later change will be missed
+	if writeFrame(w, ipcOK) != nil || w.Flush() != nil {
+		return
+	}
+	for ch := range changes {
+		key, err := encodeKey(ch.Key)
+		if err != nil {
+			continue
+		}
+		var value []byte
+		if ch.Kind == EventSet {
+			if value, err = json.Marshal(ch.Value); err != nil {
+				continue
+			}
+		}
+		if writeFrame(w, ipcOK, []byte(ch.Kind.String()), []byte(key), value) != nil {
+			return
+		}
+		if len(changes) == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// writeFrame writes a frame made of the operation or status b and fields
+func writeFrame(w io.Writer, b byte, fields ...[]byte) error {
+	n := 1
+	for _, f := range fields {
+		n += 4 + len(f)
+	}
+	buf := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	buf = append(buf, b)
+	for _, f := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+		buf = append(buf, f...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads a frame and returns its operation or status byte and its fields
+func readFrame(r io.Reader) (b byte, fields [][]byte, err error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 || n > ipcMaxFrame {
+		return 0, nil, ErrIPCFrame
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	b, rest := frame[0], frame[1:]
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return 0, nil, ErrIPCFrame
+		}
+		l := binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+		if uint64(l) > uint64(len(rest)) {
+			return 0, nil, ErrIPCFrame
+		}
+		fields = append(fields, rest[:l])
+		rest = rest[l:]
+	}
+	return b, fields, nil
+}
+
+// IPCClient is a client of ServeIPC, safe for concurrent use. Requests share a single connection.
+type IPCClient[K comparable, V any] struct {
+	mu      sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+// DialIPC connects to the map served by ServeIPC on the Unix socket at path
+func DialIPC[K comparable, V any](path string) (*IPCClient[K, V], error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &IPCClient[K, V]{network: "unix", addr: path, conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection, the streams returned by Watch are not affected
+func (c *IPCClient[K, V]) Close() error {
+	return c.conn.Close()
+}
+
+// request sends a request and returns its response, a status 2 is returned as an error
+func (c *IPCClient[K, V]) request(op byte, fields ...[]byte) (status byte, reply [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeFrame(c.conn, op, fields...); err != nil {
+		return 0, nil, err
+	}
+	status, reply, err = readFrame(c.r)
+	if err == nil && status == ipcError {
+		msg := ""
+		if len(reply) > 0 {
+			msg = string(reply[0])
+		}
+		err = errors.New(msg)
+	}
+	return status, reply, err
+}
+
+// Get returns the value of key
+func (c *IPCClient[K, V]) Get(key K) (v V, ok bool, err error) {
+	k, err := encodeKey(key)
+	if err != nil {
+		return v, false, err
+	}
+	status, reply, err := c.request(ipcGet, []byte(k))
+	if err != nil || status == ipcNotFound {
+		return v, false, err
+	}
+	if len(reply) != 1 {
+		return v, false, ErrIPCFrame
+	}
+	return v, true, json.Unmarshal(reply[0], &v)
+}
+
+// Set sets key to value, the error of the Set of the served map is returned with its message only
+func (c *IPCClient[K, V]) Set(key K, value V) error {
+	k, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.request(ipcSet, []byte(k), data)
+	return err
+}
+
+// Delete removes key and reports whether it was present
+func (c *IPCClient[K, V]) Delete(key K) (bool, error) {
+	k, err := encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+	status, _, err := c.request(ipcDelete, []byte(k))
+	return err == nil && status == ipcOK, err
+}
+
+// Keys returns the keys of the map in no particular order
+func (c *IPCClient[K, V]) Keys() ([]K, error) {
+	_, reply, err := c.request(ipcKeys)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]K, len(reply))
+	for i, k := range reply {
+		if keys[i], err = decodeKey[K](string(k)); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// Watch streams the changes of the map on a new connection until ctx is done or the connection is lost,
+// the channel is then closed. It returns once the server started watching, so no later change is missed.
+func (c *IPCClient[K, V]) Watch(ctx context.Context) (<-chan Event[K, V], error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if err := writeFrame(conn, ipcWatch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, _, err := readFrame(r); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	events := make(chan Event[K, V], DefaultChangeBuffer)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		defer conn.Close()
+		for {
+			_, fields, err := readFrame(r)
+			if err != nil || len(fields) != 3 {
+				return
+			}
+			var e Event[K, V]
+			switch string(fields[0]) {
+			case EventSet.String():
+				e.Kind = EventSet
+				if json.Unmarshal(fields[2], &e.Value) != nil {
+					continue
+				}
+			case EventDelete.String():
+				e.Kind = EventDelete
+			case EventFlush.String():
+				e.Kind = EventFlush
+			default:
+				continue
+			}
+			if e.Kind != EventFlush {
+				if e.Key, err = decodeKey[K](string(fields[1])); err != nil {
+					continue
+				}
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,172 @@
+package kmap
+
+import "errors"
+
+var ErrJournalTruncated = errors.New("operation no longer in the journal, it cannot be rolled back")
+
+// journalEntry is the state of a key before the change numbered seq
+type journalEntry[K comparable, V any] struct {
+	seq     uint64
+	key     K
+	old     V
+	existed bool
+}
+
+// journal keeps the last changes of a map to undo them, see WithJournal. It is guarded by the lock of the map.
+type journal[K comparable, V any] struct {
+	max     int
+	entries []journalEntry[K, V]
+	// from is the oldest seq the map can be rolled back to
+	from uint64
+	// undoing is set while changes are reverted, they are not journaled
+	undoing bool
+}
+
+// add records the state of key before the change seq, the write lock must be held
+func (j *journal[K, V]) add(seq uint64, key K, old V, existed bool) {
+	if j.max <= 0 || j.undoing {
+		return
+	}
+	if len(j.entries) == j.max {
+		j.from = j.entries[0].seq
+		j.entries = append(j.entries[:0], j.entries[1:]...)
+	}
+	j.entries = append(j.entries, journalEntry[K, V]{seq: seq, key: key, old: old, existed: existed})
+}
+
+// reset forgets every entry, the map cannot be rolled back before seq, the write lock must be held
+func (j *journal[K, V]) reset(seq uint64) {
+	if j.max > 0 {
+		j.entries = j.entries[:0]
+		j.from = seq
+	}
+}
+
+// seq returns the seq of the last entry
+func (j *journal[K, V]) seq() uint64 {
+	if len(j.entries) == 0 {
+		return j.from
+	}
+	return j.entries[len(j.entries)-1].seq
+}
+
+// undo reverts the entries newer than seq with revert, newest first, and returns how many were reverted.
+// The write lock must be held.
+func (j *journal[K, V]) undo(seq uint64, revert func(e journalEntry[K, V]) error) (int, error) {
+	j.undoing = true
+	defer func() { j.undoing = false }()
+	n := 0
+	for len(j.entries) > 0 {
+		e := j.entries[len(j.entries)-1]
+		if e.seq <= seq {
+			break
+		}
+		if err := revert(e); err != nil {
+			return n, err
+		}
+		j.entries = j.entries[:len(j.entries)-1]
+		n++
+	}
+	return n, nil
+}
+
+// target returns the seq before the last n entries, the write lock must be held
+func (j *journal[K, V]) target(n int) uint64 {
+	if n <= 0 {
+		return j.seq()
+	}
+	if n >= len(j.entries) {
+		return j.from
+	}
+	return j.entries[len(j.entries)-n].seq - 1
+}
+
+// WithJournal makes the SafeMap remember the previous state of the keys changed by its last size Set or Delete operations,
+// so Undo and RollbackTo can revert them. Flush and Clear empty the journal. Values are kept as is, not copied.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithJournal(size int) *SafeMap[K, V] {
+	c.Lock()
+	c.journal = journal[K, V]{max: size, from: c.hooks.seq}
+	c.Unlock()
+	return c
+}
+
+// Undo reverts the last n operations, newest first, and returns how many were reverted.
+// It returns ErrJournalTruncated when the journal holds fewer operations, after reverting all of them,
+// or the error of Set when a previous value does not fit anymore.
+// Reverting is itself a change reported to the listeners and streams of the map.
+func (c *SafeMap[K, V]) Undo(n int) (int, error) {
+	c.Lock()
+	defer c.unlock()
+	undone, err := c.rollback(c.journal.target(n))
+	if err == nil && undone < n {
+		err = ErrJournalTruncated
+	}
+	return undone, err
+}
+
+// RollbackTo reverts every operation made after the change numbered seq (see Change.Seq),
+// returning ErrJournalTruncated without changing anything when some of them are no longer in the journal.
+func (c *SafeMap[K, V]) RollbackTo(seq uint64) error {
+	c.Lock()
+	defer c.unlock()
+	if seq < c.journal.from || c.journal.max <= 0 {
+		return ErrJournalTruncated
+	}
+	_, err := c.rollback(seq)
+	return err
+}
+
+// rollback reverts the journaled operations made after seq, the write lock must be held
+func (c *SafeMap[K, V]) rollback(seq uint64) (int, error) {
+	return c.journal.undo(seq, func(e journalEntry[K, V]) error {
+		if e.existed {
+			return c.set(e.key, e.old)
+		}
+		c.remove(e.key)
+		return nil
+	})
+}
+
+// WithJournal makes the OrderedMap remember the previous state of the keys changed by its last size Set or Delete operations,
+// so Undo and RollbackTo can revert them. Flush and Clear empty the journal. Restored keys go back to the end of the order.
+// It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithJournal(size int) *OrderedMap[K, V] {
+	m.Lock()
+	m.journal = journal[K, V]{max: size, from: m.hooks.seq}
+	m.Unlock()
+	return m
+}
+
+// Undo reverts the last n operations, newest first, and returns how many were reverted, see SafeMap.Undo
+func (m *OrderedMap[K, V]) Undo(n int) (int, error) {
+	m.Lock()
+	defer m.unlock()
+	undone, err := m.rollback(m.journal.target(n))
+	if err == nil && undone < n {
+		err = ErrJournalTruncated
+	}
+	return undone, err
+}
+
+// RollbackTo reverts every operation made after the change numbered seq, see SafeMap.RollbackTo
+func (m *OrderedMap[K, V]) RollbackTo(seq uint64) error {
+	m.Lock()
+	defer m.unlock()
+	if seq < m.journal.from || m.journal.max <= 0 {
+		return ErrJournalTruncated
+	}
+	_, err := m.rollback(seq)
+	return err
+}
+
+// rollback reverts the journaled operations made after seq, the write lock must be held
+func (m *OrderedMap[K, V]) rollback(seq uint64) (int, error) {
+	return m.journal.undo(seq, func(e journalEntry[K, V]) error {
+		if e.existed {
+			return m.set(e.key, e.old)
+		}
+		m.remove(e.key)
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package kmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonlBatch is the number of entries ImportJSONL sets at once
+const jsonlBatch = 1024
+
+// jsonlEntry is a line written by ExportJSONL
+type jsonlEntry[K comparable, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// ExportJSONL writes the map to w as JSON Lines, one {"key":...,"value":...} object per entry in no particular order,
+// to pipe it into jq, bulk loaders or line-oriented diffs. Keys and values are in their JSON form
+// and each line is written as soon as it is encoded. Entries are read from a snapshot, see Snapshot,
+// so the map is neither locked nor copied while writing, expired entries are skipped.
+func (c *SafeMap[K, V]) ExportJSONL(w io.Writer) error {
+	c.Lock()
+	s := c.snapshot()
+	c.Unlock()
+	return writeJSONL(w, func(encode func(key K, value V) error) error {
+		now := nowNano()
+		for k, i := range s.items {
+			if i.expired(now) {
+				continue
+			}
+			if err := encode(k, s.value(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportJSONL sets the entries read from r as JSON Lines, see ExportJSONL. Entries are decoded and set
+// by batches as they are read, so the input is never held in memory at once. Reading stops at the first
+// invalid line or failing SetMany, the entries read before are kept.
+func (c *SafeMap[K, V]) ImportJSONL(r io.Reader) error {
+	return readJSONL(r, func(batch []Pair[K, V]) error {
+		entries := make(map[K]V, len(batch))
+		for _, p := range batch {
+			entries[p.Key] = p.Value
+		}
+		return c.SetMany(entries)
+	})
+}
+
+// ExportJSONL writes the map to w as JSON Lines in order, see SafeMap.ExportJSONL
+func (m *OrderedMap[K, V]) ExportJSONL(w io.Writer) error {
+	return writeJSONL(w, func(encode func(key K, value V) error) error {
+		for _, e := range m.Entries() {
+			if err := encode(e.Key, e.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportJSONL sets the entries read from r as JSON Lines, new keys are appended in the order of the lines,
+// see SafeMap.ImportJSONL
+func (m *OrderedMap[K, V]) ImportJSONL(r io.Reader) error {
+	return readJSONL(r, m.SetPairs)
+}
+
+// writeJSONL writes the entries each passes to encode as JSON Lines
+func writeJSONL[K comparable, V any](w io.Writer, each func(encode func(key K, value V) error) error) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	err := each(func(key K, value V) error {
+		return enc.Encode(jsonlEntry[K, V]{Key: key, Value: value})
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readJSONL decodes the JSON Lines of r and passes them to set by batches of jsonlBatch entries
+func readJSONL[K comparable, V any](r io.Reader, set func([]Pair[K, V]) error) error {
+	dec := json.NewDecoder(r)
+	batch := make([]Pair[K, V], 0, jsonlBatch)
+	for n := 1; ; n++ {
+		var e struct {
+			Key   *K `json:"key"`
+			Value V  `json:"value"`
+		}
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && e.Key == nil {
+			err = fmt.Errorf("%w: missing key", ErrInvalidFormat)
+		}
+		if err != nil {
+			if len(batch) > 0 {
+				if err := set(batch); err != nil {
+					return err
+				}
+			}
+			return fmt.Errorf("entry %d: %w", n, err)
+		}
+		if batch = append(batch, Pair[K, V]{Key: *e.Key, Value: e.Value}); len(batch) == jsonlBatch {
+			if err := set(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return set(batch)
+}
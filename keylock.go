@@ -0,0 +1,95 @@
+package kmap
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sync"
+)
+
+// keyStripes is the number of mutexes LockKey spreads the keys over
+const keyStripes = 256
+
+// hashSeed seeds the default hash of keys, see hashKey
+var hashSeed = maphash.MakeSeed()
+
+// hashKey is the default hash of keys: strings and integers are hashed directly, other keys through their fmt representation
+func hashKey[K comparable](key K) uint64 {
+	switch k := any(key).(type) {
+	case string:
+		return maphash.String(hashSeed, k)
+	case int:
+		return mix64(uint64(k))
+	case int64:
+		return mix64(uint64(k))
+	case int32:
+		return mix64(uint64(k))
+	case uint:
+		return mix64(uint64(k))
+	case uint64:
+		return mix64(k)
+	case uint32:
+		return mix64(uint64(k))
+	}
+	return maphash.String(hashSeed, fmt.Sprint(key))
+}
+
+// mix64 spreads the bits of consecutive integers (splitmix64 finalizer)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// keyLocks are the striped mutexes of LockKey, allocated on first use
+type keyLocks[K comparable] struct {
+	once    sync.Once
+	stripes *[keyStripes]sync.Mutex
+}
+
+// lock locks the stripe of key, hash is the hasher of the map and may be nil
+func (l *keyLocks[K]) lock(key K, hash func(K) uint64) (unlock func()) {
+	l.once.Do(func() { l.stripes = new([keyStripes]sync.Mutex) })
+	h := hashKey[K]
+	if hash != nil {
+		h = hash
+	}
+	mu := &l.stripes[h(key)%keyStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// LockKey locks key and returns the function unlocking it, so callers can serialize work done outside the map per key
+// (only one refresh of user X at a time) while other keys proceed. Keys are spread over a fixed set of mutexes:
+// two keys may share one, so a goroutine must not lock a key while holding another.
+// Key locks are independent from the map lock, the map can be used while holding them.
+func (c *SafeMap[K, V]) LockKey(key K) (unlock func()) {
+	return c.keyLocks.lock(key, c.hasher)
+}
+
+// LockKey locks key and returns the function unlocking it, see SafeMap.LockKey
+func (m *OrderedMap[K, V]) LockKey(key K) (unlock func()) {
+	return m.keyLocks.lock(key, m.hasher)
+}
+
+// WithHasher replaces the hash of keys used to spread them over the LockKey stripes and the SaveToShards files,
+// to tune the distribution of pathological key sets. The default hashes strings and integers with maphash,
+// other keys through their fmt representation, and shard files by their encoded key.
+// The hasher must be deterministic. It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithHasher(hash func(K) uint64) *SafeMap[K, V] {
+	c.Lock()
+	c.hasher = hash
+	c.Unlock()
+	return c
+}
+
+// WithHasher replaces the hash of keys used to spread them over the LockKey stripes, see SafeMap.WithHasher.
+// It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithHasher(hash func(K) uint64) *OrderedMap[K, V] {
+	m.Lock()
+	m.hasher = hash
+	m.Unlock()
+	return m
+}
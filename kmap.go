@@ -3,6 +3,7 @@ package kmap
 import (
 	"errors"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -14,6 +15,15 @@ var (
 type item[V any] struct {
 	Value V
 	Size  int
+	// spill is the overflow file holding the value, see WithOverflow
+	spill string
+	// rev is the seq of the last change of the item, see GetWithRevision
+	rev uint64
+	// expires is the Unix nanosecond at which the item expires, 0 for never, ttl its duration, see SetWithTTL
+	expires int64
+	ttl     int64
+	// slot locates the serialized value when the map uses an arena, see WithArena
+	slot arenaSlot
 }
 
 type SafeMap[K comparable, V any] struct {
@@ -21,6 +31,52 @@ type SafeMap[K comparable, V any] struct {
 	items map[K]item[V]
 	size  int
 	limit int
+
+	// dirty tracks keys changed since the last save, see SaveDeltaToFile.
+	// It is nil until a full save or load established a base snapshot.
+	dirtyMu sync.Mutex
+	dirty   map[K]bool
+	flushed bool
+
+	overflowDir       string
+	overflowThreshold int
+
+	// backend mirrors every mutation when set, see WithBackend
+	backend PersistBackend
+	// writer propagates the values set, see WithWriter
+	writer *writer[K, V]
+
+	// sizeFunc replaces getValueSize when set, see WithSizeFunc
+	sizeFunc func(V) int
+
+	// evictToFitSet makes Set evict entries instead of returning ErrLimitExceeded, see WithEvictToFit
+	evictToFitSet bool
+	evictPolicy   EvictPolicy
+
+	// shared is set when items is also used by a snapshot, it must be copied before any change, see Snapshot
+	shared bool
+	// stats counts reads per key when enabled, see WithStats
+	stats hitCounter[K]
+	// hooks are the listeners of changes, see OnSet
+	hooks hooks[K, V]
+	// journal keeps the last changes to undo them, see WithJournal
+	journal journal[K, V]
+	// keyLocks serialize callers per key, see LockKey
+	keyLocks keyLocks[K]
+	// hasher replaces hashKey when set, see WithHasher
+	hasher func(K) uint64
+	// readMostly serves reads without locking when enabled, see WithReadMostly
+	readMostly readMostly[K, V]
+	// arena holds the serialized values when set, see WithArena
+	arena *arena
+	// interner shares identical strings, see WithInterning
+	interner *interner
+	// idle tracks the last access of each key, see WithIdleTimeout
+	idle idleTracker[K]
+	// expiry loads and refreshes the entries set with a TTL, see WithRefreshAhead
+	expiry expiry[K, V]
+	// log reports notable events, see WithEventLogger
+	log eventLog
 }
 
 func New[K comparable, V any](limitMb ...int) *SafeMap[K, V] {
@@ -36,28 +92,86 @@ func New[K comparable, V any](limitMb ...int) *SafeMap[K, V] {
 }
 
 func (c *SafeMap[K, V]) Get(key K) (v V, ok bool) {
+	if i, exists, ok := c.fromClean(key); ok {
+		if exists && i.live() {
+			c.stats.hit(key)
+			c.idle.access(key)
+			c.read(key, i)
+			return i.Value, true
+		}
+		return v, false
+	}
 	c.RLock()
-	if i, exists := c.items[key]; exists {
-		c.RUnlock()
-		return i.Value, true
+	i, exists := c.items[key]
+	exists = exists && i.live()
+	if exists {
+		v = c.value(i)
+		c.stats.hit(key)
+		c.idle.access(key)
 	}
+	promote := c.missed()
 	c.RUnlock()
-	return
+	if promote {
+		c.promote()
+	}
+	if exists {
+		c.read(key, i)
+	}
+	return v, exists
+}
+
+// Has reports whether key is present without copying its value, nor reading it back from disk when it was spilled
+func (c *SafeMap[K, V]) Has(key K) bool {
+	if i, exists, ok := c.fromClean(key); ok {
+		return exists && i.live()
+	}
+	c.RLock()
+	i, ok := c.items[key]
+	ok = ok && i.live()
+	promote := c.missed()
+	c.RUnlock()
+	if promote {
+		c.promote()
+	}
+	return ok
 }
 
 func (c *SafeMap[K, V]) GetAny(keys ...K) (v V, ok bool) {
+	if c.readMostly.clean.Load() != nil {
+		for _, key := range keys {
+			if v, ok = c.Get(key); ok {
+				return v, true
+			}
+		}
+		return v, false
+	}
 	c.RLock()
 	for _, key := range keys {
-		if i, exists := c.items[key]; exists {
+		if i, exists := c.items[key]; exists && i.live() {
+			v = c.value(i)
+			c.stats.hit(key)
+			c.idle.access(key)
 			c.RUnlock()
-			return i.Value, true
+			c.read(key, i)
+			return v, true
 		}
 	}
 	c.RUnlock()
 	return
 }
 
+// Sizer is implemented by values that know their memory footprint in bytes.
+// The default accounting only measures strings, byte slices and a few common slices and maps,
+// any other type counts for its shallow unsafe.Sizeof (8 bytes for a pointer, whatever it points to),
+// so values holding large buffers should implement it for the size limit to be meaningful.
+type Sizer interface {
+	SizeBytes() int
+}
+
 func getValueSize(value any) int {
+	if s, ok := value.(Sizer); ok {
+		return s.SizeBytes()
+	}
 	var size int
 	switch v := value.(type) {
 	case string:
@@ -102,58 +216,251 @@ func getValueSize(value any) int {
 
 func (c *SafeMap[K, V]) Set(key K, value V) error {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlock()
+	return c.set(key, value)
+}
+
+// set is Set, the write lock must be held
+func (c *SafeMap[K, V]) set(key K, value V) error {
+	return c.setTTL(key, value, 0)
+}
+
+// setTTL is SetWithTTL, the write lock must be held
+func (c *SafeMap[K, V]) setTTL(key K, value V, ttl time.Duration) error {
+	return c.setExpiry(key, value, ttl, 0)
+}
+
+// setExpiry sets key to value expiring at, in Unix nanoseconds, or after ttl when at is 0, the write lock must be held
+func (c *SafeMap[K, V]) setExpiry(key K, value V, ttl time.Duration, at int64) error {
+	// Large values go to disk when overflow is enabled
+	if c.overflowDir != "" && c.shouldSpill(c.valueSize(value)) {
+		spilled, err := c.spill(value)
+		if err != nil {
+			return err
+		}
+		return c.store(key, spilled, value, ttl, at)
+	}
 
 	// Check size limits if enabled
 	if c.limit > 0 {
-		size := getValueSize(value)
+		size := c.valueSize(value)
 		if size > c.limit {
+			c.log.warn("kmap: value rejected", "key", key, "size", size, "limit", c.limit, "error", ErrLargeData)
 			return ErrLargeData
 		}
 
 		if size+c.size > c.limit {
-			return ErrLimitExceeded
-		}
-		// Update size tracking
-		if i, exists := c.items[key]; exists {
-			c.size -= i.Size
+			if !c.evictToFitSet {
+				c.log.warn("kmap: value rejected", "key", key, "size", size, "limit", c.limit, "error", ErrLimitExceeded)
+				return ErrLimitExceeded
+			}
+			// The previous value of key is replaced, it does not need room
+			c.evictToFit(size-c.items[key].Size, func(k K) bool { return k == key })
 		}
+		return c.store(key, item[V]{Value: value, Size: size}, value, ttl, at)
+	}
+	return c.store(key, item[V]{Value: value}, value, ttl, at)
+}
 
-		// Store item in map
-		c.items[key] = item[V]{Value: value, Size: size}
-		c.size += size
-
-		return nil
+// store puts i under key, replacing and releasing any previous item, the write lock must be held.
+// value is the plain value of i, which may be spilled to disk. It expires at, in Unix nanoseconds,
+// or when at is 0 after ttl, or the default TTL when ttl <= 0.
+func (c *SafeMap[K, V]) store(key K, i item[V], value V, ttl time.Duration, at int64) error {
+	// The expiry is known before the entry is written through, so backends store it
+	if at != 0 {
+		i.expireAt(at)
+	} else {
+		if ttl <= 0 {
+			ttl = c.expiry.defaultTTL
+		}
+		i.expireIn(c.jittered(ttl))
+	}
+	if c.arena != nil && i.spill == "" {
+		var err error
+		if i, err = c.toArena(i); err != nil {
+			return err
+		}
+	}
+	if c.backend != nil {
+		if err := putRecord(c.backend, key, value, i.Size, i.expires); err != nil {
+			c.log.error("kmap: backend write failed", "key", key, "error", err)
+			c.release(i)
+			return err
+		}
+	}
+	if c.writer != nil {
+		if err := c.writer.write(key, value); err != nil {
+			c.release(i)
+			return err
+		}
+	}
+	c.own()
+	var previous V
+	old, exists := c.items[key]
+	if exists {
+		if c.journal.max > 0 {
+			previous = c.value(old)
+		}
+		c.size -= old.Size
+		c.release(old)
+	}
+	if c.interner != nil {
+		if exists {
+			releaseAny(c.interner, key)
+			releaseAny(c.interner, old.Value)
+		}
+		key = internAny(c.interner, key)
+		i.Value = internAny(c.interner, i.Value)
+	}
+	c.hooks.record(EventSet, key, value)
+	i.rev = c.hooks.seq
+	c.items[key] = i
+	c.size += i.Size
+	c.idle.access(key)
+	c.markDirty(key, true)
+	c.journal.add(c.hooks.seq, key, previous, exists)
+	if exists && c.arena != nil {
+		c.compactArena()
 	}
-	// Store item in map
-	c.items[key] = item[V]{Value: value}
 	return nil
 }
 
+// remove deletes key and reports whether it was present, the write lock must be held
+func (c *SafeMap[K, V]) remove(key K) bool {
+	i, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.own()
+	var previous V
+	if c.journal.max > 0 {
+		previous = c.value(i)
+	}
+	c.size -= i.Size
+	c.release(i)
+	if c.interner != nil {
+		releaseAny(c.interner, key)
+		releaseAny(c.interner, i.Value)
+	}
+	delete(c.items, key)
+	c.stats.forget(key)
+	c.idle.forget(key)
+	c.markDirty(key, false)
+	c.hooks.record(EventDelete, key, *new(V))
+	c.journal.add(c.hooks.seq, key, previous, true)
+	if c.backend != nil {
+		if err := deleteRecord(c.backend, key); err != nil {
+			c.log.error("kmap: backend delete failed", "key", key, "error", err)
+		}
+	}
+	if c.arena != nil {
+		c.compactArena()
+	}
+	return true
+}
+
 func (c *SafeMap[K, V]) Delete(key K) {
 	c.Lock()
-	if i, ok := c.items[key]; ok {
-		c.size -= i.Size
-		delete(c.items, key)
+	c.remove(key)
+	c.unlock()
+}
+
+// GetAndDelete removes key and returns its value in a single locked operation,
+// so concurrent consumers can claim an entry without another one getting it too
+func (c *SafeMap[K, V]) GetAndDelete(key K) (v V, ok bool) {
+	c.Lock()
+	defer c.unlock()
+	i, ok := c.items[key]
+	if !ok {
+		return v, false
+	}
+	if !i.live() {
+		c.remove(key)
+		return v, false
 	}
-	c.Unlock()
+	v = c.value(i)
+	c.remove(key)
+	return v, true
 }
 
 func (c *SafeMap[K, V]) Flush() {
 	c.Lock()
-	if len(c.items) > 0 {
-		c.items = make(map[K]item[V])
-		c.size = 0
-	}
-	c.Unlock()
+	c.flush()
+	c.unlock()
 }
 func (c *SafeMap[K, V]) Clear() {
 	c.Lock()
-	if len(c.items) > 0 {
-		c.items = make(map[K]item[V])
-		c.size = 0
+	c.flush()
+	c.unlock()
+}
+
+// flush removes every item, the write lock must be held
+func (c *SafeMap[K, V]) flush() {
+	c.hooks.record(EventFlush, *new(K), *new(V))
+	c.journal.reset(c.hooks.seq)
+	// The backend is cleared even when the map is empty, it may hold entries the map was not loaded with
+	if c.backend != nil {
+		if err := clearBackend(c.backend, c.limit); err != nil {
+			c.log.error("kmap: backend flush failed", "error", err)
+		}
+	}
+	if len(c.items) == 0 {
+		return
+	}
+	c.dropClean()
+	c.releaseAll()
+	c.items = make(map[K]item[V])
+	c.size = 0
+	c.stats.reset()
+	c.idle.reset()
+	c.markFlushed()
+}
+
+// markDirty records a change of key for the next delta save, the write lock must be held
+func (c *SafeMap[K, V]) markDirty(key K, live bool) {
+	c.dirtyMu.Lock()
+	if c.dirty != nil {
+		c.dirty[key] = live
+	}
+	c.dirtyMu.Unlock()
+}
+
+// markFlushed records that every key was removed, the write lock must be held
+func (c *SafeMap[K, V]) markFlushed() {
+	c.dirtyMu.Lock()
+	if c.dirty != nil {
+		c.dirty = make(map[K]bool)
+		c.flushed = true
+	}
+	c.dirtyMu.Unlock()
+}
+
+// resetDirty starts tracking changes from the current state, the read or write lock must be held.
+// Saves whose bytes may still fail to reach their destination call restore when they do, it puts back
+// the changes tracked before the reset so the next delta still holds them. restore does not need the lock.
+func (c *SafeMap[K, V]) resetDirty() (restore func()) {
+	c.dirtyMu.Lock()
+	dirty, flushed := c.dirty, c.flushed
+	c.dirty = make(map[K]bool)
+	c.flushed = false
+	c.dirtyMu.Unlock()
+	return func() {
+		c.dirtyMu.Lock()
+		defer c.dirtyMu.Unlock()
+		switch {
+		case dirty == nil:
+			// There was no base snapshot, there is still none
+			c.dirty = nil
+		case !c.flushed:
+			// Keys changed since the reset keep their latest state
+			for k, live := range dirty {
+				if _, ok := c.dirty[k]; !ok {
+					c.dirty[k] = live
+				}
+			}
+			c.flushed = flushed
+		}
 	}
-	c.Unlock()
 }
 
 func (c *SafeMap[K, V]) Len() int {
@@ -169,11 +476,12 @@ func (c *SafeMap[K, V]) Keys() []K {
 		c.RUnlock()
 		return nil
 	}
-	keys := make([]K, n)
-	i := 0
-	for k := range c.items {
-		keys[i] = k
-		i++
+	keys := make([]K, 0, n)
+	now := nowNano()
+	for k, i := range c.items {
+		if !i.expired(now) {
+			keys = append(keys, k)
+		}
 	}
 	c.RUnlock()
 	return keys
@@ -186,11 +494,12 @@ func (c *SafeMap[K, V]) Values() []V {
 		c.RUnlock()
 		return nil
 	}
-	values := make([]V, n)
-	i := 0
+	values := make([]V, 0, n)
+	now := nowNano()
 	for _, item := range c.items {
-		values[i] = item.Value
-		i++
+		if !item.expired(now) {
+			values = append(values, c.value(item))
+		}
 	}
 	c.RUnlock()
 	return values
@@ -209,11 +518,15 @@ func (c *SafeMap[K, V]) Range(f func(key K, value V) bool) {
 		k K
 		v V
 	}, 0, n)
+	now := nowNano()
 	for k, item := range c.items {
+		if item.expired(now) {
+			continue
+		}
 		pairs = append(pairs, struct {
 			k K
 			v V
-		}{k, item.Value})
+		}{k, c.value(item)})
 	}
 	c.RUnlock()
 
@@ -247,32 +560,57 @@ func (c *SafeMap[K, V]) GetOrCompute(key K, fn func() V) V {
 	return value
 }
 
-// SetIfNotExists sets the value if the key doesn't exist and returns true.
+// GetOrComputeErr is GetOrCompute for functions that can fail, like database queries or HTTP fetches:
+// when fn returns an error nothing is stored and the error is returned.
+// When the computed value cannot be stored because of the size limit, it is returned with the error of Set.
+func (c *SafeMap[K, V]) GetOrComputeErr(key K, fn func() (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return value, err
+	}
+	return value, c.Set(key, value)
+}
+
+// SetIfNotExists sets the value if the key doesn't exist or has expired and returns true.
 // If the key exists, it returns false and makes no changes.
 func (c *SafeMap[K, V]) SetIfNotExists(key K, value V) bool {
 	c.Lock()
-	if _, exists := c.items[key]; exists {
-		c.Unlock()
+	defer c.unlock()
+	if i, exists := c.items[key]; exists && i.live() {
 		return false
 	}
-	c.Unlock()
-
-	c.Set(key, value)
+	c.set(key, value)
 	return true
 }
 
+// Update sets key to the value returned by fn, called with the current value and whether it exists,
+// while holding the write lock, so read-modify-write patterns are race-free.
+// fn must not call methods of the map. The error is the one Set would return for the new value.
+func (c *SafeMap[K, V]) Update(key K, fn func(old V, exists bool) V) error {
+	c.Lock()
+	defer c.unlock()
+	var old V
+	i, exists := c.items[key]
+	exists = exists && i.live()
+	if exists {
+		old = c.value(i)
+	}
+	return c.set(key, fn(old, exists))
+}
+
 // DeleteAll removes all the specified keys and returns the number of keys removed
 func (c *SafeMap[K, V]) DeleteAll(keys ...K) int {
 	if len(keys) == 0 {
 		return 0
 	}
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlock()
 	count := 0
 	for _, key := range keys {
-		if i, ok := c.items[key]; ok {
-			c.size -= i.Size
-			delete(c.items, key)
+		if c.remove(key) {
 			count++
 		}
 	}
@@ -286,11 +624,20 @@ func (c *SafeMap[K, V]) GetAll(keys ...K) map[K]V {
 	}
 	c.RLock()
 	result := make(map[K]V, len(keys))
+	var expiring []Pair[K, item[V]]
 	for _, key := range keys {
-		if i, ok := c.items[key]; ok {
-			result[key] = i.Value
+		if i, ok := c.items[key]; ok && i.live() {
+			result[key] = c.value(i)
+			c.stats.hit(key)
+			c.idle.access(key)
+			if i.expires != 0 {
+				expiring = append(expiring, Pair[K, item[V]]{Key: key, Value: i})
+			}
 		}
 	}
 	c.RUnlock()
+	for _, p := range expiring {
+		c.read(p.Key, p.Value)
+	}
 	return result
 }
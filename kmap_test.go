@@ -1,10 +1,26 @@
 package kmap
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 var keyPool = sync.Pool{
@@ -156,6 +172,21 @@ func TestOrderedMap(t *testing.T) {
 		if !ok || val != 1 {
 			t.Errorf("Copy failed to maintain values")
 		}
+
+		limited := NewOrdered[string, string](1)
+		limited.Set("a", "value")
+		c := limited.Copy()
+		if c.limit != limited.limit || c.size != limited.size || c.kv["a"].size != 5 {
+			t.Errorf("Copy should keep limit and sizes: limit %d size %d", c.limit, c.size)
+		}
+
+		deep := NewOrdered[string, []int](1)
+		deep.Set("a", []int{1, 2})
+		clone := deep.CloneWith(func(v []int) []int { return append([]int(nil), v...) })
+		clone.GetOrDefault("a", nil)[0] = 10
+		if v, _ := deep.Get("a"); v[0] != 1 || clone.size != 16 || clone.limit != deep.limit {
+			t.Errorf("CloneWith should copy values and keep sizes, got %v size %d", v, clone.size)
+		}
 	})
 }
 
@@ -656,6 +687,18 @@ func TestOrderedMap_Sugar(t *testing.T) {
 		}
 	})
 
+	t.Run("DeleteAllFreesSize", func(t *testing.T) {
+		m := NewOrdered[string, string](1)
+		big := strings.Repeat("x", 600*1024)
+		if err := m.Set("a", big); err != nil {
+			t.Fatal(err)
+		}
+		m.DeleteAll("a")
+		if err := m.Set("b", big); err != nil {
+			t.Errorf("DeleteAll should free the size of the removed keys, got %v", err)
+		}
+	})
+
 	t.Run("GetAll", func(t *testing.T) {
 		m := NewOrdered[string, int]()
 		m.Set("one", 1)
@@ -670,3 +713,2877 @@ func TestOrderedMap_Sugar(t *testing.T) {
 		}
 	})
 }
+
+func TestSafeMap_Overflow(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "kmap_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "overflow")
+	m := New[string, string](1).WithOverflow(dir, 1024)
+	big := strings.Repeat("x", 4*1024*1024) // larger than the limit itself
+	if err := m.Set("big", big); err != nil {
+		t.Fatalf("Set of spilled value failed: %v", err)
+	}
+	m.Set("small", "hot")
+
+	if m.size != 3 {
+		t.Errorf("Spilled value should not count toward size, got %d", m.size)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected 1 overflow file, got %d", len(files))
+	}
+	if v, ok := m.Get("big"); !ok || v != big {
+		t.Errorf("Spilled value not read back correctly")
+	}
+
+	path := filepath.Join(tmpDir, "overflow.bin")
+	if err := m.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	m2 := New[string, string]().WithOverflow(filepath.Join(tmpDir, "overflow2"), 1024)
+	if err := m2.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m2.Get("big"); v != big {
+		t.Errorf("Spilled value not persisted")
+	}
+	if i := m2.items["big"]; i.spill == "" {
+		t.Errorf("Loaded large value should be spilled again")
+	}
+
+	m.Set("big", "now small")
+	m.Delete("small")
+	files, _ = os.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Overflow file not removed after overwrite, got %d files", len(files))
+	}
+}
+
+type sizedBlob struct {
+	data []byte
+}
+
+func (b *sizedBlob) SizeBytes() int {
+	return len(b.data)
+}
+
+func TestSizer(t *testing.T) {
+	t.Run("Sizer", func(t *testing.T) {
+		m := New[string, *sizedBlob](1)
+		if err := m.Set("a", &sizedBlob{data: make([]byte, 1000)}); err != nil {
+			t.Fatal(err)
+		}
+		if m.size != 1000 {
+			t.Errorf("Expected size 1000, got %d", m.size)
+		}
+		if err := m.Set("b", &sizedBlob{data: make([]byte, 2*1024*1024)}); err != ErrLargeData {
+			t.Errorf("Expected ErrLargeData, got %v", err)
+		}
+	})
+
+	t.Run("SizeAndLimit", func(t *testing.T) {
+		m := New[string, string](1)
+		m.Set("a", "hello")
+		if m.Size() != 5 || m.Limit() != 1024*1024 {
+			t.Errorf("Unexpected size %d or limit %d", m.Size(), m.Limit())
+		}
+		o := NewOrdered[string, string]()
+		o.Set("a", "hello")
+		if o.Size() != 0 || o.Limit() != -1 {
+			t.Errorf("Unexpected size %d or limit %d", o.Size(), o.Limit())
+		}
+	})
+
+	t.Run("GetSize", func(t *testing.T) {
+		m := New[string, string](1)
+		m.Set("a", "hello")
+		if size, ok := m.GetSize("a"); !ok || size != 5 {
+			t.Errorf("Expected size 5, got %d", size)
+		}
+		if _, ok := m.GetSize("b"); ok {
+			t.Errorf("Missing keys should not be found")
+		}
+		o := NewOrdered[string, string](1)
+		o.Set("a", "hello!")
+		if size, ok := o.GetSize("a"); !ok || size != 6 {
+			t.Errorf("Expected size 6, got %d", size)
+		}
+	})
+
+	t.Run("SizeFunc", func(t *testing.T) {
+		type user struct {
+			Name   string
+			Avatar []byte
+		}
+		sizeOf := func(u user) int { return len(u.Name) + len(u.Avatar) }
+
+		m := New[string, user](1).WithSizeFunc(sizeOf)
+		m.Set("a", user{Name: "bob", Avatar: make([]byte, 500)})
+		m.Set("a", user{Name: "bob", Avatar: make([]byte, 100)})
+		if m.size != 103 {
+			t.Errorf("Expected size 103, got %d", m.size)
+		}
+
+		o := NewOrdered[string, user](1).WithSizeFunc(sizeOf)
+		o.Set("a", user{Name: "alice", Avatar: make([]byte, 10)})
+		if o.size != 15 {
+			t.Errorf("Expected size 15, got %d", o.size)
+		}
+		if err := o.Set("b", user{Avatar: make([]byte, 2*1024*1024)}); err != ErrLargeData {
+			t.Errorf("Expected ErrLargeData, got %v", err)
+		}
+	})
+}
+
+func TestDeepSize(t *testing.T) {
+	type node struct {
+		Name     string
+		Payload  []byte
+		Children []*node
+		Meta     map[string]any
+	}
+	shared := &node{Name: "shared", Payload: make([]byte, 1000)}
+	root := &node{
+		Name:     "root",
+		Payload:  make([]byte, 10000),
+		Children: []*node{shared, shared},
+		Meta:     map[string]any{"tags": []string{"a", "b"}},
+	}
+	shared.Children = []*node{root} // cycle
+
+	m := New[string, *node](1).WithDeepSize()
+	m.Set("root", root)
+	if m.size < 11000 || m.size > 12000 {
+		t.Errorf("Expected about 11000 bytes, got %d", m.size)
+	}
+	if shallow := New[string, *node](1); shallow.Set("root", root) == nil && shallow.size >= 1000 {
+		t.Errorf("Default accounting should stay shallow, got %d", shallow.size)
+	}
+
+	o := NewOrdered[string, []string](1).WithDeepSize()
+	o.Set("a", []string{"hello", "world"})
+	if want := 24 + 2*16 + 10; o.size != want {
+		t.Errorf("Expected %d bytes, got %d", want, o.size)
+	}
+
+	s := New[string, *sizedBlob](1).WithDeepSize()
+	s.Set("a", &sizedBlob{data: make([]byte, 5)})
+	if s.size != 5 {
+		t.Errorf("Sizer should take precedence, got %d", s.size)
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	value := strings.Repeat("x", 300*1024)
+
+	m := New[int, string]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, value)
+	}
+	if m.Size() != 0 {
+		t.Fatalf("Unlimited maps should not measure values, got %d", m.Size())
+	}
+	if n := m.SetLimit(2); n != 0 || m.Size() != 10*len(value) || m.Len() != 10 {
+		t.Errorf("Limit without eviction should keep entries: removed %d, size %d, len %d", n, m.Size(), m.Len())
+	}
+	if err := m.Set(10, value); err != ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded over the new limit, got %v", err)
+	}
+	if n := m.SetLimit(2, true); n != 4 || m.Len() != 6 || m.Size() > m.Limit() {
+		t.Errorf("Unexpected eviction: removed %d, len %d, size %d", n, m.Len(), m.Size())
+	}
+	m.SetLimit(0)
+	if m.Limit() != -1 || m.Set(10, value) != nil {
+		t.Errorf("Limit should be removed")
+	}
+
+	o := NewOrdered[int, string](3)
+	for i := 0; i < 10; i++ {
+		o.Set(i, value)
+	}
+	if n := o.SetLimit(1, true); n != 7 {
+		t.Errorf("Expected 7 entries removed, got %d", n)
+	}
+	if keys := o.Keys(); len(keys) != 3 || keys[0] != 7 {
+		t.Errorf("Oldest entries should be removed first, got %v", keys)
+	}
+}
+
+func TestEvictToFit(t *testing.T) {
+	value := strings.Repeat("x", 300*1024)
+
+	m := New[int, string](1).WithEvictToFit()
+	for i := 0; i < 10; i++ {
+		if err := m.Set(i, value); err != nil {
+			t.Fatalf("Set should evict instead of failing, got %v", err)
+		}
+	}
+	if m.Len() != 3 || m.Size() > m.Limit() {
+		t.Errorf("Expected 3 entries within the limit, got %d entries and %d bytes", m.Len(), m.Size())
+	}
+	if _, ok := m.Get(9); !ok {
+		t.Errorf("The last value set should be kept")
+	}
+	if err := m.Set(9, value+"y"); err != nil || m.Len() != 3 {
+		t.Errorf("Replacing a value should not evict it: %v, len %d", err, m.Len())
+	}
+	if err := m.Set(100, strings.Repeat("x", 2*1024*1024)); err != ErrLargeData {
+		t.Errorf("Expected ErrLargeData, got %v", err)
+	}
+
+	t.Run("Largest", func(t *testing.T) {
+		m := New[string, string](1).WithEvictToFit(EvictLargest)
+		m.Set("small", "abc")
+		m.Set("large", strings.Repeat("x", 600*1024))
+		m.Set("new", value)
+		m.Set("newer", value)
+		if _, ok := m.Get("large"); ok {
+			t.Errorf("The largest entry should be evicted first")
+		}
+		if _, ok := m.Get("small"); !ok {
+			t.Errorf("Small entries should be kept")
+		}
+	})
+
+	t.Run("Ordered", func(t *testing.T) {
+		o := NewOrdered[int, string](1).WithEvictToFit()
+		for i := 0; i < 10; i++ {
+			if err := o.Set(i, value); err != nil {
+				t.Fatalf("Set should evict instead of failing, got %v", err)
+			}
+		}
+		if keys := o.Keys(); len(keys) != 3 || keys[0] != 7 {
+			t.Errorf("Oldest entries should be evicted first, got %v", keys)
+		}
+
+		o = NewOrdered[int, string](1).WithEvictToFit(EvictLargest)
+		o.Set(0, "abc")
+		o.Set(1, strings.Repeat("x", 600*1024))
+		o.Set(2, value)
+		o.Set(3, value)
+		if keys := o.Keys(); len(keys) != 3 || keys[1] != 2 {
+			t.Errorf("The largest entry should be evicted first, got %v", keys)
+		}
+	})
+}
+
+func TestSetMany(t *testing.T) {
+	value := strings.Repeat("x", 300*1024)
+
+	m := New[int, string](1)
+	if err := m.SetMany(map[int]string{1: value, 2: value}); err != nil || m.Len() != 2 {
+		t.Fatalf("SetMany failed: %v, len %d", err, m.Len())
+	}
+	if err := m.SetMany(map[int]string{3: value, 4: value}); err != ErrLimitExceeded || m.Len() != 2 {
+		t.Errorf("Entries over the limit should not be inserted: %v, len %d", err, m.Len())
+	}
+	if err := m.SetMany(map[int]string{1: value, 2: value, 3: value}); err != nil || m.Size() != 3*len(value) {
+		t.Errorf("Replaced values should not need room: %v, size %d", err, m.Size())
+	}
+
+	e := New[int, string](1).WithEvictToFit()
+	e.SetMany(map[int]string{1: value, 2: value})
+	if err := e.SetMany(map[int]string{3: value, 4: value}); err != nil || e.Len() != 3 || !e.Has(3) || !e.Has(4) {
+		t.Errorf("Older entries should be evicted: %v, keys %v", err, e.Keys())
+	}
+
+	o := NewOrdered[string, int]()
+	o.Set("b", 0)
+	o.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}, {"a", 4}})
+	if keys, values := o.Keys(), o.Values(); !reflect.DeepEqual(keys, []string{"b", "a", "c"}) || !reflect.DeepEqual(values, []int{2, 4, 3}) {
+		t.Errorf("Unexpected pairs: %v %v", keys, values)
+	}
+
+	lo := NewOrdered[int, string](1)
+	if err := lo.SetPairs([]Pair[int, string]{{1, value}, {2, value}, {3, value}, {4, value}}); err != ErrLimitExceeded || lo.Len() != 0 {
+		t.Errorf("Pairs over the limit should not be inserted: %v, len %d", err, lo.Len())
+	}
+}
+
+func TestToMap(t *testing.T) {
+	src := map[string]int{"a": 1, "b": 2, "c": 3}
+
+	m := New[string, int]()
+	if err := m.SetFromMap(src); err != nil {
+		t.Fatal(err)
+	}
+	got := m.ToMap()
+	if !reflect.DeepEqual(got, src) {
+		t.Errorf("Expected %v, got %v", src, got)
+	}
+	got["d"] = 4
+	if m.Len() != 3 {
+		t.Errorf("ToMap should return a copy")
+	}
+
+	o := NewOrdered[string, int]()
+	if err := o.SetFromMap(src); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.ToMap(); !reflect.DeepEqual(got, src) {
+		t.Errorf("Expected %v, got %v", src, got)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := New[string, int]()
+	o := NewOrdered[string, int]()
+	incr := func(old int, exists bool) int {
+		if !exists {
+			return 1
+		}
+		return old + 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Update("counter", incr)
+			o.Update("counter", incr)
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("counter"); v != 100 {
+		t.Errorf("Expected 100, got %d", v)
+	}
+	if v, _ := o.Get("counter"); v != 100 {
+		t.Errorf("Expected 100, got %d", v)
+	}
+
+	l := New[string, string](1)
+	err := l.Update("big", func(string, bool) string { return strings.Repeat("x", 2*1024*1024) })
+	if err != ErrLargeData || l.Len() != 0 {
+		t.Errorf("Expected ErrLargeData, got %v", err)
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	m := New[int, int]()
+	o := NewOrdered[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Set(i, i)
+		o.Set(i, i)
+	}
+
+	var claimed, claimedOrdered sync.Map
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if v, ok := m.GetAndDelete(i); ok {
+					if _, dup := claimed.LoadOrStore(v, true); dup {
+						t.Errorf("Value %d claimed twice", v)
+					}
+				}
+				if v, ok := o.GetAndDelete(i); ok {
+					if _, dup := claimedOrdered.LoadOrStore(v, true); dup {
+						t.Errorf("Value %d claimed twice", v)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if m.Len() != 0 || o.Len() != 0 {
+		t.Errorf("Every entry should be claimed, %d and %d left", m.Len(), o.Len())
+	}
+	if _, ok := m.GetAndDelete(1); ok {
+		t.Errorf("Missing keys should not be found")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	m := New[string, int64]()
+	o := NewOrdered[string, float64]()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Add(m, "hits", 2)
+			AddOrdered(o, "rate", 0.5)
+		}()
+	}
+	wg.Wait()
+	if got := Add(m, "hits", -1); got != 199 {
+		t.Errorf("Expected 199, got %d", got)
+	}
+	if got, _ := o.Get("rate"); got != 50 {
+		t.Errorf("Expected 50, got %v", got)
+	}
+}
+
+func TestWithLock(t *testing.T) {
+	transfer := func(tx Accessor[string, int]) {
+		from, _ := tx.Get("from")
+		if from < 10 {
+			return
+		}
+		to, _ := tx.Get("to")
+		tx.Set("from", from-10)
+		tx.Set("to", to+10)
+		if from == 10 {
+			tx.Delete("from")
+		}
+	}
+
+	m := New[string, int]()
+	m.Set("from", 50)
+	o := NewOrdered[string, int]()
+	o.Set("from", 50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.WithLock(transfer)
+			o.WithLock(transfer)
+		}()
+	}
+	wg.Wait()
+	for _, got := range []map[string]int{m.ToMap(), o.ToMap()} {
+		if !reflect.DeepEqual(got, map[string]int{"to": 50}) {
+			t.Errorf("Unexpected state %v", got)
+		}
+	}
+
+	o.Set("a", 1)
+	o.Set("b", 2)
+	o.WithLock(func(tx Accessor[string, int]) {
+		tx.Range(func(key string, value int) bool {
+			tx.Delete(key)
+			return true
+		})
+	})
+	if o.Len() != 0 {
+		t.Errorf("Range should allow deleting, %v left", o.Keys())
+	}
+}
+
+func TestTxn(t *testing.T) {
+	value := strings.Repeat("x", 300*1024)
+
+	m := New[string, string](1)
+	m.Set("a", value)
+	m.Set("b", value)
+	tx := m.Txn().Set("c", value).Set("d", value)
+	if err := tx.Commit(); err != ErrLimitExceeded {
+		t.Errorf("Expected ErrLimitExceeded, got %v", err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("A failed commit should not change the map, got %v", m.Keys())
+	}
+	if err := tx.Commit(); err != ErrTxnDone {
+		t.Errorf("Expected ErrTxnDone, got %v", err)
+	}
+
+	// Deleting in the same transaction makes room
+	if err := m.Txn().Delete("a").Set("c", value).Set("d", value).Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := m.Keys(); len(got) != 3 || m.Size() != 3*len(value) {
+		t.Errorf("Unexpected keys %v, size %d", got, m.Size())
+	}
+
+	tx = m.Txn().Delete("b")
+	tx.Discard()
+	if _, ok := m.Get("b"); !ok || tx.Commit() != ErrTxnDone {
+		t.Errorf("A discarded transaction should not change the map")
+	}
+
+	o := NewOrdered[string, int]()
+	o.Set("a", 1)
+	if err := o.Txn().Set("b", 2).Delete("a").Set("c", 3).Set("a", 4).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := o.Keys(); !reflect.DeepEqual(keys, []string{"b", "c", "a"}) {
+		t.Errorf("Changes should apply in order, got %v", keys)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := New[int, int](1)
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	s := m.Snapshot()
+	m.Set(0, 100)
+	m.Delete(1)
+	m.Set(10, 10)
+	if v, _ := s.Get(0); v != 0 || s.Len() != 10 || s.Size() != 80 {
+		t.Errorf("The snapshot should not see later changes: %v", s.ToMap())
+	}
+	s.Set(20, 20)
+	if _, ok := m.Get(20); ok {
+		t.Errorf("Changing the snapshot should not change the map")
+	}
+	if v, _ := m.Get(0); v != 100 || m.Len() != 10 {
+		t.Errorf("Unexpected map %v", m.ToMap())
+	}
+
+	// Writers and snapshot readers do not race
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			m.Set(i%50, i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.Snapshot().Range(func(int, int) bool { return true })
+		}
+	}()
+	wg.Wait()
+
+	o := NewOrdered[string, int]()
+	o.Set("a", 1)
+	o.Set("b", 2)
+	os := o.Snapshot()
+	o.Delete("a")
+	if keys := os.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Unexpected snapshot keys %v", keys)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	m := New[string, string]()
+	m.Set("env", "prod")
+	frozen := m.Freeze()
+	m.Set("env", "dev")
+	if v, _ := frozen.Get("env"); v != "prod" || frozen.Len() != 1 {
+		t.Errorf("The frozen view should not see later changes, got %q", v)
+	}
+	if _, ok := frozen.(interface{ Set(string, string) error }); ok {
+		t.Errorf("The frozen view should not expose Set")
+	}
+
+	o := NewOrdered[string, int]()
+	o.Set("b", 2)
+	o.Set("a", 1)
+	if keys := o.Freeze().Keys(); !reflect.DeepEqual(keys, []string{"b", "a"}) {
+		t.Errorf("The frozen view should keep the order, got %v", keys)
+	}
+}
+
+func TestCloneWith(t *testing.T) {
+	m := New[string, []int](1)
+	m.Set("a", []int{1, 2})
+
+	shallow := m.Copy()
+	deep := m.CloneWith(func(v []int) []int { return append([]int(nil), v...) })
+	v, _ := m.Get("a")
+	v[0] = 100
+
+	if got, _ := shallow.Get("a"); got[0] != 100 {
+		t.Errorf("Copy should share values, got %v", got)
+	}
+	if got, _ := deep.Get("a"); got[0] != 1 || deep.Size() != 16 || deep.Limit() != m.Limit() {
+		t.Errorf("CloneWith should copy values, got %v with size %d", got, deep.Size())
+	}
+	m.Set("b", nil)
+	if shallow.Len() != 1 || deep.Len() != 1 {
+		t.Errorf("Copies should be independent from the map")
+	}
+
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+	m.SetWithTTL("t", []int{1}, 10*time.Second)
+	m.SetWithTTL("gone", []int{2}, time.Second)
+	now += int64(2 * time.Second)
+	_, rev, _ := m.GetWithRevision("t")
+	deep = m.CloneWith(func(v []int) []int { return append([]int(nil), v...) })
+	if ttl, ok := deep.TTL("t"); !ok || ttl != 8*time.Second {
+		t.Errorf("CloneWith should keep the TTL, got %v %v", ttl, ok)
+	}
+	if _, r, _ := deep.GetWithRevision("t"); r != rev {
+		t.Errorf("CloneWith should keep the revision %d, got %d", rev, r)
+	}
+	if deep.Len() != 3 || deep.Has("gone") {
+		t.Errorf("CloneWith should not copy expired entries, got %v", deep.Keys())
+	}
+}
+
+func TestMerge(t *testing.T) {
+	newMaps := func() (*SafeMap[string, int], *SafeMap[string, int]) {
+		a, b := New[string, int](), New[string, int]()
+		a.SetFromMap(map[string]int{"x": 1, "y": 2})
+		b.SetFromMap(map[string]int{"y": 20, "z": 30})
+		return a, b
+	}
+
+	a, b := newMaps()
+	a.Merge(b, KeepMine[string, int])
+	if got := a.ToMap(); !reflect.DeepEqual(got, map[string]int{"x": 1, "y": 2, "z": 30}) {
+		t.Errorf("KeepMine: unexpected %v", got)
+	}
+
+	a, b = newMaps()
+	a.Merge(b, nil)
+	if got := a.ToMap(); !reflect.DeepEqual(got, map[string]int{"x": 1, "y": 20, "z": 30}) {
+		t.Errorf("KeepTheirs: unexpected %v", got)
+	}
+
+	a, b = newMaps()
+	a.Merge(b, func(key string, mine, theirs int) int { return mine + theirs })
+	if v, _ := a.Get("y"); v != 22 {
+		t.Errorf("Expected 22, got %d", v)
+	}
+
+	// Merging both ways concurrently must not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); a.Merge(b, nil) }()
+		go func() { defer wg.Done(); b.Merge(a, nil) }()
+	}
+	wg.Wait()
+}
+
+func TestReduce(t *testing.T) {
+	m := New[string, int]()
+	m.SetFromMap(map[string]int{"a": 1, "b": 2, "c": 3})
+	if total := Reduce(m, 0, func(acc int, _ string, v int) int { return acc + v }); total != 6 {
+		t.Errorf("Expected 6, got %d", total)
+	}
+
+	o := NewOrdered[string, int]()
+	o.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}})
+	joined := ReduceOrdered(o, "", func(acc string, k string, _ int) string { return acc + k })
+	if joined != "abc" {
+		t.Errorf("Expected abc, got %q", joined)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	m := New[int, int](1)
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+	}
+	even, odd := m.Partition(func(k, v int) bool { return v%2 == 0 })
+	if even.Len() != 5 || odd.Len() != 5 || even.Size()+odd.Size() != m.Size() || even.Limit() != m.Limit() {
+		t.Errorf("Unexpected partition %v %v", even.ToMap(), odd.ToMap())
+	}
+	if _, ok := even.Get(3); ok || m.Len() != 10 {
+		t.Errorf("Odd values should not match and the map should not change")
+	}
+	m.SetWithTTL(10, 10, time.Hour)
+	if even, _ := m.Partition(func(k, v int) bool { return v%2 == 0 }); !even.Has(10) {
+		t.Error("Partition should keep entries with a TTL")
+	} else if ttl, ok := even.TTL(10); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Partition should keep the TTL, got %v %v", ttl, ok)
+	}
+	m.Delete(10)
+
+	groups := GroupBy(m, func(k, v int) string {
+		if v < 3 {
+			return "small"
+		}
+		return "large"
+	})
+	if len(groups["small"]) != 3 || len(groups["large"]) != 7 {
+		t.Errorf("Unexpected groups %v", groups)
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	m := New[int, int]()
+	o := NewOrdered[int, int]()
+	for i := 0; i < 10; i++ {
+		m.Set(i, i)
+		o.Set(i, i)
+	}
+	positive := func(k, v int) bool { return v >= 0 }
+	large := func(k, v int) bool { return v > 7 }
+	negative := func(k, v int) bool { return v < 0 }
+
+	if !m.All(positive) || m.All(large) || !o.All(positive) || o.All(large) {
+		t.Errorf("Unexpected All result")
+	}
+	if !m.Any(large) || m.Any(negative) || !o.Any(large) || o.Any(negative) {
+		t.Errorf("Unexpected Any result")
+	}
+	if m.CountIf(large) != 2 || o.CountIf(large) != 2 {
+		t.Errorf("Expected 2 large values")
+	}
+
+	calls := 0
+	o.Any(func(k, v int) bool { calls++; return true })
+	if calls != 1 {
+		t.Errorf("Any should stop at the first match, called %d times", calls)
+	}
+	if !New[int, int]().All(negative) {
+		t.Errorf("All should be true for an empty map")
+	}
+	// The SafeMap predicates run without the lock
+	if !m.Any(func(k, v int) bool { _, ok := m.Get(k); return ok }) {
+		t.Errorf("The map should be usable from the predicate")
+	}
+}
+
+func TestFind(t *testing.T) {
+	o := NewOrdered[string, int]()
+	o.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 20}, {"c", 30}})
+	if k, v, ok := o.Find(func(k string, v int) bool { return v > 10 }); !ok || k != "b" || v != 20 {
+		t.Errorf("Expected the first match b, got %q %d %v", k, v, ok)
+	}
+
+	m := New[string, int]()
+	m.SetFromMap(map[string]int{"a": 1, "b": 20, "c": 30})
+	if k, v, ok := m.Find(func(k string, v int) bool { return v > 10 }); !ok || v <= 10 || (k != "b" && k != "c") {
+		t.Errorf("Unexpected match %q %d %v", k, v, ok)
+	}
+	if _, _, ok := m.Find(func(k string, v int) bool { return v > 100 }); ok {
+		t.Errorf("Nothing should match")
+	}
+}
+
+func TestHas(t *testing.T) {
+	m := New[string, [64]int]()
+	o := NewOrdered[string, [64]int]()
+	m.Set("a", [64]int{})
+	o.Set("a", [64]int{})
+	if !m.Has("a") || m.Has("b") || !o.Has("a") || o.Has("b") {
+		t.Errorf("Unexpected Has result")
+	}
+}
+
+func TestKeysPage(t *testing.T) {
+	m := New[int, int]()
+	o := NewOrdered[int, int]()
+	for i := 0; i < 25; i++ {
+		m.Set(i, i)
+		o.Set(i, i)
+	}
+
+	seen := map[int]bool{}
+	var cursor Cursor
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Paging does not end")
+		}
+		var keys []int
+		keys, cursor = m.KeysPage(cursor, 10)
+		for _, k := range keys {
+			if seen[k] {
+				t.Errorf("Key %d listed twice", k)
+			}
+			seen[k] = true
+		}
+		if pages == 0 {
+			// Deleting keys while paging does not disturb the cursor
+			m.Delete(keys[len(keys)-1])
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected 25 keys, got %d", len(seen))
+	}
+	m.SetWithTTL(100, 100, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if all, _ := m.KeysPage("", 0); len(all) != 24 {
+		t.Errorf("KeysPage should skip expired keys, got %v", all)
+	}
+
+	keys, cursor := o.KeysPage("", 10)
+	if !reflect.DeepEqual(keys, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("Unexpected first page %v", keys)
+	}
+	o.Delete(9)
+	keys, cursor = o.KeysPage(cursor, 10)
+	if len(keys) != 10 || keys[0] != 10 {
+		t.Errorf("The next page should resume after a deleted key, got %v", keys)
+	}
+	keys, cursor = o.KeysPage(cursor, 10)
+	if len(keys) != 5 || keys[4] != 24 || cursor != "" {
+		t.Errorf("Unexpected last page %v, cursor %q", keys, cursor)
+	}
+	if all, _ := o.KeysPage("", 0); len(all) != 24 {
+		t.Errorf("A limit of 0 should return every key, got %d", len(all))
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	m := New[int, bool]()
+	for _, k := range []int{5, -2, 9, 0} {
+		m.Set(k, true)
+	}
+	if keys := m.SortedKeys(); !reflect.DeepEqual(keys, []int{-2, 0, 5, 9}) {
+		t.Errorf("Unexpected default order %v", keys)
+	}
+	if keys := m.SortedKeys(func(a, b int) bool { return a > b }); !reflect.DeepEqual(keys, []int{9, 5, 0, -2}) {
+		t.Errorf("Unexpected custom order %v", keys)
+	}
+
+	type point struct{ X, Y int }
+	p := New[point, bool]()
+	p.Set(point{2, 1}, true)
+	p.Set(point{1, 2}, true)
+	if keys := p.SortedKeys(); keys[0] != (point{1, 2}) {
+		t.Errorf("Unexpected struct key order %v", keys)
+	}
+}
+
+func TestTopKeys(t *testing.T) {
+	m := New[string, string]().WithStats()
+	o := NewOrdered[string, string](1).WithStats()
+	for _, k := range []string{"a", "bbb", "cc"} {
+		m.Set(k, strings.Repeat("x", len(k)*10))
+		o.Set(k, strings.Repeat("x", len(k)*10))
+	}
+	for i := 0; i < 3; i++ {
+		m.Get("cc")
+		o.Get("cc")
+	}
+	m.Get("a")
+	o.GetAll("a")
+
+	for _, top := range [][]KeyStat[string]{m.TopBySize(2), o.TopBySize(2)} {
+		if len(top) != 2 || top[0].Key != "bbb" || top[0].Size != 30 || top[1].Key != "cc" || top[1].Hits != 3 {
+			t.Errorf("Unexpected top by size %+v", top)
+		}
+	}
+	for _, top := range [][]KeyStat[string]{m.TopByHits(0), o.TopByHits(0)} {
+		if len(top) != 2 || top[0].Key != "cc" || top[0].Hits != 3 || top[0].Size != 20 || top[1].Key != "a" {
+			t.Errorf("Unexpected top by hits %+v", top)
+		}
+	}
+
+	m.Delete("cc")
+	if top := m.TopByHits(1); len(top) != 1 || top[0].Key != "a" {
+		t.Errorf("Deleted keys should not be listed, got %+v", top)
+	}
+	if New[string, int]().TopByHits(1) != nil {
+		t.Errorf("TopByHits should be nil without stats")
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	m := New[string, int]().WithStats()
+	o := NewOrdered[string, int]().WithStats()
+	for _, k := range []string{"a", "b", "c"} {
+		m.Set(k, 0)
+		o.Set(k, 0)
+	}
+	for i := 0; i < 10; i++ {
+		m.Get("b")
+		o.Get("b")
+		if i%2 == 0 {
+			m.GetAny("x", "c")
+			o.GetOrDefault("c", 0)
+		}
+	}
+	if hot := m.HotKeys(2); !reflect.DeepEqual(hot, []string{"b", "c"}) {
+		t.Errorf("Unexpected hot keys %v", hot)
+	}
+	if hot := o.HotKeys(1); !reflect.DeepEqual(hot, []string{"b"}) {
+		t.Errorf("Unexpected hot keys %v", hot)
+	}
+
+	m.ResetHits()
+	o.ResetHits()
+	m.Get("a")
+	if hot := m.HotKeys(0); !reflect.DeepEqual(hot, []string{"a"}) {
+		t.Errorf("Hits should be reset, got %v", hot)
+	}
+	if hot := o.HotKeys(0); len(hot) != 0 {
+		t.Errorf("Hits should be reset, got %v", hot)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	log := func(format string, args ...any) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	m := New[string, int]()
+	m.OnSet(func(key string, value int) {
+		// Listeners run without the lock and may use the map
+		m.Has(key)
+		log("set %s=%d", key, value)
+	}).OnDelete(func(key string) {
+		log("delete %s", key)
+	}).OnFlush(func() {
+		log("flush")
+	})
+	m.Set("a", 1)
+	m.Update("a", func(old int, _ bool) int { return old + 1 })
+	m.Delete("a")
+	m.Delete("missing")
+	m.Set("b", 2)
+	m.DeleteAll("b")
+	m.Flush()
+	expected := []string{"set a=1", "set a=2", "delete a", "set b=2", "delete b", "flush"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+
+	events = nil
+	o := NewOrdered[string, int](1).WithEvictToFit()
+	o.OnSet(func(key string, value int) { log("set %s", key) }).OnDelete(func(key string) { log("delete %s", key) })
+	o.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}})
+	o.GetAndDelete("a")
+	o.Txn().Set("c", 3).Delete("b").Commit()
+	expected = []string{"set a", "set b", "delete a", "set c", "delete b"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	var events []Event[string, int]
+	m := New[string, int]()
+	stop := WatchPrefix(m, "user:", func(e Event[string, int]) {
+		events = append(events, e)
+	})
+	m.Set("user:1", 1)
+	m.Set("order:1", 10)
+	m.Delete("user:1")
+	m.Flush()
+	stop()
+	m.Set("user:2", 2)
+	expected := []Event[string, int]{
+		{Kind: EventSet, Key: "user:1", Value: 1},
+		{Kind: EventDelete, Key: "user:1"},
+		{Kind: EventFlush},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+
+	var keys []int
+	o := NewOrdered[int, string]()
+	o.WatchWhere(func(k int) bool { return k%2 == 0 }, func(e Event[int, string]) {
+		keys = append(keys, e.Key)
+	})
+	o.SetPairs([]Pair[int, string]{{1, "a"}, {2, "b"}, {3, "c"}, {4, "d"}})
+	if !reflect.DeepEqual(keys, []int{2, 4}) {
+		t.Errorf("Expected [2 4], got %v", keys)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	m := New[string, int]().WithChangeBuffer(3)
+	ch := m.Changes()
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Delete("a")
+	m.Set("c", 3) // dropped, the buffer is full
+	first := <-ch
+	if first.Seq != 1 || first.Kind != EventSet || first.Key != "a" || first.Value != 1 {
+		t.Errorf("Unexpected first change %+v", first)
+	}
+	<-ch
+	third := <-ch
+	if third.Seq != 3 || third.Kind != EventDelete {
+		t.Errorf("Unexpected third change %+v", third)
+	}
+	m.Set("d", 4)
+	if next := <-ch; next.Seq != 5 || next.Key != "d" {
+		t.Errorf("Expected a gap before seq 5, got %+v", next)
+	}
+	m.CloseChanges(ch)
+	if _, ok := <-ch; ok {
+		t.Error("Stream should be closed")
+	}
+
+	o := NewOrdered[string, int]().WithChangeBuffer(1, BufferClose)
+	och := o.Changes()
+	o.Set("a", 1)
+	o.Set("b", 2)
+	if c := <-och; c.Key != "a" {
+		t.Errorf("Expected a, got %+v", c)
+	}
+	if _, ok := <-och; ok {
+		t.Error("Stream should be closed once the buffer overflowed")
+	}
+}
+
+func TestUndo(t *testing.T) {
+	m := New[string, int]().WithJournal(3)
+	ch := m.Changes()
+	m.Set("a", 1)
+	base := (<-ch).Seq
+	m.Set("a", 2)
+	m.Set("b", 3)
+	m.Delete("a")
+	if n, err := m.Undo(2); n != 2 || err != nil {
+		t.Fatalf("Expected 2 operations undone, got %d %v", n, err)
+	}
+	if v, _ := m.Get("a"); v != 2 || m.Has("b") {
+		t.Errorf("Expected a=2 and no b, got %v", m.ToMap())
+	}
+	if err := m.RollbackTo(base); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("a"); v != 1 || m.Len() != 1 {
+		t.Errorf("Expected a=1, got %v", m.ToMap())
+	}
+
+	for i := 0; i < 5; i++ {
+		m.Set(getKey(i), i)
+	}
+	if err := m.RollbackTo(base); err != ErrJournalTruncated {
+		t.Errorf("Expected ErrJournalTruncated, got %v", err)
+	}
+	if n, err := m.Undo(5); n != 3 || err != ErrJournalTruncated {
+		t.Errorf("Expected 3 operations undone and ErrJournalTruncated, got %d %v", n, err)
+	}
+
+	o := NewOrdered[string, int]().WithJournal(10)
+	o.Set("a", 1)
+	o.Set("b", 2)
+	o.Delete("a")
+	o.Set("b", 3)
+	o.Undo(2)
+	if !reflect.DeepEqual(o.Keys(), []string{"b", "a"}) || o.GetOrDefault("b", 0) != 2 {
+		t.Errorf("Unexpected state after undo %v %v", o.Keys(), o.Values())
+	}
+}
+
+func TestRevision(t *testing.T) {
+	m := New[string, int]()
+	m.Set("a", 1)
+	_, rev1, ok := m.GetWithRevision("a")
+	if !ok || rev1 == 0 {
+		t.Fatalf("Expected a revision, got %d %v", rev1, ok)
+	}
+	m.Set("b", 2)
+	if m.Revision("a") != rev1 {
+		t.Error("Revision of a should not change when b is set")
+	}
+	m.Set("a", 3)
+	v, rev2, _ := m.GetWithRevision("a")
+	if v != 3 || rev2 <= rev1 {
+		t.Errorf("Expected a newer revision, got %d after %d", rev2, rev1)
+	}
+	m.Delete("a")
+	if _, _, ok := m.GetWithRevision("a"); ok || m.Revision("a") != 0 {
+		t.Error("Deleted key should have no revision")
+	}
+	m.Set("a", 3)
+	if m.Revision("a") <= rev2 {
+		t.Error("Revision should keep increasing after a delete")
+	}
+	if s := m.Snapshot(); s.Revision("b") != m.Revision("b") {
+		t.Error("Snapshot should keep revisions")
+	}
+
+	o := NewOrdered[string, int]()
+	o.Set("a", 1)
+	rev := o.Revision("a")
+	o.Set("a", 1)
+	if _, r, _ := o.GetWithRevision("a"); r <= rev {
+		t.Errorf("Expected a newer revision, got %d after %d", r, rev)
+	}
+}
+
+func TestSetIfRevision(t *testing.T) {
+	m := New[string, int]()
+	if err := m.SetIfRevision("a", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, rev, _ := m.GetWithRevision("a")
+	if err := m.SetIfRevision("a", 2, 0); err == nil {
+		t.Error("Expected a conflict when the key exists")
+	}
+	m.Set("a", 5)
+	err := m.SetIfRevision("a", 2, rev)
+	conflict, ok := err.(*RevisionConflictError[string])
+	if !ok || conflict.Expected != rev || conflict.Actual != m.Revision("a") {
+		t.Fatalf("Expected a RevisionConflictError, got %v", err)
+	}
+	if err := m.SetIfRevision("a", 6, conflict.Actual); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("a"); v != 6 {
+		t.Errorf("Expected 6, got %d", v)
+	}
+	m.SetWithTTL("b", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if m.Revision("b") != 0 {
+		t.Errorf("An expired key should have no revision, got %d", m.Revision("b"))
+	}
+	if err := m.SetIfRevision("b", 2, 0); err != nil {
+		t.Errorf("An expired key should be missing, got %v", err)
+	}
+
+	o := NewOrdered[string, int]()
+	o.Set("a", 1)
+	if err := o.SetIfRevision("a", 2, o.Revision("a")+1); err == nil {
+		t.Error("Expected a conflict")
+	}
+	if err := o.SetIfRevision("a", 2, o.Revision("a")); err != nil || o.GetOrDefault("a", 0) != 2 {
+		t.Errorf("Expected a=2, got %v", err)
+	}
+}
+
+func TestGetOrComputeErr(t *testing.T) {
+	m := New[string, int]()
+	failure := fmt.Errorf("unavailable")
+	if _, err := m.GetOrComputeErr("a", func() (int, error) { return 0, failure }); err != failure {
+		t.Errorf("Expected the error of fn, got %v", err)
+	}
+	if m.Has("a") {
+		t.Error("Failed computations should not be cached")
+	}
+	v, err := m.GetOrComputeErr("a", func() (int, error) { return 1, nil })
+	if v != 1 || err != nil {
+		t.Errorf("Expected 1, got %d %v", v, err)
+	}
+	v, _ = m.GetOrComputeErr("a", func() (int, error) { return 2, nil })
+	if v != 1 {
+		t.Errorf("Expected the cached 1, got %d", v)
+	}
+
+	o := NewOrdered[string, int]()
+	o.GetOrComputeErr("a", func() (int, error) { return 0, failure })
+	o.GetOrComputeErr("b", func() (int, error) { return 2, nil })
+	if !reflect.DeepEqual(o.Keys(), []string{"b"}) {
+		t.Errorf("Expected [b], got %v", o.Keys())
+	}
+}
+
+func TestContext(t *testing.T) {
+	m := New[string, int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	v, err := m.GetOrComputeCtx(ctx, "a", func(ctx context.Context) (int, error) { return 1, ctx.Err() })
+	if v != 1 || err != nil {
+		t.Fatalf("Expected 1, got %d %v", v, err)
+	}
+	ch := m.ChangesCtx(ctx)
+	cancel()
+	if _, err := m.GetOrComputeCtx(ctx, "b", func(ctx context.Context) (int, error) { return 2, nil }); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if v, err := m.GetOrComputeCtx(ctx, "a", nil); v != 1 || err != nil {
+		t.Errorf("Stored values should be returned once ctx is done, got %d %v", v, err)
+	}
+	for range ch {
+		// The stream is closed once ctx is done
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	m := New[string, int]()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Get then Set is not atomic, the key lock makes it so
+			unlock := m.LockKey("counter")
+			v, _ := m.Get("counter")
+			m.Set("counter", v+1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("counter"); v != 50 {
+		t.Errorf("Expected 50, got %d", v)
+	}
+
+	o := NewOrdered[int, int]()
+	unlock := o.LockKey(1)
+	o.Set(1, 1)
+	unlock()
+	o.LockKey(1)()
+}
+
+func TestReadMostly(t *testing.T) {
+	m := New[string, int]().WithReadMostly()
+	for i := 0; i < 10; i++ {
+		m.Set(getKey(i), i)
+	}
+	for i := 0; i < 10; i++ {
+		m.Get(getKey(i))
+	}
+	if m.readMostly.clean.Load() == nil {
+		t.Fatal("Reads should have promoted the items")
+	}
+	if v, ok := m.Get("key3"); !ok || v != 3 || m.Has("missing") {
+		t.Errorf("Expected key3=3 from the clean view, got %d %v", v, ok)
+	}
+	s := m.Snapshot()
+	m.Set("key3", 30)
+	if m.readMostly.clean.Load() != nil {
+		t.Error("Writes should drop the clean view")
+	}
+	if v, _ := m.Get("key3"); v != 30 {
+		t.Errorf("Expected 30, got %d", v)
+	}
+	if v, _ := s.Get("key3"); v != 3 {
+		t.Errorf("Snapshot should keep 3, got %d", v)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if g == 0 && i%100 == 0 {
+					m.Set(getKey(i%10), i)
+				}
+				m.GetAny("missing", getKey(i%10))
+			}
+		}(g)
+	}
+	wg.Wait()
+	m.Flush()
+	if m.Has("key1") {
+		t.Error("Flush should drop the clean view")
+	}
+}
+
+func TestMoveBefore(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}})
+	m.MoveBefore("d", "a")
+	m.MoveAfter("a", "c")
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"d", "b", "c", "a"}) {
+		t.Errorf("Expected [d b c a], got %v", keys)
+	}
+	if m.Back().Key != "a" || m.Front().Key != "d" || m.Back().Prev().Key != "c" {
+		t.Error("Links are inconsistent after moving")
+	}
+	if m.MoveBefore("a", "a") || m.MoveAfter("missing", "a") || m.MoveAfter("a", "missing") {
+		t.Error("Invalid moves should return false")
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}, {"e", 5}})
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		k, v, ok := m.GetAt(i)
+		if !ok || k != key || v != i+1 {
+			t.Errorf("GetAt(%d): got %s=%d %v", i, k, v, ok)
+		}
+		if m.IndexOf(key) != i {
+			t.Errorf("IndexOf(%s): expected %d, got %d", key, i, m.IndexOf(key))
+		}
+	}
+	if _, _, ok := m.GetAt(5); ok {
+		t.Error("GetAt out of range should fail")
+	}
+	if _, _, ok := m.GetAt(-1); ok {
+		t.Error("GetAt with a negative index should fail")
+	}
+	if m.IndexOf("missing") != -1 {
+		t.Error("IndexOf of a missing key should be -1")
+	}
+}
+
+func TestSlice(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}})
+	if got := m.Slice(1, 3); !reflect.DeepEqual(got, []Entry[string, int]{{"b", 2}, {"c", 3}}) {
+		t.Errorf("Expected [b c], got %v", got)
+	}
+	if got := m.Slice(-2, 10); len(got) != 4 || got[3].Key != "d" {
+		t.Errorf("Expected the whole map, got %v", got)
+	}
+	if got := m.Slice(4, 6); got != nil {
+		t.Errorf("Expected no entries past the end, got %v", got)
+	}
+}
+
+func TestPop(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}})
+	if k, v, ok := m.PopFront(); !ok || k != "a" || v != 1 {
+		t.Errorf("Expected a=1, got %s=%d %v", k, v, ok)
+	}
+	if k, v, ok := m.PopBack(); !ok || k != "c" || v != 3 {
+		t.Errorf("Expected c=3, got %s=%d %v", k, v, ok)
+	}
+	m.PopBack()
+	if _, _, ok := m.PopFront(); ok || m.Len() != 0 {
+		t.Error("Pop on an empty map should fail")
+	}
+}
+
+func TestOrderedSort(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.SetPairs([]Pair[string, int]{{"a", 3}, {"b", 1}, {"c", 2}, {"d", 1}, {"e", 5}})
+	m.Sort(func(a, b Entry[string, int]) bool { return a.Value < b.Value })
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"b", "d", "c", "a", "e"}) {
+		t.Errorf("Expected a stable sort by value [b d c a e], got %v", keys)
+	}
+	var back []string
+	for el := m.Back(); el != nil; el = el.Prev() {
+		back = append(back, el.Key)
+	}
+	if !reflect.DeepEqual(back, []string{"e", "a", "c", "d", "b"}) {
+		t.Errorf("Prev links are inconsistent: %v", back)
+	}
+	m.Set("f", 0)
+	if m.Back().Key != "f" {
+		t.Error("New keys should be appended after sorting")
+	}
+}
+
+func TestReverse(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.Reverse()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}})
+	m.Reverse()
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"c", "b", "a"}) {
+		t.Errorf("Expected [c b a], got %v", keys)
+	}
+	if m.Back().Key != "a" || m.Back().Prev().Key != "b" || m.Front().Prev() != nil {
+		t.Error("Links are inconsistent after reversing")
+	}
+}
+
+func TestAccessOrder(t *testing.T) {
+	m := NewOrdered[string, int]().WithAccessOrder()
+	m.SetPairs([]Pair[string, int]{{"a", 1}, {"b", 2}, {"c", 3}})
+	m.Get("a")
+	m.Set("b", 20)
+	if keys := m.Keys(); !reflect.DeepEqual(keys, []string{"c", "a", "b"}) {
+		t.Errorf("Expected [c a b], got %v", keys)
+	}
+	if m.GetOrDefault("c", 0) != 3 || m.Back().Key != "c" {
+		t.Error("GetOrDefault should move the key to the back")
+	}
+	if k, _, _ := m.PopFront(); k != "a" {
+		t.Errorf("Expected the least recently used a, got %s", k)
+	}
+
+	lru := NewOrdered[int, string](1).WithAccessOrder().WithEvictToFit()
+	half := strings.Repeat("x", 400*1024)
+	lru.Set(1, half)
+	lru.Set(2, half)
+	lru.Get(1)
+	lru.Set(3, half)
+	if lru.Has(2) || !lru.Has(1) || !lru.Has(3) {
+		t.Errorf("Expected the least recently used key 2 to be evicted, got %v", lru.Keys())
+	}
+}
+
+func TestSortedMap(t *testing.T) {
+	m := NewSorted[int, string]()
+	for _, k := range []int{50, 10, 40, 20, 30} {
+		m.Set(k, fmt.Sprint(k))
+	}
+	for i := 0; i < 1000; i++ {
+		m.Set(1000+i, "")
+	}
+	for i := 0; i < 1000; i += 2 {
+		m.Delete(1000 + i)
+	}
+	if m.Len() != 505 {
+		t.Errorf("Expected 505 entries, got %d", m.Len())
+	}
+	keys := m.Keys()
+	if !reflect.DeepEqual(keys[:6], []int{10, 20, 30, 40, 50, 1001}) || keys[len(keys)-1] != 1999 {
+		t.Errorf("Keys should be sorted, got %v...", keys[:6])
+	}
+	if v, ok := m.Get(30); !ok || v != "30" {
+		t.Errorf("Expected 30, got %q %v", v, ok)
+	}
+	if k, _, _ := m.Min(); k != 10 {
+		t.Errorf("Expected Min 10, got %d", k)
+	}
+	if k, _, _ := m.Max(); k != 1999 {
+		t.Errorf("Expected Max 1999, got %d", k)
+	}
+	if k, _, ok := m.Floor(35); !ok || k != 30 {
+		t.Errorf("Expected Floor(35) 30, got %d", k)
+	}
+	if k, _, ok := m.Ceiling(35); !ok || k != 40 {
+		t.Errorf("Expected Ceiling(35) 40, got %d", k)
+	}
+	if _, _, ok := m.Floor(5); ok {
+		t.Error("Floor below Min should fail")
+	}
+	if _, _, ok := m.Ceiling(2000); ok {
+		t.Error("Ceiling above Max should fail")
+	}
+	if m.DeleteAll(10, 20, 99) != 2 || m.Has(10) {
+		t.Error("DeleteAll should remove 10 and 20")
+	}
+	m.Flush()
+	if _, _, ok := m.Max(); ok || m.Len() != 0 {
+		t.Error("Flush should empty the map")
+	}
+
+	limited := NewSorted[string, string](1)
+	if err := limited.Set("a", strings.Repeat("x", 2*1024*1024)); err != ErrLargeData {
+		t.Errorf("Expected ErrLargeData, got %v", err)
+	}
+	limited.Set("a", "abc")
+	limited.Set("a", "abcd")
+	if limited.Size() != 4 {
+		t.Errorf("Expected size 4, got %d", limited.Size())
+	}
+}
+
+func TestSortedMapRange(t *testing.T) {
+	m := NewSorted[int64, int]()
+	for ts := int64(0); ts < 100; ts += 10 {
+		m.Set(ts, int(ts/10))
+	}
+	got := m.GetRange(15, 50)
+	if !reflect.DeepEqual(got, []Entry[int64, int]{{20, 2}, {30, 3}, {40, 4}}) {
+		t.Errorf("Expected [20 30 40], got %v", got)
+	}
+	if got := m.GetRange(50, 50); got != nil {
+		t.Errorf("Expected an empty range, got %v", got)
+	}
+	var keys []int64
+	m.RangeBetween(0, 1000, func(key int64, value int) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if !reflect.DeepEqual(keys, []int64{0, 10, 20}) {
+		t.Errorf("Expected [0 10 20], got %v", keys)
+	}
+}
+
+func TestMultiMap(t *testing.T) {
+	m := NewMulti[string, string](1)
+	m.Add("tags", "go", "cache")
+	m.Add("tags", "go")
+	m.Add("langs", "go")
+	if got := m.GetAll("tags"); !reflect.DeepEqual(got, []string{"go", "cache", "go"}) {
+		t.Errorf("Expected [go cache go], got %v", got)
+	}
+	if m.CountValues("tags") != 3 || m.Count() != 4 || m.Len() != 2 || m.Size() != 11 {
+		t.Errorf("Unexpected counts: %d values of tags, %d values, %d keys, size %d", m.CountValues("tags"), m.Count(), m.Len(), m.Size())
+	}
+	if n := m.RemoveValue("tags", "go"); n != 2 || m.HasValue("tags", "go") {
+		t.Errorf("Expected 2 removed values, got %d", n)
+	}
+	if m.RemoveValue("langs", "go") != 1 || m.Has("langs") {
+		t.Error("A key without values should be deleted")
+	}
+	if m.Delete("tags") != 1 || m.Size() != 0 || m.Count() != 0 {
+		t.Errorf("Expected an empty map, got size %d count %d", m.Size(), m.Count())
+	}
+	if err := m.Add("big", strings.Repeat("x", 2*1024*1024)); err != ErrLargeData {
+		t.Errorf("Expected ErrLargeData, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Add("concurrent", fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+	if m.CountValues("concurrent") != 10 {
+		t.Errorf("Expected 10 values, got %d", m.CountValues("concurrent"))
+	}
+}
+
+func TestCounterMap(t *testing.T) {
+	c := NewCounter[string]()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Incr(getKey(i % 10))
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Get("key3") != 800 || c.Len() != 10 {
+		t.Errorf("Expected 10 counters at 800, got %d for key3 and %d counters", c.Get("key3"), c.Len())
+	}
+	if c.Add("key3", -100) != 700 {
+		t.Error("Add should return the new value")
+	}
+	snapshot := c.Snapshot()
+	if snapshot["key3"] != 700 || snapshot["key4"] != 800 {
+		t.Errorf("Unexpected snapshot %v", snapshot)
+	}
+	if reset := c.Reset(); reset["key4"] != 800 || c.Len() != 0 || c.Get("key4") != 0 {
+		t.Errorf("Reset should return the counters and remove them, got %v", reset)
+	}
+}
+
+func TestPriorityMap(t *testing.T) {
+	m := NewPriority[string, int]()
+	m.Set("c", 3, 30)
+	m.Set("a", 1, 10)
+	m.Set("b", 2, 20)
+	m.SetPriority("c", 5)
+	if k, _, p, _ := m.PeekLowest(); k != "c" || p != 5 {
+		t.Errorf("Expected c with priority 5, got %s %v", k, p)
+	}
+	var order []string
+	for {
+		k, _, _, ok := m.PopLowest()
+		if !ok {
+			break
+		}
+		order = append(order, k)
+	}
+	if !reflect.DeepEqual(order, []string{"c", "a", "b"}) {
+		t.Errorf("Expected [c a b], got %v", order)
+	}
+
+	third := strings.Repeat("x", 400*1024)
+	limited := NewPriority[string, string](1)
+	limited.Set("cheap", third, 1)
+	limited.Set("costly", third, 100)
+	if err := limited.Set("medium", third, 50); err != nil {
+		t.Fatal(err)
+	}
+	if limited.Delete("cheap") || !limited.Delete("medium") {
+		t.Error("The cheap entry should have been evicted for the medium one")
+	}
+	limited.Set("medium", third, 50)
+	if err := limited.Set("cheaper", third, 0); err != ErrLimitExceeded {
+		t.Errorf("A cheap entry should not evict costly ones, got %v", err)
+	}
+	if limited.Len() != 2 || limited.Size() != 800*1024 {
+		t.Errorf("Expected 2 entries, got %v size %d", limited.Keys(), limited.Size())
+	}
+}
+
+func TestPrefixMap(t *testing.T) {
+	m := NewPrefix[int]()
+	m.Set("user:1", 1)
+	m.Set("user:1:posts", 10)
+	m.Set("user:2", 2)
+	m.Set("order:1", 100)
+	m.Set("", 0)
+	m.Set("user:2", 20)
+	if m.Len() != 5 || m.CountPrefix("user:") != 3 {
+		t.Errorf("Expected 5 keys and 3 users, got %d and %d", m.Len(), m.CountPrefix("user:"))
+	}
+	got := m.GetByPrefix("user:1")
+	if !reflect.DeepEqual(got, map[string]int{"user:1": 1, "user:1:posts": 10}) {
+		t.Errorf("Unexpected GetByPrefix result %v", got)
+	}
+	if k, v, ok := m.LongestPrefixOf("user:1:likes"); !ok || k != "user:1" || v != 1 {
+		t.Errorf("Expected user:1, got %q %d %v", k, v, ok)
+	}
+	if n := m.DeleteByPrefix("user:"); n != 3 || m.Has("user:2") || m.Len() != 2 {
+		t.Errorf("Expected 3 users removed, got %d and %d keys left", n, m.Len())
+	}
+	if !m.Delete("order:1") || m.Delete("order:1") || m.CountPrefix("o") != 0 {
+		t.Error("Delete should remove order:1 once")
+	}
+	if v, ok := m.Get(""); !ok || v != 0 || m.Len() != 1 {
+		t.Error("The empty key should remain")
+	}
+	if m.DeleteByPrefix("") != 1 || m.Len() != 0 {
+		t.Error("An empty prefix should remove every key")
+	}
+}
+
+func TestKeysMatching(t *testing.T) {
+	m := New[string, int]()
+	for _, k := range []string{"user:123:name", "user:123:posts/1", "user:124:name", "user:1", "order:123"} {
+		m.Set(k, 1)
+	}
+	keys, err := KeysMatching(m, "user:123:*")
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"user:123:name", "user:123:posts/1"}) {
+		t.Errorf("Unexpected keys %v %v", keys, err)
+	}
+	if keys, _ := KeysMatching(m, "user:12[!3]:name"); !reflect.DeepEqual(keys, []string{"user:124:name"}) {
+		t.Errorf("Expected user:124:name, got %v", keys)
+	}
+	if keys, _ := KeysMatching(m, "user:?"); !reflect.DeepEqual(keys, []string{"user:1"}) {
+		t.Errorf("Expected user:1, got %v", keys)
+	}
+	m.SetWithTTL("user:2", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if keys, _ := KeysMatching(m, "user:?"); !reflect.DeepEqual(keys, []string{"user:1"}) {
+		t.Errorf("Expired keys should be skipped, got %v", keys)
+	}
+	m.Delete("user:2")
+	if n, err := DeleteMatching(m, "user:*"); n != 4 || err != nil || m.Len() != 1 {
+		t.Errorf("Expected 4 removed keys, got %d %v", n, err)
+	}
+	if n := DeleteMatchingRegexp(m, regexp.MustCompile(`^order:\d+$`)); n != 1 {
+		t.Errorf("Expected order:123 removed, got %d", n)
+	}
+	if re, err := CompileGlob("a[b"); err != nil || !re.MatchString("a[b") {
+		t.Errorf("Unterminated classes should match literally, got %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	m := New[int, user]()
+	m.SetMany(map[int]user{1: {"ann", 31}, 2: {"bob", 17}, 3: {"cid", 45}, 4: {"dan", 28}, 5: {"eve", 52}})
+	adults := m.Query().
+		Where(func(_ int, u user) bool { return u.Age >= 18 }).
+		OrderBy(func(a, b Pair[int, user]) bool { return a.Value.Age > b.Value.Age }).
+		Offset(1).
+		Limit(2)
+	if names := adults.Values(); len(names) != 2 || names[0].Name != "cid" || names[1].Name != "ann" {
+		t.Errorf("Expected [cid ann], got %v", names)
+	}
+	if n := m.Query().Where(func(id int, _ user) bool { return id%2 == 1 }).Count(); n != 3 {
+		t.Errorf("Expected 3 odd ids, got %d", n)
+	}
+	if _, ok := m.Query().Where(func(int, user) bool { return false }).First(); ok {
+		t.Error("First should fail without results")
+	}
+
+	o := NewOrdered[string, int]()
+	o.SetPairs([]Pair[string, int]{{"c", 3}, {"a", 1}, {"b", 2}})
+	if keys := o.Query().Where(func(_ string, v int) bool { return v > 1 }).Keys(); !reflect.DeepEqual(keys, []string{"c", "b"}) {
+		t.Errorf("Expected the order of the map [c b], got %v", keys)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	failure := fmt.Errorf("store down")
+	store := map[string]int{}
+	through := New[string, int]().WithWriter(func(ctx context.Context, key string, v int) error {
+		if v < 0 {
+			return failure
+		}
+		store[key] = v
+		return nil
+	})
+	through.Set("a", 1)
+	if err := through.Set("b", -1); err != failure || through.Has("b") {
+		t.Errorf("A failed write-through should fail Set, got %v", err)
+	}
+	if store["a"] != 1 {
+		t.Error("Write-through should write a")
+	}
+
+	var mu sync.Mutex
+	written := map[string]int{}
+	attempts := 0
+	var failed []error
+	behind := New[string, int]().WithWriter(func(ctx context.Context, key string, v int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if key == "flaky" {
+			attempts++
+			if attempts < 3 {
+				return failure
+			}
+		}
+		if key == "broken" {
+			return failure
+		}
+		written[key] = v
+		return nil
+	}, WriterOptions{Mode: WriteBehind, FlushInterval: time.Hour, MaxRetries: 2, RetryDelay: time.Millisecond, OnError: func(err error) {
+		failed = append(failed, err)
+	}})
+	behind.Set("a", 1)
+	behind.Set("a", 2)
+	behind.Set("flaky", 3)
+	behind.Set("broken", 4)
+	if err := behind.FlushWrites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(written, map[string]int{"a": 2, "flaky": 3}) || attempts != 3 {
+		t.Errorf("Unexpected writes %v after %d attempts", written, attempts)
+	}
+	mu.Unlock()
+	if len(failed) != 1 || !errors.Is(failed[0], failure) {
+		t.Errorf("Expected the broken write to be reported, got %v", failed)
+	}
+	behind.Set("c", 5)
+	behind.StopWriter()
+	if written["c"] != 5 {
+		t.Error("StopWriter should write the queued changes")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	loaded := make(chan string, 1)
+	c := New[string, int]().WithLoader(func(ctx context.Context, key string) (int, error) {
+		loaded <- key
+		return 2, nil
+	}).WithRefreshAhead(0.8)
+	c.SetWithTTL("a", 1, 10*time.Second)
+	if ttl, ok := c.TTL("a"); !ok || ttl != 10*time.Second {
+		t.Errorf("Expected a TTL of 10s, got %v %v", ttl, ok)
+	}
+
+	now += int64(5 * time.Second)
+	if v, _ := c.Get("a"); v != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+	select {
+	case <-loaded:
+		t.Error("The entry should not be refreshed before 80% of its TTL")
+	default:
+	}
+
+	now += int64(4 * time.Second)
+	if v, _ := c.Get("a"); v != 1 {
+		t.Errorf("Expected the current value while refreshing, got %v", v)
+	}
+	if key := <-loaded; key != "a" {
+		t.Errorf("Expected a to be refreshed, got %v", key)
+	}
+	for i := 0; i < 100; i++ {
+		if ttl, _ := c.TTL("a"); ttl == 10*time.Second {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, _ := c.Get("a"); v != 2 {
+		t.Errorf("Expected the refreshed value 2, got %v", v)
+	}
+
+	c.SetWithTTL("b", 1, time.Second)
+	now += int64(2 * time.Second)
+	if c.Has("b") || len(c.Keys()) != 1 {
+		t.Error("An expired entry should be missing")
+	}
+	if n := c.Cleanup(); n != 1 || c.Len() != 1 {
+		t.Errorf("Expected 1 expired entry removed, got %d", n)
+	}
+}
+
+func TestExpiredEntriesAreMissing(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[string, int]()
+	expire := func() {
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			c.SetWithTTL(k, 10, time.Second)
+		}
+		now += int64(2 * time.Second)
+	}
+	expire()
+
+	if v := Add(c, "a", 1); v != 1 {
+		t.Errorf("Add should start an expired counter from 0, got %d", v)
+	}
+	if !c.SetIfNotExists("b", 2) {
+		t.Error("SetIfNotExists should set an expired key")
+	}
+	if v, _ := c.Get("b"); v != 2 {
+		t.Errorf("Expected 2, got %d", v)
+	}
+	c.Update("c", func(old int, exists bool) int {
+		if exists || old != 0 {
+			t.Errorf("Update should see an expired key as missing, got %d %v", old, exists)
+		}
+		return 3
+	})
+	if _, ok := c.GetAndDelete("d"); ok {
+		t.Error("GetAndDelete should not return an expired entry")
+	}
+	if c.Len() != 4 {
+		t.Errorf("GetAndDelete should remove the expired entry, got %d entries", c.Len())
+	}
+	c.WithLock(func(tx Accessor[string, int]) {
+		if _, ok := tx.Get("e"); ok {
+			t.Error("The accessor should not return an expired entry")
+		}
+		tx.Range(func(key string, value int) bool {
+			if key == "e" {
+				t.Error("The accessor should not range over an expired entry")
+			}
+			return true
+		})
+	})
+	if c.Any(func(key string, value int) bool { return key == "e" }) {
+		t.Error("Any should skip expired entries")
+	}
+	match, rest := c.Partition(func(key string, value int) bool { return true })
+	if match.Has("e") || rest.Len() != 0 {
+		t.Error("Partition should skip expired entries")
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	loaded := make(chan struct{})
+	c := New[string, int]().WithLoader(func(ctx context.Context, key string) (int, error) {
+		defer close(loaded)
+		return 2, nil
+	}).WithStaleFor(time.Minute)
+	c.SetWithTTL("a", 1, time.Second)
+	if v, stale, ok := c.GetStale("a"); v != 1 || stale || !ok {
+		t.Errorf("Expected a fresh 1, got %v %v %v", v, stale, ok)
+	}
+
+	now += int64(2 * time.Second)
+	if c.Cleanup() != 0 {
+		t.Error("The janitor should keep stale entries")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("Get should not return an expired entry")
+	}
+	if v, stale, ok := c.GetStale("a"); v != 1 || !stale || !ok {
+		t.Errorf("Expected a stale 1, got %v %v %v", v, stale, ok)
+	}
+	<-loaded
+	for i := 0; i < 100; i++ {
+		if _, ok := c.Get("a"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, _ := c.Get("a"); v != 2 {
+		t.Errorf("Expected the reloaded value 2, got %v", v)
+	}
+	if _, _, ok := c.GetStale("b"); ok {
+		t.Error("A missing key should not be found")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[string, string](1)
+	c.SetWithTTL("session", "data", time.Minute)
+	rev, size := c.Revision("session"), c.Size()
+	now += int64(50 * time.Second)
+	if !c.Touch("session", time.Minute) {
+		t.Fatal("Touch should find the entry")
+	}
+	now += int64(50 * time.Second)
+	if v, ok := c.Get("session"); !ok || v != "data" {
+		t.Errorf("Expected the touched entry to be alive, got %v %v", v, ok)
+	}
+	if c.Revision("session") != rev || c.Size() != size {
+		t.Error("Touch should not rewrite the value")
+	}
+	if !c.Touch("session", 0) {
+		t.Fatal("Touch should find the entry")
+	}
+	if ttl, ok := c.TTL("session"); !ok || ttl != 0 {
+		t.Errorf("Expected no TTL, got %v", ttl)
+	}
+	c.SetWithTTL("gone", "x", time.Second)
+	now += int64(2 * time.Second)
+	if c.Touch("gone", time.Minute) || c.Touch("missing", time.Minute) {
+		t.Error("Touch should not revive expired or missing entries")
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[string, int]().WithSlidingExpiration()
+	c.SetWithTTL("a", 1, time.Minute)
+	c.SetWithTTL("b", 2, time.Minute)
+	for i := 0; i < 3; i++ {
+		now += int64(50 * time.Second)
+		if _, ok := c.Get("a"); !ok {
+			t.Fatalf("Expected a to stay alive while read, read %d", i)
+		}
+	}
+	if c.Has("b") {
+		t.Error("Expected b to expire without reads")
+	}
+	if ttl, _ := c.TTL("a"); ttl != time.Minute {
+		t.Errorf("Expected the TTL of a to restart, got %v", ttl)
+	}
+	now += int64(2 * time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to expire once idle")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[string, int]().WithIdleTimeout(30 * time.Minute)
+	c.Set("read", 1)
+	c.Set("forgotten", 2)
+	c.SetWithTTL("ttl", 3, time.Hour)
+	now += int64(20 * time.Minute)
+	c.Get("read")
+	c.Has("ttl")
+	now += int64(20 * time.Minute)
+	if n := c.Cleanup(); n != 2 {
+		t.Errorf("Expected 2 idle entries removed, got %d", n)
+	}
+	if !reflect.DeepEqual(c.Keys(), []string{"read"}) {
+		t.Errorf("Expected only the read entry to remain, got %v", c.Keys())
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	c := New[int, int]().WithTTLJitter(0.1)
+	ttls := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		c.SetWithTTL(i, i, time.Hour)
+		ttl, ok := c.TTL(i)
+		if !ok || ttl < 54*time.Minute || ttl > 66*time.Minute {
+			t.Fatalf("Expected a TTL within 10%% of an hour, got %v", ttl)
+		}
+		ttls[ttl.Round(time.Second)] = true
+	}
+	if len(ttls) < 10 {
+		t.Errorf("Expected spread TTLs, got %d distinct values", len(ttls))
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[int, int]()
+	for i := 0; i < 10; i++ {
+		c.SetWithTTL(i, i, time.Duration(i+1)*time.Second)
+	}
+	now += int64(5 * time.Second)
+	if n := c.Cleanup(); n != 5 || c.Len() != 5 {
+		t.Errorf("Expected 5 entries removed, got %d", n)
+	}
+	now += int64(time.Minute)
+	c.Cleanup()
+	st := c.CleanupStats()
+	if st.Runs != 2 || st.Removed != 10 || st.LastRemoved != 5 || st.LastRun.IsZero() {
+		t.Errorf("Unexpected cleanup stats %+v", st)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	c := New[string, int]().WithDefaultTTL(time.Minute)
+	c.Set("a", 1)
+	c.SetMany(map[string]int{"b": 2})
+	c.SetWithTTL("c", 3, time.Hour)
+	for key, want := range map[string]time.Duration{"a": time.Minute, "b": time.Minute, "c": time.Hour} {
+		if ttl, ok := c.TTL(key); !ok || ttl <= want-time.Second || ttl > want {
+			t.Errorf("Expected a TTL of %v for %s, got %v", want, key, ttl)
+		}
+	}
+}
+
+func TestSetWithExpiry(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	c := New[string, int]().WithDefaultTTL(time.Minute).WithTTLJitter(0.5)
+	at := time.Unix(0, now).Add(time.Hour)
+	c.SetWithExpiry("a", 1, at)
+	c.SetWithExpiry("b", 2, time.Time{})
+	c.SetWithExpiry("c", 3, time.Unix(0, now).Add(-time.Second))
+	if ttl, ok := c.TTL("a"); !ok || ttl != time.Hour {
+		t.Errorf("Expected a TTL of exactly 1h without jitter, got %v", ttl)
+	}
+	if ttl, ok := c.TTL("b"); !ok || ttl != 0 {
+		t.Errorf("Expected no TTL despite the default one, got %v", ttl)
+	}
+	if _, ok := c.Get("c"); ok {
+		t.Error("An entry set with a past expiry should read as missing")
+	}
+	now = at.UnixNano()
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a to expire at its absolute time")
+	}
+}
+
+func TestInterning(t *testing.T) {
+	c := New[string, string]().WithInterning()
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprint("user", i), strings.Repeat("Mozilla", 1+i%2))
+	}
+	if n := c.InternedStrings(); n != 102 {
+		t.Errorf("Expected 100 keys and 2 values interned, got %d", n)
+	}
+	a, _ := c.Get("user0")
+	b, _ := c.Get("user2")
+	if unsafe.StringData(a) != unsafe.StringData(b) {
+		t.Error("Identical values should share their bytes")
+	}
+	for i := 0; i < 100; i += 2 {
+		c.Delete(fmt.Sprint("user", i))
+	}
+	c.Set("user1", "other")
+	if n := c.InternedStrings(); n != 52 {
+		t.Errorf("Expected 50 keys and 2 values interned, got %d", n)
+	}
+	c.Flush()
+	if n := c.InternedStrings(); n != 0 {
+		t.Errorf("Expected no interned strings after Flush, got %d", n)
+	}
+}
+
+func TestArena(t *testing.T) {
+	type user struct {
+		Name string
+		Tags []string
+	}
+	c := New[int, user]().WithArena()
+	for i := 0; i < 1000; i++ {
+		c.Set(i, user{Name: fmt.Sprint("user", i), Tags: []string{"a", "b"}})
+	}
+	if v, ok := c.Get(42); !ok || !reflect.DeepEqual(v, user{Name: "user42", Tags: []string{"a", "b"}}) {
+		t.Errorf("Expected user42, got %v", v)
+	}
+	snap := c.Snapshot()
+
+	// Rewriting the values enough times compacts the chunks
+	big := strings.Repeat("x", 1000)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			c.Set(i, user{Name: big, Tags: []string{fmt.Sprint(round)}})
+		}
+	}
+	if c.arena.garbage > c.arena.live || c.arena.live != 1000*len(`{"Name":"`+big+`","Tags":["4"]}`) {
+		t.Errorf("Expected the arena to be compacted, got %d live and %d garbage bytes", c.arena.live, c.arena.garbage)
+	}
+	if v, _ := c.Get(999); v.Tags[0] != "4" {
+		t.Errorf("Expected the last round, got %v", v.Tags)
+	}
+	if v, _ := snap.Get(42); v.Name != "user42" {
+		t.Errorf("The snapshot should keep its values, got %v", v.Name)
+	}
+	c.Delete(0)
+	if c.Has(0) || c.Len() != 999 {
+		t.Error("Expected 0 to be deleted")
+	}
+}
+
+func TestEachKey(t *testing.T) {
+	c := New[int, int]()
+	m := NewOrdered[int, int]()
+	for i := 0; i < 5; i++ {
+		c.Set(i, i*10)
+		m.Set(i, i*10)
+	}
+	sum := 0
+	c.EachValue(func(v int) bool {
+		sum += v
+		return true
+	})
+	if sum != 100 {
+		t.Errorf("Expected 100, got %d", sum)
+	}
+	var keys []int
+	m.EachKey(func(k int) bool {
+		keys = append(keys, k)
+		return k < 2
+	})
+	if !reflect.DeepEqual(keys, []int{0, 1, 2}) {
+		t.Errorf("Expected the iteration to stop at 2, got %v", keys)
+	}
+	buf := make([]int, 0, 16)
+	buf = c.AppendKeys(buf[:0])
+	sort.Ints(buf)
+	if !reflect.DeepEqual(buf, []int{0, 1, 2, 3, 4}) || cap(buf) != 16 {
+		t.Errorf("Expected the keys in the given buffer, got %v", buf)
+	}
+	if got := m.AppendKeys([]int{-1}); !reflect.DeepEqual(got, []int{-1, 0, 1, 2, 3, 4}) {
+		t.Errorf("Expected the keys appended in order, got %v", got)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	m := NewOrdered[string, int]()
+	m.Set("b", 2)
+	m.Set("a", 1)
+	if got := m.Entries(); !reflect.DeepEqual(got, []Entry[string, int]{{"b", 2}, {"a", 1}}) {
+		t.Errorf("Expected the entries in order, got %v", got)
+	}
+	s := NewSorted[string, int]()
+	s.Set("b", 2)
+	s.Set("a", 1)
+	if got := s.Entries(); !reflect.DeepEqual(got, []Entry[string, int]{{"a", 1}, {"b", 2}}) {
+		t.Errorf("Expected the entries sorted, got %v", got)
+	}
+	c := New[string, int]()
+	c.Set("a", 1)
+	c.Set("b", 2)
+	got := c.Entries()
+	sort.Slice(got, func(i, j int) bool { return got[i].Key < got[j].Key })
+	if !reflect.DeepEqual(got, []Entry[string, int]{{"a", 1}, {"b", 2}}) {
+		t.Errorf("Unexpected entries %v", got)
+	}
+}
+
+func TestParallelMapValues(t *testing.T) {
+	c := New[int, int]()
+	for i := 0; i < 1000; i++ {
+		c.Set(i, i)
+	}
+	squares := ParallelMapValues(c, 4, func(k, v int) string { return fmt.Sprint(v * v) })
+	if v, _ := squares.Get(12); squares.Len() != 1000 || v != "144" {
+		t.Errorf("Expected 1000 squares, got %d and %v", squares.Len(), v)
+	}
+	even := ParallelFilter(c, 0, func(k, v int) bool { return v%2 == 0 })
+	if even.Len() != 500 || !even.Has(998) || even.Has(999) {
+		t.Errorf("Expected the 500 even values, got %d", even.Len())
+	}
+	if ParallelFilter(New[int, int](), 4, func(k, v int) bool { return true }).Len() != 0 {
+		t.Error("Expected an empty map")
+	}
+
+	c.SetWithTTL(1000, 1000, time.Hour)
+	c.SetWithTTL(1002, 1002, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	even = ParallelFilter(c, 4, func(k, v int) bool { return v%2 == 0 })
+	if ttl, ok := even.TTL(1000); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("ParallelFilter should keep the TTL, got %v %v", ttl, ok)
+	}
+	if even.Len() != 501 {
+		t.Errorf("ParallelFilter should leave expired entries out, got %d entries", even.Len())
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	m := NewOrdered[string, int]()
+	for i, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		m.Set(name, i)
+	}
+	p := m.Pipe().
+		Filter(func(k string, v int) bool { return v%2 == 1 }).
+		Map(func(k string, v int) int { return v * 10 }).
+		SortBy(func(a, b Entry[string, int]) bool { return a.Value > b.Value }).
+		Take(2)
+	want := []Entry[string, int]{{"f", 50}, {"d", 30}}
+	if got := p.Collect(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	m.Set("g", 7)
+	if got := p.Collect(); got[0].Key != "g" {
+		t.Errorf("Expected the pipeline to run over fresh entries, got %v", got)
+	}
+	labels := PipeMap(m.Pipe().Take(2), func(k string, v int) string { return fmt.Sprint(k, "=", v) }).Collect()
+	if !reflect.DeepEqual(labels, []Entry[string, string]{{"a", "a=0"}, {"b", "b=1"}}) {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if got := m.Values(); got[1] != 1 {
+		t.Error("The pipeline should not change the map")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "kmap_test_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	c := New[int, string]()
+	for i := 0; i < 5; i++ {
+		c.Set(i, fmt.Sprint("v", i))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/cache/", c.Handler(AdminOptions{Path: filepath.Join(tmpDir, "cache.kmap")}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method, path string, into any) int {
+		req, _ := http.NewRequest(method, srv.URL+"/debug/cache/"+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if into != nil {
+			json.NewDecoder(resp.Body).Decode(into)
+		}
+		return resp.StatusCode
+	}
+
+	var keys struct {
+		Total int
+		Keys  []string
+	}
+	if do("GET", "keys?offset=1&limit=2", &keys); keys.Total != 5 || !reflect.DeepEqual(keys.Keys, []string{"1", "2"}) {
+		t.Errorf("Unexpected keys page %+v", keys)
+	}
+	var entry struct{ Key, Value string }
+	if do("GET", "key?key=3", &entry); entry.Value != "v3" {
+		t.Errorf("Expected v3, got %+v", entry)
+	}
+	if status := do("GET", "key?key=9", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+	if status := do("GET", "key?key=x", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad key, got %d", status)
+	}
+	if status := do("POST", "save", nil); status != http.StatusNoContent {
+		t.Errorf("Expected the map to be saved, got %d", status)
+	}
+	if status := do("DELETE", "key?key=3", nil); status != http.StatusNoContent || c.Has(3) {
+		t.Errorf("Expected 3 to be deleted, got %d", status)
+	}
+	if status := do("POST", "load", nil); status != http.StatusNoContent || !c.Has(3) {
+		t.Errorf("Expected the map to be loaded, got %d", status)
+	}
+	var stats map[string]any
+	if do("GET", "stats", &stats); stats["len"] != float64(5) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestRESTHandler(t *testing.T) {
+	type user struct{ Name string }
+	c := New[string, user]()
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	srv := httptest.NewServer(http.StripPrefix("/users", RESTHandler(c, RESTOptions{Middleware: auth})))
+	defer srv.Close()
+
+	do := func(method, path, body string, into any) int {
+		req, _ := http.NewRequest(method, srv.URL+"/users"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if into != nil {
+			json.NewDecoder(resp.Body).Decode(into)
+		}
+		return resp.StatusCode
+	}
+
+	for _, name := range []string{"ann", "bob", "alice"} {
+		if status := do("PUT", "/"+name, `{"Name":"`+name+`"}`, nil); status != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", status)
+		}
+	}
+	var u user
+	if do("GET", "/bob", "", &u); u.Name != "bob" {
+		t.Errorf("Expected bob, got %+v", u)
+	}
+	var list struct {
+		Total int
+		Items []struct {
+			Key   string
+			Value user
+		}
+	}
+	if do("GET", "/?prefix=a&limit=1&offset=1", "", &list); list.Total != 2 || len(list.Items) != 1 || list.Items[0].Key != "ann" {
+		t.Errorf("Unexpected list %+v", list)
+	}
+	if status := do("PUT", "/bad", `{`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", status)
+	}
+	if status := do("DELETE", "/bob", "", nil); status != http.StatusNoContent || c.Has("bob") {
+		t.Errorf("Expected bob to be deleted, got %d", status)
+	}
+	if status := do("GET", "/bob", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+	resp, err := http.Get(srv.URL + "/users/ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the middleware to reject the request, got %d", resp.StatusCode)
+	}
+}
+
+func TestChangesHandler(t *testing.T) {
+	c := New[string, int]()
+	srv := httptest.NewServer(c.ChangesHandler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+
+	c.Set("a", 1)
+	c.Delete("a")
+	want := "id: 1\nevent: set\ndata: {\"key\":\"a\",\"value\":1}\n\nid: 2\nevent: delete\ndata: {\"key\":\"a\"}\n\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestServeMemcached(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	m := New[string, MemcachedItem]()
+	go ServeMemcached(l, m)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	expect := func(cmd string, want ...string) {
+		t.Helper()
+		fmt.Fprint(conn, cmd)
+		for _, w := range want {
+			line, err := r.ReadString('\n')
+			if err != nil || line != w+"\r\n" {
+				t.Fatalf("%q: got %q %v, want %q", cmd, line, err, w)
+			}
+		}
+	}
+
+	expect("set a 0 0 5\r\nhello\r\n", "STORED")
+	expect("set b 4294967295 60 2 noreply\r\nhi\r\n")
+	expect("get a b c\r\n", "VALUE a 0 5", "hello", "VALUE b 4294967295 2", "hi", "END")
+	if v, _ := m.Get("b"); v.Flags != 4294967295 || string(v.Data) != "hi" {
+		t.Fatalf("got %+v, want the flags and the data", v)
+	}
+	m.Set("go", MemcachedItem{Flags: 7, Data: []byte("set from Go")})
+	expect("get go\r\n", "VALUE go 7 11", "set from Go", "END")
+	if ttl, _ := m.TTL("b"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("got ttl %v", ttl)
+	}
+	expect("delete a\r\n", "DELETED")
+	expect("delete a\r\n", "NOT_FOUND")
+	expect("bogus\r\n", "ERROR")
+	expect("set c 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk")
+
+	for _, size := range []string{"9223372036854775807", "1048577"} {
+		conn, err = net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		r = bufio.NewReader(conn)
+		expect("set big 0 0 "+size+"\r\n", "SERVER_ERROR object too large for cache")
+		if _, err := r.ReadString('\n'); err != io.EOF {
+			t.Fatalf("got %v, want the connection closed", err)
+		}
+	}
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	expect("flush_all\r\n", "OK")
+	if m.Len() != 0 {
+		t.Fatalf("got %d entries after flush_all", m.Len())
+	}
+	fmt.Fprint(conn, "stats\r\n")
+	stats := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		f := strings.Fields(line)
+		stats[f[1]] = f[2]
+	}
+	if stats["get_hits"] != "3" || stats["get_misses"] != "1" || stats["cmd_set"] != "2" || stats["curr_items"] != "0" {
+		t.Fatalf("got %v", stats)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	leader := New[string, int]()
+	leader.Set("a", 1)
+	leader.Set("b", 2)
+	go leader.ServeReplication(l)
+
+	follower := New[string, int]()
+	follower.Set("stale", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go follower.Follow(ctx, l.Addr().String(), FollowOptions{RetryInterval: 10 * time.Millisecond})
+
+	waitFor := func(want map[string]int) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+			if reflect.DeepEqual(follower.ToMap(), want) {
+				return
+			}
+		}
+		t.Fatalf("got %v, want %v", follower.ToMap(), want)
+	}
+	waitFor(map[string]int{"a": 1, "b": 2})
+
+	leader.Set("c", 3)
+	leader.Delete("a")
+	waitFor(map[string]int{"b": 2, "c": 3})
+	leader.Flush()
+	leader.Set("d", 4)
+	waitFor(map[string]int{"d": 4})
+
+	// Loads are not changes, the followers catch up from a new snapshot
+	saved := New[string, int]()
+	saved.Set("e", 5)
+	path := filepath.Join(t.TempDir(), "saved.kmap")
+	if err := saved.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(map[string]int{"e": 5})
+}
+
+func TestSharedMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.kmap")
+	w, err := CreateShared[int](path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := CreateShared[int](path, 4096); !errors.Is(err, ErrSharedWriter) {
+		t.Fatalf("got %v, want ErrSharedWriter", err)
+	}
+	r, err := OpenShared[int](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := w.SetMany(map[string]int{"a": 1, "b": 2, "c": 3}); err != nil {
+		t.Fatal(err)
+	}
+	w.Delete("b")
+	if v, ok := r.Get("a"); !ok || v != 1 {
+		t.Fatalf("got %v %v", v, ok)
+	}
+	if r.Has("b") || r.Len() != 2 {
+		t.Fatalf("got %v %d", r.Has("b"), r.Len())
+	}
+	if err := r.Set("d", 4); !errors.Is(err, ErrSharedReadOnly) {
+		t.Fatalf("got %v, want ErrSharedReadOnly", err)
+	}
+
+	// Rewriting a key many times fills the heap with garbage, which is compacted
+	for i := 0; i < 1000; i++ {
+		if err := w.Set("counter", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, ok := r.Get("counter"); !ok || v != 999 {
+		t.Fatalf("got %v %v", v, ok)
+	}
+	keys := r.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "c", "counter"}) {
+		t.Fatalf("got %v", keys)
+	}
+
+	err = nil
+	for i := 0; err == nil && i < 1000; i++ {
+		err = w.Set(getKey(i), i)
+	}
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("got %v, want ErrLimitExceeded", err)
+	}
+	if v, ok := r.Get("a"); !ok || v != 1 {
+		t.Fatalf("got %v %v", v, ok)
+	}
+
+	// Recreating the map while it is still mapped leaves the readers on the previous file
+	w.Close()
+	w2, err := CreateShared[int](path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if v, ok := r.Get("a"); !ok || v != 1 {
+		t.Fatalf("got %v %v from the previous file", v, ok)
+	}
+	r2, err := OpenShared[int](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if r2.Len() != 0 {
+		t.Fatalf("got %d keys in the new file", r2.Len())
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("got leftover files %v", matches)
+	}
+}
+
+func TestServeIPC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmap.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	m := New[string, int]()
+	go m.ServeIPC(l)
+
+	client, err := DialIPC[string, int](path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := client.Get("a"); err != nil || !ok || v != 1 {
+		t.Fatalf("got %v %v %v", v, ok, err)
+	}
+	if _, ok, err := client.Get("missing"); err != nil || ok {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	if ok, err := client.Delete("b"); err != nil || !ok {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	keys, err := client.Keys()
+	if err != nil || !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatalf("got %v %v", keys, err)
+	}
+
+	want := []Event[string, int]{{Kind: EventSet, Key: "a", Value: 1}, {Kind: EventSet, Key: "b", Value: 2}, {Kind: EventDelete, Key: "b"}}
+	for _, w := range want {
+		if e := <-events; e != w {
+			t.Fatalf("got %+v, want %+v", e, w)
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+// recordLogger is a Logger keeping the messages logged at each level
+type recordLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) add(level, msg string, args ...any) {
+	l.mu.Lock()
+	l.logs = append(l.logs, level+" "+msg+" "+fmt.Sprint(args...))
+	l.mu.Unlock()
+}
+
+func (l *recordLogger) Debug(msg string, args ...any) { l.add("DEBUG", msg, args...) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.add("INFO", msg, args...) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.add("WARN", msg, args...) }
+func (l *recordLogger) Error(msg string, args ...any) { l.add("ERROR", msg, args...) }
+
+func TestEventLogger(t *testing.T) {
+	log := &recordLogger{}
+	m := New[string, string](1).WithEventLogger(log)
+	big := strings.Repeat("x", 600*1024)
+	m.Set("a", big)
+	if err := m.Set("b", big); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("got %v", err)
+	}
+	m.WithEvictToFit()
+	m.Set("b", big)
+	m.Cleanup()
+	<-m.SaveToFileAsync(filepath.Join(t.TempDir(), "missing", "\x00")).Done
+
+	want := []string{"WARN kmap: value rejected", "INFO kmap: entries evicted", "DEBUG kmap: cleanup", "ERROR kmap: asynchronous save failed"}
+	if len(log.logs) != len(want) {
+		t.Fatalf("got %q", log.logs)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(log.logs[i], w) {
+			t.Errorf("got %q, want %q", log.logs[i], w)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	now := time.Now().UnixNano()
+	clock := nowNano
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = clock }()
+
+	m := New[string, string]()
+	m.Set("b", strings.Repeat("x", 100))
+	m.SetWithTTL("a", "short", time.Minute)
+	var buf bytes.Buffer
+	if err := m.Dump(&buf, DumpOptions{MaxValueLen: 10, Sorted: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "SafeMap len=2 size=0B limit=none\n" +
+		"  \"a\" = \"short\"  (size=5B rev=2 ttl=1m0s)\n" +
+		"  \"b\" = \"xxxxxxxxx...(102 bytes)  (size=100B rev=1)\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	o := NewOrdered[int, int]()
+	for i := 0; i < 30; i++ {
+		o.Set(30-i, i)
+	}
+	lines := strings.Split(strings.TrimSpace(o.String()), "\n")
+	if len(lines) != 22 || lines[1] != "  30 = 0  (size=8B rev=1)" || lines[21] != "  ... 10 more" {
+		t.Fatalf("got %q", lines)
+	}
+}
+
+func TestYAML(t *testing.T) {
+	type server struct {
+		Host  string   `json:"host"`
+		Port  int      `json:"port"`
+		Tags  []string `json:"tags"`
+		Notes string   `json:"notes,omitempty"`
+	}
+	m := NewOrdered[string, server]()
+	m.Set("web", server{Host: "example.com", Port: 8080, Tags: []string{"front", "yes"}, Notes: "line one\nline two\n"})
+	m.Set("db: primary", server{Host: "", Port: 5432})
+	var buf bytes.Buffer
+	if err := m.ExportYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `web:
+  host: example.com
+  port: 8080
+  tags:
+    - front
+    - "yes"
+  notes: |
+    line one
+    line two
+"db: primary":
+  host: ""
+  port: 5432
+  tags: null
+`
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	back := NewOrdered[string, server]()
+	if err := back.ImportYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Entries(), m.Entries()) {
+		t.Fatalf("got %+v", back.Entries())
+	}
+
+	doc := `%YAML 1.2
+---
+# edited by hand
+b: {host: 'it''s', port: 0x10, tags: [a, "b c", 'd']}   # flow
+a:
+  host: >-
+    folded
+    text
+  tags:
+  - x # comment
+  -
+c:
+...
+ignored: true
+`
+	s := New[string, server]()
+	if err := s.ImportYAML(strings.NewReader(doc)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("b"); v.Host != "it's" || v.Port != 16 || !reflect.DeepEqual(v.Tags, []string{"a", "b c", "d"}) {
+		t.Fatalf("got %+v", v)
+	}
+	if v, _ := s.Get("a"); v.Host != "folded text" || !reflect.DeepEqual(v.Tags, []string{"x", ""}) {
+		t.Fatalf("got %+v", v)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("got %d entries", s.Len())
+	}
+	for _, bad := range []string{"a: &x 1", "a:\n\tb: 1", "- a", "a: [1,\n  2]", "a: 1\n   b: 2"} {
+		if err := s.ImportYAML(strings.NewReader(bad)); !errors.Is(err, ErrYAML) {
+			t.Fatalf("%q: got %v", bad, err)
+		}
+	}
+}
+
+func TestExportTOML(t *testing.T) {
+	type backend struct {
+		URL    string         `json:"url"`
+		Weight int            `json:"weight"`
+		Meta   map[string]any `json:"meta,omitempty"`
+	}
+	type settings struct {
+		Name     string    `json:"name"`
+		Ratio    float64   `json:"ratio"`
+		Enabled  bool      `json:"enabled"`
+		Ports    []int     `json:"ports"`
+		Backends []backend `json:"backends"`
+		Limits   struct {
+			Max int `json:"max"`
+		} `json:"limits"`
+		Parent *settings `json:"parent"`
+	}
+	m := New[string, any]()
+	m.Set("version", 3)
+	m.Set("owner name", "ops \"team\"\n")
+	s := settings{Name: "api", Ratio: 0.5, Enabled: true, Ports: []int{80, 443}}
+	s.Backends = []backend{{URL: "http://a", Weight: 1, Meta: map[string]any{"zone": "eu"}}, {URL: "http://b", Weight: 2}}
+	s.Limits.Max = 10
+	m.Set("service", s)
+	m.Set("mixed", []any{1, "a", map[string]any{"b": true, "c": nil}})
+
+	var buf bytes.Buffer
+	if err := ExportTOML(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	want := `mixed = [1, "a", { b = true }]
+"owner name" = "ops \"team\"\n"
+version = 3
+
+[service]
+name = "api"
+ratio = 0.5
+enabled = true
+ports = [80, 443]
+
+[[service.backends]]
+url = "http://a"
+weight = 1
+
+[service.backends.meta]
+zone = "eu"
+
+[[service.backends]]
+url = "http://b"
+weight = 2
+
+[service.limits]
+max = 10
+`
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	m.Set("bad", []any{nil})
+	if err := ExportTOML(&buf, m); !errors.Is(err, ErrTOML) {
+		t.Fatalf("got %v, want ErrTOML", err)
+	}
+}
+
+func TestJSONL(t *testing.T) {
+	m := NewOrdered[int, []string]()
+	m.Set(2, []string{"a<b"})
+	m.Set(1, nil)
+	var buf bytes.Buffer
+	if err := m.ExportJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"key\":2,\"value\":[\"a<b\"]}\n{\"key\":1,\"value\":null}\n"; buf.String() != want {
+		t.Fatalf("got %q", buf.String())
+	}
+	back := NewOrdered[int, []string]()
+	if err := back.ImportJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Entries(), m.Entries()) {
+		t.Fatalf("got %v", back.Entries())
+	}
+
+	var lines strings.Builder
+	for i := 0; i < 2*jsonlBatch+1; i++ {
+		fmt.Fprintf(&lines, "{\"key\":\"k%d\",\"value\":%d}\n", i, i)
+	}
+	s := New[string, int]()
+	if err := s.ImportJSONL(strings.NewReader(lines.String())); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("k2048"); s.Len() != 2*jsonlBatch+1 || v != 2048 {
+		t.Fatalf("got %d entries, k2048=%d", s.Len(), v)
+	}
+	if err := s.ImportJSONL(strings.NewReader("{\"key\":\"x\",\"value\":1}\n{\"value\":2}\n")); !errors.Is(err, ErrInvalidFormat) {
+		t.Fatalf("got %v, want ErrInvalidFormat", err)
+	}
+	if v, _ := s.Get("x"); v != 1 {
+		t.Fatalf("got x=%d, the entries before the error should be set", v)
+	}
+
+	s.SetWithTTL("gone", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	buf.Reset()
+	if err := s.ExportJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := New[string, int]()
+	if err := exported.ImportJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if exported.Has("gone") || exported.Len() != s.Len()-1 || !reflect.DeepEqual(exported.ToMap(), s.ToMap()) {
+		t.Fatalf("got %d entries, want the %d live ones", exported.Len(), s.Len()-1)
+	}
+}
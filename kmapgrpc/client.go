@@ -0,0 +1,159 @@
+package kmapgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/kamalshkeir/kmap/kmapgrpc/kmappb"
+	"google.golang.org/grpc"
+)
+
+// ClientOptions configures NewClient
+type ClientOptions struct {
+	// VirtualNodes is the number of points of each server on the hash ring, 100 by default.
+	// More points spread the keys more evenly.
+	VirtualNodes int
+	// Replicas is the number of servers holding each key, 1 by default
+	Replicas int
+}
+
+// Client routes Get, Set and Delete across several servers (see Register) by consistent hashing,
+// so a sharded cache tier is made of plain kmap processes: adding or removing a server only moves
+// the keys of its neighbours on the ring. Each key is written to Replicas servers and read from the first one answering.
+type Client[V any] struct {
+	servers  map[string]kmappb.KmapClient
+	ring     []ringPoint
+	replicas int
+}
+
+// ringPoint is a virtual node, a point of a server on the hash ring
+type ringPoint struct {
+	hash   uint64
+	server string
+}
+
+// NewClient returns a client of the servers, keyed by their address (or any stable name, it places them on the ring).
+// Connections are created by the caller with grpc.NewClient and closed by the caller.
+func NewClient[V any](servers map[string]grpc.ClientConnInterface, opts ...ClientOptions) *Client[V] {
+	var o ClientOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.VirtualNodes <= 0 {
+		o.VirtualNodes = 100
+	}
+	if o.Replicas <= 0 {
+		o.Replicas = 1
+	}
+	if o.Replicas > len(servers) {
+		o.Replicas = len(servers)
+	}
+	c := &Client[V]{servers: make(map[string]kmappb.KmapClient, len(servers)), replicas: o.Replicas}
+	for name, conn := range servers {
+		c.servers[name] = kmappb.NewKmapClient(conn)
+		for i := 0; i < o.VirtualNodes; i++ {
+			c.ring = append(c.ring, ringPoint{hash: ringHash(name + "#" + strconv.Itoa(i)), server: name})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool {
+		if c.ring[i].hash != c.ring[j].hash {
+			return c.ring[i].hash < c.ring[j].hash
+		}
+		return c.ring[i].server < c.ring[j].server
+	})
+	return c
+}
+
+// ringHash places a key or a virtual node on the ring. It must be the same in every process,
+// FNV-1a is finalized with splitmix64 since it barely changes the high bits of short similar names.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Servers returns the servers holding key, the first one is read first
+func (c *Client[V]) Servers(key string) []string {
+	if len(c.ring) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	servers := make([]string, 0, c.replicas)
+	for i := 0; len(servers) < c.replicas && i < len(c.ring); i++ {
+		p := c.ring[(start+i)%len(c.ring)]
+		if !contains(servers, p.server) {
+			servers = append(servers, p.server)
+		}
+	}
+	return servers
+}
+
+// contains reports whether s holds v
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the value of key from the first of its servers answering, the error is returned
+// when none of them does
+func (c *Client[V]) Get(ctx context.Context, key string) (v V, ok bool, err error) {
+	for _, name := range c.Servers(key) {
+		res, e := c.servers[name].Get(ctx, &kmappb.GetRequest{Key: key})
+		if e != nil {
+			err = e
+			continue
+		}
+		if !res.GetFound() {
+			return v, false, nil
+		}
+		if err := json.Unmarshal(res.GetValue(), &v); err != nil {
+			return v, false, err
+		}
+		return v, true, nil
+	}
+	return v, false, err
+}
+
+// Set sets key to value on each of its servers, the errors of the servers which failed are joined
+func (c *Client[V]) Set(ctx context.Context, key string, value V) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range c.Servers(key) {
+		if _, err := c.servers[name].Set(ctx, &kmappb.SetRequest{Key: key, Value: data}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delete removes key from each of its servers, deleted is true when it was found on one of them
+func (c *Client[V]) Delete(ctx context.Context, key string) (deleted bool, err error) {
+	var errs []error
+	for _, name := range c.Servers(key) {
+		res, err := c.servers[name].Delete(ctx, &kmappb.DeleteRequest{Key: key})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted = deleted || res.GetDeleted()
+	}
+	return deleted, errors.Join(errs...)
+}
@@ -0,0 +1,124 @@
+// Package kmapgrpc serves a kmap over gRPC, with the typed contract of kmap.proto, so non-Go clients
+// and sidecars can access the map of a process over the network.
+package kmapgrpc
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/kamalshkeir/kmap/kmapgrpc --go-grpc_out=. --go-grpc_opt=module=github.com/kamalshkeir/kmap/kmapgrpc kmap.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/kamalshkeir/kmap"
+	"github.com/kamalshkeir/kmap/kmapgrpc/kmappb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements the Kmap service over a SafeMap, values are exchanged as JSON documents
+type Server[V any] struct {
+	kmappb.UnimplementedKmapServer
+	m *kmap.SafeMap[string, V]
+}
+
+// NewServer returns the Kmap service backed by m
+func NewServer[V any](m *kmap.SafeMap[string, V]) *Server[V] {
+	return &Server[V]{m: m}
+}
+
+// Register registers the Kmap service backed by m on s
+func Register[V any](s grpc.ServiceRegistrar, m *kmap.SafeMap[string, V]) {
+	kmappb.RegisterKmapServer(s, NewServer(m))
+}
+
+// Get returns the JSON value of a key, Found is false when it is missing
+func (s *Server[V]) Get(ctx context.Context, req *kmappb.GetRequest) (*kmappb.GetResponse, error) {
+	v, ok := s.m.Get(req.GetKey())
+	if !ok {
+		return &kmappb.GetResponse{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &kmappb.GetResponse{Value: data, Found: true}, nil
+}
+
+// Set decodes the JSON value of the request and sets it, InvalidArgument is returned when it does not decode to V
+// and ResourceExhausted when it does not fit in the map
+func (s *Server[V]) Set(ctx context.Context, req *kmappb.SetRequest) (*kmappb.SetResponse, error) {
+	var v V
+	if err := json.Unmarshal(req.GetValue(), &v); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.m.Set(req.GetKey(), v); err != nil {
+		if errors.Is(err, kmap.ErrLargeData) || errors.Is(err, kmap.ErrLimitExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &kmappb.SetResponse{}, nil
+}
+
+// Delete removes a key, Deleted is false when it was missing
+func (s *Server[V]) Delete(ctx context.Context, req *kmappb.DeleteRequest) (*kmappb.DeleteResponse, error) {
+	_, ok := s.m.GetAndDelete(req.GetKey())
+	return &kmappb.DeleteResponse{Deleted: ok}, nil
+}
+
+// Range streams the entries whose key starts with the prefix of the request, in no particular order
+func (s *Server[V]) Range(req *kmappb.RangeRequest, stream kmappb.Kmap_RangeServer) error {
+	var err error
+	s.m.Range(func(key string, value V) bool {
+		if !strings.HasPrefix(key, req.GetPrefix()) {
+			return true
+		}
+		var data []byte
+		if data, err = json.Marshal(value); err != nil {
+			err = status.Error(codes.Internal, err.Error())
+			return false
+		}
+		err = stream.Send(&kmappb.Entry{Key: key, Value: data})
+		return err == nil
+	})
+	return err
+}
+
+// Watch streams the changes of the keys starting with the prefix of the request, and every flush,
+// until the client cancels the call, see kmap.SafeMap.Changes
+func (s *Server[V]) Watch(req *kmappb.WatchRequest, stream kmappb.Kmap_WatchServer) error {
+	changes := s.m.ChangesCtx(stream.Context())
+	// Headers tell the client that no later change will be missed
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for ch := range changes {
+		if ch.Kind != kmap.EventFlush && !strings.HasPrefix(ch.Key, req.GetPrefix()) {
+			continue
+		}
+		msg := &kmappb.Change{Seq: ch.Seq, Key: ch.Key}
+		switch ch.Kind {
+		case kmap.EventSet:
+			msg.Kind = kmappb.Change_KIND_SET
+			data, err := json.Marshal(ch.Value)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			msg.Value = data
+		case kmap.EventDelete:
+			msg.Kind = kmappb.Change_KIND_DELETE
+		case kmap.EventFlush:
+			msg.Kind = kmappb.Change_KIND_FLUSH
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+	if err := stream.Context().Err(); err != nil {
+		return err
+	}
+	// The stream was closed by the map, see kmap.BufferClose
+	return status.Error(codes.Aborted, "kmap: the stream of changes was closed, reload and watch again")
+}
@@ -0,0 +1,142 @@
+package kmapgrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/kamalshkeir/kmap"
+	"github.com/kamalshkeir/kmap/kmapgrpc/kmappb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serve serves m on an in-memory listener and returns a connection to it
+func serve(t *testing.T, m *kmap.SafeMap[string, int]) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	Register(srv, m)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServer(t *testing.T) {
+	m := kmap.New[string, int]()
+	conn := serve(t, m)
+	client := kmappb.NewKmapClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch, err := client.Watch(ctx, &kmappb.WatchRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first change is only sent once the subscription exists
+	if _, err := watch.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Set(ctx, &kmappb.SetRequest{Key: "user:1", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Set(ctx, &kmappb.SetRequest{Key: "other", Value: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Set(ctx, &kmappb.SetRequest{Key: "user:2", Value: []byte(`"x"`)}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want InvalidArgument", err)
+	}
+
+	res, err := client.Get(ctx, &kmappb.GetRequest{Key: "user:1"})
+	if err != nil || !res.Found || string(res.Value) != "1" {
+		t.Fatalf("got %v %v", res, err)
+	}
+	if res, err := client.Get(ctx, &kmappb.GetRequest{Key: "missing"}); err != nil || res.Found {
+		t.Fatalf("got %v %v", res, err)
+	}
+
+	rng, err := client.Range(ctx, &kmappb.RangeRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		e, err := rng.Recv()
+		if err != nil {
+			break
+		}
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 1 || keys[0] != "user:1" {
+		t.Fatalf("got %v", keys)
+	}
+
+	if res, err := client.Delete(ctx, &kmappb.DeleteRequest{Key: "user:1"}); err != nil || !res.Deleted {
+		t.Fatalf("got %v %v", res, err)
+	}
+
+	set, err := watch.Recv()
+	if err != nil || set.Kind != kmappb.Change_KIND_SET || set.Key != "user:1" || string(set.Value) != "1" {
+		t.Fatalf("got %v %v", set, err)
+	}
+	del, err := watch.Recv()
+	if err != nil || del.Kind != kmappb.Change_KIND_DELETE || del.Key != "user:1" {
+		t.Fatalf("got %v %v", del, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	maps := map[string]*kmap.SafeMap[string, int]{}
+	conns := map[string]grpc.ClientConnInterface{}
+	for _, name := range []string{"a", "b", "c"} {
+		maps[name] = kmap.New[string, int]()
+		conns[name] = serve(t, maps[name])
+	}
+	client := NewClient[int](conns, ClientOptions{Replicas: 2})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := client.Set(ctx, fmt.Sprint("key", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total := 0
+	for name, m := range maps {
+		if m.Len() == 0 || m.Len() == 100 {
+			t.Fatalf("server %s holds %d keys", name, m.Len())
+		}
+		total += m.Len()
+	}
+	if total != 200 {
+		t.Fatalf("got %d copies, want 200", total)
+	}
+
+	servers := client.Servers("key7")
+	if len(servers) != 2 || servers[0] == servers[1] {
+		t.Fatalf("got %v", servers)
+	}
+	// Reads stop at the first server answering, even without the key
+	maps[servers[0]].Delete("key7")
+	if v, ok, err := client.Get(ctx, "key7"); err != nil || ok {
+		t.Fatalf("got %v %v %v, the first server answers", v, ok, err)
+	}
+	if deleted, err := client.Delete(ctx, "key7"); err != nil || !deleted {
+		t.Fatalf("got %v %v", deleted, err)
+	}
+	if v, ok, err := client.Get(ctx, "key8"); err != nil || !ok || v != 8 {
+		t.Fatalf("got %v %v %v", v, ok, err)
+	}
+}
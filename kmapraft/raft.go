@@ -0,0 +1,230 @@
+// Package kmapraft replicates a kmap with Raft, so a small cluster agrees on every write: Set and Delete
+// return once a majority of the nodes committed them, which suits coordination data like feature flags and leases.
+// The transport and the stores of Raft are pluggable, see Config.
+package kmapraft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/kamalshkeir/kmap"
+)
+
+// Config configures New
+type Config struct {
+	// ID identifies the node in the cluster
+	ID raft.ServerID
+	// Transport connects the node to the others, raft.NewTCPTransport or raft.NewInmemTransport for instance
+	Transport raft.Transport
+	// Raft tunes the timeouts of Raft, raft.DefaultConfig() when nil. Its LocalID is set to ID.
+	Raft *raft.Config
+	// LogStore, StableStore and SnapshotStore keep the state of Raft, in memory when nil:
+	// such a node must then join the cluster again after a restart
+	LogStore      raft.LogStore
+	StableStore   raft.StableStore
+	SnapshotStore raft.SnapshotStore
+	// ApplyTimeout bounds how long Set and Delete wait for their commit, 5s by default
+	ApplyTimeout time.Duration
+}
+
+// Map is a SafeMap replicated by Raft: writes go through the log of the cluster and are applied to the SafeMap
+// of every node in the same order. Writes must be made on the leader, ErrNotLeader is returned elsewhere.
+type Map[K comparable, V any] struct {
+	m       *kmap.SafeMap[K, V]
+	raft    *raft.Raft
+	timeout time.Duration
+}
+
+// ErrNotLeader is returned by the writes and linearizable reads made on a node which is not the leader
+var ErrNotLeader = raft.ErrNotLeader
+
+// New starts a Raft node applying the log of the cluster to m, which must not be written to directly.
+// A new cluster is created by calling Bootstrap on one of its nodes.
+// Every node must apply the log to the same content, so m must not evict entries to fit (see SafeMap.WithEvictToFit):
+// each node would evict different ones. Expiry times are computed by the leader, the TTL jitter of m is not applied,
+// while sliding expiration and idle timeouts, which depend on the reads of each node, are not supported.
+func New[K comparable, V any](m *kmap.SafeMap[K, V], cfg Config) (*Map[K, V], error) {
+	if cfg.Transport == nil {
+		return nil, errors.New("kmapraft: a transport is required")
+	}
+	if m.EvictsToFit() {
+		return nil, errors.New("kmapraft: a map evicting to fit cannot be replicated, nodes would evict different entries")
+	}
+	conf := raft.DefaultConfig()
+	if cfg.Raft != nil {
+		c := *cfg.Raft
+		conf = &c
+	}
+	conf.LocalID = cfg.ID
+	if cfg.LogStore == nil {
+		cfg.LogStore = raft.NewInmemStore()
+	}
+	if cfg.StableStore == nil {
+		cfg.StableStore = raft.NewInmemStore()
+	}
+	if cfg.SnapshotStore == nil {
+		cfg.SnapshotStore = raft.NewInmemSnapshotStore()
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = 5 * time.Second
+	}
+	r, err := raft.NewRaft(conf, &fsm[K, V]{m: m}, cfg.LogStore, cfg.StableStore, cfg.SnapshotStore, cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &Map[K, V]{m: m, raft: r, timeout: cfg.ApplyTimeout}, nil
+}
+
+// Bootstrap creates a new cluster made of servers, it must be called once on a single node
+func (r *Map[K, V]) Bootstrap(servers ...raft.Server) error {
+	return r.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+}
+
+// Raft returns the underlying Raft node, to add or remove servers or find the leader
+func (r *Map[K, V]) Raft() *raft.Raft {
+	return r.raft
+}
+
+// Shutdown stops the node, the SafeMap keeps its content
+func (r *Map[K, V]) Shutdown() error {
+	return r.raft.Shutdown().Error()
+}
+
+// Set sets key to value in the whole cluster, it returns once the write is committed and applied on this node.
+// The key gets the default TTL of the map of this node, see SafeMap.WithDefaultTTL.
+// The error of the Set of the SafeMap, ErrLimitExceeded for instance, is returned as is,
+// the map is then unchanged on every node using the same limit.
+func (r *Map[K, V]) Set(key K, value V) error {
+	return r.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL is Set with a TTL of ttl, or the default TTL when ttl <= 0. The expiry time is computed here,
+// so every node expires key at the same instant of their clocks, even when they apply the write late or replay it.
+func (r *Map[K, V]) SetWithTTL(key K, value V, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = r.m.DefaultTTL()
+	}
+	cmd := command[K]{Op: opSet, Key: key, Value: data}
+	if ttl > 0 {
+		cmd.Expires = time.Now().Add(ttl).UnixNano()
+	}
+	return r.apply(cmd)
+}
+
+// Delete removes key in the whole cluster, it returns once the write is committed and applied on this node
+func (r *Map[K, V]) Delete(key K) error {
+	return r.apply(command[K]{Op: opDelete, Key: key})
+}
+
+// Get returns the value of key on this node, which may lag behind the leader, see GetLinearizable
+func (r *Map[K, V]) Get(key K) (V, bool) {
+	return r.m.Get(key)
+}
+
+// GetLinearizable returns the value of key once this node confirmed it is still the leader and applied
+// every committed write, so it reflects every Set and Delete which returned before it was called.
+func (r *Map[K, V]) GetLinearizable(key K) (v V, ok bool, err error) {
+	if err := r.raft.VerifyLeader().Error(); err != nil {
+		return v, false, err
+	}
+	if err := r.raft.Barrier(r.timeout).Error(); err != nil {
+		return v, false, err
+	}
+	v, ok = r.m.Get(key)
+	return v, ok, nil
+}
+
+// apply commits cmd and returns the error of applying it
+func (r *Map[K, V]) apply(cmd command[K]) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	f := r.raft.Apply(data, r.timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+// command is an entry of the Raft log
+type command[K comparable] struct {
+	Op    string          `json:"op"`
+	Key   K               `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// Expires is the absolute expiry time of a set in Unix nanoseconds, 0 when the key never expires
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// fsm applies the Raft log to a SafeMap
+type fsm[K comparable, V any] struct {
+	m *kmap.SafeMap[K, V]
+}
+
+// Apply applies a committed command, its error is the response of the log entry
+func (f *fsm[K, V]) Apply(l *raft.Log) interface{} {
+	var cmd command[K]
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case opSet:
+		var v V
+		if err := json.Unmarshal(cmd.Value, &v); err != nil {
+			return err
+		}
+		// The clock of the leader decided the expiry, applying it as is keeps the nodes identical
+		var at time.Time
+		if cmd.Expires != 0 {
+			at = time.Unix(0, cmd.Expires)
+		}
+		return f.m.SetWithExpiry(cmd.Key, v, at)
+	case opDelete:
+		f.m.Delete(cmd.Key)
+		return nil
+	}
+	return fmt.Errorf("kmapraft: unknown command %q", cmd.Op)
+}
+
+// Snapshot takes a point-in-time copy of the map, written later by Persist without blocking Apply
+func (f *fsm[K, V]) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot[K, V]{m: f.m.Snapshot()}, nil
+}
+
+// Restore replaces the content of the map with a snapshot written by Persist
+func (f *fsm[K, V]) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	return f.m.LoadFrom(rc)
+}
+
+// fsmSnapshot is a snapshot of the map taken by fsm.Snapshot
+type fsmSnapshot[K comparable, V any] struct {
+	m *kmap.SafeMap[K, V]
+}
+
+// Persist writes the snapshot in the file format of kmap
+func (s *fsmSnapshot[K, V]) Persist(sink raft.SnapshotSink) error {
+	if err := s.m.SaveTo(sink, kmap.SaveOptions{}); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot[K, V]) Release() {}
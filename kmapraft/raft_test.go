@@ -0,0 +1,107 @@
+package kmapraft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/kamalshkeir/kmap"
+)
+
+func TestCluster(t *testing.T) {
+	const n = 3
+	nodes := make([]*Map[string, int], n)
+	transports := make([]*raft.InmemTransport, n)
+	servers := make([]raft.Server, n)
+	for i := range nodes {
+		id := raft.ServerID(fmt.Sprint("node", i))
+		addr, trans := raft.NewInmemTransport(raft.ServerAddress(id))
+		transports[i] = trans
+		servers[i] = raft.Server{ID: id, Address: addr}
+	}
+	for i, a := range transports {
+		for j, b := range transports {
+			if i != j {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+	for i := range nodes {
+		conf := raft.DefaultConfig()
+		conf.LogOutput = io.Discard
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		node, err := New(kmap.New[string, int]().WithTTLJitter(0.5), Config{ID: servers[i].ID, Transport: transports[i], Raft: conf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Shutdown()
+		nodes[i] = node
+	}
+	if err := nodes[0].Bootstrap(servers...); err != nil {
+		t.Fatal(err)
+	}
+
+	var leader *Map[string, int]
+	for start := time.Now(); leader == nil && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for _, node := range nodes {
+			if node.Raft().State() == raft.Leader {
+				leader = node
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+
+	if err := leader.Set("flag", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Set("lease", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Delete("lease"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.SetWithTTL("session", 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := leader.GetLinearizable("flag"); err != nil || !ok || v != 1 {
+		t.Fatalf("got %v %v %v", v, ok, err)
+	}
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		if err := node.Set("x", 0); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("got %v, want ErrNotLeader", err)
+		}
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			v, ok := node.Get("flag")
+			_, lease := node.Get("lease")
+			ttl, session := node.m.TTL("session")
+			if ok && v == 1 && !lease && session {
+				// Without jitter, the expiry of the leader is applied as is
+				if ttl <= 50*time.Second || ttl > time.Minute {
+					t.Fatalf("follower got a TTL of %v", ttl)
+				}
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("follower got %v %v %v", v, ok, lease)
+			}
+		}
+	}
+}
+
+func TestNewRejectsEviction(t *testing.T) {
+	_, trans := raft.NewInmemTransport("node")
+	m := kmap.New[string, int](1).WithEvictToFit()
+	if _, err := New(m, Config{ID: "node", Transport: trans}); err == nil {
+		t.Fatal("a map evicting to fit should be rejected")
+	}
+}
@@ -0,0 +1,164 @@
+package kmap
+
+import "sort"
+
+// EvictPolicy selects which entries are removed to make room, see WithEvictToFit and SetLimit
+type EvictPolicy uint8
+
+const (
+	// EvictDefault removes entries in no particular order from a SafeMap and oldest first from an OrderedMap
+	EvictDefault EvictPolicy = iota
+	// EvictLargest removes the largest entries first, freeing the space with the fewest evictions
+	EvictLargest
+)
+
+// WithEvictToFit makes Set evict entries following policy (EvictDefault when omitted) until the new value fits,
+// instead of returning ErrLimitExceeded. Values larger than the whole limit still return ErrLargeData.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithEvictToFit(policy ...EvictPolicy) *SafeMap[K, V] {
+	c.Lock()
+	c.evictToFitSet = true
+	if len(policy) > 0 {
+		c.evictPolicy = policy[0]
+	}
+	c.unlock()
+	return c
+}
+
+// EvictsToFit reports whether Set evicts entries to make room instead of returning ErrLimitExceeded, see WithEvictToFit
+func (c *SafeMap[K, V]) EvictsToFit() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.evictToFitSet
+}
+
+// WithEvictToFit makes Set evict entries following policy (EvictDefault when omitted) until the new value fits,
+// instead of returning ErrLimitExceeded. Values larger than the whole limit still return ErrLargeData.
+// It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithEvictToFit(policy ...EvictPolicy) *OrderedMap[K, V] {
+	m.Lock()
+	m.evictToFitSet = true
+	if len(policy) > 0 {
+		m.evictPolicy = policy[0]
+	}
+	m.unlock()
+	return m
+}
+
+// SetLimit changes the size limit of the SafeMap to limitMb megabytes at runtime, limitMb <= 0 removes the limit.
+// Unlimited maps do not measure their values, so setting a limit on one measures every value first.
+// When the map holds more than the new limit, entries are kept unless evict is true:
+// they are then removed following the eviction policy until the map fits, and the number of removed entries is returned.
+func (c *SafeMap[K, V]) SetLimit(limitMb int, evict ...bool) int {
+	c.Lock()
+	defer c.unlock()
+
+	limit := -1
+	if limitMb > 0 {
+		limit = limitMb * 1024 * 1024
+	}
+	if c.limit <= 0 && limit > 0 {
+		c.measureAll()
+	}
+	c.limit = limit
+	if limit <= 0 || len(evict) == 0 || !evict[0] {
+		return 0
+	}
+	return c.evictToFit(0, nil)
+}
+
+// measureAll recomputes the size of every value kept in memory, the write lock must be held
+func (c *SafeMap[K, V]) measureAll() {
+	c.own()
+	for k, i := range c.items {
+		if i.spill != "" {
+			continue
+		}
+		c.size -= i.Size
+		i.Size = c.valueSize(c.value(i))
+		c.size += i.Size
+		c.items[k] = i
+	}
+}
+
+// evictToFit removes entries not kept by keep (which may be nil) following the eviction policy until need more bytes fit under the limit
+// and returns how many were removed, the write lock must be held.
+// Spilled values do not count toward the limit and are never evicted.
+func (c *SafeMap[K, V]) evictToFit(need int, keep func(K) bool) int {
+	if c.size+need <= c.limit {
+		return 0
+	}
+	keys := make([]K, 0, len(c.items))
+	for k, i := range c.items {
+		if i.spill == "" && (keep == nil || !keep(k)) {
+			keys = append(keys, k)
+		}
+	}
+	if c.evictPolicy == EvictLargest {
+		sort.Slice(keys, func(a, b int) bool { return c.items[keys[a]].Size > c.items[keys[b]].Size })
+	}
+	n := 0
+	for _, k := range keys {
+		if c.size+need <= c.limit {
+			break
+		}
+		c.remove(k)
+		n++
+	}
+	if n > 0 {
+		c.log.info("kmap: entries evicted", "removed", n, "need", need, "limit", c.limit)
+	}
+	return n
+}
+
+// SetLimit changes the size limit of the OrderedMap to limitMb megabytes at runtime, limitMb <= 0 removes the limit.
+// Unlimited maps do not measure their values, so setting a limit on one measures every value first.
+// When the map holds more than the new limit, entries are kept unless evict is true:
+// they are then removed following the eviction policy until the map fits, and the number of removed entries is returned.
+func (m *OrderedMap[K, V]) SetLimit(limitMb int, evict ...bool) int {
+	m.Lock()
+	defer m.unlock()
+
+	limit := -1
+	if limitMb > 0 {
+		limit = limitMb * 1024 * 1024
+	}
+	if m.limit <= 0 && limit > 0 {
+		m.size = 0
+		for el := m.ll.Front(); el != nil; el = el.Next() {
+			el.size = m.valueSize(el.Value)
+			m.size += el.size
+		}
+	}
+	m.limit = limit
+	if limit <= 0 || len(evict) == 0 || !evict[0] {
+		return 0
+	}
+	return m.evictToFit(0, nil)
+}
+
+// evictToFit removes entries not kept by keep (which may be nil) following the eviction policy until need more bytes fit under the limit
+// and returns how many were removed, the write lock must be held
+func (m *OrderedMap[K, V]) evictToFit(need int, keep func(K) bool) int {
+	if m.size+need <= m.limit {
+		return 0
+	}
+	victims := make([]*Element[K, V], 0, len(m.kv))
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		if keep == nil || !keep(el.Key) {
+			victims = append(victims, el)
+		}
+	}
+	if m.evictPolicy == EvictLargest {
+		sort.SliceStable(victims, func(a, b int) bool { return victims[a].size > victims[b].size })
+	}
+	n := 0
+	for _, el := range victims {
+		if m.size+need <= m.limit {
+			break
+		}
+		m.remove(el.Key)
+		n++
+	}
+	return n
+}
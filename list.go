@@ -5,6 +5,8 @@ type Element[K comparable, V any] struct {
 	Key        K
 	Value      V
 	size       int
+	// rev is the seq of the last change of the element, see GetWithRevision
+	rev uint64
 }
 
 func (e *Element[K, V]) Next() *Element[K, V] {
@@ -73,3 +75,91 @@ func (l *list[K, V]) PushBack(key K, value V) *Element[K, V] {
 	l.root.prev = e
 	return e
 }
+
+// InsertBefore links e, which must not be in the list, right before mark
+func (l *list[K, V]) InsertBefore(e, mark *Element[K, V]) {
+	e.next = mark
+	e.prev = mark.prev
+	if mark.prev == nil {
+		l.root.next = e
+	} else {
+		mark.prev.next = e
+	}
+	mark.prev = e
+}
+
+// InsertAfter links e, which must not be in the list, right after mark
+func (l *list[K, V]) InsertAfter(e, mark *Element[K, V]) {
+	e.prev = mark
+	e.next = mark.next
+	if mark.next == nil {
+		l.root.prev = e
+	} else {
+		mark.next.prev = e
+	}
+	mark.next = e
+}
+
+// Sort reorders the list with a stable merge sort of the links, without moving or allocating elements
+func (l *list[K, V]) Sort(less func(a, b *Element[K, V]) bool) {
+	head := mergeSort(l.root.next, less)
+	var prev *Element[K, V]
+	for e := head; e != nil; e = e.next {
+		e.prev = prev
+		prev = e
+	}
+	l.root.next = head
+	l.root.prev = prev
+}
+
+// mergeSort sorts the chain of next links starting at head and returns its new head, prev links are not maintained
+func mergeSort[K comparable, V any](head *Element[K, V], less func(a, b *Element[K, V]) bool) *Element[K, V] {
+	if head == nil || head.next == nil {
+		return head
+	}
+	// Split in the middle, fast moves twice as fast as slow
+	slow, fast := head, head.next
+	for fast != nil && fast.next != nil {
+		slow = slow.next
+		fast = fast.next.next
+	}
+	second := slow.next
+	slow.next = nil
+	a, b := mergeSort(head, less), mergeSort(second, less)
+
+	var merged Element[K, V]
+	tail := &merged
+	for a != nil && b != nil {
+		// Taking from a unless b is strictly less keeps the sort stable
+		if less(b, a) {
+			tail.next, b = b, b.next
+		} else {
+			tail.next, a = a, a.next
+		}
+		tail = tail.next
+	}
+	if a != nil {
+		tail.next = a
+	} else {
+		tail.next = b
+	}
+	return merged.next
+}
+
+// Reverse flips the order of the list by swapping the links of every element
+func (l *list[K, V]) Reverse() {
+	for e := l.root.next; e != nil; e = e.prev {
+		e.next, e.prev = e.prev, e.next
+	}
+	l.root.next, l.root.prev = l.root.prev, l.root.next
+}
+
+// MoveToBack moves e, which must be in the list, to its back
+func (l *list[K, V]) MoveToBack(e *Element[K, V]) {
+	back := l.root.prev
+	if back == e {
+		return
+	}
+	l.Remove(e)
+	l.InsertAfter(e, back)
+}
@@ -0,0 +1,56 @@
+package kmap
+
+// Logger receives the notable events of a map with structured fields (alternating keys and values),
+// *slog.Logger implements it, see WithLogger
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// eventLog reports events to an optional Logger
+type eventLog struct {
+	l Logger
+}
+
+func (e *eventLog) debug(msg string, args ...any) {
+	if e.l != nil {
+		e.l.Debug(msg, args...)
+	}
+}
+
+func (e *eventLog) info(msg string, args ...any) {
+	if e.l != nil {
+		e.l.Info(msg, args...)
+	}
+}
+
+func (e *eventLog) warn(msg string, args ...any) {
+	if e.l != nil {
+		e.l.Warn(msg, args...)
+	}
+}
+
+func (e *eventLog) error(msg string, args ...any) {
+	if e.l != nil {
+		e.l.Error(msg, args...)
+	}
+}
+
+// WithEventLogger makes the SafeMap log its notable events to l, which is mostly useful for the failures of
+// background goroutines that are otherwise only visible by polling result structs:
+//
+//	Info   evictions made to fit new values, with the number of entries removed
+//	Warn   values rejected by the limit (ErrLargeData, ErrLimitExceeded), failed reloads of WithRefreshAhead
+//	Error  failed writes of the backend, of WithWriter and of the asynchronous saves and loads
+//	Debug  sweeps of the janitor, with the number of entries removed and their duration
+//
+// l may be called while the lock of the map is held, it must not use the map. See WithLogger for log/slog.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithEventLogger(l Logger) *SafeMap[K, V] {
+	c.Lock()
+	c.log.l = l
+	c.Unlock()
+	return c
+}
@@ -0,0 +1,14 @@
+//go:build go1.21
+
+package kmap
+
+import "log/slog"
+
+// WithLogger makes the SafeMap log its notable events to l with structured fields, see WithEventLogger.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithLogger(l *slog.Logger) *SafeMap[K, V] {
+	if l == nil {
+		return c.WithEventLogger(nil)
+	}
+	return c.WithEventLogger(l)
+}
@@ -0,0 +1,82 @@
+package kmap
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CompileGlob compiles a glob pattern matching whole keys: * matches any sequence of characters, separators included,
+// ? matches a single character and [...] a character class, other characters match themselves
+func CompileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// KeysMatching returns the keys of c matching the glob pattern (see CompileGlob), like user:123:*
+func KeysMatching[V any](c *SafeMap[string, V], pattern string) ([]string, error) {
+	re, err := CompileGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return KeysMatchingRegexp(c, re), nil
+}
+
+// DeleteMatching removes the keys of c matching the glob pattern (see CompileGlob) under a single lock
+// and returns how many were removed, to invalidate a namespace of keys like user:123:*
+func DeleteMatching[V any](c *SafeMap[string, V], pattern string) (int, error) {
+	re, err := CompileGlob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	return DeleteMatchingRegexp(c, re), nil
+}
+
+// KeysMatchingRegexp returns the keys of c matched by re, expired keys are skipped like in Keys
+func KeysMatchingRegexp[V any](c *SafeMap[string, V], re *regexp.Regexp) []string {
+	c.RLock()
+	defer c.RUnlock()
+	var keys []string
+	for k, i := range c.items {
+		if i.live() && re.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// DeleteMatchingRegexp removes the keys of c matched by re under a single lock and returns how many were removed
+func DeleteMatchingRegexp[V any](c *SafeMap[string, V], re *regexp.Regexp) int {
+	c.Lock()
+	defer c.unlock()
+	n := 0
+	for k := range c.items {
+		if re.MatchString(k) && c.remove(k) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,231 @@
+package kmap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memcachedMaxKey is the longest key accepted by memcached
+const memcachedMaxKey = 250
+
+// memcachedMaxItem is the largest data block accepted by set, the default item size limit of memcached.
+// Larger blocks are refused before they are allocated and the connection is closed, since it cannot resync.
+const memcachedMaxItem = 1 << 20
+
+// memcachedRelative is the largest expiration time taken as a number of seconds, above it is a Unix time
+const memcachedRelative = 60 * 60 * 24 * 30
+
+// ServeMemcached serves c with the memcached text protocol on l until l is closed, so a small memcached instance
+// can be replaced by an embedded kmap, persisted with SaveToFile or a backend like any other map.
+// The commands are get (with several keys), set, delete, flush_all, stats, version and quit, with noreply.
+// Expiration times use SetWithTTL, run a janitor to remove expired entries (see StartJanitor).
+// The data of each key is stored with its flags in a MemcachedItem.
+// Like http.Serve, it always returns a non-nil error, the one of l.Accept.
+func ServeMemcached(l net.Listener, c *SafeMap[string, MemcachedItem]) error {
+	s := &memcached{c: c, start: time.Now()}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// MemcachedItem is a value stored by ServeMemcached: the data block of set with the flags sent along
+type MemcachedItem struct {
+	Flags uint32
+	Data  []byte
+}
+
+// memcached is the state shared by the connections of ServeMemcached
+type memcached struct {
+	c     *SafeMap[string, MemcachedItem]
+	start time.Time
+
+	conns, totalConns        atomic.Int64
+	cmdGet, cmdSet, cmdFlush atomic.Int64
+	hits, misses             atomic.Int64
+}
+
+// serve answers the commands of conn until it is closed or sends quit
+func (s *memcached) serve(conn net.Conn) {
+	defer conn.Close()
+	s.conns.Add(1)
+	s.totalConns.Add(1)
+	defer s.conns.Add(-1)
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := s.command(fields, r, w); err != nil {
+			// The data block could not be read, the connection is out of sync
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// command answers the command of fields to w, the data block of set is read from r.
+// An error is only returned when the connection must be closed.
+func (s *memcached) command(fields []string, r *bufio.Reader, w io.Writer) error {
+	if fields[0] != "get" && len(fields) > 1 && fields[len(fields)-1] == "noreply" {
+		fields = fields[:len(fields)-1]
+		w = io.Discard
+	}
+	switch fields[0] {
+	case "get":
+		if len(fields) < 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return nil
+		}
+		for _, key := range fields[1:] {
+			s.cmdGet.Add(1)
+			v, ok := s.c.Get(key)
+			if !ok {
+				s.misses.Add(1)
+				continue
+			}
+			s.hits.Add(1)
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, v.Flags, len(v.Data))
+			w.Write(v.Data)
+			fmt.Fprint(w, "\r\n")
+		}
+		fmt.Fprint(w, "END\r\n")
+	case "set":
+		return s.set(fields, r, w)
+	case "delete":
+		if len(fields) != 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if _, ok := s.c.GetAndDelete(fields[1]); ok {
+			fmt.Fprint(w, "DELETED\r\n")
+		} else {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+		}
+	case "flush_all":
+		s.cmdFlush.Add(1)
+		delay := 0
+		if len(fields) > 1 {
+			delay, _ = strconv.Atoi(fields[1])
+		}
+		if delay > 0 {
+			time.AfterFunc(time.Duration(delay)*time.Second, s.c.Flush)
+		} else {
+			s.c.Flush()
+		}
+		fmt.Fprint(w, "OK\r\n")
+	case "stats":
+		s.stats(w)
+	case "version":
+		fmt.Fprint(w, "VERSION kmap\r\n")
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+// set answers set <key> <flags> <exptime> <bytes>, reading the data block from r
+func (s *memcached) set(fields []string, r *bufio.Reader, w io.Writer) error {
+	if len(fields) != 5 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return nil
+	}
+	key := fields[1]
+	flags, errFlags := strconv.ParseUint(fields[2], 10, 32)
+	exptime, errExp := strconv.ParseInt(fields[3], 10, 64)
+	n, errLen := strconv.Atoi(fields[4])
+	if errLen != nil || n < 0 {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return errors.New("kmap: memcached data block of unknown length")
+	}
+	if n > memcachedMaxItem {
+		fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+		return errors.New("kmap: memcached data block too large")
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[n:]) != "\r\n" {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return errors.New("kmap: memcached data block not terminated")
+	}
+	if errFlags != nil || errExp != nil || len(key) > memcachedMaxKey {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	s.cmdSet.Add(1)
+
+	var ttl time.Duration
+	switch {
+	case exptime < 0:
+		// Expired right away, like memcached
+		s.c.Delete(key)
+		fmt.Fprint(w, "STORED\r\n")
+		return nil
+	case exptime > memcachedRelative:
+		ttl = time.Until(time.Unix(exptime, 0))
+		if ttl <= 0 {
+			s.c.Delete(key)
+			fmt.Fprint(w, "STORED\r\n")
+			return nil
+		}
+	default:
+		ttl = time.Duration(exptime) * time.Second
+	}
+	if err := s.c.SetWithTTL(key, MemcachedItem{Flags: uint32(flags), Data: data[:n:n]}, ttl); err != nil {
+		if errors.Is(err, ErrLargeData) {
+			fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+		} else {
+			fmt.Fprint(w, "SERVER_ERROR out of memory storing object\r\n")
+		}
+		return nil
+	}
+	fmt.Fprint(w, "STORED\r\n")
+	return nil
+}
+
+// stats answers the stats command with the counters memcached clients and dashboards read the most
+func (s *memcached) stats(w io.Writer) {
+	now := time.Now()
+	stat := func(name string, value any) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.start)/time.Second))
+	stat("time", now.Unix())
+	stat("version", "kmap")
+	stat("curr_connections", s.conns.Load())
+	stat("total_connections", s.totalConns.Load())
+	stat("cmd_get", s.cmdGet.Load())
+	stat("cmd_set", s.cmdSet.Load())
+	stat("cmd_flush", s.cmdFlush.Load())
+	stat("get_hits", s.hits.Load())
+	stat("get_misses", s.misses.Load())
+	stat("curr_items", s.c.Len())
+	stat("bytes", s.c.Size())
+	stat("limit_maxbytes", s.c.Limit())
+	fmt.Fprint(w, "END\r\n")
+}
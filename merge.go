@@ -0,0 +1,33 @@
+package kmap
+
+// KeepMine is a Merge strategy keeping the value of the map being merged into
+func KeepMine[K comparable, V any](key K, mine, theirs V) V {
+	return mine
+}
+
+// KeepTheirs is a Merge strategy keeping the value of the other map
+func KeepTheirs[K comparable, V any](key K, mine, theirs V) V {
+	return theirs
+}
+
+// Merge copies every entry of other into the SafeMap, resolve picks the value of keys present in both
+// (KeepTheirs when nil, see also KeepMine). other is copied before locking the map, so maps can be merged into each other
+// concurrently without deadlocking. The merge is atomic: when the result does not fit in the limit,
+// ErrLargeData or ErrLimitExceeded is returned and the map is left untouched, like SetMany.
+func (c *SafeMap[K, V]) Merge(other *SafeMap[K, V], resolve func(key K, mine, theirs V) V) error {
+	if other == nil || other == c {
+		return nil
+	}
+	theirs := other.ToMap()
+
+	c.Lock()
+	defer c.unlock()
+	if resolve != nil {
+		for k, v := range theirs {
+			if i, ok := c.items[k]; ok {
+				theirs[k] = resolve(k, c.value(i), v)
+			}
+		}
+	}
+	return c.apply(theirs, nil)
+}
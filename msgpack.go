@@ -0,0 +1,450 @@
+package kmap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Minimal MessagePack (https://github.com/msgpack/msgpack/blob/master/spec.md) support for EncodingMsgpack.
+// Values are marshaled to JSON by marshalValue and transcoded from and to JSON here, the timestamp extension is decoded as an RFC 3339 string like time.Time in JSON.
+
+var errMsgpackType = errors.New("unexpected msgpack type")
+
+type msgpackEncoder struct {
+	w   *bufio.Writer
+	buf [9]byte
+	err error
+}
+
+func newMsgpackEncoder(w io.Writer) *msgpackEncoder {
+	return &msgpackEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *msgpackEncoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// writeSized writes the prefix byte followed by v as a big endian integer of n bytes
+func (e *msgpackEncoder) writeSized(prefix byte, v uint64, n int) {
+	e.buf[0] = prefix
+	for i := n; i > 0; i-- {
+		e.buf[i] = byte(v)
+		v >>= 8
+	}
+	e.write(e.buf[:n+1])
+}
+
+// writeLen writes a length using the fix form when it fits, then the 8, 16 or 32 bits forms (prefix8 may be 0 when absent)
+func (e *msgpackEncoder) writeLen(n int, fix byte, fixMax int, prefix8, prefix16, prefix32 byte) {
+	switch {
+	case n <= fixMax:
+		e.write([]byte{fix | byte(n)})
+	case prefix8 != 0 && n <= math.MaxUint8:
+		e.writeSized(prefix8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.writeSized(prefix16, uint64(n), 2)
+	default:
+		e.writeSized(prefix32, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	e.writeLen(n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	e.writeLen(n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func (e *msgpackEncoder) string(s string) {
+	e.writeLen(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0:
+		e.uint(uint64(v))
+	case v >= -32:
+		e.write([]byte{byte(v)})
+	case v >= math.MinInt8:
+		e.writeSized(0xd0, uint64(v), 1)
+	case v >= math.MinInt16:
+		e.writeSized(0xd1, uint64(v), 2)
+	case v >= math.MinInt32:
+		e.writeSized(0xd2, uint64(v), 4)
+	default:
+		e.writeSized(0xd3, uint64(v), 8)
+	}
+}
+
+func (e *msgpackEncoder) uint(v uint64) {
+	switch {
+	case v <= math.MaxInt8:
+		e.write([]byte{byte(v)})
+	case v <= math.MaxUint8:
+		e.writeSized(0xcc, v, 1)
+	case v <= math.MaxUint16:
+		e.writeSized(0xcd, v, 2)
+	case v <= math.MaxUint32:
+		e.writeSized(0xce, v, 4)
+	default:
+		e.writeSized(0xcf, v, 8)
+	}
+}
+
+func (e *msgpackEncoder) bool(v bool) {
+	if v {
+		e.write([]byte{0xc3})
+	} else {
+		e.write([]byte{0xc2})
+	}
+}
+
+// value transcodes a JSON value
+func (e *msgpackEncoder) value(data []byte) {
+	if e.err != nil {
+		return
+	}
+	v, err := parseJSON(data)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.parsed(v)
+}
+
+// parsed writes a value returned by parseJSON
+func (e *msgpackEncoder) parsed(v any) {
+	switch v := v.(type) {
+	case nil:
+		e.write([]byte{0xc0})
+	case bool:
+		e.bool(v)
+	case string:
+		e.string(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.int(i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			e.uint(u)
+		} else if f, err := v.Float64(); err == nil {
+			e.writeSized(0xcb, math.Float64bits(f), 8)
+		} else if e.err == nil {
+			e.err = err
+		}
+	case []any:
+		e.arrayHeader(len(v))
+		for _, elem := range v {
+			e.parsed(elem)
+		}
+	case jsonObject:
+		e.mapHeader(len(v))
+		for _, f := range v {
+			e.string(f.key)
+			e.parsed(f.value)
+		}
+	}
+}
+
+func (e *msgpackEncoder) flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+type msgpackDecoder struct {
+	r   byteReader
+	buf [8]byte
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &msgpackDecoder{r: br}
+}
+
+// readUint reads a big endian integer of n bytes
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range d.buf[:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// readLen reads the length following a 8, 16 or 32 bits prefix, b is the prefix and first the 8 bits one
+func (d *msgpackDecoder) readLen(b, first byte) (int, error) {
+	n, err := d.readUint(1 << (b - first))
+	return int(n), err
+}
+
+func (d *msgpackDecoder) mapHeader() (int, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b >= 0x80 && b <= 0x8f:
+		return int(b & 0x0f), nil
+	case b == 0xde || b == 0xdf:
+		return d.readLen(b, 0xdd)
+	}
+	return 0, fmt.Errorf("%w: expected map, got 0x%02x", errMsgpackType, b)
+}
+
+func (d *msgpackDecoder) arrayHeader() (int, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b >= 0x90 && b <= 0x9f:
+		return int(b & 0x0f), nil
+	case b == 0xdc || b == 0xdd:
+		return d.readLen(b, 0xdb)
+	}
+	return 0, fmt.Errorf("%w: expected array, got 0x%02x", errMsgpackType, b)
+}
+
+func (d *msgpackDecoder) string() (string, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	data, err := d.readString(b)
+	return string(data), err
+}
+
+// readString reads the content of a str or bin value starting with b
+func (d *msgpackDecoder) readString(b byte) ([]byte, error) {
+	var n int
+	var err error
+	switch {
+	case b >= 0xa0 && b <= 0xbf:
+		n = int(b & 0x1f)
+	case b >= 0xd9 && b <= 0xdb:
+		n, err = d.readLen(b, 0xd9)
+	case b >= 0xc4 && b <= 0xc6:
+		n, err = d.readLen(b, 0xc4)
+	default:
+		return nil, fmt.Errorf("%w: expected string, got 0x%02x", errMsgpackType, b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readFull(d.r, n)
+}
+
+func (d *msgpackDecoder) int() (int64, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0xcc && b <= 0xcf:
+		v, err := d.readUint(1 << (b - 0xcc))
+		if err == nil && v > math.MaxInt64 {
+			err = fmt.Errorf("%w: integer overflows int64", ErrInvalidFormat)
+		}
+		return int64(v), err
+	case b >= 0xd0 && b <= 0xd3:
+		n := 1 << (b - 0xd0)
+		v, err := d.readUint(n)
+		shift := 64 - 8*n
+		return int64(v<<shift) >> shift, err
+	}
+	return 0, fmt.Errorf("%w: expected integer, got 0x%02x", errMsgpackType, b)
+}
+
+func (d *msgpackDecoder) bool() (bool, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: expected bool, got 0x%02x", errMsgpackType, b)
+}
+
+// value transcodes the next value to JSON
+func (d *msgpackDecoder) value() ([]byte, error) {
+	return d.appendJSON(nil, 0)
+}
+
+func (d *msgpackDecoder) skip() error {
+	_, err := d.appendJSON(nil, 0)
+	return err
+}
+
+// appendJSON transcodes the next value to JSON
+func (d *msgpackDecoder) appendJSON(dst []byte, depth int) ([]byte, error) {
+	if depth > maxDocDepth {
+		return nil, errDocDepth
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return strconv.AppendInt(dst, int64(b), 10), nil
+	case b >= 0xe0:
+		return strconv.AppendInt(dst, int64(int8(b)), 10), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.appendMap(dst, int(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.appendArray(dst, int(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf, b >= 0xd9 && b <= 0xdb:
+		s, err := d.readString(b)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONString(dst, string(s)), nil
+	case b >= 0xc4 && b <= 0xc6:
+		// Binary is base64 in JSON, as for []byte
+		s, err := d.readString(b)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONString(dst, base64.StdEncoding.EncodeToString(s)), nil
+	case b >= 0xcc && b <= 0xcf:
+		v, err := d.readUint(1 << (b - 0xcc))
+		return strconv.AppendUint(dst, v, 10), err
+	case b >= 0xd0 && b <= 0xd3:
+		n := 1 << (b - 0xd0)
+		v, err := d.readUint(n)
+		shift := 64 - 8*n
+		return strconv.AppendInt(dst, int64(v<<shift)>>shift, 10), err
+	case b == 0xca:
+		v, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONFloat(dst, float64(math.Float32frombits(uint32(v))), 32)
+	case b == 0xcb:
+		v, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return appendJSONFloat(dst, math.Float64frombits(v), 64)
+	case b == 0xdc || b == 0xdd:
+		n, err := d.readLen(b, 0xdb)
+		if err != nil {
+			return nil, err
+		}
+		return d.appendArray(dst, n, depth)
+	case b == 0xde || b == 0xdf:
+		n, err := d.readLen(b, 0xdd)
+		if err != nil {
+			return nil, err
+		}
+		return d.appendMap(dst, n, depth)
+	case b >= 0xd4 && b <= 0xd8:
+		return d.appendExt(dst, 1<<(b-0xd4))
+	case b >= 0xc7 && b <= 0xc9:
+		n, err := d.readLen(b, 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.appendExt(dst, n)
+	case b == 0xc0:
+		return append(dst, "null"...), nil
+	case b == 0xc2:
+		return append(dst, "false"...), nil
+	case b == 0xc3:
+		return append(dst, "true"...), nil
+	}
+	return nil, fmt.Errorf("%w: 0x%02x", errMsgpackType, b)
+}
+
+func (d *msgpackDecoder) appendArray(dst []byte, n, depth int) ([]byte, error) {
+	dst = append(dst, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		var err error
+		if dst, err = d.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (d *msgpackDecoder) appendMap(dst []byte, n, depth int) ([]byte, error) {
+	dst = append(dst, '{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		start := len(dst)
+		var err error
+		if dst, err = d.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+		if dst, err = quoteJSONKey(dst, start); err != nil {
+			return nil, err
+		}
+		dst = append(dst, ':')
+		if dst, err = d.appendJSON(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// appendExt transcodes an extension of n bytes, only the timestamp extension (-1) is known
+func (d *msgpackDecoder) appendExt(dst []byte, n int) ([]byte, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFull(d.r, n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != -1 {
+		return nil, fmt.Errorf("%w: extension type %d", errMsgpackType, int8(typ))
+	}
+	var sec, nsec int64
+	switch n {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(data))
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		nsec, sec = int64(v>>34), int64(v&(1<<34-1))
+	case 12:
+		nsec, sec = int64(binary.BigEndian.Uint32(data)), int64(binary.BigEndian.Uint64(data[4:]))
+	default:
+		return nil, fmt.Errorf("%w: timestamp of %d bytes", errMsgpackType, n)
+	}
+	return appendJSONString(dst, time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano)), nil
+}
@@ -0,0 +1,216 @@
+package kmap
+
+import "sync"
+
+// MultiMap maps each key to several values, kept in the order they were added.
+// Values must be comparable so RemoveValue can find them. Like SafeMap, a limit bounds the size of all the values.
+type MultiMap[K comparable, V comparable] struct {
+	sync.RWMutex
+	items map[K][]V
+	// count is the number of values of all the keys
+	count int
+	size  int
+	limit int
+}
+
+func NewMulti[K comparable, V comparable](limitMb ...int) *MultiMap[K, V] {
+	limitmb := -1
+	if len(limitMb) > 0 && limitMb[0] > 0 {
+		limitmb = limitMb[0] * 1024 * 1024
+	}
+	return &MultiMap[K, V]{
+		items: make(map[K][]V),
+		limit: limitmb,
+	}
+}
+
+// Add appends values to the values of key. When they do not fit in the limit, none is added and
+// ErrLargeData or ErrLimitExceeded is returned.
+func (m *MultiMap[K, V]) Add(key K, values ...V) error {
+	if len(values) == 0 {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.limit > 0 {
+		size := 0
+		for _, v := range values {
+			size += getValueSize(v)
+		}
+		if size > m.limit {
+			return ErrLargeData
+		}
+		if m.size+size > m.limit {
+			return ErrLimitExceeded
+		}
+		m.size += size
+	}
+	m.items[key] = append(m.items[key], values...)
+	m.count += len(values)
+	return nil
+}
+
+// RemoveValue removes every occurrence of value from the values of key and returns how many were removed.
+// The key is deleted once it has no value left.
+func (m *MultiMap[K, V]) RemoveValue(key K, value V) int {
+	m.Lock()
+	defer m.Unlock()
+	values, ok := m.items[key]
+	if !ok {
+		return 0
+	}
+	// Filter into a new slice, the previous one may have been returned by GetAll
+	kept := make([]V, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	removed := len(values) - len(kept)
+	if removed == 0 {
+		return 0
+	}
+	if m.limit > 0 {
+		m.size -= removed * getValueSize(value)
+	}
+	m.count -= removed
+	if len(kept) == 0 {
+		delete(m.items, key)
+	} else {
+		m.items[key] = kept
+	}
+	return removed
+}
+
+// GetAll returns a copy of the values of key, in the order they were added, nil when it has none
+func (m *MultiMap[K, V]) GetAll(key K) []V {
+	m.RLock()
+	defer m.RUnlock()
+	values, ok := m.items[key]
+	if !ok {
+		return nil
+	}
+	return append([]V(nil), values...)
+}
+
+// Get returns the first value of key
+func (m *MultiMap[K, V]) Get(key K) (v V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if values := m.items[key]; len(values) > 0 {
+		return values[0], true
+	}
+	return v, false
+}
+
+// CountValues returns the number of values of key
+func (m *MultiMap[K, V]) CountValues(key K) int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.items[key])
+}
+
+// HasValue reports whether value is one of the values of key
+func (m *MultiMap[K, V]) HasValue(key K, value V) bool {
+	m.RLock()
+	defer m.RUnlock()
+	for _, v := range m.items[key] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Has reports whether key has at least one value
+func (m *MultiMap[K, V]) Has(key K) bool {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.items[key]
+	return ok
+}
+
+// Delete removes key with all its values and returns how many values it had
+func (m *MultiMap[K, V]) Delete(key K) int {
+	m.Lock()
+	defer m.Unlock()
+	values, ok := m.items[key]
+	if !ok {
+		return 0
+	}
+	if m.limit > 0 {
+		for _, v := range values {
+			m.size -= getValueSize(v)
+		}
+	}
+	m.count -= len(values)
+	delete(m.items, key)
+	return len(values)
+}
+
+// Len returns the number of keys, see Count for the number of values
+func (m *MultiMap[K, V]) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.items)
+}
+
+// Count returns the number of values of all the keys
+func (m *MultiMap[K, V]) Count() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.count
+}
+
+func (m *MultiMap[K, V]) Keys() []K {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]K, 0, len(m.items))
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Range calls f sequentially for each key with a copy of its values. If f returns false, range stops the iteration.
+// f runs without the lock.
+func (m *MultiMap[K, V]) Range(f func(key K, values []V) bool) {
+	m.RLock()
+	pairs := make([]Pair[K, []V], 0, len(m.items))
+	for k, values := range m.items {
+		pairs = append(pairs, Pair[K, []V]{Key: k, Value: append([]V(nil), values...)})
+	}
+	m.RUnlock()
+	for _, p := range pairs {
+		if !f(p.Key, p.Value) {
+			break
+		}
+	}
+}
+
+// Size returns the total accounted size of the values in bytes.
+// Values are only measured when the map has a limit, Size is 0 for unlimited maps.
+func (m *MultiMap[K, V]) Size() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.size
+}
+
+// Limit returns the size limit in bytes, -1 when the map is unlimited
+func (m *MultiMap[K, V]) Limit() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.limit
+}
+
+func (m *MultiMap[K, V]) Flush() {
+	m.Lock()
+	m.items = make(map[K][]V)
+	m.count = 0
+	m.size = 0
+	m.Unlock()
+}
+
+func (m *MultiMap[K, V]) Clear() {
+	m.Flush()
+}
@@ -0,0 +1,36 @@
+package kmap
+
+// Number is the constraint of the values Add and AddOrdered work with
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Add adds delta to the value of key (0 when missing or expired) under the write lock and returns the new value,
+// so the map can hold counters and rate metrics. Use a negative delta to decrement.
+// Like GetOrSet, a value that cannot be stored because of the size limit is returned but not kept.
+func Add[K comparable, V Number](c *SafeMap[K, V], key K, delta V) V {
+	c.Lock()
+	defer c.unlock()
+	var v V
+	if i, ok := c.items[key]; ok && i.live() {
+		v = c.value(i)
+	}
+	v += delta
+	c.set(key, v)
+	return v
+}
+
+// AddOrdered is Add for an OrderedMap, new keys are appended to the back
+func AddOrdered[K comparable, V Number](m *OrderedMap[K, V], key K, delta V) V {
+	m.Lock()
+	defer m.unlock()
+	var v V
+	if element, ok := m.kv[key]; ok {
+		v = element.Value
+	}
+	v += delta
+	m.set(key, v)
+	return v
+}
@@ -0,0 +1,376 @@
+package kmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ObjectStore is a minimal blob storage, such as S3, GCS or Azure Blob, used to keep snapshots without a persistent disk
+type ObjectStore interface {
+	// Put uploads size bytes read from r under key, replacing any existing object.
+	// size is -1 when unknown, for the snapshots SaveToObjectStore streams as they are encoded: r is then read until EOF.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object stored under key, the caller closes the returned reader
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// SaveToObjectStore saves the SafeMap to store under key. A snapshot of the map (see Snapshot) is encoded
+// while it is uploaded, so the encoded data is never held in memory and the map is not locked during the upload.
+func (m *SafeMap[K, V]) SaveToObjectStore(ctx context.Context, store ObjectStore, key string, opts SaveOptions) error {
+	m.Lock()
+	s := m.snapshot()
+	restore := m.resetDirty()
+	m.Unlock()
+	err := putStream(ctx, store, key, func(w io.Writer) error {
+		_, err := s.saveTo(w, opts)
+		return err
+	})
+	if err != nil {
+		restore()
+	}
+	return err
+}
+
+// LoadFromObjectStore replaces the content of the SafeMap with the snapshot stored in store under key
+func (m *SafeMap[K, V]) LoadFromObjectStore(ctx context.Context, store ObjectStore, key string) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return m.LoadFrom(r)
+}
+
+// SaveToObjectStore saves the OrderedMap to store under key. Like for a SafeMap, the data is encoded while
+// it is uploaded, from a copy of the map (see Snapshot) so the map is not locked during the upload.
+func (m *OrderedMap[K, V]) SaveToObjectStore(ctx context.Context, store ObjectStore, key string, opts SaveOptions) error {
+	s := m.Snapshot()
+	return putStream(ctx, store, key, func(w io.Writer) error {
+		return s.SaveTo(w, opts)
+	})
+}
+
+// putStream uploads to store under key what write writes, as it is written, with an unknown size
+func putStream(ctx context.Context, store ObjectStore, key string, write func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := store.Put(ctx, key, pr, -1)
+	// write fails instead of blocking when Put stopped reading early
+	pr.Close()
+	if werr := <-done; err == nil {
+		err = werr
+	}
+	return err
+}
+
+// LoadFromObjectStore replaces the content of the OrderedMap with the snapshot stored in store under key
+func (m *OrderedMap[K, V]) LoadFromObjectStore(ctx context.Context, store ObjectStore, key string) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return m.LoadFrom(r)
+}
+
+// S3Store is an ObjectStore for S3 compatible services (AWS S3, MinIO, R2, Ceph...),
+// using path style URLs and AWS Signature Version 4.
+type S3Store struct {
+	// Endpoint is the service URL, for example https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// PartSize is the size of the parts of the multipart uploads used for objects of unknown size, 8 MiB by default.
+	// S3 requires at least 5 MiB. Only one part is held in memory at a time.
+	PartSize int
+}
+
+// defaultPartSize is the PartSize of an S3Store when it is not set
+const defaultPartSize = 8 << 20
+
+// Put uploads an object, the payload is streamed and sent unsigned (UNSIGNED-PAYLOAD).
+// An object of unknown size is sent with a single request when it fits in a part, with a multipart upload otherwise.
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size >= 0 {
+		return s.putObject(ctx, key, r, size)
+	}
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(ctx, key, bytes.NewReader(buf[:n]), int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(ctx, key, r, buf)
+}
+
+// putObject uploads size bytes read from r with a single request
+func (s *S3Store) putObject(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Part is an uploaded part listed to complete a multipart upload
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads buf, which is full, then the rest of r by parts of the size of buf
+func (s *S3Store) putMultipart(ctx context.Context, key string, r io.Reader, buf []byte) error {
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.call(ctx, http.MethodPost, s.objectURL(key)+"?uploads", nil, &created); err != nil {
+		return err
+	}
+	upload := s.objectURL(key) + "?uploadId=" + url.QueryEscape(created.UploadID)
+
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	n := len(buf)
+	err := func() error {
+		for part := 1; ; part++ {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+				upload+"&partNumber="+strconv.Itoa(part), bytes.NewReader(buf[:n]))
+			if err != nil {
+				return err
+			}
+			resp, err := s.do(req, "UNSIGNED-PAYLOAD")
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, s3Part{PartNumber: part, ETag: resp.Header.Get("ETag")})
+
+			n, err = io.ReadFull(r, buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		body, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+		return s.call(ctx, http.MethodPost, upload, body, nil)
+	}()
+	if err != nil {
+		// The parts already uploaded are billed until the upload is aborted
+		if req, rerr := http.NewRequestWithContext(ctx, http.MethodDelete, upload, nil); rerr == nil {
+			if resp, rerr := s.do(req, emptyPayloadHash); rerr == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	return err
+}
+
+// call sends a request with body and decodes the XML response into out when not nil.
+// S3 can answer errors with a 200 status once it has started to answer, they are returned too.
+func (s *S3Store) call(ctx context.Context, method, u string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	resp, err := s.do(req, hex.EncodeToString(hash[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var answer struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &answer) == nil && answer.XMLName.Local == "Error" {
+		return fmt.Errorf("kmap: s3 %s %s: %s: %s", method, req.URL.Path, answer.Code, answer.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// Get downloads an object
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// objectURL returns the URL of key, each segment of the key is escaped like in the signature
+// so characters such as ?, # or + stay in the object name. url.PathEscape would leave +, : and @ as is
+// while S3 signs them escaped.
+func (s *S3Store) objectURL(key string) string {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	for i, seg := range segments {
+		segments[i] = awsURIEncode(seg)
+	}
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + strings.Join(segments, "/")
+}
+
+func (s *S3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, s.AccessKey, s.SecretKey, s.Region, "s3", payloadHash, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("kmap: s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+// emptyPayloadHash is the hex sha256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 adds the x-amz-date, x-amz-content-sha256 and Authorization headers of AWS Signature Version 4 to req.
+// Every header already set on req is signed, along with host.
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalURI is the path sent in req, its segments are already encoded as required by SigV4, see objectURL
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// canonicalQuery sorts and encodes the query parameters as required by SigV4
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters of RFC 3986
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -10,6 +10,26 @@ type OrderedMap[K comparable, V any] struct {
 	ll    list[K, V]
 	size  int
 	limit int
+
+	// sizeFunc replaces getValueSize when set, see WithSizeFunc
+	sizeFunc func(V) int
+
+	// evictToFitSet makes Set evict entries instead of returning ErrLimitExceeded, see WithEvictToFit
+	evictToFitSet bool
+	evictPolicy   EvictPolicy
+
+	// stats counts reads per key when enabled, see WithStats
+	stats hitCounter[K]
+	// hooks are the listeners of changes, see OnSet
+	hooks hooks[K, V]
+	// journal keeps the last changes to undo them, see WithJournal
+	journal journal[K, V]
+	// keyLocks serialize callers per key, see LockKey
+	keyLocks keyLocks[K]
+	// hasher replaces hashKey when set, see WithHasher
+	hasher func(K) uint64
+	// accessOrder moves the entries read or set to the back, see WithAccessOrder
+	accessOrder bool
 }
 
 func NewOrdered[K comparable, V any](limitMb ...int) *OrderedMap[K, V] {
@@ -25,16 +45,36 @@ func NewOrdered[K comparable, V any](limitMb ...int) *OrderedMap[K, V] {
 }
 
 func (m *OrderedMap[K, V]) Get(key K) (value V, ok bool) {
+	if m.accessOrder {
+		return m.touch(key)
+	}
 	m.RLock()
 	defer m.RUnlock()
 	v, ok := m.kv[key]
 	if ok {
 		value = v.Value
+		m.stats.hit(key)
 	}
 	return
 }
 
+// Has reports whether key is present without copying its value
+func (m *OrderedMap[K, V]) Has(key K) bool {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.kv[key]
+	return ok
+}
+
 func (m *OrderedMap[K, V]) GetAny(keys ...K) (V, bool) {
+	if m.accessOrder {
+		for _, key := range keys {
+			if v, ok := m.touch(key); ok {
+				return v, true
+			}
+		}
+		return *new(V), false
+	}
 	m.RLock()
 	defer m.RUnlock()
 	found := false
@@ -42,6 +82,7 @@ func (m *OrderedMap[K, V]) GetAny(keys ...K) (V, bool) {
 		i, ok := m.kv[key]
 		if ok {
 			found = true
+			m.stats.hit(key)
 			return i.Value, found
 		}
 	}
@@ -50,48 +91,71 @@ func (m *OrderedMap[K, V]) GetAny(keys ...K) (V, bool) {
 
 func (m *OrderedMap[K, V]) Set(key K, value V) error {
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
+	return m.set(key, value)
+}
 
+// set is Set, the write lock must be held
+func (m *OrderedMap[K, V]) set(key K, value V) error {
 	if m.limit > 0 {
 		// Only check string size if we have a size limit
-		size := getValueSize(value)
+		size := m.valueSize(value)
 		if size > m.limit {
 			return ErrLargeData
 		}
 
 		if size+m.size > m.limit {
-			return ErrLimitExceeded
-		}
-		_, alreadyExist := m.kv[key]
-		if alreadyExist {
-			oldSize := m.kv[key].size
-			m.kv[key].Value = value
-			m.kv[key].size = size
-			m.size = m.size - oldSize + size
-			return nil
+			if !m.evictToFitSet {
+				return ErrLimitExceeded
+			}
+			// The previous value of key is replaced, it does not need room
+			need := size
+			if old, ok := m.kv[key]; ok {
+				need -= old.size
+			}
+			m.evictToFit(need, func(k K) bool { return k == key })
 		}
-		element := m.ll.PushBack(key, value)
-		element.size = size
-		m.kv[key] = element
-		m.size += size
+		m.put(key, value, size)
 		return nil
 	}
 
-	_, alreadyExist := m.kv[key]
-	if alreadyExist {
-		m.kv[key].Value = value
-		return nil
-	}
+	m.put(key, value, 0)
+	return nil
+}
 
+// put sets value under key with its accounted size, appending new keys to the back, the write lock must be held
+func (m *OrderedMap[K, V]) put(key K, value V, size int) {
+	m.hooks.record(EventSet, key, value)
+	if element, ok := m.kv[key]; ok {
+		m.journal.add(m.hooks.seq, key, element.Value, true)
+		m.size += size - element.size
+		element.Value = value
+		element.size = size
+		element.rev = m.hooks.seq
+		if m.accessOrder {
+			m.ll.MoveToBack(element)
+		}
+		return
+	}
+	m.journal.add(m.hooks.seq, key, *new(V), false)
 	element := m.ll.PushBack(key, value)
+	element.size = size
+	element.rev = m.hooks.seq
 	m.kv[key] = element
-	return nil
+	m.size += size
 }
 
 func (m *OrderedMap[K, V]) GetOrDefault(key K, defaultValue V) V {
+	if m.accessOrder {
+		if v, ok := m.touch(key); ok {
+			return v
+		}
+		return defaultValue
+	}
 	m.RLock()
 	defer m.RUnlock()
 	if value, ok := m.kv[key]; ok {
+		m.stats.hit(key)
 		return value.Value
 	}
 
@@ -137,34 +201,60 @@ func (m *OrderedMap[K, V]) Values() (values []V) {
 
 func (m *OrderedMap[K, V]) Delete(key K) (didDelete bool) {
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
+	return m.remove(key)
+}
+
+// remove deletes key and reports whether it was present, the write lock must be held
+func (m *OrderedMap[K, V]) remove(key K) bool {
 	element, ok := m.kv[key]
 	if ok {
 		m.size -= element.size
 		m.ll.Remove(element)
 		delete(m.kv, key)
+		m.stats.forget(key)
+		m.hooks.record(EventDelete, key, *new(V))
+		m.journal.add(m.hooks.seq, key, element.Value, true)
 	}
-
 	return ok
 }
 
+// GetAndDelete removes key and returns its value in a single locked operation,
+// so concurrent consumers can claim an entry without another one getting it too
+func (m *OrderedMap[K, V]) GetAndDelete(key K) (value V, ok bool) {
+	m.Lock()
+	defer m.unlock()
+	element, ok := m.kv[key]
+	if !ok {
+		return value, false
+	}
+	m.remove(key)
+	return element.Value, true
+}
+
 func (m *OrderedMap[K, V]) Clear() {
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
 	for k := range m.kv {
 		delete(m.kv, k)
 	}
 	m.ll = list[K, V]{}
 	m.size = 0
+	m.stats.reset()
+	m.hooks.record(EventFlush, *new(K), *new(V))
+	m.journal.reset(m.hooks.seq)
 }
 func (m *OrderedMap[K, V]) Flush() {
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
 	for k := range m.kv {
 		delete(m.kv, k)
 	}
 	m.ll = list[K, V]{}
 	m.size = 0
+	m.stats.reset()
+	m.hooks.record(EventFlush, *new(K), *new(V))
+	m.journal.reset(m.hooks.seq)
 }
 
 func (m *OrderedMap[K, V]) Front() *Element[K, V] {
@@ -179,14 +269,10 @@ func (m *OrderedMap[K, V]) Back() *Element[K, V] {
 	return m.ll.Back()
 }
 
+// Copy returns a shallow copy of the OrderedMap keeping the order, the limit and the size of each entry,
+// values are shared with the original. See CloneWith to copy them too.
 func (m *OrderedMap[K, V]) Copy() *OrderedMap[K, V] {
-	m.RLock()
-	defer m.RUnlock()
-	m2 := NewOrdered[K, V]()
-	for el := m.Front(); el != nil; el = el.Next() {
-		m2.Set(el.Key, el.Value)
-	}
-	return m2
+	return m.Snapshot()
 }
 
 func (m *OrderedMap[K, V]) Range(f func(key K, value V) bool) {
@@ -221,31 +307,57 @@ func (m *OrderedMap[K, V]) GetOrCompute(key K, fn func() V) V {
 	return value
 }
 
+// GetOrComputeErr is GetOrCompute for functions that can fail, like database queries or HTTP fetches:
+// when fn returns an error nothing is stored and the error is returned.
+// When the computed value cannot be stored because of the size limit, it is returned with the error of Set.
+func (m *OrderedMap[K, V]) GetOrComputeErr(key K, fn func() (V, error)) (V, error) {
+	if v, ok := m.Get(key); ok {
+		return v, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return value, err
+	}
+	return value, m.Set(key, value)
+}
+
 // SetIfNotExists sets the value if the key doesn't exist and returns true.
 // If the key exists, it returns false and makes no changes.
 func (m *OrderedMap[K, V]) SetIfNotExists(key K, value V) bool {
 	m.Lock()
 	if _, exists := m.kv[key]; exists {
-		m.Unlock()
+		m.unlock()
 		return false
 	}
-	m.Unlock()
+	m.unlock()
 	m.Set(key, value)
 	return true
 }
 
+// Update sets key to the value returned by fn, called with the current value and whether it exists,
+// while holding the write lock, so read-modify-write patterns are race-free.
+// fn must not call methods of the map. The error is the one Set would return for the new value.
+func (m *OrderedMap[K, V]) Update(key K, fn func(old V, exists bool) V) error {
+	m.Lock()
+	defer m.unlock()
+	var old V
+	element, exists := m.kv[key]
+	if exists {
+		old = element.Value
+	}
+	return m.set(key, fn(old, exists))
+}
+
 // DeleteAll removes all the specified keys and returns the number of keys removed
 func (m *OrderedMap[K, V]) DeleteAll(keys ...K) int {
 	if len(keys) == 0 {
 		return 0
 	}
 	m.Lock()
-	defer m.Unlock()
+	defer m.unlock()
 	count := 0
 	for _, key := range keys {
-		if e, ok := m.kv[key]; ok {
-			m.ll.Remove(e)
-			delete(m.kv, key)
+		if m.remove(key) {
 			count++
 		}
 	}
@@ -262,8 +374,47 @@ func (m *OrderedMap[K, V]) GetAll(keys ...K) map[K]V {
 	for _, key := range keys {
 		if e, ok := m.kv[key]; ok {
 			result[key] = e.Value
+			m.stats.hit(key)
 		}
 	}
 	m.RUnlock()
 	return result
 }
+
+// MoveBefore moves key right before mark, so the order can be edited like the data of a menu or a playlist.
+// It returns false and changes nothing when one of the keys is missing or they are the same.
+func (m *OrderedMap[K, V]) MoveBefore(key, mark K) bool {
+	m.Lock()
+	defer m.Unlock()
+	element, markElement, ok := m.pair(key, mark)
+	if ok {
+		m.ll.Remove(element)
+		m.ll.InsertBefore(element, markElement)
+	}
+	return ok
+}
+
+// MoveAfter moves key right after mark, see MoveBefore
+func (m *OrderedMap[K, V]) MoveAfter(key, mark K) bool {
+	m.Lock()
+	defer m.Unlock()
+	element, markElement, ok := m.pair(key, mark)
+	if ok {
+		m.ll.Remove(element)
+		m.ll.InsertAfter(element, markElement)
+	}
+	return ok
+}
+
+// pair returns the elements of two distinct keys present in the map, the lock must be held
+func (m *OrderedMap[K, V]) pair(key, mark K) (element, markElement *Element[K, V], ok bool) {
+	if key == mark {
+		return nil, nil, false
+	}
+	element, ok = m.kv[key]
+	if !ok {
+		return nil, nil, false
+	}
+	markElement, ok = m.kv[mark]
+	return element, markElement, ok
+}
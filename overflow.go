@@ -0,0 +1,113 @@
+package kmap
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// WithOverflow makes the SafeMap spill values larger than thresholdBytes to individual files in dir.
+// Spilled values only keep a reference in memory and do not count toward the size limit,
+// they are read back and decoded on every access, so it is meant for a few large, rarely read blobs.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithOverflow(dir string, thresholdBytes int) *SafeMap[K, V] {
+	c.Lock()
+	c.overflowDir = dir
+	c.overflowThreshold = thresholdBytes
+	c.Unlock()
+	return c
+}
+
+// shouldSpill reports whether value must be stored on disk, the lock must be held
+func (c *SafeMap[K, V]) shouldSpill(size int) bool {
+	return c.overflowDir != "" && size > c.overflowThreshold
+}
+
+// spill writes value to a new file in the overflow directory and returns an item referencing it
+func (c *SafeMap[K, V]) spill(value V) (item[V], error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return item[V]{}, err
+	}
+	if err := os.MkdirAll(c.overflowDir, 0755); err != nil {
+		return item[V]{}, err
+	}
+	file, err := os.CreateTemp(c.overflowDir, "*.kmapv")
+	if err != nil {
+		return item[V]{}, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return item[V]{}, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return item[V]{}, err
+	}
+	return item[V]{spill: file.Name()}, nil
+}
+
+// value returns the value of i, reading it back from disk if it was spilled. The lock must be held.
+func (c *SafeMap[K, V]) value(i item[V]) V {
+	if i.slot.chunk != 0 {
+		return c.fromArena(i)
+	}
+	if i.spill == "" {
+		return i.Value
+	}
+	var v V
+	if data, err := os.ReadFile(i.spill); err == nil {
+		json.Unmarshal(data, &v)
+	}
+	return v
+}
+
+// release removes the overflow file of i if any and frees its bytes in the arena, the write lock must be held
+func (c *SafeMap[K, V]) release(i item[V]) {
+	if i.spill != "" {
+		os.Remove(i.spill)
+	}
+	if i.slot.chunk != 0 {
+		c.arena.free(i.slot)
+	}
+}
+
+// releaseAll removes the overflow files of every item and the interned strings, the write lock must be held
+func (c *SafeMap[K, V]) releaseAll() {
+	if c.interner != nil {
+		c.interner.reset()
+	}
+	if c.arena != nil {
+		c.arena = &arena{enc: c.arena.enc}
+	}
+	if c.overflowDir == "" {
+		return
+	}
+	for _, i := range c.items {
+		c.release(i)
+	}
+}
+
+// spillLoaded moves loaded values above the overflow threshold to disk and the others to the arena if any,
+// the write lock must be held
+func (c *SafeMap[K, V]) spillLoaded() error {
+	if c.overflowDir != "" {
+		c.own()
+		for k, i := range c.items {
+			if i.spill != "" || !c.shouldSpill(c.valueSize(i.Value)) {
+				continue
+			}
+			spilled, err := c.spill(i.Value)
+			if err != nil {
+				return err
+			}
+			c.size -= i.Size
+			spilled.rev, spilled.expires, spilled.ttl = i.rev, i.expires, i.ttl
+			c.items[k] = spilled
+		}
+	}
+	if c.arena != nil {
+		return c.arenaLoaded()
+	}
+	return nil
+}
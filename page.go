@@ -0,0 +1,155 @@
+package kmap
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cursor is the position of KeysPage in a map, it is a plain string so it can be passed around in URLs.
+// The zero Cursor starts at the beginning, an empty Cursor is returned after the last page.
+type Cursor string
+
+// newCursor returns the cursor after the key encoded as key, at position pos
+func newCursor(pos int, key string) Cursor {
+	return Cursor(strconv.Itoa(pos) + ":" + key)
+}
+
+// parse returns the position and the encoded key of c, ok is false for the zero Cursor or an invalid one
+func (c Cursor) parse() (pos int, key string, ok bool) {
+	p, key, found := strings.Cut(string(c), ":")
+	if !found {
+		return 0, "", false
+	}
+	pos, err := strconv.Atoi(p)
+	if err != nil || pos < 0 {
+		return 0, "", false
+	}
+	return pos, key, true
+}
+
+// KeysPage returns up to limit keys after cursor and the cursor of the next page, empty after the last one.
+// limit <= 0 returns every remaining key.
+// Keys are listed in the order of their persisted form (see SaveToFile), keys that cannot be persisted
+// and expired ones are skipped. Paging is best-effort: keys added behind the cursor while paging are not listed,
+// but no key is listed twice and no key present during the whole listing is missed.
+// Each page reads and encodes every key of the map, which allocates for keys other than strings,
+// but holds at most 2*limit of them at once.
+func (c *SafeMap[K, V]) KeysPage(cursor Cursor, limit int) ([]K, Cursor) {
+	_, after, hasAfter := cursor.parse()
+
+	type encodedKey struct {
+		key K
+		enc string
+	}
+	var page []encodedKey
+	trim := func() {
+		sort.Slice(page, func(i, j int) bool { return page[i].enc < page[j].enc })
+		if limit > 0 && len(page) > limit {
+			page = page[:limit]
+		}
+	}
+
+	c.RLock()
+	now := nowNano()
+	for k, i := range c.items {
+		if i.expired(now) {
+			continue
+		}
+		enc, err := encodeKey(k)
+		if err != nil || hasAfter && enc <= after {
+			continue
+		}
+		page = append(page, encodedKey{k, enc})
+		if limit > 0 && len(page) >= 2*limit {
+			trim()
+		}
+	}
+	c.RUnlock()
+	trim()
+
+	keys := make([]K, len(page))
+	for i, p := range page {
+		keys[i] = p.key
+	}
+	if limit <= 0 || len(page) < limit {
+		return keys, ""
+	}
+	return keys, newCursor(0, page[len(page)-1].enc)
+}
+
+// KeysPage returns up to limit keys after cursor in order and the cursor of the next page, empty after the last one.
+// limit <= 0 returns every remaining key.
+// Paging is stable: keys added while paging are listed at the end, and when the last key of a page is deleted
+// the next page resumes from about its position.
+func (m *OrderedMap[K, V]) KeysPage(cursor Cursor, limit int) ([]K, Cursor) {
+	m.RLock()
+	defer m.RUnlock()
+
+	// The cursor holds the last key of the previous page and its position, used when the key was deleted
+	el, start := m.ll.Front(), 0
+	pos, after, ok := cursor.parse()
+	if ok {
+		if key, err := decodeKey[K](after); err == nil && m.kv[key] != nil {
+			el, start = m.kv[key].Next(), pos+1
+		} else {
+			for ; start < pos && el != nil; start++ {
+				el = el.Next()
+			}
+		}
+	}
+
+	var keys []K
+	var last *Element[K, V]
+	for ; el != nil && (limit <= 0 || len(keys) < limit); el = el.Next() {
+		keys = append(keys, el.Key)
+		last = el
+	}
+	if el == nil {
+		return keys, ""
+	}
+	enc, _ := encodeKey(last.Key)
+	return keys, newCursor(start+len(keys)-1, enc)
+}
+
+// SortedKeys returns the keys sorted with less. Without less, keys of an ordered kind (numbers, strings, bools)
+// are sorted in ascending order and other keys in the order of their persisted form, see SaveToFile.
+func (c *SafeMap[K, V]) SortedKeys(less ...func(a, b K) bool) []K {
+	keys := c.Keys()
+	if len(less) > 0 && less[0] != nil {
+		sort.Slice(keys, func(i, j int) bool { return less[0](keys[i], keys[j]) })
+		return keys
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// sortKeys sorts keys in their natural order, see SortedKeys
+func sortKeys[K comparable](keys []K) {
+	if len(keys) < 2 {
+		return
+	}
+	rv := reflect.ValueOf(keys)
+	var less func(a, b reflect.Value) bool
+	switch rv.Type().Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less = func(a, b reflect.Value) bool { return a.Int() < b.Int() }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		less = func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(a, b reflect.Value) bool { return a.Float() < b.Float() }
+	case reflect.String:
+		less = func(a, b reflect.Value) bool { return a.String() < b.String() }
+	case reflect.Bool:
+		less = func(a, b reflect.Value) bool { return !a.Bool() && b.Bool() }
+	default:
+		encoded := make(map[K]string, len(keys))
+		for _, k := range keys {
+			encoded[k], _ = encodeKey(k)
+		}
+		sort.SliceStable(keys, func(i, j int) bool { return encoded[keys[i]] < encoded[keys[j]] })
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(rv.Index(i), rv.Index(j)) })
+}
@@ -1,22 +1,16 @@
 package kmap
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"sync/atomic"
+	"time"
 )
 
-const (
-	magicNumber = uint32(0x4B4D4150) // "KMAP" in ASCII
-	version     = uint32(1)
-)
+const magicNumber = uint32(0x4B4D4150) // "KMAP" in ASCII
 
 // SaveOptions configures how the map is saved to disk
 type SaveOptions struct {
@@ -25,6 +19,11 @@ type SaveOptions struct {
 	// CompressLevel sets the gzip compression level (1-9, higher = better compression but slower)
 	// Only used if Compress is true. Defaults to gzip.DefaultCompression
 	CompressLevel int
+	// Encoding selects how values are serialized, EncodingJSON by default
+	Encoding Encoding
+	// LockTimeout bounds how long saving and loading a file wait while another process holds its lock,
+	// ErrLockTimeout is then returned. 0 waits as long as needed.
+	LockTimeout time.Duration
 }
 
 // SaveResult represents the result of an asynchronous save operation
@@ -76,6 +75,13 @@ func writeBinary(w io.Writer, v interface{}) error {
 		}
 		_, err := w.Write([]byte(val))
 		return err
+	case []byte:
+		length := int32(len(val))
+		if err := binary.Write(w, binary.LittleEndian, length); err != nil {
+			return err
+		}
+		_, err := w.Write(val)
+		return err
 	default:
 		// Create wrapper with type info
 		wrapper := valueWrapper{
@@ -133,7 +139,7 @@ func readBinary(r io.Reader, into interface{}) error {
 		}
 		*val = string(buf)
 		return nil
-	default:
+	case *[]byte:
 		var length int32
 		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 			return err
@@ -141,52 +147,39 @@ func readBinary(r io.Reader, into interface{}) error {
 		if length < 0 || length > 1<<30 {
 			return errors.New("invalid data length")
 		}
-		buf := make([]byte, length)
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return err
-		}
-
-		// Unmarshal wrapper
-		var wrapper valueWrapper
-		if err := json.Unmarshal(buf, &wrapper); err != nil {
-			return err
-		}
-
-		// For interface{} destination
-		if v, ok := into.(*interface{}); ok {
-			return json.Unmarshal(wrapper.Value, v)
-		}
-		return json.Unmarshal(wrapper.Value, into)
-	}
-}
-
-// writeHeader writes the file header
-func writeHeader(w io.Writer) error {
-	if err := binary.Write(w, binary.LittleEndian, magicNumber); err != nil {
+		*val = make([]byte, length)
+		_, err := io.ReadFull(r, *val)
 		return err
+	default:
+		return readWrapped(r, into)
 	}
-	return binary.Write(w, binary.LittleEndian, version)
 }
 
-// readHeader reads and verifies the file header
-func readHeader(r io.Reader) error {
-	var magic uint32
-	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+// readWrapped reads a value written by the default case of writeBinary
+func readWrapped(r io.Reader, into interface{}) error {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return err
 	}
-	if magic != magicNumber {
-		return errors.New("invalid file format")
+	if length < 0 || length > 1<<30 {
+		return errors.New("invalid data length")
 	}
-
-	var ver uint32
-	if err := binary.Read(r, binary.LittleEndian, &ver); err != nil {
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	if ver != version {
-		return errors.New("unsupported file version")
+
+	// Unmarshal wrapper
+	var wrapper valueWrapper
+	if err := json.Unmarshal(buf, &wrapper); err != nil {
+		return err
 	}
 
-	return nil
+	// For interface{} destination
+	if v, ok := into.(*interface{}); ok {
+		return json.Unmarshal(wrapper.Value, v)
+	}
+	return json.Unmarshal(wrapper.Value, into)
 }
 
 // SaveToFile saves the SafeMap to a file at the specified path
@@ -196,55 +189,37 @@ func (m *SafeMap[K, V]) SaveToFile(path string) error {
 
 // SaveToFileWithOptions saves the SafeMap to a file with the specified options
 func (m *SafeMap[K, V]) SaveToFileWithOptions(path string, opts SaveOptions) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
-	}
-
-	var buf bytes.Buffer
-	var finalWriter io.Writer = &buf
+	return m.SaveToBackend(NewFileBackend(path, opts))
+}
 
-	if opts.Compress {
-		level := opts.CompressLevel
-		if level == 0 {
-			level = gzip.DefaultCompression
-		}
-		gzipWriter, err := gzip.NewWriterLevel(&buf, level)
-		if err != nil {
-			return err
-		}
-		finalWriter = gzipWriter
-		defer gzipWriter.Close()
-	}
+// SaveTo writes the SafeMap to w in the current file format
+func (m *SafeMap[K, V]) SaveTo(w io.Writer, opts SaveOptions) error {
+	_, err := m.saveTo(w, opts)
+	return err
+}
 
+// saveTo is SaveTo, restore puts back the changes tracked for deltas when w was a buffer which could not be stored
+func (m *SafeMap[K, V]) saveTo(w io.Writer, opts SaveOptions) (restore func(), err error) {
 	m.RLock()
 	defer m.RUnlock()
 
-	// Convert items to serializable format
-	data := mapData{
+	hdr := fileHeader{
 		Size:  m.size,
 		Limit: m.limit,
-		Items: make(map[string]itemData),
+		Count: int64(len(m.items)),
 	}
-
-	for k, v := range m.items {
-		valueBytes, err := json.Marshal(v.Value)
-		if err != nil {
-			return err
-		}
-
-		data.Items[fmt.Sprintf("%v", k)] = itemData{
-			Type:  fmt.Sprintf("%T", v.Value),
-			Value: valueBytes,
-			Size:  v.Size,
-		}
+	if m.expiring() {
+		hdr.Flags |= flagExpiry
 	}
-
-	// Write data
-	if err := json.NewEncoder(finalWriter).Encode(data); err != nil {
-		return err
+	err = writeSnapshot(w, opts, hdr, func(emit func(key string, value []byte, size int, expires int64) error) error {
+		return m.eachRecord(opts.Encoding, func(rec Record) error {
+			return emit(rec.Key, rec.Value, rec.Size, rec.Expires)
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return os.WriteFile(path, buf.Bytes(), 0644)
+	return m.resetDirty(), nil
 }
 
 // SaveToFileAsync saves the SafeMap to a file asynchronously
@@ -261,6 +236,9 @@ func (m *SafeMap[K, V]) SaveToFileAsyncWithOptions(path string, opts SaveOptions
 	go func() {
 		defer close(result.Done)
 		result.Error = m.SaveToFileWithOptions(path, opts)
+		if result.Error != nil {
+			m.log.error("kmap: asynchronous save failed", "path", path, "error", result.Error)
+		}
 		result.Progress.Store(100)
 	}()
 
@@ -269,58 +247,40 @@ func (m *SafeMap[K, V]) SaveToFileAsyncWithOptions(path string, opts SaveOptions
 
 // LoadFromFile loads the SafeMap from a file at the specified path
 func (m *SafeMap[K, V]) LoadFromFile(path string) error {
-	data, err := os.ReadFile(path)
+	return m.LoadFromBackend(NewFileBackend(path, SaveOptions{}))
+}
+
+// LoadFrom replaces the content of the SafeMap with the data read from r.
+// Any format written by a previous version of kmap is accepted, compressed or not.
+func (m *SafeMap[K, V]) LoadFrom(r io.Reader) error {
+	hdr, entries, err := readSnapshot[K, V](r)
 	if err != nil {
 		return err
 	}
-
-	reader := bytes.NewReader(data)
-	var finalReader io.Reader = reader
-
-	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
-		gzipReader, err := gzip.NewReader(reader)
-		if err != nil {
-			return err
-		}
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, gzipReader); err != nil {
-			gzipReader.Close()
-			return err
-		}
-		gzipReader.Close()
-		finalReader = bytes.NewReader(buf.Bytes())
+	if hdr.Flags&flagDelta != 0 {
+		return ErrDeltaFile
 	}
 
 	m.Lock()
 	defer m.Unlock()
-
-	var mapData mapData
-	if err := json.NewDecoder(finalReader).Decode(&mapData); err != nil {
-		return err
-	}
-
-	m.size = mapData.Size
-	m.limit = mapData.Limit
-	m.items = make(map[K]item[V])
-
-	for kStr, itemData := range mapData.Items {
-		var k K
-		if err := json.Unmarshal([]byte(fmt.Sprintf("%q", kStr)), &k); err != nil {
-			return err
-		}
-
-		var v V
-		if err := json.Unmarshal(itemData.Value, &v); err != nil {
-			return err
-		}
-
-		m.items[k] = item[V]{
-			Value: v,
-			Size:  itemData.Size,
-		}
-	}
-
-	return nil
+	defer m.resetDirty()
+
+	m.hooks.reload()
+	m.dropClean()
+	m.releaseAll()
+	m.size = hdr.Size
+	m.limit = hdr.Limit
+	m.items = make(map[K]item[V], len(entries))
+	now := nowNano()
+	for _, e := range entries {
+		// Entries which expired while the map was saved are not resurrected
+		if i, ok := loadedItem(e, now); ok {
+			m.items[e.Key] = i
+		} else {
+			m.size -= e.Size
+		}
+	}
+	return m.spillLoaded()
 }
 
 // LoadFromFileAsync loads the SafeMap from a file asynchronously
@@ -332,6 +292,9 @@ func (m *SafeMap[K, V]) LoadFromFileAsync(path string) *LoadResult {
 	go func() {
 		defer close(result.Done)
 		result.Error = m.LoadFromFile(path)
+		if result.Error != nil {
+			m.log.error("kmap: asynchronous load failed", "path", path, "error", result.Error)
+		}
 		result.Progress.Store(100)
 	}()
 
@@ -345,155 +308,60 @@ func (m *OrderedMap[K, V]) SaveToFile(path string) error {
 
 // SaveToFileWithOptions saves the OrderedMap to a file with the specified options
 func (m *OrderedMap[K, V]) SaveToFileWithOptions(path string, opts SaveOptions) error {
-	// Create parent directories if they don't exist
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return err
-	}
-
-	// Create a temporary buffer to write data
-	var buf bytes.Buffer
-	var finalWriter io.Writer = &buf
-
-	var gzipWriter *gzip.Writer
-	if opts.Compress {
-		level := opts.CompressLevel
-		if level == 0 {
-			level = gzip.DefaultCompression
-		}
-		var err error
-		gzipWriter, err = gzip.NewWriterLevel(&buf, level)
-		if err != nil {
-			return err
-		}
-		finalWriter = gzipWriter
-	}
-
-	// Write header
-	if err := writeHeader(finalWriter); err != nil {
-		return err
-	}
+	return m.SaveToBackend(NewFileBackend(path, opts))
+}
 
+// SaveTo writes the OrderedMap to w in the current file format, preserving order
+func (m *OrderedMap[K, V]) SaveTo(w io.Writer, opts SaveOptions) error {
 	m.RLock()
 	defer m.RUnlock()
 
-	// Write map header
-	if err := writeBinary(finalWriter, m.size); err != nil {
-		return err
-	}
-	if err := writeBinary(finalWriter, m.limit); err != nil {
-		return err
-	}
-	if err := writeBinary(finalWriter, int64(m.Len())); err != nil {
-		return err
-	}
-
-	// Write items in order
-	for el := m.Front(); el != nil; el = el.Next() {
-		if err := writeBinary(finalWriter, el.Key); err != nil {
-			return err
-		}
-		if err := writeBinary(finalWriter, el.Value); err != nil {
-			return err
-		}
-		if err := writeBinary(finalWriter, el.size); err != nil {
-			return err
-		}
-	}
-
-	// Close gzip writer if used
-	if gzipWriter != nil {
-		if err := gzipWriter.Close(); err != nil {
-			return err
-		}
-	}
-
-	// Write buffer to file
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+	hdr := fileHeader{
+		Size:  m.size,
+		Limit: m.limit,
+		Count: int64(len(m.kv)),
 	}
-	defer file.Close()
-
-	_, err = file.Write(buf.Bytes())
-	return err
+	return writeSnapshot(w, opts, hdr, func(emit func(key string, value []byte, size int, expires int64) error) error {
+		return m.eachRecord(opts.Encoding, func(rec Record) error {
+			return emit(rec.Key, rec.Value, rec.Size, 0)
+		})
+	})
 }
 
 // LoadFromFile loads the OrderedMap from a file at the specified path
 func (m *OrderedMap[K, V]) LoadFromFile(path string) error {
-	// Read entire file into memory
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-
-	// Create reader from data
-	reader := bytes.NewReader(data)
-	var finalReader io.Reader = reader
-
-	// Check if data is gzip compressed
-	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
-		gzipReader, err := gzip.NewReader(reader)
-		if err != nil {
-			return err
-		}
-		// For gzip reader, we need to read all data into a buffer
-		var buf bytes.Buffer
-		if _, err := io.Copy(&buf, gzipReader); err != nil {
-			gzipReader.Close()
-			return err
-		}
-		if err := gzipReader.Close(); err != nil {
-			return err
-		}
-		finalReader = bytes.NewReader(buf.Bytes())
-	}
-
-	// Read and verify header
-	if err := readHeader(finalReader); err != nil {
-		return err
-	}
+	return m.LoadFromBackend(NewFileBackend(path, SaveOptions{}))
+}
 
-	// Read map header
-	var size, limit int
-	var count int64
-	if err := readBinary(finalReader, &size); err != nil {
+// LoadFrom replaces the content of the OrderedMap with the data read from r.
+// Any format written by a previous version of kmap is accepted, compressed or not.
+// Files saved by a SafeMap have no meaningful order, entries are appended as they are read.
+func (m *OrderedMap[K, V]) LoadFrom(r io.Reader) error {
+	hdr, entries, err := readSnapshot[K, V](r)
+	if err != nil {
 		return err
 	}
-	if err := readBinary(finalReader, &limit); err != nil {
-		return err
-	}
-	if err := readBinary(finalReader, &count); err != nil {
-		return err
+	if hdr.Flags&flagDelta != 0 {
+		return ErrDeltaFile
 	}
 
 	m.Lock()
 	defer m.Unlock()
 
 	// Clear existing data
-	m.kv = make(map[K]*Element[K, V], int(count))
+	m.kv = make(map[K]*Element[K, V], len(entries))
 	m.ll = list[K, V]{}
-	m.size = size
-	m.limit = limit
-
-	// Read items in order
-	for i := int64(0); i < count; i++ {
-		var k K
-		var v V
-		var sz int
-		if err := readBinary(finalReader, &k); err != nil {
-			return err
-		}
-		if err := readBinary(finalReader, &v); err != nil {
-			return err
-		}
-		if err := readBinary(finalReader, &sz); err != nil {
-			return err
+	m.size = hdr.Size
+	m.limit = hdr.Limit
+
+	for _, e := range entries {
+		if old, ok := m.kv[e.Key]; ok {
+			m.ll.Remove(old)
 		}
-		el := m.ll.PushBack(k, v)
-		el.size = sz
-		m.kv[k] = el
+		el := m.ll.PushBack(e.Key, e.Value)
+		el.size = e.Size
+		m.kv[e.Key] = el
 	}
-
 	return nil
 }
 
@@ -0,0 +1,97 @@
+package kmap
+
+import "sort"
+
+// Pipeline chains transformations over a copy of the entries of a map, see SafeMap.Pipe.
+// Filter, Map, SortBy and Take are recorded and run in order by Collect, in place over a single copy
+// taken under one lock acquisition, so no intermediate slices are allocated and the functions run without the lock held.
+// A Pipeline can be collected several times, each time over fresh entries.
+type Pipeline[K comparable, V any] struct {
+	entries func() []Entry[K, V]
+	stages  []func(pairs []Entry[K, V]) []Entry[K, V]
+}
+
+// Pipe starts a pipeline over the entries of the SafeMap, in no particular order
+func (c *SafeMap[K, V]) Pipe() *Pipeline[K, V] {
+	return &Pipeline[K, V]{entries: c.Entries}
+}
+
+// Pipe starts a pipeline over the entries of the OrderedMap, in order
+func (m *OrderedMap[K, V]) Pipe() *Pipeline[K, V] {
+	return &Pipeline[K, V]{entries: m.Entries}
+}
+
+// Pipe starts a pipeline over the entries of the SortedMap, in ascending order
+func (m *SortedMap[K, V]) Pipe() *Pipeline[K, V] {
+	return &Pipeline[K, V]{entries: m.Entries}
+}
+
+func (p *Pipeline[K, V]) then(stage func(pairs []Entry[K, V]) []Entry[K, V]) *Pipeline[K, V] {
+	p.stages = append(p.stages, stage)
+	return p
+}
+
+// Filter keeps the entries pred is true for
+func (p *Pipeline[K, V]) Filter(pred func(key K, value V) bool) *Pipeline[K, V] {
+	return p.then(func(pairs []Entry[K, V]) []Entry[K, V] {
+		kept := pairs[:0]
+		for _, e := range pairs {
+			if pred(e.Key, e.Value) {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+}
+
+// Map replaces the value of each entry by the one fn returns, see PipeMap to change the type of the values
+func (p *Pipeline[K, V]) Map(fn func(key K, value V) V) *Pipeline[K, V] {
+	return p.then(func(pairs []Entry[K, V]) []Entry[K, V] {
+		for i, e := range pairs {
+			pairs[i].Value = fn(e.Key, e.Value)
+		}
+		return pairs
+	})
+}
+
+// SortBy sorts the entries with less, the sort is stable
+func (p *Pipeline[K, V]) SortBy(less func(a, b Entry[K, V]) bool) *Pipeline[K, V] {
+	return p.then(func(pairs []Entry[K, V]) []Entry[K, V] {
+		sort.SliceStable(pairs, func(i, j int) bool { return less(pairs[i], pairs[j]) })
+		return pairs
+	})
+}
+
+// Take keeps the first n entries
+func (p *Pipeline[K, V]) Take(n int) *Pipeline[K, V] {
+	return p.then(func(pairs []Entry[K, V]) []Entry[K, V] {
+		if n < 0 {
+			n = 0
+		}
+		if len(pairs) > n {
+			return pairs[:n]
+		}
+		return pairs
+	})
+}
+
+// Collect runs the pipeline and returns the resulting entries
+func (p *Pipeline[K, V]) Collect() []Entry[K, V] {
+	pairs := p.entries()
+	for _, stage := range p.stages {
+		pairs = stage(pairs)
+	}
+	return pairs
+}
+
+// PipeMap continues p with values of another type, computed by fn for each entry
+func PipeMap[K comparable, V any, R any](p *Pipeline[K, V], fn func(key K, value V) R) *Pipeline[K, R] {
+	return &Pipeline[K, R]{entries: func() []Entry[K, R] {
+		pairs := p.Collect()
+		mapped := make([]Entry[K, R], len(pairs))
+		for i, e := range pairs {
+			mapped[i] = Entry[K, R]{Key: e.Key, Value: fn(e.Key, e.Value)}
+		}
+		return mapped
+	}}
+}
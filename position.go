@@ -0,0 +1,114 @@
+package kmap
+
+// GetAt returns the key and value at position i in the order of the OrderedMap, ok is false when i is out of range.
+// It walks the list from the nearest end, under a single read lock.
+func (m *OrderedMap[K, V]) GetAt(i int) (key K, value V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	el := m.at(i)
+	if el == nil {
+		return key, value, false
+	}
+	return el.Key, el.Value, true
+}
+
+// IndexOf returns the position of key in the order of the OrderedMap, -1 when it is missing
+func (m *OrderedMap[K, V]) IndexOf(key K) int {
+	m.RLock()
+	defer m.RUnlock()
+	if _, ok := m.kv[key]; !ok {
+		return -1
+	}
+	i := 0
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		if el.Key == key {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+// at returns the element at position i, nil when out of range, the lock must be held
+func (m *OrderedMap[K, V]) at(i int) *Element[K, V] {
+	n := len(m.kv)
+	if i < 0 || i >= n {
+		return nil
+	}
+	if i < n/2 {
+		el := m.ll.Front()
+		for ; i > 0; i-- {
+			el = el.Next()
+		}
+		return el
+	}
+	el := m.ll.Back()
+	for j := n - 1; j > i; j-- {
+		el = el.Prev()
+	}
+	return el
+}
+
+// Slice returns the entries from position start up to end excluded, in order, under a single read lock,
+// for paginated APIs backed by an OrderedMap. Positions are clamped to the map, so a page past the end is empty.
+func (m *OrderedMap[K, V]) Slice(start, end int) []Entry[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	if start < 0 {
+		start = 0
+	}
+	if end > len(m.kv) {
+		end = len(m.kv)
+	}
+	if start >= end {
+		return nil
+	}
+	entries := make([]Entry[K, V], 0, end-start)
+	for el := m.at(start); len(entries) < end-start; el = el.Next() {
+		entries = append(entries, Entry[K, V]{Key: el.Key, Value: el.Value})
+	}
+	return entries
+}
+
+// PopFront removes the first entry and returns it, ok is false when the map is empty.
+// It is atomic, so the OrderedMap can back a work queue consumed by several goroutines.
+func (m *OrderedMap[K, V]) PopFront() (key K, value V, ok bool) {
+	m.Lock()
+	defer m.unlock()
+	return m.pop(m.ll.Front())
+}
+
+// PopBack removes the last entry and returns it, ok is false when the map is empty, see PopFront
+func (m *OrderedMap[K, V]) PopBack() (key K, value V, ok bool) {
+	m.Lock()
+	defer m.unlock()
+	return m.pop(m.ll.Back())
+}
+
+// pop removes el if not nil and returns its entry, the write lock must be held
+func (m *OrderedMap[K, V]) pop(el *Element[K, V]) (key K, value V, ok bool) {
+	if el == nil {
+		return key, value, false
+	}
+	m.remove(el.Key)
+	return el.Key, el.Value, true
+}
+
+// Sort reorders the entries with less under the write lock, so an insertion-ordered map can be sorted by key
+// or value on demand. The sort is stable, entries set afterwards are still appended to the back.
+// less must not call methods of the map.
+func (m *OrderedMap[K, V]) Sort(less func(a, b Entry[K, V]) bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.ll.Sort(func(a, b *Element[K, V]) bool {
+		return less(Entry[K, V]{Key: a.Key, Value: a.Value}, Entry[K, V]{Key: b.Key, Value: b.Value})
+	})
+}
+
+// Reverse flips the order of the entries in place under the write lock,
+// for sources delivering entries newest first when consumers want them oldest first
+func (m *OrderedMap[K, V]) Reverse() {
+	m.Lock()
+	m.ll.Reverse()
+	m.Unlock()
+}
@@ -0,0 +1,205 @@
+package kmap
+
+import "sync"
+
+type trieNode[V any] struct {
+	children map[byte]*trieNode[V]
+	value    V
+	set      bool
+	// count is the number of values in the subtree of the node, itself included
+	count int
+}
+
+// PrefixMap is a map of string keys stored in a trie: the entries sharing a prefix are found or removed
+// in time proportional to the prefix and to their number, whatever the size of the map.
+// It suits routing tables and invalidating namespaces of cache keys.
+type PrefixMap[V any] struct {
+	sync.RWMutex
+	root trieNode[V]
+}
+
+func NewPrefix[V any]() *PrefixMap[V] {
+	return &PrefixMap[V]{}
+}
+
+// node returns the node of key, nil when there is none, the lock must be held
+func (m *PrefixMap[V]) node(key string) *trieNode[V] {
+	n := &m.root
+	for i := 0; i < len(key); i++ {
+		n = n.children[key[i]]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (m *PrefixMap[V]) Get(key string) (v V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if n := m.node(key); n != nil && n.set {
+		return n.value, true
+	}
+	return v, false
+}
+
+// Has reports whether key is present
+func (m *PrefixMap[V]) Has(key string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	n := m.node(key)
+	return n != nil && n.set
+}
+
+func (m *PrefixMap[V]) Set(key string, value V) {
+	m.Lock()
+	defer m.Unlock()
+	if n := m.node(key); n != nil && n.set {
+		n.value = value
+		return
+	}
+	n := &m.root
+	n.count++
+	for i := 0; i < len(key); i++ {
+		child := n.children[key[i]]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[byte]*trieNode[V])
+			}
+			child = &trieNode[V]{}
+			n.children[key[i]] = child
+		}
+		child.count++
+		n = child
+	}
+	n.value = value
+	n.set = true
+}
+
+// Delete removes key and reports whether it was present
+func (m *PrefixMap[V]) Delete(key string) bool {
+	m.Lock()
+	defer m.Unlock()
+	n := m.node(key)
+	if n == nil || !n.set {
+		return false
+	}
+	n.set = false
+	n.value = *new(V)
+	m.detach(key, 1)
+	return true
+}
+
+// detach subtracts removed from the count of the nodes on the path of key,
+// unlinking the nodes left without values. The write lock must be held.
+func (m *PrefixMap[V]) detach(key string, removed int) {
+	n := &m.root
+	n.count -= removed
+	for i := 0; i < len(key); i++ {
+		child := n.children[key[i]]
+		child.count -= removed
+		if child.count == 0 {
+			delete(n.children, key[i])
+			return
+		}
+		n = child
+	}
+}
+
+// DeleteByPrefix removes every key starting with prefix and returns how many were removed
+func (m *PrefixMap[V]) DeleteByPrefix(prefix string) int {
+	m.Lock()
+	defer m.Unlock()
+	n := m.node(prefix)
+	if n == nil || n.count == 0 {
+		return 0
+	}
+	removed := n.count
+	if prefix == "" {
+		m.root = trieNode[V]{}
+		return removed
+	}
+	m.detach(prefix, removed)
+	return removed
+}
+
+// GetByPrefix returns the entries with a key starting with prefix
+func (m *PrefixMap[V]) GetByPrefix(prefix string) map[string]V {
+	m.RLock()
+	defer m.RUnlock()
+	n := m.node(prefix)
+	if n == nil {
+		return map[string]V{}
+	}
+	result := make(map[string]V, n.count)
+	walkTrie(n, []byte(prefix), func(key []byte, value V) {
+		result[string(key)] = value
+	})
+	return result
+}
+
+// KeysWithPrefix returns the keys starting with prefix, in no particular order
+func (m *PrefixMap[V]) KeysWithPrefix(prefix string) []string {
+	m.RLock()
+	defer m.RUnlock()
+	n := m.node(prefix)
+	if n == nil {
+		return nil
+	}
+	keys := make([]string, 0, n.count)
+	walkTrie(n, []byte(prefix), func(key []byte, _ V) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// CountPrefix returns the number of keys starting with prefix in O(len(prefix))
+func (m *PrefixMap[V]) CountPrefix(prefix string) int {
+	m.RLock()
+	defer m.RUnlock()
+	if n := m.node(prefix); n != nil {
+		return n.count
+	}
+	return 0
+}
+
+// LongestPrefixOf returns the longest key that is a prefix of s, the lookup of routing tables
+func (m *PrefixMap[V]) LongestPrefixOf(s string) (key string, value V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	n := &m.root
+	for i := 0; ; i++ {
+		if n.set {
+			key, value, ok = s[:i], n.value, true
+		}
+		if i == len(s) {
+			return
+		}
+		n = n.children[s[i]]
+		if n == nil {
+			return
+		}
+	}
+}
+
+func (m *PrefixMap[V]) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.root.count
+}
+
+func (m *PrefixMap[V]) Flush() {
+	m.Lock()
+	m.root = trieNode[V]{}
+	m.Unlock()
+}
+
+// walkTrie calls f for each value under n, key holds the path to n and is reused between calls
+func walkTrie[V any](n *trieNode[V], key []byte, f func(key []byte, value V)) {
+	if n.set {
+		f(key, n.value)
+	}
+	for b, child := range n.children {
+		walkTrie(child, append(key, b), f)
+	}
+}
@@ -0,0 +1,257 @@
+package kmap
+
+import (
+	"container/heap"
+	"sync"
+)
+
+type priorityEntry[K comparable, V any] struct {
+	key      K
+	value    V
+	priority float64
+	size     int
+	// index is the position of the entry in the heap
+	index int
+}
+
+// priorityHeap is a min-heap of entries ordered by priority, implementing heap.Interface
+type priorityHeap[K comparable, V any] []*priorityEntry[K, V]
+
+func (h priorityHeap[K, V]) Len() int           { return len(h) }
+func (h priorityHeap[K, V]) Less(i, j int) bool { return h[i].priority < h[j].priority }
+func (h priorityHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *priorityHeap[K, V]) Push(x any) {
+	e := x.(*priorityEntry[K, V])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *priorityHeap[K, V]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// PriorityMap keeps a priority with each entry, for caches where some entries are much more expensive to rebuild
+// than others: when the limit is reached, the entries with the lowest priority are evicted first.
+// PopLowest and PeekLowest are O(log n) and O(1) thanks to a heap.
+type PriorityMap[K comparable, V any] struct {
+	sync.RWMutex
+	items map[K]*priorityEntry[K, V]
+	heap  priorityHeap[K, V]
+	size  int
+	limit int
+
+	// sizeFunc replaces getValueSize when set, see WithSizeFunc
+	sizeFunc func(V) int
+}
+
+func NewPriority[K comparable, V any](limitMb ...int) *PriorityMap[K, V] {
+	limitmb := -1
+	if len(limitMb) > 0 && limitMb[0] > 0 {
+		limitmb = limitMb[0] * 1024 * 1024
+	}
+	return &PriorityMap[K, V]{
+		items: make(map[K]*priorityEntry[K, V]),
+		limit: limitmb,
+	}
+}
+
+// WithSizeFunc makes the PriorityMap measure values with fn instead of the default accounting (see Sizer).
+// It should be called right after NewPriority, before the map is used.
+func (m *PriorityMap[K, V]) WithSizeFunc(fn func(V) int) *PriorityMap[K, V] {
+	m.Lock()
+	m.sizeFunc = fn
+	m.Unlock()
+	return m
+}
+
+// valueSize returns the accounted size of value, the lock must be held
+func (m *PriorityMap[K, V]) valueSize(value V) int {
+	if m.sizeFunc != nil {
+		return m.sizeFunc(value)
+	}
+	return getValueSize(value)
+}
+
+// Set sets key to value with priority. When the map is full, entries with a priority lower than or equal to
+// priority are evicted, lowest first, to make room. If they do not free enough, ErrLimitExceeded is returned
+// and nothing changes: a cheap entry never evicts more expensive ones.
+func (m *PriorityMap[K, V]) Set(key K, value V, priority float64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	size := 0
+	if m.limit > 0 {
+		size = m.valueSize(value)
+		if size > m.limit {
+			return ErrLargeData
+		}
+		// The previous value of key is replaced, it does not need room
+		need := size
+		if old, ok := m.items[key]; ok {
+			need -= old.size
+		}
+		if m.size+need > m.limit {
+			if m.size+need-m.evictable(key, priority) > m.limit {
+				return ErrLimitExceeded
+			}
+			m.evict(key, func() bool { return m.size+need > m.limit })
+		}
+	}
+
+	if e, ok := m.items[key]; ok {
+		m.size += size - e.size
+		e.value = value
+		e.size = size
+		e.priority = priority
+		heap.Fix(&m.heap, e.index)
+		return nil
+	}
+	e := &priorityEntry[K, V]{key: key, value: value, priority: priority, size: size}
+	heap.Push(&m.heap, e)
+	m.items[key] = e
+	m.size += size
+	return nil
+}
+
+// evictable returns the size of the entries other than key with a priority lower than or equal to priority,
+// the lock must be held
+func (m *PriorityMap[K, V]) evictable(key K, priority float64) int {
+	size := 0
+	for _, e := range m.heap {
+		if e.priority <= priority && e.key != key {
+			size += e.size
+		}
+	}
+	return size
+}
+
+// evict removes the entries with the lowest priority, except key, while more returns true. The write lock must be held.
+func (m *PriorityMap[K, V]) evict(key K, more func() bool) {
+	var kept []*priorityEntry[K, V]
+	for more() && len(m.heap) > 0 {
+		e := heap.Pop(&m.heap).(*priorityEntry[K, V])
+		if e.key == key {
+			kept = append(kept, e)
+			continue
+		}
+		delete(m.items, e.key)
+		m.size -= e.size
+	}
+	for _, e := range kept {
+		heap.Push(&m.heap, e)
+	}
+}
+
+func (m *PriorityMap[K, V]) Get(key K) (v V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if e, ok := m.items[key]; ok {
+		return e.value, true
+	}
+	return v, false
+}
+
+// Priority returns the priority of key, ok is false when it is missing
+func (m *PriorityMap[K, V]) Priority(key K) (priority float64, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if e, ok := m.items[key]; ok {
+		return e.priority, true
+	}
+	return 0, false
+}
+
+// SetPriority changes the priority of key and reports whether it is present
+func (m *PriorityMap[K, V]) SetPriority(key K, priority float64) bool {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.items[key]
+	if ok {
+		e.priority = priority
+		heap.Fix(&m.heap, e.index)
+	}
+	return ok
+}
+
+// Delete removes key and reports whether it was present
+func (m *PriorityMap[K, V]) Delete(key K) bool {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.items[key]
+	if ok {
+		heap.Remove(&m.heap, e.index)
+		delete(m.items, key)
+		m.size -= e.size
+	}
+	return ok
+}
+
+// PopLowest removes the entry with the lowest priority and returns it, ok is false when the map is empty
+func (m *PriorityMap[K, V]) PopLowest() (key K, value V, priority float64, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.heap) == 0 {
+		return key, value, 0, false
+	}
+	e := heap.Pop(&m.heap).(*priorityEntry[K, V])
+	delete(m.items, e.key)
+	m.size -= e.size
+	return e.key, e.value, e.priority, true
+}
+
+// PeekLowest returns the entry with the lowest priority without removing it, ok is false when the map is empty
+func (m *PriorityMap[K, V]) PeekLowest() (key K, value V, priority float64, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if len(m.heap) == 0 {
+		return key, value, 0, false
+	}
+	e := m.heap[0]
+	return e.key, e.value, e.priority, true
+}
+
+func (m *PriorityMap[K, V]) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.items)
+}
+
+func (m *PriorityMap[K, V]) Keys() []K {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]K, 0, len(m.items))
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Size returns the total accounted size of the values in bytes.
+// Values are only measured when the map has a limit, Size is 0 for unlimited maps.
+func (m *PriorityMap[K, V]) Size() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.size
+}
+
+// Limit returns the size limit in bytes, -1 when the map is unlimited
+func (m *PriorityMap[K, V]) Limit() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.limit
+}
+
+func (m *PriorityMap[K, V]) Flush() {
+	m.Lock()
+	m.items = make(map[K]*priorityEntry[K, V])
+	m.heap = nil
+	m.size = 0
+	m.Unlock()
+}
@@ -0,0 +1,124 @@
+package kmap
+
+import "sort"
+
+// Query selects, sorts and pages the entries of a map like a small in-memory database, see SafeMap.Query.
+// It runs when Collect, Count, Keys, Values or First is called: the entries are filtered under a single read lock,
+// so the result is consistent, then sorted and paged without the lock. A Query can be run several times.
+type Query[K comparable, V any] struct {
+	scan   func(visit func(key K, value V))
+	where  []func(key K, value V) bool
+	less   func(a, b Pair[K, V]) bool
+	offset int
+	limit  int
+}
+
+// Query starts a query over the entries of the SafeMap
+func (c *SafeMap[K, V]) Query() *Query[K, V] {
+	return &Query[K, V]{scan: func(visit func(key K, value V)) {
+		c.RLock()
+		defer c.RUnlock()
+		now := nowNano()
+		for k, i := range c.items {
+			if !i.expired(now) {
+				visit(k, c.value(i))
+			}
+		}
+	}}
+}
+
+// Query starts a query over the entries of the OrderedMap, results keep the order of the map unless OrderBy is used
+func (m *OrderedMap[K, V]) Query() *Query[K, V] {
+	return &Query[K, V]{scan: func(visit func(key K, value V)) {
+		m.RLock()
+		defer m.RUnlock()
+		for el := m.ll.Front(); el != nil; el = el.Next() {
+			visit(el.Key, el.Value)
+		}
+	}}
+}
+
+// Where keeps the entries matching pred, several Where must all match. pred runs under the read lock of the map
+// and must not call its methods.
+func (q *Query[K, V]) Where(pred func(key K, value V) bool) *Query[K, V] {
+	q.where = append(q.where, pred)
+	return q
+}
+
+// OrderBy sorts the results with less, the sort is stable
+func (q *Query[K, V]) OrderBy(less func(a, b Pair[K, V]) bool) *Query[K, V] {
+	q.less = less
+	return q
+}
+
+// Offset skips the first n results
+func (q *Query[K, V]) Offset(n int) *Query[K, V] {
+	q.offset = n
+	return q
+}
+
+// Limit keeps at most n results, all of them when n <= 0
+func (q *Query[K, V]) Limit(n int) *Query[K, V] {
+	q.limit = n
+	return q
+}
+
+// Collect runs the query and returns the matching entries
+func (q *Query[K, V]) Collect() []Pair[K, V] {
+	var pairs []Pair[K, V]
+	q.scan(func(key K, value V) {
+		for _, pred := range q.where {
+			if !pred(key, value) {
+				return
+			}
+		}
+		pairs = append(pairs, Pair[K, V]{Key: key, Value: value})
+	})
+	if q.less != nil {
+		sort.SliceStable(pairs, func(i, j int) bool { return q.less(pairs[i], pairs[j]) })
+	}
+	if q.offset > 0 {
+		if q.offset >= len(pairs) {
+			return nil
+		}
+		pairs = pairs[q.offset:]
+	}
+	if q.limit > 0 && len(pairs) > q.limit {
+		pairs = pairs[:q.limit]
+	}
+	return pairs
+}
+
+// Count runs the query and returns the number of results
+func (q *Query[K, V]) Count() int {
+	return len(q.Collect())
+}
+
+// Keys runs the query and returns the keys of the results
+func (q *Query[K, V]) Keys() []K {
+	pairs := q.Collect()
+	keys := make([]K, len(pairs))
+	for i, p := range pairs {
+		keys[i] = p.Key
+	}
+	return keys
+}
+
+// Values runs the query and returns the values of the results
+func (q *Query[K, V]) Values() []V {
+	pairs := q.Collect()
+	values := make([]V, len(pairs))
+	for i, p := range pairs {
+		values[i] = p.Value
+	}
+	return values
+}
+
+// First runs the query and returns its first result, ok is false when there is none
+func (q *Query[K, V]) First() (p Pair[K, V], ok bool) {
+	pairs := q.Collect()
+	if len(pairs) == 0 {
+		return p, false
+	}
+	return pairs[0], true
+}
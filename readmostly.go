@@ -0,0 +1,62 @@
+package kmap
+
+import "sync/atomic"
+
+// readMostly is the lock-free read path of a SafeMap, see WithReadMostly
+type readMostly[K comparable, V any] struct {
+	enabled bool
+	// clean is a complete view of the items nobody changes, nil while writes are more recent
+	clean atomic.Pointer[map[K]item[V]]
+	// misses counts the reads that took the lock since clean was dropped
+	misses atomic.Int64
+}
+
+// WithReadMostly makes reads (Get, GetAny, Has) of the SafeMap lock-free for workloads with a stable key set, like sync.Map:
+// they use a read-only view of the items that the first write drops. Reads then take the read lock again,
+// and once they missed the view as many times as there are entries, the current items become the new view.
+// The next write copies them (see Snapshot), so frequent writes get slower: keep the default for write-heavy maps.
+// Maps using WithOverflow always take the lock. It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithReadMostly() *SafeMap[K, V] {
+	c.Lock()
+	c.readMostly.enabled = true
+	c.Unlock()
+	return c
+}
+
+// fromClean looks key up in the read-only view, ok is false when there is none and the lock must be taken
+func (c *SafeMap[K, V]) fromClean(key K) (i item[V], exists, ok bool) {
+	clean := c.readMostly.clean.Load()
+	if clean == nil {
+		return i, false, false
+	}
+	i, exists = (*clean)[key]
+	return i, exists, true
+}
+
+// missed counts a read that took the lock and reports whether the view should be rebuilt, the read lock must be held
+func (c *SafeMap[K, V]) missed() bool {
+	if !c.readMostly.enabled {
+		return false
+	}
+	return c.readMostly.misses.Add(1) >= int64(len(c.items))
+}
+
+// promote makes the current items the read-only view, they are copied by the next write
+func (c *SafeMap[K, V]) promote() {
+	c.Lock()
+	defer c.Unlock()
+	if c.overflowDir != "" || c.arena != nil || c.readMostly.clean.Load() != nil {
+		return
+	}
+	items := c.items
+	c.shared = true
+	c.readMostly.misses.Store(0)
+	c.readMostly.clean.Store(&items)
+}
+
+// dropClean discards the read-only view before the items change, the write lock must be held
+func (c *SafeMap[K, V]) dropClean() {
+	if c.readMostly.enabled {
+		c.readMostly.clean.Store(nil)
+	}
+}
@@ -0,0 +1,191 @@
+package kmap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// FollowOptions configures Follow
+type FollowOptions struct {
+	// TLSConfig makes the connections to the leader use TLS, serve them with tls.NewListener
+	TLSConfig *tls.Config
+	// RetryInterval is how long to wait before connecting again after the connection to the leader is lost, 1s by default
+	RetryInterval time.Duration
+	// OnError receives the errors ending the connections to the leader, they are retried anyway
+	OnError func(err error)
+}
+
+// replMessage is a line of the replication protocol: the snapshot is a series of set messages ended by synced,
+// then each change of the leader follows with its Seq
+type replMessage[K comparable, V any] struct {
+	Op    string `json:"op"`
+	Seq   uint64 `json:"seq,omitempty"`
+	Key   K      `json:"key"`
+	Value V      `json:"value"`
+}
+
+// replSynced is the Op ending the snapshot
+const replSynced = "synced"
+
+// ServeReplication makes the SafeMap the leader of the followers connecting to l (see Follow), until l is closed:
+// each follower receives a snapshot of the map then every change from then on, so several processes share
+// a warm cache. Wrap l with tls.NewListener to use TLS. A follower falling behind by more than the buffer
+// of WithChangeBuffer is disconnected, it then connects again and catches up from a new snapshot.
+// Keys and values are sent as JSON, TTLs are not replicated: followers can expire entries with WithDefaultTTL.
+// Loading the map (LoadFromFile, LoadFromBackend...) disconnects the followers, which catch up from a new snapshot.
+// Like http.Serve, it always returns a non-nil error, the one of l.Accept.
+func (c *SafeMap[K, V]) ServeReplication(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.replicate(conn)
+	}
+}
+
+// replicate sends a snapshot then the changes of the map to the follower on conn until it is gone or behind
+func (c *SafeMap[K, V]) replicate(conn net.Conn) {
+	defer conn.Close()
+	// The stream starts right after the snapshot so no change is missed or sent twice
+	c.Lock()
+	changes := c.hooks.subscribeWith(BufferClose)
+	s := c.snapshot()
+	c.Unlock()
+	go func() {
+		// Followers send nothing, the read returns once they are gone or conn is closed
+		io.Copy(io.Discard, conn)
+		c.CloseChanges(changes)
+	}()
+
+	w := bufio.NewWriter(conn)
+	enc := json.NewEncoder(w)
+	now := nowNano()
+	for k, i := range s.items {
+		if i.expired(now) {
+			continue
+		}
+		if enc.Encode(replMessage[K, V]{Op: EventSet.String(), Key: k, Value: s.value(i)}) != nil {
+			return
+		}
+	}
+	if enc.Encode(replMessage[K, V]{Op: replSynced, Seq: s.hooks.seq}) != nil || w.Flush() != nil {
+		return
+	}
+	for ch := range changes {
+		if enc.Encode(replMessage[K, V]{Op: ch.Kind.String(), Seq: ch.Seq, Key: ch.Key, Value: ch.Value}) != nil {
+			return
+		}
+		if len(changes) == 0 && w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Follow makes the SafeMap a follower of the leader serving ServeReplication at addr, until ctx is done:
+// the content of the map is replaced by a snapshot of the leader, then every change of the leader is applied to it.
+// The connection is retried whenever it is lost, catching up from a new snapshot, so the map never needs
+// to be reloaded by hand. Changes made to the follower itself are not sent back and may be overwritten.
+// It returns the error of ctx.
+func (c *SafeMap[K, V]) Follow(ctx context.Context, addr string, opts ...FollowOptions) error {
+	var o FollowOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = time.Second
+	}
+	for {
+		err := c.follow(ctx, addr, o.TLSConfig)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if o.OnError != nil {
+			o.OnError(err)
+		}
+		select {
+		case <-time.After(o.RetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// follow applies the snapshot and the changes sent by the leader at addr until the connection is lost
+func (c *SafeMap[K, V]) follow(ctx context.Context, addr string, config *tls.Config) error {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	snapshot := make(map[K]V)
+	for {
+		var msg replMessage[K, V]
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if snapshot != nil {
+			switch msg.Op {
+			case EventSet.String():
+				snapshot[msg.Key] = msg.Value
+			case replSynced:
+				if err := c.replace(snapshot); err != nil {
+					return err
+				}
+				snapshot = nil
+			default:
+				return fmt.Errorf("kmap: unexpected replication message %q in the snapshot", msg.Op)
+			}
+			continue
+		}
+		switch msg.Op {
+		case EventSet.String():
+			err = c.Set(msg.Key, msg.Value)
+		case EventDelete.String():
+			c.Delete(msg.Key)
+		case EventFlush.String():
+			c.Flush()
+		default:
+			err = fmt.Errorf("kmap: unexpected replication message %q", msg.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replace makes entries the content of the map under a single lock, the keys missing from entries are deleted
+func (c *SafeMap[K, V]) replace(entries map[K]V) error {
+	c.Lock()
+	defer c.unlock()
+	deleted := make(map[K]bool)
+	for k := range c.items {
+		if _, ok := entries[k]; !ok {
+			deleted[k] = true
+		}
+	}
+	return c.apply(entries, deleted)
+}
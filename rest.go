@@ -0,0 +1,110 @@
+package kmap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// RESTOptions configures RESTHandler
+type RESTOptions struct {
+	// Middleware wraps the handler, to authenticate the requests for instance
+	Middleware func(next http.Handler) http.Handler
+	// MaxBodyBytes limits the size of PUT bodies, 1MB by default
+	MaxBodyBytes int64
+	// ReadOnly rejects PUT and DELETE with 405
+	ReadOnly bool
+}
+
+// RESTHandler serves the SafeMap as a REST resource, so small services can use it as their storage:
+//
+//	GET    /{key}                          the value as JSON, 404 when missing
+//	PUT    /{key}                          sets the JSON value of the body, 204
+//	DELETE /{key}                          204, 404 when missing
+//	GET    /?prefix=p&offset=0&limit=100   {"total", "items": [{"key", "value"}]}, keys sorted
+//
+// Keys are the path below the mount point, mount it with http.StripPrefix. PUT answers 413 for values
+// above the limit of the map (ErrLargeData) and 507 when the map is full (ErrLimitExceeded).
+func RESTHandler[V any](c *SafeMap[string, V], opts ...RESTOptions) http.Handler {
+	var o RESTOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = 1 << 20
+	}
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if o.ReadOnly && r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case key == "" && r.Method == http.MethodGet:
+			restList(c, w, r)
+		case key == "":
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		case r.Method == http.MethodGet:
+			v, ok := c.Get(key)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, v)
+		case r.Method == http.MethodPut:
+			var v V
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, o.MaxBodyBytes)).Decode(&v); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := c.Set(key, v); err != nil {
+				writeError(w, restStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			if _, ok := c.GetAndDelete(key); !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	if o.Middleware != nil {
+		h = o.Middleware(h)
+	}
+	return h
+}
+
+// restList answers the listing of RESTHandler
+func restList[V any](c *SafeMap[string, V], w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	entries := c.Query().Where(func(key string, value V) bool {
+		return strings.HasPrefix(key, prefix)
+	}).OrderBy(func(a, b Pair[string, V]) bool {
+		return a.Key < b.Key
+	}).Collect()
+	type restItem struct {
+		Key   string `json:"key"`
+		Value V      `json:"value"`
+	}
+	items := make([]restItem, 0, len(entries))
+	for _, e := range page(entries, r) {
+		items = append(items, restItem{Key: e.Key, Value: e.Value})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"total": len(entries), "items": items})
+}
+
+// restStatus returns the HTTP status of an error of Set
+func restStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrLargeData):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrLimitExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
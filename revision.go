@@ -0,0 +1,98 @@
+package kmap
+
+import "fmt"
+
+// RevisionConflictError is returned by SetIfRevision when the key was changed since the expected revision
+type RevisionConflictError[K comparable] struct {
+	Key      K
+	Expected uint64
+	// Actual is the current revision of the key, 0 when it is missing
+	Actual uint64
+}
+
+func (e *RevisionConflictError[K]) Error() string {
+	return fmt.Sprintf("revision conflict on key %v: expected %d, found %d", e.Key, e.Expected, e.Actual)
+}
+
+// GetWithRevision returns the value of key with its revision, which changes whenever the key is set or deleted:
+// revisions are increasing numbers shared by all the keys of the map (the Seq of their last Change),
+// so a key set again after a delete never gets back an old revision. They make cheap ETags and
+// "has this changed since I last looked" checks. Entries loaded from a file or a backend have revision 0 until they change.
+func (c *SafeMap[K, V]) GetWithRevision(key K) (v V, rev uint64, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	i, ok := c.items[key]
+	if !ok || !i.live() {
+		return v, 0, false
+	}
+	c.stats.hit(key)
+	c.idle.access(key)
+	return c.value(i), i.rev, true
+}
+
+// Revision returns the revision of key without reading its value, 0 when it is missing, see GetWithRevision
+func (c *SafeMap[K, V]) Revision(key K) uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	if i, ok := c.items[key]; ok && i.live() {
+		return i.rev
+	}
+	return 0
+}
+
+// GetWithRevision returns the value of key with its revision, see SafeMap.GetWithRevision
+func (m *OrderedMap[K, V]) GetWithRevision(key K) (v V, rev uint64, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	element, ok := m.kv[key]
+	if !ok {
+		return v, 0, false
+	}
+	m.stats.hit(key)
+	return element.Value, element.rev, true
+}
+
+// Revision returns the revision of key without reading its value, 0 when it is missing, see GetWithRevision
+func (m *OrderedMap[K, V]) Revision(key K) uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	if element, ok := m.kv[key]; ok {
+		return element.rev
+	}
+	return 0
+}
+
+// SetIfRevision sets key to value only if its revision is still expectedRev, 0 meaning the key must be missing,
+// giving optimistic concurrency control to goroutines editing shared entries: read with GetWithRevision,
+// compute, then retry on a *RevisionConflictError. Other errors are those of Set.
+// Entries loaded from a file or a backend must be set once before they can be guarded.
+func (c *SafeMap[K, V]) SetIfRevision(key K, value V, expectedRev uint64) error {
+	c.Lock()
+	defer c.unlock()
+	// An expired entry is missing, like for GetWithRevision
+	var rev uint64
+	i, ok := c.items[key]
+	ok = ok && i.live()
+	if ok {
+		rev = i.rev
+	}
+	if ok != (expectedRev != 0) || rev != expectedRev {
+		return &RevisionConflictError[K]{Key: key, Expected: expectedRev, Actual: rev}
+	}
+	return c.set(key, value)
+}
+
+// SetIfRevision sets key to value only if its revision is still expectedRev, see SafeMap.SetIfRevision
+func (m *OrderedMap[K, V]) SetIfRevision(key K, value V, expectedRev uint64) error {
+	m.Lock()
+	defer m.unlock()
+	var rev uint64
+	element, ok := m.kv[key]
+	if ok {
+		rev = element.rev
+	}
+	if ok != (expectedRev != 0) || rev != expectedRev {
+		return &RevisionConflictError[K]{Key: key, Expected: expectedRev, Actual: rev}
+	}
+	return m.set(key, value)
+}
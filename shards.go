@@ -0,0 +1,267 @@
+package kmap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// shardFilePattern names each shard file after its index and the total number of shards
+const shardFilePattern = "shard-%04d-of-%04d.kmap"
+
+// shardLockFile is the file of a shard directory locked while a set is saved or loaded, see openLocked
+const shardLockFile = "shards.lock"
+
+var ErrIncompleteShards = errors.New("shard set is incomplete")
+
+type shardEntry[V any] struct {
+	key  string
+	item item[V]
+}
+
+// SaveToShards splits the SafeMap across n files in dir, one per hash range of the keys,
+// encoding and writing them in parallel. This is much faster than SaveToFile for maps of several GB.
+// Like SaveToFile, the set is saved under a lock (see SaveOptions.LockTimeout) and the shards are written
+// to temporary files renamed over the previous ones once they are all written. A crash while renaming them
+// leaves shards of two saves, which LoadFromShards refuses.
+// Shard files left over from a previous save with a different n are removed once the new set is written.
+func (m *SafeMap[K, V]) SaveToShards(dir string, n int, opts SaveOptions) error {
+	if n < 1 {
+		n = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	lock, err := openLocked(filepath.Join(dir, shardLockFile), os.O_RDWR|os.O_CREATE, opts.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	// Partition and encode a snapshot, see Snapshot, so values changed during the save are not read
+	m.Lock()
+	s := m.snapshot()
+	hasher := m.hasher
+	m.resetDirty()
+	m.Unlock()
+	buckets := make([][]shardEntry[V], n)
+	for k, v := range s.items {
+		key, err := encodeKey(k)
+		if err != nil {
+			return err
+		}
+		i := shardIndex(key, n)
+		if hasher != nil {
+			i = int(hasher(k) % uint64(n))
+		}
+		buckets[i] = append(buckets[i], shardEntry[V]{key: key, item: v})
+	}
+
+	// The shards of a save share their creation time, so a set mixing several saves is detected
+	created := time.Now().UnixNano()
+	temps := make([]string, n)
+	err = runParallel(n, func(i int) error {
+		hdr := fileHeader{
+			CreatedAt: created,
+			Limit:     s.limit,
+			Count:     int64(len(buckets[i])),
+		}
+		for _, e := range buckets[i] {
+			hdr.Size += e.item.Size
+		}
+
+		var buf bytes.Buffer
+		for _, e := range buckets[i] {
+			if e.item.expires != 0 {
+				hdr.Flags |= flagExpiry
+				break
+			}
+		}
+		err := writeSnapshot(&buf, opts, hdr, func(emit func(key string, value []byte, size int, expires int64) error) error {
+			for _, e := range buckets[i] {
+				value, err := marshalValue(opts.Encoding, e.item.Value)
+				if err != nil {
+					return err
+				}
+				if err := emit(e.key, value, e.item.Size, e.item.expires); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		temps[i], err = writeTemp(filepath.Join(dir, fmt.Sprintf(shardFilePattern, i, n)), buf.Bytes())
+		return err
+	})
+	for i := 0; err == nil && i < n; i++ {
+		err = os.Rename(temps[i], filepath.Join(dir, fmt.Sprintf(shardFilePattern, i, n)))
+		temps[i] = ""
+	}
+	if err != nil {
+		for _, tmp := range temps {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+		// The base snapshot is unknown now, deltas are refused until the next full save
+		m.dirtyMu.Lock()
+		m.dirty = nil
+		m.dirtyMu.Unlock()
+		return err
+	}
+
+	// Remove shards of previous saves using a different shard count
+	files, err := filepath.Glob(filepath.Join(dir, "shard-*-of-*.kmap"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		var idx, total int
+		if _, err := fmt.Sscanf(filepath.Base(f), shardFilePattern, &idx, &total); err == nil && total != n {
+			os.Remove(f)
+		}
+	}
+	return nil
+}
+
+// LoadFromShards replaces the content of the SafeMap with the shard files saved in dir by SaveToShards,
+// reading them in parallel. It fails with ErrIncompleteShards if a shard of the set is missing
+// or comes from another save.
+func (m *SafeMap[K, V]) LoadFromShards(dir string) error {
+	// Sets saved without the lock file have no saver to wait for
+	if lock, err := openLocked(filepath.Join(dir, shardLockFile), os.O_RDONLY, 0); err == nil {
+		defer lock.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	paths, err := shardFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	headers := make([]fileHeader, len(paths))
+	results := make([][]fileEntry[K, V], len(paths))
+	err = runParallel(len(paths), func(i int) error {
+		file, err := os.Open(paths[i])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		headers[i], results[i], err = readSnapshot[K, V](file)
+		if err == nil && headers[i].Flags&flagDelta != 0 {
+			err = ErrDeltaFile
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i, hdr := range headers {
+		if hdr.CreatedAt != headers[0].CreatedAt {
+			return fmt.Errorf("%w: %s and %s were written by different saves", ErrIncompleteShards, paths[0], paths[i])
+		}
+	}
+
+	total := 0
+	for _, entries := range results {
+		total += len(entries)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	defer m.resetDirty()
+	m.hooks.reload()
+	m.dropClean()
+	m.releaseAll()
+	m.items = make(map[K]item[V], total)
+	m.size = 0
+	m.limit = headers[0].Limit
+	now := nowNano()
+	for i, entries := range results {
+		m.size += headers[i].Size
+		for _, e := range entries {
+			if it, ok := loadedItem(e, now); ok {
+				m.items[e.Key] = it
+			} else {
+				m.size -= e.Size
+			}
+		}
+	}
+	return m.spillLoaded()
+}
+
+// shardFiles returns the paths of a complete shard set in dir, ordered by shard index
+func shardFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "shard-*-of-*.kmap"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: no shard files in %s", ErrIncompleteShards, dir)
+	}
+
+	found := make(map[int]string)
+	expected := 0
+	for _, f := range files {
+		var idx, total int
+		if _, err := fmt.Sscanf(filepath.Base(f), shardFilePattern, &idx, &total); err != nil {
+			continue
+		}
+		if expected != 0 && total != expected {
+			return nil, fmt.Errorf("%w: mixed shard counts %d and %d in %s", ErrIncompleteShards, expected, total, dir)
+		}
+		expected = total
+		found[idx] = f
+	}
+	if expected == 0 || len(found) != expected {
+		return nil, fmt.Errorf("%w: found %d of %d shards in %s", ErrIncompleteShards, len(found), expected, dir)
+	}
+
+	paths := make([]string, 0, expected)
+	for idx := 0; idx < expected; idx++ {
+		p, ok := found[idx]
+		if !ok {
+			return nil, fmt.Errorf("%w: shard %d missing in %s", ErrIncompleteShards, idx, dir)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// shardIndex maps an encoded key to one of n shards
+func shardIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// runParallel calls fn for 0..n-1 using at most GOMAXPROCS goroutines and returns the first error
+func runParallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(i); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,495 @@
+package kmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+var (
+	ErrSharedReadOnly    = errors.New("shared map opened read-only, only its creator can change it")
+	ErrSharedWriter      = errors.New("shared map already has a writer")
+	ErrSharedUnsupported = errors.New("shared maps are not supported on this platform")
+)
+
+// Layout of a shared map file: a header, a hash table of buckets pointing into a heap of records.
+// Records are [key length u32][value length u32][key][value], appended to the heap;
+// replaced and deleted ones are garbage until the heap is full and compacted.
+const (
+	sharedMagic   = "KMSH"
+	sharedVersion = 1
+
+	sharedOffSeq        = 8
+	sharedOffSize       = 16
+	sharedOffBuckets    = 24
+	sharedOffCount      = 32
+	sharedOffTombstones = 40
+	sharedOffUsed       = 48
+	sharedOffGarbage    = 56
+	sharedHeader        = 64
+
+	// Buckets hold 0 when empty, 1 when deleted, else the offset of the record in the heap + 2
+	sharedEmpty   = 0
+	sharedDeleted = 1
+)
+
+// SharedMap is an experimental map stored in a memory-mapped file, so several processes on one host share
+// a read-mostly dataset instead of holding a copy each: one process creates and writes it (see CreateShared),
+// the others read it in place (see OpenShared). Keys are strings, values are encoded like in snapshot files.
+// Reads never block the writer, they retry while a write is in progress, so a writer dying in the middle
+// of a write leaves the map unreadable until it is created again. Unix only.
+type SharedMap[V any] struct {
+	mu       sync.Mutex
+	file     *os.File
+	data     []byte
+	enc      Encoding
+	writable bool
+}
+
+// CreateShared creates the shared map file at path, replacing any previous one, with room for sizeBytes
+// of keys, values and index, and opens it for writing. Only one process can have it open for writing at a time,
+// ErrSharedWriter is returned otherwise. Values are encoded with enc, JSON by default.
+// The new file is renamed over the previous one, so processes that still map it keep reading its last content
+// until they open the map again, instead of crashing on a truncated mapping.
+func CreateShared[V any](path string, sizeBytes int, enc ...Encoding) (*SharedMap[V], error) {
+	e := EncodingJSON
+	if len(enc) > 0 {
+		e = enc[0]
+	}
+	if !e.valid() {
+		return nil, ErrUnknownEncoding
+	}
+	buckets := 16
+	for buckets*128 < sizeBytes {
+		buckets *= 2
+	}
+	if sizeBytes < sharedHeader+buckets*8+64 {
+		sizeBytes = sharedHeader + buckets*8 + 64
+	}
+	// The lock of the previous file tells whether a writer still has it open
+	old, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer old.Close()
+	if ok, err := tryLockFile(old, true); !ok || err != nil {
+		if err == nil {
+			err = ErrSharedWriter
+		}
+		return nil, err
+	}
+	if same, err := sameFile(old, path); err != nil || !same {
+		// Another writer replaced it since it was opened
+		if err == nil {
+			err = ErrSharedWriter
+		}
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	data, err := createSharedFile(f, sizeBytes)
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+		if err != nil {
+			munmapShared(data)
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	s := &SharedMap[V]{file: f, data: data, enc: e, writable: true}
+	le := binary.LittleEndian
+	le.PutUint16(data[4:], sharedVersion)
+	le.PutUint16(data[6:], uint16(e))
+	le.PutUint64(data[sharedOffSize:], uint64(sizeBytes))
+	le.PutUint64(data[sharedOffBuckets:], uint64(buckets))
+	// The magic is written last, readers opening the file meanwhile see it as invalid
+	copy(data, sharedMagic)
+	return s, nil
+}
+
+// createSharedFile locks the new file f, sizes it to sizeBytes and maps it for writing
+func createSharedFile(f *os.File, sizeBytes int) ([]byte, error) {
+	if ok, err := tryLockFile(f, true); !ok || err != nil {
+		if err == nil {
+			err = ErrSharedWriter
+		}
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(sizeBytes)); err != nil {
+		return nil, err
+	}
+	return mmapShared(f, sizeBytes, true)
+}
+
+// OpenShared opens the shared map file at path created by CreateShared for reading
+func OpenShared[V any](path string) (*SharedMap[V], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < sharedHeader {
+		f.Close()
+		return nil, ErrInvalidFormat
+	}
+	data, err := mmapShared(f, int(info.Size()), false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &SharedMap[V]{file: f, data: data}
+	le := binary.LittleEndian
+	switch {
+	case string(data[:4]) != sharedMagic || le.Uint64(data[sharedOffSize:]) != uint64(len(data)):
+		err = ErrInvalidFormat
+	case le.Uint16(data[4:]) != sharedVersion:
+		err = ErrUnsupportedVersion
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.enc = Encoding(le.Uint16(data[6:]))
+	return s, nil
+}
+
+// Close unmaps the file, the SharedMap must not be used afterwards. Readers keep the data of a closed writer.
+func (s *SharedMap[V]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		return nil
+	}
+	err := munmapShared(s.data)
+	s.data = nil
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// seq is the write counter of the map, odd while a write is in progress
+func (s *SharedMap[V]) seq() *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.data[sharedOffSeq]))
+}
+
+// read runs fn until it reads the map while no write is in progress, fn must copy what it reads.
+// fn returns false when it read inconsistent data, which only happens while a write is in progress.
+func (s *SharedMap[V]) read(fn func() bool) {
+	for {
+		before := atomic.LoadUint64(s.seq())
+		if before%2 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		ok := fn()
+		if atomic.LoadUint64(s.seq()) == before && ok {
+			return
+		}
+	}
+}
+
+// write runs fn as a write of the map, readers retry until it is done
+func (s *SharedMap[V]) write(fn func() error) error {
+	if !s.writable {
+		return ErrSharedReadOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.seq()
+	atomic.StoreUint64(seq, atomic.LoadUint64(seq)+1)
+	defer atomic.StoreUint64(seq, atomic.LoadUint64(seq)+1)
+	return fn()
+}
+
+func (s *SharedMap[V]) header(off int) uint64 {
+	return binary.LittleEndian.Uint64(s.data[off:])
+}
+
+func (s *SharedMap[V]) setHeader(off int, v uint64) {
+	binary.LittleEndian.PutUint64(s.data[off:], v)
+}
+
+// heap returns the region holding the records
+func (s *SharedMap[V]) heap() []byte {
+	return s.data[sharedHeader+8*int(s.header(sharedOffBuckets)):]
+}
+
+// bucket returns the content of bucket b
+func (s *SharedMap[V]) bucket(b uint64) uint64 {
+	return binary.LittleEndian.Uint64(s.data[sharedHeader+8*b:])
+}
+
+func (s *SharedMap[V]) setBucket(b, v uint64) {
+	binary.LittleEndian.PutUint64(s.data[sharedHeader+8*b:], v)
+}
+
+// record returns the key and value of the record at off in the heap, ok is false when it is out of bounds
+func (s *SharedMap[V]) record(off uint64) (key, value []byte, ok bool) {
+	heap := s.heap()
+	if off+8 > uint64(len(heap)) {
+		return nil, nil, false
+	}
+	kn := uint64(binary.LittleEndian.Uint32(heap[off:]))
+	vn := uint64(binary.LittleEndian.Uint32(heap[off+4:]))
+	end := off + 8 + kn + vn
+	if end > uint64(len(heap)) || end < off {
+		return nil, nil, false
+	}
+	return heap[off+8 : off+8+kn], heap[off+8+kn : end], true
+}
+
+// lookup returns the bucket of key, found is false when it is missing: the bucket is then the one to insert it into.
+// ok is false when the table is inconsistent, which only happens while a write is in progress.
+func (s *SharedMap[V]) lookup(key string) (bucket uint64, found, ok bool) {
+	buckets := s.header(sharedOffBuckets)
+	if buckets == 0 || buckets&(buckets-1) != 0 || sharedHeader+8*buckets > uint64(len(s.data)) {
+		return 0, false, false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	mask := buckets - 1
+	insert := ^uint64(0)
+	for i, b := uint64(0), h.Sum64()&mask; i < buckets; i, b = i+1, (b+1)&mask {
+		switch v := s.bucket(b); v {
+		case sharedEmpty:
+			if insert == ^uint64(0) {
+				insert = b
+			}
+			return insert, false, true
+		case sharedDeleted:
+			if insert == ^uint64(0) {
+				insert = b
+			}
+		default:
+			k, _, ok := s.record(v - 2)
+			if !ok {
+				return 0, false, false
+			}
+			if string(k) == key {
+				return b, true, true
+			}
+		}
+	}
+	return insert, false, insert != ^uint64(0)
+}
+
+// Get returns the value of key
+func (s *SharedMap[V]) Get(key string) (v V, ok bool) {
+	var data []byte
+	s.read(func() bool {
+		data, ok = nil, false
+		b, found, consistent := s.lookup(key)
+		if !consistent || !found {
+			return consistent
+		}
+		_, value, consistent := s.record(s.bucket(b) - 2)
+		data, ok = append([]byte(nil), value...), true
+		return consistent
+	})
+	if !ok || unmarshalValue(s.enc, data, &v) != nil {
+		return v, false
+	}
+	return v, true
+}
+
+// Has reports whether key is present
+func (s *SharedMap[V]) Has(key string) (ok bool) {
+	s.read(func() bool {
+		_, found, consistent := s.lookup(key)
+		ok = found
+		return consistent
+	})
+	return ok
+}
+
+// Len returns the number of entries
+func (s *SharedMap[V]) Len() (n int) {
+	s.read(func() bool {
+		n = int(s.header(sharedOffCount))
+		return true
+	})
+	return n
+}
+
+// Range calls f for each entry, in no particular order, until it returns false.
+// The entries are copied first so f may take its time.
+func (s *SharedMap[V]) Range(f func(key string, value V) bool) {
+	var keys []string
+	var values [][]byte
+	s.read(func() bool {
+		keys, values = keys[:0], values[:0]
+		buckets := s.header(sharedOffBuckets)
+		if sharedHeader+8*buckets > uint64(len(s.data)) {
+			return false
+		}
+		for b := uint64(0); b < buckets; b++ {
+			if v := s.bucket(b); v > sharedDeleted {
+				k, value, ok := s.record(v - 2)
+				if !ok {
+					return false
+				}
+				keys = append(keys, string(k))
+				values = append(values, append([]byte(nil), value...))
+			}
+		}
+		return true
+	})
+	for i, k := range keys {
+		var v V
+		if unmarshalValue(s.enc, values[i], &v) != nil {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// Keys returns the keys in no particular order
+func (s *SharedMap[V]) Keys() []string {
+	var keys []string
+	s.Range(func(key string, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Set sets key to value. It returns ErrLargeData when the entry cannot fit in the file
+// and ErrLimitExceeded when the file is full, ErrSharedReadOnly for readers.
+func (s *SharedMap[V]) Set(key string, value V) error {
+	data, err := marshalValue(s.enc, value)
+	if err != nil {
+		return err
+	}
+	return s.write(func() error {
+		return s.put(key, data)
+	})
+}
+
+// SetMany sets every entry in a single write, readers see all of them or none, see Set.
+// When the file gets full, the entries already set are kept.
+func (s *SharedMap[V]) SetMany(entries map[string]V) error {
+	encoded := make(map[string][]byte, len(entries))
+	for k, v := range entries {
+		data, err := marshalValue(s.enc, v)
+		if err != nil {
+			return err
+		}
+		encoded[k] = data
+	}
+	return s.write(func() error {
+		for k, data := range encoded {
+			if err := s.put(k, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes key and reports whether it was present, it is a no-op for readers
+func (s *SharedMap[V]) Delete(key string) (deleted bool) {
+	s.write(func() error {
+		b, found, _ := s.lookup(key)
+		if !found {
+			return nil
+		}
+		s.free(s.bucket(b) - 2)
+		s.setBucket(b, sharedDeleted)
+		s.setHeader(sharedOffCount, s.header(sharedOffCount)-1)
+		s.setHeader(sharedOffTombstones, s.header(sharedOffTombstones)+1)
+		deleted = true
+		return nil
+	})
+	return deleted
+}
+
+// put sets key to the encoded value data, during a write
+func (s *SharedMap[V]) put(key string, data []byte) error {
+	need := uint64(8 + len(key) + len(data))
+	buckets := s.header(sharedOffBuckets)
+	if need > uint64(len(s.heap())) {
+		return ErrLargeData
+	}
+	b, found, _ := s.lookup(key)
+	full := s.header(sharedOffUsed)+need > uint64(len(s.heap()))
+	crowded := !found && 4*(s.header(sharedOffCount)+s.header(sharedOffTombstones)+1) > 3*buckets
+	if full || crowded {
+		s.compact()
+		if s.header(sharedOffUsed)+need > uint64(len(s.heap())) || (!found && 4*(s.header(sharedOffCount)+1) > 3*buckets) {
+			return ErrLimitExceeded
+		}
+		b, found, _ = s.lookup(key)
+	}
+
+	off := s.alloc(key, data)
+	if found {
+		s.free(s.bucket(b) - 2)
+	} else {
+		if s.bucket(b) == sharedDeleted {
+			s.setHeader(sharedOffTombstones, s.header(sharedOffTombstones)-1)
+		}
+		s.setHeader(sharedOffCount, s.header(sharedOffCount)+1)
+	}
+	s.setBucket(b, off+2)
+	return nil
+}
+
+// alloc appends a record to the heap and returns its offset, there must be room for it
+func (s *SharedMap[V]) alloc(key string, data []byte) uint64 {
+	heap := s.heap()
+	off := s.header(sharedOffUsed)
+	binary.LittleEndian.PutUint32(heap[off:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(heap[off+4:], uint32(len(data)))
+	copy(heap[off+8:], key)
+	copy(heap[off+8+uint64(len(key)):], data)
+	s.setHeader(sharedOffUsed, off+8+uint64(len(key)+len(data)))
+	return off
+}
+
+// free counts the record at off as garbage
+func (s *SharedMap[V]) free(off uint64) {
+	k, v, _ := s.record(off)
+	s.setHeader(sharedOffGarbage, s.header(sharedOffGarbage)+uint64(8+len(k)+len(v)))
+}
+
+// compact rewrites the live records at the start of the heap and drops the deleted buckets, during a write
+func (s *SharedMap[V]) compact() {
+	buckets := s.header(sharedOffBuckets)
+	var live []Pair[string, []byte]
+	for b := uint64(0); b < buckets; b++ {
+		if v := s.bucket(b); v > sharedDeleted {
+			k, value, _ := s.record(v - 2)
+			live = append(live, Pair[string, []byte]{Key: string(k), Value: append([]byte(nil), value...)})
+		}
+		s.setBucket(b, sharedEmpty)
+	}
+	s.setHeader(sharedOffUsed, 0)
+	s.setHeader(sharedOffGarbage, 0)
+	s.setHeader(sharedOffTombstones, 0)
+	for _, e := range live {
+		b, _, _ := s.lookup(e.Key)
+		s.setBucket(b, s.alloc(e.Key, e.Value)+2)
+	}
+}
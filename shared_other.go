@@ -0,0 +1,13 @@
+//go:build !unix
+
+package kmap
+
+import "os"
+
+func mmapShared(f *os.File, size int, writable bool) ([]byte, error) {
+	return nil, ErrSharedUnsupported
+}
+
+func munmapShared(data []byte) error {
+	return ErrSharedUnsupported
+}
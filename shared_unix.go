@@ -0,0 +1,21 @@
+//go:build unix
+
+package kmap
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapShared maps size bytes of f in memory, shared with the other processes mapping it
+func mmapShared(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+func munmapShared(data []byte) error {
+	return syscall.Munmap(data)
+}
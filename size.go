@@ -0,0 +1,210 @@
+package kmap
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Size returns the total accounted size of the values in bytes.
+// Values are only measured when the map has a limit, Size is 0 for unlimited maps.
+func (c *SafeMap[K, V]) Size() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.size
+}
+
+// Limit returns the size limit in bytes, -1 when the map is unlimited
+func (c *SafeMap[K, V]) Limit() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.limit
+}
+
+// Size returns the total accounted size of the values in bytes.
+// Values are only measured when the map has a limit, Size is 0 for unlimited maps.
+func (m *OrderedMap[K, V]) Size() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.size
+}
+
+// Limit returns the size limit in bytes, -1 when the map is unlimited
+func (m *OrderedMap[K, V]) Limit() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.limit
+}
+
+// WithSizeFunc makes the SafeMap measure values with fn instead of the default accounting (see Sizer),
+// for value types you cannot add a SizeBytes method to.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithSizeFunc(fn func(V) int) *SafeMap[K, V] {
+	c.Lock()
+	c.sizeFunc = fn
+	c.Unlock()
+	return c
+}
+
+// valueSize returns the accounted size of value, the lock must be held
+func (c *SafeMap[K, V]) valueSize(value V) int {
+	if c.sizeFunc != nil {
+		return c.sizeFunc(value)
+	}
+	return getValueSize(value)
+}
+
+// WithSizeFunc makes the OrderedMap measure values with fn instead of the default accounting (see Sizer).
+// It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithSizeFunc(fn func(V) int) *OrderedMap[K, V] {
+	m.Lock()
+	m.sizeFunc = fn
+	m.Unlock()
+	return m
+}
+
+// valueSize returns the accounted size of value, the lock must be held
+func (m *OrderedMap[K, V]) valueSize(value V) int {
+	if m.sizeFunc != nil {
+		return m.sizeFunc(value)
+	}
+	return getValueSize(value)
+}
+
+// WithDeepSize makes the SafeMap measure values that do not implement Sizer by walking them with reflection:
+// slices, maps, strings, pointers and interfaces are followed, so the limit reflects the memory actually held.
+// It is slower than the default accounting on large values and replaces any WithSizeFunc.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithDeepSize() *SafeMap[K, V] {
+	return c.WithSizeFunc(deepValueSize[V])
+}
+
+// WithDeepSize makes the OrderedMap measure values that do not implement Sizer by walking them with reflection,
+// see SafeMap.WithDeepSize. It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithDeepSize() *OrderedMap[K, V] {
+	return m.WithSizeFunc(deepValueSize[V])
+}
+
+func deepValueSize[V any](value V) int {
+	if s, ok := any(value).(Sizer); ok {
+		return s.SizeBytes()
+	}
+	return deepSize(reflect.ValueOf(&value).Elem())
+}
+
+// deepSize returns the size of v and of everything it references, memory reachable twice is counted once
+func deepSize(v reflect.Value) int {
+	return int(v.Type().Size()) + referencedSize(v, map[uintptr]bool{})
+}
+
+// referencedSize returns the size of the memory referenced by v, outside of v itself
+func referencedSize(v reflect.Value, seen map[uintptr]bool) int {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len()
+	case reflect.Pointer:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return int(v.Type().Elem().Size()) + referencedSize(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		// Pointers are stored in the interface itself, other values are boxed
+		if e.Kind() == reflect.Pointer {
+			return referencedSize(e, seen)
+		}
+		return int(e.Type().Size()) + referencedSize(e, seen)
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		size := v.Cap() * int(v.Type().Elem().Size())
+		if !isFlat(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += referencedSize(v.Index(i), seen)
+			}
+		}
+		return size
+	case reflect.Array:
+		size := 0
+		if !isFlat(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				size += referencedSize(v.Index(i), seen)
+			}
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		t := v.Type()
+		size := v.Len() * int(t.Key().Size()+t.Elem().Size())
+		if !isFlat(t.Key()) || !isFlat(t.Elem()) {
+			iter := v.MapRange()
+			for iter.Next() {
+				size += referencedSize(iter.Key(), seen) + referencedSize(iter.Value(), seen)
+			}
+		}
+		return size
+	case reflect.Struct:
+		size := 0
+		if !isFlat(v.Type()) {
+			for i := 0; i < v.NumField(); i++ {
+				size += referencedSize(v.Field(i), seen)
+			}
+		}
+		return size
+	}
+	return 0
+}
+
+var flatTypes sync.Map // reflect.Type -> bool
+
+// isFlat reports whether values of t reference no other memory, so they need not be walked
+func isFlat(t reflect.Type) bool {
+	if flat, ok := flatTypes.Load(t); ok {
+		return flat.(bool)
+	}
+	flat := true
+	switch t.Kind() {
+	case reflect.Array:
+		flat = isFlat(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField() && flat; i++ {
+			flat = isFlat(t.Field(i).Type)
+		}
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+	default:
+		flat = false
+	}
+	flatTypes.Store(t, flat)
+	return flat
+}
+
+// GetSize returns the accounted size of the value of key in bytes and whether key is present.
+// Like Size, it is 0 for unlimited maps and for values spilled to disk.
+func (c *SafeMap[K, V]) GetSize(key K) (int, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	i, ok := c.items[key]
+	return i.Size, ok
+}
+
+// GetSize returns the accounted size of the value of key in bytes and whether key is present.
+// Like Size, it is 0 for unlimited maps.
+func (m *OrderedMap[K, V]) GetSize(key K) (int, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	el, ok := m.kv[key]
+	if !ok {
+		return 0, false
+	}
+	return el.size, true
+}
@@ -0,0 +1,184 @@
+package kmap
+
+// Snapshot returns a point-in-time copy of the SafeMap in O(1): both maps share their entries until one of them changes,
+// which then copies them once (copy-on-write). Long Range or save operations on the snapshot neither block writers
+// nor see their changes. The snapshot keeps the limit and size accounting but no backend, overflow or change tracking.
+// Spilled values of a map using WithOverflow are read back into the snapshot, which is then a full copy.
+func (c *SafeMap[K, V]) Snapshot() *SafeMap[K, V] {
+	c.Lock()
+	defer c.Unlock()
+	return c.snapshot()
+}
+
+// snapshot is Snapshot, the write lock must be held
+func (c *SafeMap[K, V]) snapshot() *SafeMap[K, V] {
+	s := &SafeMap[K, V]{
+		items:         c.items,
+		size:          c.size,
+		limit:         c.limit,
+		sizeFunc:      c.sizeFunc,
+		evictToFitSet: c.evictToFitSet,
+		evictPolicy:   c.evictPolicy,
+		shared:        true,
+	}
+	// Revisions keep increasing in the snapshot
+	s.hooks.seq = c.hooks.seq
+	if c.overflowDir != "" || c.arena != nil {
+		// Overflow files and arenas belong to c, which removes or compacts them when the values change
+		s.items = make(map[K]item[V], len(c.items))
+		for k, i := range c.items {
+			s.items[k] = item[V]{Value: c.value(i), Size: i.Size, rev: i.rev, expires: i.expires, ttl: i.ttl}
+		}
+		s.shared = false
+		return s
+	}
+	c.shared = true
+	return s
+}
+
+// own copies the items shared with a snapshot before they are changed, the write lock must be held
+func (c *SafeMap[K, V]) own() {
+	c.dropClean()
+	if !c.shared {
+		return
+	}
+	items := make(map[K]item[V], len(c.items))
+	for k, i := range c.items {
+		items[k] = i
+	}
+	c.items = items
+	c.shared = false
+}
+
+// Snapshot returns a point-in-time copy of the OrderedMap keeping the order, the limit and the size accounting.
+// Elements are exposed by Front and GetElement so they cannot be shared: unlike SafeMap.Snapshot, the copy is made
+// upfront, under the read lock.
+func (m *OrderedMap[K, V]) Snapshot() *OrderedMap[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	s := &OrderedMap[K, V]{
+		kv:            make(map[K]*Element[K, V], len(m.kv)),
+		limit:         m.limit,
+		sizeFunc:      m.sizeFunc,
+		evictToFitSet: m.evictToFitSet,
+		evictPolicy:   m.evictPolicy,
+		accessOrder:   m.accessOrder,
+	}
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		s.put(el.Key, el.Value, el.size)
+		s.kv[el.Key].rev = el.rev
+	}
+	s.hooks.seq = m.hooks.seq
+	return s
+}
+
+// CloneWith returns a deep copy of the OrderedMap keeping the order, every value is copied with clone.
+// The copy keeps the limit, values are measured again when the map has one.
+func (m *OrderedMap[K, V]) CloneWith(clone func(V) V) *OrderedMap[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	s := &OrderedMap[K, V]{
+		kv:            make(map[K]*Element[K, V], len(m.kv)),
+		limit:         m.limit,
+		sizeFunc:      m.sizeFunc,
+		evictToFitSet: m.evictToFitSet,
+		evictPolicy:   m.evictPolicy,
+		accessOrder:   m.accessOrder,
+	}
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		v := clone(el.Value)
+		size := 0
+		if s.limit > 0 {
+			size = s.valueSize(v)
+		}
+		s.put(el.Key, v, size)
+	}
+	return s
+}
+
+// ReadOnlyMap is a map that cannot be changed, see Freeze
+type ReadOnlyMap[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	GetAny(keys ...K) (V, bool)
+	Keys() []K
+	Values() []V
+	Range(f func(key K, value V) bool)
+	Len() int
+}
+
+// Freeze returns a read-only view of the current content of the SafeMap, later changes to the map are not visible.
+// It is meant for maps built at startup and handed to code that must not modify them.
+func (c *SafeMap[K, V]) Freeze() ReadOnlyMap[K, V] {
+	return frozenMap[K, V]{c.Snapshot()}
+}
+
+// Freeze returns a read-only view of the current content of the OrderedMap, iterated in order.
+// Later changes to the map are not visible.
+func (m *OrderedMap[K, V]) Freeze() ReadOnlyMap[K, V] {
+	return frozenOrderedMap[K, V]{m.Snapshot()}
+}
+
+// frozenMap hides the methods changing the snapshot it wraps
+type frozenMap[K comparable, V any] struct {
+	m *SafeMap[K, V]
+}
+
+func (f frozenMap[K, V]) Get(key K) (V, bool)                { return f.m.Get(key) }
+func (f frozenMap[K, V]) GetAny(keys ...K) (V, bool)         { return f.m.GetAny(keys...) }
+func (f frozenMap[K, V]) Keys() []K                          { return f.m.Keys() }
+func (f frozenMap[K, V]) Values() []V                        { return f.m.Values() }
+func (f frozenMap[K, V]) Range(fn func(key K, value V) bool) { f.m.Range(fn) }
+func (f frozenMap[K, V]) Len() int                           { return f.m.Len() }
+
+// frozenOrderedMap hides the methods changing the snapshot it wraps
+type frozenOrderedMap[K comparable, V any] struct {
+	m *OrderedMap[K, V]
+}
+
+func (f frozenOrderedMap[K, V]) Get(key K) (V, bool)                { return f.m.Get(key) }
+func (f frozenOrderedMap[K, V]) GetAny(keys ...K) (V, bool)         { return f.m.GetAny(keys...) }
+func (f frozenOrderedMap[K, V]) Keys() []K                          { return f.m.Keys() }
+func (f frozenOrderedMap[K, V]) Values() []V                        { return f.m.Values() }
+func (f frozenOrderedMap[K, V]) Range(fn func(key K, value V) bool) { f.m.Range(fn) }
+func (f frozenOrderedMap[K, V]) Len() int                           { return f.m.Len() }
+
+// Copy returns a shallow copy of the SafeMap, values are shared with the original. It is cheap, see Snapshot.
+func (c *SafeMap[K, V]) Copy() *SafeMap[K, V] {
+	return c.Snapshot()
+}
+
+// CloneWith returns a deep copy of the SafeMap, every value is copied with clone.
+// The copy keeps the limit, values are measured again when the map has one.
+// Entries keep their TTL and revision, expired ones are not copied.
+func (c *SafeMap[K, V]) CloneWith(clone func(V) V) *SafeMap[K, V] {
+	c.RLock()
+	defer c.RUnlock()
+	s := c.newLike(len(c.items))
+	// Like in snapshot, revisions keep increasing in the copy
+	s.hooks.seq = c.hooks.seq
+	now := nowNano()
+	for k, i := range c.items {
+		if i.expired(now) {
+			continue
+		}
+		v := clone(c.value(i))
+		size := 0
+		if s.limit > 0 {
+			size = s.valueSize(v)
+		}
+		s.items[k] = item[V]{Value: v, Size: size, rev: i.rev, expires: i.expires, ttl: i.ttl}
+		s.size += size
+	}
+	return s
+}
+
+// newLike returns an empty SafeMap with the limit and accounting settings of c, the lock must be held
+func (c *SafeMap[K, V]) newLike(capacity int) *SafeMap[K, V] {
+	return &SafeMap[K, V]{
+		items:         make(map[K]item[V], capacity),
+		limit:         c.limit,
+		sizeFunc:      c.sizeFunc,
+		evictToFitSet: c.evictToFitSet,
+		evictPolicy:   c.evictPolicy,
+	}
+}
@@ -0,0 +1,461 @@
+package kmap
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Ordered is the constraint of the keys of a SortedMap, the types supporting the < operator
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// sortedMaxLevel bounds the height of the skip list, with a 1/4 promotion rate it suits billions of keys
+const sortedMaxLevel = 16
+
+type sortedNode[K Ordered, V any] struct {
+	key   K
+	value V
+	size  int
+	// next holds the following node at each level the node is linked in
+	next []*sortedNode[K, V]
+}
+
+// SortedMap keeps its keys sorted in a skip list: Set, Get and Delete are O(log n),
+// iteration follows the order of the keys and Min, Max, Floor and Ceiling find the bounds of a key.
+// Float keys must not be NaN.
+type SortedMap[K Ordered, V any] struct {
+	sync.RWMutex
+	head   *sortedNode[K, V]
+	level  int
+	length int
+	size   int
+	limit  int
+
+	// sizeFunc replaces getValueSize when set, see WithSizeFunc
+	sizeFunc func(V) int
+}
+
+func NewSorted[K Ordered, V any](limitMb ...int) *SortedMap[K, V] {
+	limitmb := -1
+	if len(limitMb) > 0 && limitMb[0] > 0 {
+		limitmb = limitMb[0] * 1024 * 1024
+	}
+	return &SortedMap[K, V]{
+		head:  &sortedNode[K, V]{next: make([]*sortedNode[K, V], sortedMaxLevel)},
+		level: 1,
+		limit: limitmb,
+	}
+}
+
+// WithSizeFunc makes the SortedMap measure values with fn instead of the default accounting (see Sizer).
+// It should be called right after NewSorted, before the map is used.
+func (m *SortedMap[K, V]) WithSizeFunc(fn func(V) int) *SortedMap[K, V] {
+	m.Lock()
+	m.sizeFunc = fn
+	m.Unlock()
+	return m
+}
+
+// valueSize returns the accounted size of value, the lock must be held
+func (m *SortedMap[K, V]) valueSize(value V) int {
+	if m.sizeFunc != nil {
+		return m.sizeFunc(value)
+	}
+	return getValueSize(value)
+}
+
+// search returns the node of key, nil when missing, and fills update (when not nil) with the last node
+// before key at each level. The lock must be held.
+func (m *SortedMap[K, V]) search(key K, update []*sortedNode[K, V]) *sortedNode[K, V] {
+	x := m.head
+	for lvl := m.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil && x.next[lvl].key < key {
+			x = x.next[lvl]
+		}
+		if update != nil {
+			update[lvl] = x
+		}
+	}
+	x = x.next[0]
+	if x != nil && x.key == key {
+		return x
+	}
+	return nil
+}
+
+// ceiling returns the first node with a key >= key, nil when there is none, the lock must be held
+func (m *SortedMap[K, V]) ceiling(key K) *sortedNode[K, V] {
+	x := m.head
+	for lvl := m.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil && x.next[lvl].key < key {
+			x = x.next[lvl]
+		}
+	}
+	return x.next[0]
+}
+
+// floor returns the last node with a key <= key, nil when there is none, the lock must be held
+func (m *SortedMap[K, V]) floor(key K) *sortedNode[K, V] {
+	x := m.head
+	for lvl := m.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil && x.next[lvl].key <= key {
+			x = x.next[lvl]
+		}
+	}
+	if x == m.head {
+		return nil
+	}
+	return x
+}
+
+func randomLevel() int {
+	lvl := 1
+	for lvl < sortedMaxLevel && rand.Uint32()&3 == 0 {
+		lvl++
+	}
+	return lvl
+}
+
+func (m *SortedMap[K, V]) Get(key K) (v V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	if node := m.search(key, nil); node != nil {
+		return node.value, true
+	}
+	return v, false
+}
+
+// Has reports whether key is present without copying its value
+func (m *SortedMap[K, V]) Has(key K) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.search(key, nil) != nil
+}
+
+func (m *SortedMap[K, V]) GetAny(keys ...K) (v V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, key := range keys {
+		if node := m.search(key, nil); node != nil {
+			return node.value, true
+		}
+	}
+	return v, false
+}
+
+func (m *SortedMap[K, V]) Set(key K, value V) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.set(key, value)
+}
+
+// set is Set, the write lock must be held
+func (m *SortedMap[K, V]) set(key K, value V) error {
+	var update [sortedMaxLevel]*sortedNode[K, V]
+	node := m.search(key, update[:])
+	size := 0
+	if m.limit > 0 {
+		size = m.valueSize(value)
+		if size > m.limit {
+			return ErrLargeData
+		}
+		// The previous value of key is replaced, it does not need room
+		need := size
+		if node != nil {
+			need -= node.size
+		}
+		if m.size+need > m.limit {
+			return ErrLimitExceeded
+		}
+	}
+	if node != nil {
+		m.size += size - node.size
+		node.value = value
+		node.size = size
+		return nil
+	}
+
+	lvl := randomLevel()
+	for ; m.level < lvl; m.level++ {
+		update[m.level] = m.head
+	}
+	node = &sortedNode[K, V]{key: key, value: value, size: size, next: make([]*sortedNode[K, V], lvl)}
+	for i := 0; i < lvl; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	m.length++
+	m.size += size
+	return nil
+}
+
+// remove deletes key and returns its node, nil when it was missing, the write lock must be held
+func (m *SortedMap[K, V]) remove(key K) *sortedNode[K, V] {
+	var update [sortedMaxLevel]*sortedNode[K, V]
+	node := m.search(key, update[:])
+	if node == nil {
+		return nil
+	}
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for m.level > 1 && m.head.next[m.level-1] == nil {
+		m.level--
+	}
+	m.length--
+	m.size -= node.size
+	return node
+}
+
+func (m *SortedMap[K, V]) Delete(key K) {
+	m.Lock()
+	m.remove(key)
+	m.Unlock()
+}
+
+// GetAndDelete removes key and returns its value in a single locked operation
+func (m *SortedMap[K, V]) GetAndDelete(key K) (v V, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	if node := m.remove(key); node != nil {
+		return node.value, true
+	}
+	return v, false
+}
+
+// DeleteAll removes all the specified keys and returns the number of keys removed
+func (m *SortedMap[K, V]) DeleteAll(keys ...K) int {
+	m.Lock()
+	defer m.Unlock()
+	count := 0
+	for _, key := range keys {
+		if m.remove(key) != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// GetAll returns all the values for the specified keys that exist
+func (m *SortedMap[K, V]) GetAll(keys ...K) map[K]V {
+	if len(keys) == 0 {
+		return nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+	result := make(map[K]V, len(keys))
+	for _, key := range keys {
+		if node := m.search(key, nil); node != nil {
+			result[key] = node.value
+		}
+	}
+	return result
+}
+
+func (m *SortedMap[K, V]) Flush() {
+	m.Lock()
+	m.flush()
+	m.Unlock()
+}
+
+func (m *SortedMap[K, V]) Clear() {
+	m.Lock()
+	m.flush()
+	m.Unlock()
+}
+
+// flush removes every node, the write lock must be held
+func (m *SortedMap[K, V]) flush() {
+	m.head = &sortedNode[K, V]{next: make([]*sortedNode[K, V], sortedMaxLevel)}
+	m.level = 1
+	m.length = 0
+	m.size = 0
+}
+
+func (m *SortedMap[K, V]) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.length
+}
+
+// Size returns the total accounted size of the values in bytes.
+// Values are only measured when the map has a limit, Size is 0 for unlimited maps.
+func (m *SortedMap[K, V]) Size() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.size
+}
+
+// Limit returns the size limit in bytes, -1 when the map is unlimited
+func (m *SortedMap[K, V]) Limit() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.limit
+}
+
+// Keys returns the keys in ascending order
+func (m *SortedMap[K, V]) Keys() []K {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]K, 0, m.length)
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		keys = append(keys, x.key)
+	}
+	return keys
+}
+
+// Entries returns the keys with their values in ascending order, read under a single lock acquisition
+func (m *SortedMap[K, V]) Entries() []Entry[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	entries := make([]Entry[K, V], 0, m.length)
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		entries = append(entries, Entry[K, V]{Key: x.key, Value: x.value})
+	}
+	return entries
+}
+
+// Values returns the values in the ascending order of their keys
+func (m *SortedMap[K, V]) Values() []V {
+	m.RLock()
+	defer m.RUnlock()
+	values := make([]V, 0, m.length)
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		values = append(values, x.value)
+	}
+	return values
+}
+
+// Range calls f sequentially for each key and value in ascending key order. If f returns false, range stops the iteration.
+// Like SafeMap.Range, entries are copied first and f runs without the lock.
+func (m *SortedMap[K, V]) Range(f func(key K, value V) bool) {
+	m.RLock()
+	pairs := make([]Pair[K, V], 0, m.length)
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		pairs = append(pairs, Pair[K, V]{Key: x.key, Value: x.value})
+	}
+	m.RUnlock()
+	for _, p := range pairs {
+		if !f(p.Key, p.Value) {
+			break
+		}
+	}
+}
+
+// GetOrSet returns the existing value for the key if present.
+// Otherwise, it sets and returns the given value.
+func (m *SortedMap[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	m.Lock()
+	defer m.Unlock()
+	if node := m.search(key, nil); node != nil {
+		return node.value, true
+	}
+	m.set(key, value)
+	return value, false
+}
+
+// GetOrCompute returns the existing value for the key if present.
+// Otherwise, it computes the value using the provided function,
+// sets it under the key, and returns the computed value.
+func (m *SortedMap[K, V]) GetOrCompute(key K, fn func() V) V {
+	if v, ok := m.Get(key); ok {
+		return v
+	}
+	value := fn()
+	m.Set(key, value)
+	return value
+}
+
+// SetIfNotExists sets the value if the key doesn't exist and returns true.
+// If the key exists, it returns false and makes no changes.
+func (m *SortedMap[K, V]) SetIfNotExists(key K, value V) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.search(key, nil) != nil {
+		return false
+	}
+	m.set(key, value)
+	return true
+}
+
+// Update sets key to the value returned by fn, called with the current value and whether it exists,
+// while holding the write lock. fn must not call methods of the map. The error is the one Set would return for the new value.
+func (m *SortedMap[K, V]) Update(key K, fn func(old V, exists bool) V) error {
+	m.Lock()
+	defer m.Unlock()
+	var old V
+	node := m.search(key, nil)
+	if node != nil {
+		old = node.value
+	}
+	return m.set(key, fn(old, node != nil))
+}
+
+// Min returns the smallest key and its value, ok is false when the map is empty
+func (m *SortedMap[K, V]) Min() (key K, value V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	return entryOf(m.head.next[0])
+}
+
+// Max returns the largest key and its value, ok is false when the map is empty
+func (m *SortedMap[K, V]) Max() (key K, value V, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+	x := m.head
+	for lvl := m.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil {
+			x = x.next[lvl]
+		}
+	}
+	if x == m.head {
+		return key, value, false
+	}
+	return entryOf(x)
+}
+
+// Floor returns the largest key lower than or equal to key and its value, ok is false when there is none
+func (m *SortedMap[K, V]) Floor(key K) (K, V, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	return entryOf(m.floor(key))
+}
+
+// Ceiling returns the smallest key greater than or equal to key and its value, ok is false when there is none
+func (m *SortedMap[K, V]) Ceiling(key K) (K, V, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	return entryOf(m.ceiling(key))
+}
+
+func entryOf[K Ordered, V any](node *sortedNode[K, V]) (key K, value V, ok bool) {
+	if node == nil {
+		return key, value, false
+	}
+	return node.key, node.value, true
+}
+
+// GetRange returns the entries with a key from from included to to excluded, in ascending key order.
+// It finds from in O(log n), so intervals of time-series-like keys (timestamps, ids) are scanned efficiently.
+func (m *SortedMap[K, V]) GetRange(from, to K) []Entry[K, V] {
+	m.RLock()
+	defer m.RUnlock()
+	var entries []Entry[K, V]
+	for x := m.ceiling(from); x != nil && x.key < to; x = x.next[0] {
+		entries = append(entries, Entry[K, V]{Key: x.key, Value: x.value})
+	}
+	return entries
+}
+
+// RangeBetween calls f for each entry with a key from from included to to excluded, in ascending key order.
+// If f returns false, it stops the iteration. Like Range, entries are copied first and f runs without the lock.
+func (m *SortedMap[K, V]) RangeBetween(from, to K, f func(key K, value V) bool) {
+	for _, e := range m.GetRange(from, to) {
+		if !f(e.Key, e.Value) {
+			break
+		}
+	}
+}
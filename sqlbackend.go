@@ -0,0 +1,143 @@
+package kmap
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLBackend is a PersistBackend storing entries as rows of a SQLite table, one row per key with its expiry.
+// Combined with WithBackend every Set and Delete is durable as soon as it returns,
+// and the table can be queried from outside Go (sqlite3 cli, DB browsers) while debugging.
+//
+// kmap does not import a driver, open db with the one of your choice, for example:
+//
+//	db, _ := sql.Open("sqlite", "cache.db") // modernc.org/sqlite
+//	backend, _ := kmap.NewSQLBackend(db, "cache")
+//	m := kmap.New[string, User]().WithBackend(backend)
+//	m.LoadFromBackend(backend) // rebuild at startup
+type SQLBackend struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLBackend creates the entries table and its metadata table if they do not exist yet
+func NewSQLBackend(db *sql.DB, table string) (*SQLBackend, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("kmap: invalid table name %q", table)
+	}
+	b := &SQLBackend{db: db, table: table}
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		size INTEGER NOT NULL,
+		expires INTEGER NOT NULL DEFAULT 0
+	)`, table))
+	if err != nil {
+		return nil, err
+	}
+	// Tables created before expiries were stored lack their column
+	if _, err := db.Exec(fmt.Sprintf(`SELECT expires FROM %s LIMIT 0`, table)); err != nil {
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN expires INTEGER NOT NULL DEFAULT 0`, table)); err != nil {
+			return nil, err
+		}
+	}
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_meta (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	)`, table))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Put inserts or replaces a single row
+func (b *SQLBackend) Put(rec Record) error {
+	_, err := b.db.Exec(fmt.Sprintf(`INSERT INTO %s (key, value, size, expires) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, size = excluded.size, expires = excluded.expires`, b.table),
+		rec.Key, rec.Value, rec.Size, rec.Expires)
+	return err
+}
+
+// Get reads a single row
+func (b *SQLBackend) Get(key string) (Record, bool, error) {
+	rec := Record{Key: key}
+	err := b.db.QueryRow(fmt.Sprintf(`SELECT value, size, expires FROM %s WHERE key = ?`, b.table), key).
+		Scan(&rec.Value, &rec.Size, &rec.Expires)
+	if err == sql.ErrNoRows {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	return rec, true, nil
+}
+
+// Delete removes a single row
+func (b *SQLBackend) Delete(key string) error {
+	_, err := b.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE key = ?`, b.table), key)
+	return err
+}
+
+// Snapshot replaces every row in a single transaction, keeping the order of entries in the rowid
+func (b *SQLBackend) Snapshot(info SnapshotInfo, entries func(yield func(Record) error) error) error {
+	tx, err := b.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s`, b.table)); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s (key, value, size, expires) VALUES (?, ?, ?, ?)`, b.table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	err = entries(func(rec Record) error {
+		_, err := stmt.Exec(rec.Key, rec.Value, rec.Size, rec.Expires)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s_meta (name, value) VALUES ('limit', ?)
+		ON CONFLICT(name) DO UPDATE SET value = excluded.value`, b.table), info.Limit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Scan reads every row in insertion order. The size is recomputed from the rows,
+// the limit is the one of the last Snapshot, -1 (unlimited) if there was none.
+func (b *SQLBackend) Scan(fn func(Record) error) (SnapshotInfo, error) {
+	info := SnapshotInfo{Limit: -1}
+	err := b.db.QueryRow(fmt.Sprintf(`SELECT value FROM %s_meta WHERE name = 'limit'`, b.table)).Scan(&info.Limit)
+	if err != nil && err != sql.ErrNoRows {
+		return info, err
+	}
+
+	rows, err := b.db.Query(fmt.Sprintf(`SELECT key, value, size, expires FROM %s ORDER BY rowid`, b.table))
+	if err != nil {
+		return info, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec Record
+		if err := rows.Scan(&rec.Key, &rec.Value, &rec.Size, &rec.Expires); err != nil {
+			return info, err
+		}
+		info.Size += rec.Size
+		info.Count++
+		if err := fn(rec); err != nil {
+			return info, err
+		}
+	}
+	return info, rows.Err()
+}
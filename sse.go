@@ -0,0 +1,85 @@
+package kmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is the interval of the comments keeping idle change streams open through proxies
+const sseKeepAlive = 15 * time.Second
+
+// ChangesHandler returns an http.Handler streaming the changes of the SafeMap as Server-Sent Events,
+// so dashboards can show the content of a cache updating in real time (with EventSource in browsers).
+// Each change is an event named after its kind (set, delete or flush) with its Seq as id and {"key", "value"}
+// as JSON data, keys encoded like in saved files. The stream ends when the client disconnects,
+// or when it falls behind with the BufferClose policy, see WithChangeBuffer.
+func (c *SafeMap[K, V]) ChangesHandler() http.Handler {
+	return changesHandler(c.ChangesCtx)
+}
+
+// ChangesHandler returns an http.Handler streaming the changes of the OrderedMap as Server-Sent Events,
+// see SafeMap.ChangesHandler
+func (m *OrderedMap[K, V]) ChangesHandler() http.Handler {
+	return changesHandler(m.ChangesCtx)
+}
+
+func changesHandler[K comparable, V any](subscribe func(ctx context.Context) <-chan Change[K, V]) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		changes := subscribe(r.Context())
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(sseKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case ch, ok := <-changes:
+				if !ok {
+					return
+				}
+				if err := writeChange(w, ch); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// writeChange writes ch as a Server-Sent Event
+func writeChange[K comparable, V any](w http.ResponseWriter, ch Change[K, V]) error {
+	data := struct {
+		Key   string `json:"key,omitempty"`
+		Value any    `json:"value,omitempty"`
+	}{}
+	if ch.Kind != EventFlush {
+		key, err := encodeKey(ch.Key)
+		if err != nil {
+			return err
+		}
+		data.Key = key
+	}
+	if ch.Kind == EventSet {
+		data.Value = ch.Value
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ch.Seq, ch.Kind, b)
+	return err
+}
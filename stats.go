@@ -0,0 +1,227 @@
+package kmap
+
+import (
+	"sort"
+	"sync"
+)
+
+// KeyStat is a key with its accounted size and read count, see TopBySize and TopByHits
+type KeyStat[K comparable] struct {
+	Key  K
+	Size int
+	Hits uint64
+}
+
+// hitCounter counts the reads of each key once enabled, it is safe to use under the read lock of the map
+type hitCounter[K comparable] struct {
+	enabled bool
+	mu      sync.Mutex
+	hits    map[K]uint64
+}
+
+func (h *hitCounter[K]) enable() {
+	h.mu.Lock()
+	h.enabled = true
+	if h.hits == nil {
+		h.hits = make(map[K]uint64)
+	}
+	h.mu.Unlock()
+}
+
+func (h *hitCounter[K]) hit(key K) {
+	if !h.enabled {
+		return
+	}
+	h.mu.Lock()
+	h.hits[key]++
+	h.mu.Unlock()
+}
+
+func (h *hitCounter[K]) forget(key K) {
+	if !h.enabled {
+		return
+	}
+	h.mu.Lock()
+	delete(h.hits, key)
+	h.mu.Unlock()
+}
+
+func (h *hitCounter[K]) reset() {
+	if !h.enabled {
+		return
+	}
+	h.mu.Lock()
+	h.hits = make(map[K]uint64)
+	h.mu.Unlock()
+}
+
+// get returns the read count of key
+func (h *hitCounter[K]) get(key K) uint64 {
+	if !h.enabled {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hits[key]
+}
+
+// top returns the n keys read the most for which exists is true, all of them when n <= 0
+func (h *hitCounter[K]) top(n int, exists func(K) bool) []KeyStat[K] {
+	if !h.enabled {
+		return nil
+	}
+	h.mu.Lock()
+	stats := make([]KeyStat[K], 0, len(h.hits))
+	for k, hits := range h.hits {
+		if exists(k) {
+			stats = append(stats, KeyStat[K]{Key: k, Hits: hits})
+		}
+	}
+	h.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Hits > stats[j].Hits })
+	return firstStats(stats, n)
+}
+
+func firstStats[K comparable](stats []KeyStat[K], n int) []KeyStat[K] {
+	if n > 0 && len(stats) > n {
+		return stats[:n]
+	}
+	return stats
+}
+
+// WithStats makes the SafeMap count the reads of each key (Get, GetAny, GetAll), see TopByHits.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithStats() *SafeMap[K, V] {
+	c.Lock()
+	c.stats.enable()
+	c.Unlock()
+	return c
+}
+
+// TopBySize returns the n largest entries with their size and read count, all of them when n <= 0.
+// Sizes are the accounted ones when the map has a limit and are measured otherwise, spilled values count for 0.
+func (c *SafeMap[K, V]) TopBySize(n int) []KeyStat[K] {
+	c.RLock()
+	stats := make([]KeyStat[K], 0, len(c.items))
+	for k, i := range c.items {
+		size := i.Size
+		if c.limit <= 0 && i.spill == "" {
+			size = c.valueSize(c.value(i))
+		}
+		stats = append(stats, KeyStat[K]{Key: k, Size: size, Hits: c.stats.get(k)})
+	}
+	c.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Size > stats[j].Size })
+	return firstStats(stats, n)
+}
+
+// TopByHits returns the n entries read the most with their size and read count, all of them when n <= 0.
+// It returns nil unless WithStats was called.
+func (c *SafeMap[K, V]) TopByHits(n int) []KeyStat[K] {
+	c.RLock()
+	defer c.RUnlock()
+	stats := c.stats.top(n, func(k K) bool {
+		_, ok := c.items[k]
+		return ok
+	})
+	for j := range stats {
+		i := c.items[stats[j].Key]
+		stats[j].Size = i.Size
+		if c.limit <= 0 && i.spill == "" {
+			stats[j].Size = c.valueSize(c.value(i))
+		}
+	}
+	return stats
+}
+
+// WithStats makes the OrderedMap count the reads of each key (Get, GetAny, GetOrDefault, GetAll), see TopByHits.
+// It should be called right after NewOrdered, before the map is used.
+func (m *OrderedMap[K, V]) WithStats() *OrderedMap[K, V] {
+	m.Lock()
+	m.stats.enable()
+	m.Unlock()
+	return m
+}
+
+// TopBySize returns the n largest entries with their size and read count, all of them when n <= 0.
+// Sizes are the accounted ones when the map has a limit and are measured otherwise.
+func (m *OrderedMap[K, V]) TopBySize(n int) []KeyStat[K] {
+	m.RLock()
+	stats := make([]KeyStat[K], 0, len(m.kv))
+	for el := m.ll.Front(); el != nil; el = el.Next() {
+		stats = append(stats, KeyStat[K]{Key: el.Key, Size: m.elementSize(el), Hits: m.stats.get(el.Key)})
+	}
+	m.RUnlock()
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Size > stats[j].Size })
+	return firstStats(stats, n)
+}
+
+// TopByHits returns the n entries read the most with their size and read count, all of them when n <= 0.
+// It returns nil unless WithStats was called.
+func (m *OrderedMap[K, V]) TopByHits(n int) []KeyStat[K] {
+	m.RLock()
+	defer m.RUnlock()
+	stats := m.stats.top(n, func(k K) bool {
+		_, ok := m.kv[k]
+		return ok
+	})
+	for j := range stats {
+		stats[j].Size = m.elementSize(m.kv[stats[j].Key])
+	}
+	return stats
+}
+
+// elementSize returns the accounted size of el, measuring it when the map has no limit. The lock must be held.
+func (m *OrderedMap[K, V]) elementSize(el *Element[K, V]) int {
+	if m.limit > 0 {
+		return el.size
+	}
+	return m.valueSize(el.Value)
+}
+
+// HotKeys returns the n keys read the most, all of them when n <= 0, to diagnose skewed workloads or shed load.
+// It returns nil unless WithStats was called.
+func (c *SafeMap[K, V]) HotKeys(n int) []K {
+	c.RLock()
+	defer c.RUnlock()
+	return statKeys(c.stats.top(n, func(k K) bool {
+		_, ok := c.items[k]
+		return ok
+	}))
+}
+
+// ResetHits sets the read count of every key back to zero, for instance at the start of each observation window
+func (c *SafeMap[K, V]) ResetHits() {
+	c.RLock()
+	c.stats.reset()
+	c.RUnlock()
+}
+
+// HotKeys returns the n keys read the most, all of them when n <= 0, to diagnose skewed workloads or shed load.
+// It returns nil unless WithStats was called.
+func (m *OrderedMap[K, V]) HotKeys(n int) []K {
+	m.RLock()
+	defer m.RUnlock()
+	return statKeys(m.stats.top(n, func(k K) bool {
+		_, ok := m.kv[k]
+		return ok
+	}))
+}
+
+// ResetHits sets the read count of every key back to zero, for instance at the start of each observation window
+func (m *OrderedMap[K, V]) ResetHits() {
+	m.RLock()
+	m.stats.reset()
+	m.RUnlock()
+}
+
+func statKeys[K comparable](stats []KeyStat[K]) []K {
+	if stats == nil {
+		return nil
+	}
+	keys := make([]K, len(stats))
+	for i, s := range stats {
+		keys[i] = s.Key
+	}
+	return keys
+}
@@ -0,0 +1,210 @@
+package kmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrTOML = errors.New("value not representable in toml")
+
+// ExportTOML writes c to w as a TOML document sorted by key, for settings stores read by TOML-based tooling.
+// Values are converted from their JSON form (struct tags, json.Marshaler...) like ExportYAML:
+// objects become tables, nested objects sub-tables and slices of objects arrays of tables,
+// written in the order of their fields. TOML has no null, so keys and fields holding null (nil pointers, maps
+// and slices) are left out, and ErrTOML is returned for a null inside an array.
+func ExportTOML[V any](w io.Writer, c *SafeMap[string, V]) error {
+	entries := c.Entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	root := &yamlNode{kind: yamlMap, keys: make([]string, len(entries)), items: make([]*yamlNode, len(entries))}
+	for i, e := range entries {
+		data, err := json.Marshal(e.Value)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.UseNumber()
+		value, err := yamlFromJSON(dec)
+		if err != nil {
+			return err
+		}
+		root.keys[i], root.items[i] = e.Key, value
+	}
+	t := &tomlWriter{w: bufio.NewWriter(w)}
+	if err := t.table(root, nil); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
+
+// tomlWriter writes a TOML document
+type tomlWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+// table writes the key/value pairs of n then its sub-tables, path being the keys leading to n
+func (t *tomlWriter) table(n *yamlNode, path []string) error {
+	for i, k := range n.keys {
+		v := n.items[i]
+		if jsonNull(v) || tomlTable(v) || tomlTableArray(v) {
+			continue
+		}
+		line, err := appendTOMLValue(append(appendTOMLKey(nil, k), " = "...), v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(append(path, k), "."), err)
+		}
+		t.w.Write(append(line, '\n'))
+		t.started = true
+	}
+	for i, k := range n.keys {
+		v := n.items[i]
+		sub := append(path[:len(path):len(path)], k)
+		switch {
+		case tomlTable(v):
+			t.header("[", sub, "]")
+			if err := t.table(v, sub); err != nil {
+				return err
+			}
+		case tomlTableArray(v):
+			for _, item := range v.items {
+				t.header("[[", sub, "]]")
+				if err := t.table(item, sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// header writes the header of a table, separated from what precedes by a blank line
+func (t *tomlWriter) header(open string, path []string, close string) {
+	if t.started {
+		t.w.WriteByte('\n')
+	}
+	t.started = true
+	line := []byte(open)
+	for i, k := range path {
+		if i > 0 {
+			line = append(line, '.')
+		}
+		line = appendTOMLKey(line, k)
+	}
+	t.w.Write(append(append(line, close...), '\n'))
+}
+
+// jsonNull reports whether n is the JSON null
+func jsonNull(n *yamlNode) bool {
+	return n.kind == yamlScalar && !n.quoted && n.value == "null"
+}
+
+// tomlTable reports whether n is written as a table
+func tomlTable(n *yamlNode) bool {
+	return n.kind == yamlMap
+}
+
+// tomlTableArray reports whether n is written as an array of tables: a non empty array of objects
+func tomlTableArray(n *yamlNode) bool {
+	if n.kind != yamlSeq || len(n.items) == 0 {
+		return false
+	}
+	for _, item := range n.items {
+		if item.kind != yamlMap {
+			return false
+		}
+	}
+	return true
+}
+
+// appendTOMLKey appends k as a bare key when it only holds letters, digits, _ and -, quoted otherwise
+func appendTOMLKey(dst []byte, k string) []byte {
+	bare := k != ""
+	for i := 0; i < len(k) && bare; i++ {
+		c := k[i]
+		bare = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+	}
+	if bare {
+		return append(dst, k...)
+	}
+	return appendTOMLString(dst, k)
+}
+
+// appendTOMLValue appends n as an inline value, objects inside arrays become inline tables
+func appendTOMLValue(dst []byte, n *yamlNode) ([]byte, error) {
+	var err error
+	switch {
+	case n.kind == yamlSeq:
+		dst = append(dst, '[')
+		for i, item := range n.items {
+			if i > 0 {
+				dst = append(dst, ", "...)
+			}
+			if jsonNull(item) {
+				return nil, fmt.Errorf("%w: null in an array", ErrTOML)
+			}
+			if dst, err = appendTOMLValue(dst, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, ']'), nil
+	case n.kind == yamlMap:
+		dst = append(dst, '{')
+		first := true
+		for i, k := range n.keys {
+			if jsonNull(n.items[i]) {
+				continue
+			}
+			if !first {
+				dst = append(dst, ',')
+			}
+			first = false
+			dst = append(appendTOMLKey(append(dst, ' '), k), " = "...)
+			if dst, err = appendTOMLValue(dst, n.items[i]); err != nil {
+				return nil, err
+			}
+		}
+		if !first {
+			dst = append(dst, ' ')
+		}
+		return append(dst, '}'), nil
+	case n.quoted:
+		return appendTOMLString(dst, n.value), nil
+	}
+	// Booleans and JSON numbers are valid TOML as they are
+	return append(dst, n.value...), nil
+}
+
+// appendTOMLString appends s as a TOML basic string
+func appendTOMLString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			dst = append(dst, `\"`...)
+		case '\\':
+			dst = append(dst, `\\`...)
+		case '\b':
+			dst = append(dst, `\b`...)
+		case '\t':
+			dst = append(dst, `\t`...)
+		case '\n':
+			dst = append(dst, `\n`...)
+		case '\f':
+			dst = append(dst, `\f`...)
+		case '\r':
+			dst = append(dst, `\r`...)
+		default:
+			if r < 0x20 || r == 0x7f {
+				dst = fmt.Appendf(dst, `\u%04X`, r)
+			} else {
+				dst = append(dst, string(r)...)
+			}
+		}
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,385 @@
+package kmap
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// nowNano is the clock of expirations in Unix nanoseconds, tests replace it
+var nowNano = func() int64 { return time.Now().UnixNano() }
+
+// expired reports whether i has a TTL that is over at now
+func (i item[V]) expired(now int64) bool {
+	return i.expires != 0 && now >= i.expires
+}
+
+// live reports whether i has no TTL or a TTL that is not over
+func (i item[V]) live() bool {
+	return i.expires == 0 || nowNano() < i.expires
+}
+
+// expiry holds the loader of a SafeMap and the keys being reloaded in the background, see WithLoader
+type expiry[K comparable, V any] struct {
+	loader func(ctx context.Context, key K) (V, error)
+	// refreshAhead is the fraction of the TTL after which a read reloads the entry, 0 when disabled
+	refreshAhead float64
+	// sliding makes reads push the expiry of entries forward, see WithSlidingExpiration
+	sliding bool
+	// defaultTTL is given to the entries set without a TTL, see WithDefaultTTL
+	defaultTTL time.Duration
+	// jitter is the fraction by which TTLs are randomized, see WithTTLJitter
+	jitter float64
+	// staleFor is how long the janitor keeps expired entries for GetStale, in nanoseconds
+	staleFor int64
+
+	mu         sync.Mutex
+	refreshing map[K]bool
+
+	// cleanups describes the sweeps, guarded by the lock of the map, see CleanupStats
+	cleanups CleanupStats
+}
+
+// CleanupStats describes the sweeps removing expired and idle entries, see Cleanup
+type CleanupStats struct {
+	// Runs is the number of sweeps, by Cleanup or by the janitor
+	Runs uint64
+	// Removed is the total number of entries removed by the sweeps
+	Removed uint64
+	// LastRun is when the last sweep started, zero before the first one
+	LastRun time.Time
+	// LastRemoved is the number of entries removed by the last sweep
+	LastRemoved int
+	// LastDuration is how long the last sweep held the lock of the map
+	LastDuration time.Duration
+}
+
+// SetWithTTL sets key to value for ttl: once it is over, reads treat the key as missing and it is removed
+// by the next sweep of the janitor (see StartJanitor). A plain Set of the key, like ttl <= 0, gives it the default TTL
+// (see WithDefaultTTL) or none.
+// Expired entries still count in Len and Size until they are removed.
+func (c *SafeMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) error {
+	c.Lock()
+	defer c.unlock()
+	return c.setTTL(key, value, ttl)
+}
+
+// SetWithExpiry sets key to value until at, a zero at keeps it forever. Unlike SetWithTTL, neither the default TTL
+// nor the jitter of the map apply, so replicas applying the same write agree on its expiry whatever their clocks say when they do.
+// An at in the past stores the entry already expired: reads treat the key as missing.
+func (c *SafeMap[K, V]) SetWithExpiry(key K, value V, at time.Time) error {
+	c.Lock()
+	defer c.unlock()
+	if at.IsZero() {
+		return c.setExpiry(key, value, 0, neverExpires)
+	}
+	// Times up to the Unix epoch are long gone, they must not read as 0 or neverExpires
+	n := at.UnixNano()
+	if n < 1 {
+		n = 1
+	}
+	return c.setExpiry(key, value, 0, n)
+}
+
+// neverExpires is the at of setExpiry which keeps an entry forever
+const neverExpires = -1
+
+// expireAt makes i expire at, in Unix nanoseconds, or never when at is neverExpires. Its TTL is what remains of it.
+func (i *item[V]) expireAt(at int64) {
+	if at == neverExpires {
+		i.expires, i.ttl = 0, 0
+		return
+	}
+	i.expires = at
+	i.ttl = at - nowNano()
+	if i.ttl <= 0 {
+		i.ttl = 1
+	}
+}
+
+// expireIn makes i expire ttl from now, or never when ttl <= 0
+func (i *item[V]) expireIn(ttl time.Duration) {
+	if ttl <= 0 {
+		i.expires, i.ttl = 0, 0
+		return
+	}
+	i.ttl = int64(ttl)
+	i.expires = nowNano() + i.ttl
+}
+
+// Touch makes key expire ttl from now without rewriting its value, so active sessions can be kept alive cheaply,
+// ttl <= 0 removes its TTL. It returns false when key is missing or expired. The revision of key does not change.
+func (c *SafeMap[K, V]) Touch(key K, ttl time.Duration) bool {
+	c.Lock()
+	defer c.unlock()
+	i, ok := c.items[key]
+	if !ok || !i.live() {
+		return false
+	}
+	c.own()
+	i.expireIn(c.jittered(ttl))
+	c.items[key] = i
+	c.markDirty(key, true)
+	return true
+}
+
+// WithDefaultTTL gives a TTL of d to every entry set without one, by Set, SetMany, Update or any other method,
+// so caches expire entries without callers switching to SetWithTTL. SetWithTTL still overrides it per entry.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithDefaultTTL(d time.Duration) *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.defaultTTL = d
+	c.Unlock()
+	return c
+}
+
+// DefaultTTL returns the TTL given to entries set without one, 0 when they never expire, see WithDefaultTTL
+func (c *SafeMap[K, V]) DefaultTTL() time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.expiry.defaultTTL
+}
+
+// WithTTLJitter randomizes each TTL given to SetWithTTL or Touch, or by default (see WithDefaultTTL), within plus or minus fraction of it, 0.1 for instance,
+// so entries written together do not all expire at the same instant and stampede the loader or the source of truth.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithTTLJitter(fraction float64) *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.jitter = fraction
+	c.Unlock()
+	return c
+}
+
+// jittered returns ttl randomized by the jitter of the map
+func (c *SafeMap[K, V]) jittered(ttl time.Duration) time.Duration {
+	if c.expiry.jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	d := time.Duration(float64(ttl) * c.expiry.jitter * (2*rand.Float64() - 1))
+	if ttl+d <= 0 {
+		return ttl
+	}
+	return ttl + d
+}
+
+// TTL returns the time left before key expires, 0 when it has no TTL. ok is false when key is missing or expired.
+func (c *SafeMap[K, V]) TTL(key K) (ttl time.Duration, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	i, ok := c.items[key]
+	if !ok || i.expires == 0 {
+		return 0, ok
+	}
+	left := i.expires - nowNano()
+	if left <= 0 {
+		return 0, false
+	}
+	return time.Duration(left), true
+}
+
+// WithLoader sets the function loading the value of a key from its source of truth, used to reload entries
+// in the background, see WithRefreshAhead.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithLoader(fn func(ctx context.Context, key K) (V, error)) *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.loader = fn
+	c.Unlock()
+	return c
+}
+
+// WithRefreshAhead makes reads of an entry set with a TTL reload it in the background with the loader (see WithLoader)
+// once fraction of its TTL has passed, 0.8 for instance, so hot keys are renewed before they expire
+// and never cause a burst of misses. Reads keep returning the current value meanwhile, a failed reload keeps it too.
+// Each key is reloaded by one goroutine at a time, the new value gets the TTL of the previous one.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithRefreshAhead(fraction float64) *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.refreshAhead = fraction
+	c.Unlock()
+	return c
+}
+
+// shouldRefresh reports whether reading i must reload it ahead of its expiry
+func (c *SafeMap[K, V]) shouldRefresh(i item[V]) bool {
+	if i.expires == 0 || c.expiry.refreshAhead <= 0 || c.expiry.loader == nil {
+		return false
+	}
+	return nowNano() >= i.expires-int64(float64(i.ttl)*(1-c.expiry.refreshAhead))
+}
+
+// refresh reloads key in the background unless it is already being reloaded, the value is set for ttl
+func (c *SafeMap[K, V]) refresh(key K, ttl time.Duration) {
+	e := &c.expiry
+	e.mu.Lock()
+	if e.refreshing[key] {
+		e.mu.Unlock()
+		return
+	}
+	if e.refreshing == nil {
+		e.refreshing = make(map[K]bool)
+	}
+	e.refreshing[key] = true
+	e.mu.Unlock()
+
+	go func() {
+		defer func() {
+			e.mu.Lock()
+			delete(e.refreshing, key)
+			e.mu.Unlock()
+		}()
+		v, err := e.loader(context.Background(), key)
+		if err == nil {
+			err = c.SetWithTTL(key, v, ttl)
+		}
+		if err != nil {
+			c.log.warn("kmap: reload failed", "key", key, "error", err)
+		}
+	}()
+}
+
+// read is called after a successful read of i without any lock held, it reloads it when refresh-ahead is due
+// and pushes its expiry forward with sliding expiration
+func (c *SafeMap[K, V]) read(key K, i item[V]) {
+	if i.expires == 0 {
+		return
+	}
+	if c.expiry.sliding {
+		c.slide(key)
+		return
+	}
+	if c.shouldRefresh(i) {
+		c.refresh(key, time.Duration(i.ttl))
+	}
+}
+
+// WithSlidingExpiration makes every successful read (Get, GetAny, GetAll or GetStale) of an entry set with a TTL
+// restart its TTL, so entries expire after being idle for their TTL instead of after being set, the natural model
+// of session stores. Reads then take the write lock of the map for entries with a TTL,
+// refresh-ahead (see WithRefreshAhead) no longer applies since read entries never get close to their expiry.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithSlidingExpiration() *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.sliding = true
+	c.Unlock()
+	return c
+}
+
+// slide restarts the TTL of key when it is still alive
+func (c *SafeMap[K, V]) slide(key K) {
+	c.Lock()
+	defer c.Unlock()
+	i, ok := c.items[key]
+	if !ok || !i.live() {
+		return
+	}
+	c.own()
+	i.expireIn(time.Duration(i.ttl))
+	c.items[key] = i
+	c.markDirty(key, true)
+}
+
+// GetStale returns the value of key even when it expired, stale is then true and the key is reloaded in the background
+// with the loader (see WithLoader), so callers trade freshness for latency instead of waiting for the source.
+// Expired entries are only kept until the janitor removes them, see WithStaleFor.
+func (c *SafeMap[K, V]) GetStale(key K) (v V, stale, ok bool) {
+	c.RLock()
+	i, ok := c.items[key]
+	if ok {
+		v = c.value(i)
+		c.stats.hit(key)
+		c.idle.access(key)
+	}
+	c.RUnlock()
+	if !ok {
+		return v, false, false
+	}
+	if !i.live() {
+		if c.expiry.loader != nil {
+			c.refresh(key, time.Duration(i.ttl))
+		}
+		return v, true, true
+	}
+	c.read(key, i)
+	return v, false, true
+}
+
+// WithStaleFor makes the janitor keep expired entries for d more, so GetStale can still serve them while they are reloaded.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithStaleFor(d time.Duration) *SafeMap[K, V] {
+	c.Lock()
+	c.expiry.staleFor = int64(d)
+	c.Unlock()
+	return c
+}
+
+// expiring reports whether some entries have a TTL, the lock must be held
+func (c *SafeMap[K, V]) expiring() bool {
+	for _, i := range c.items {
+		if i.expires != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadedItem returns the item of an entry read back from a file or a backend, ok is false when it expired meanwhile.
+// Expiry times are absolute so the time the map spent on disk counts, the TTL of a loaded entry is what remained of it.
+func loadedItem[K comparable, V any](e fileEntry[K, V], now int64) (i item[V], ok bool) {
+	i = item[V]{Value: e.Value, Size: e.Size}
+	if e.Expires != 0 {
+		if e.Expires <= now {
+			return i, false
+		}
+		i.expires = e.Expires
+		i.ttl = e.Expires - now
+	}
+	return i, true
+}
+
+// StartJanitor removes the expired entries, and the idle ones (see WithIdleTimeout), every interval
+// in a background goroutine, until ctx is done
+func (c *SafeMap[K, V]) StartJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Cleanup()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Cleanup synchronously removes the expired entries, and the idle ones (see WithIdleTimeout),
+// like a sweep of the janitor, and returns how many were removed, see CleanupStats
+func (c *SafeMap[K, V]) Cleanup() (removed int) {
+	c.Lock()
+	defer c.unlock()
+	start := time.Now()
+	now := nowNano()
+	for k, i := range c.items {
+		if i.expired(now-c.expiry.staleFor) || c.idle.idle(k, now) {
+			c.remove(k)
+			removed++
+		}
+	}
+	st := &c.expiry.cleanups
+	st.Runs++
+	st.Removed += uint64(removed)
+	st.LastRun = start
+	st.LastRemoved = removed
+	st.LastDuration = time.Since(start)
+	c.log.debug("kmap: cleanup", "removed", removed, "duration", st.LastDuration)
+	return removed
+}
+
+// CleanupStats returns the statistics of the sweeps done by Cleanup and the janitor
+func (c *SafeMap[K, V]) CleanupStats() CleanupStats {
+	c.RLock()
+	defer c.RUnlock()
+	return c.expiry.cleanups
+}
@@ -0,0 +1,83 @@
+package kmap
+
+import "errors"
+
+var ErrTxnDone = errors.New("transaction already committed or discarded")
+
+// Txn stages Set and Delete operations that Commit applies together under one lock, or Discard drops.
+// The size of the resulting map is validated before any change is visible: when it does not fit,
+// Commit returns ErrLargeData or ErrLimitExceeded and the map is left untouched.
+// A Txn is not safe for concurrent use.
+type Txn[K comparable, V any] struct {
+	changes []change[K, V]
+	apply   func([]change[K, V]) error
+	done    bool
+}
+
+// Txn starts a transaction on the SafeMap.
+// With a backend, a failing write stops the commit and the changes already written are kept.
+func (c *SafeMap[K, V]) Txn() *Txn[K, V] {
+	return &Txn[K, V]{apply: func(changes []change[K, V]) error {
+		// Only the last change of each key matters
+		entries := make(map[K]V, len(changes))
+		deleted := make(map[K]bool)
+		for _, ch := range changes {
+			if ch.del {
+				delete(entries, ch.key)
+				deleted[ch.key] = true
+			} else {
+				delete(deleted, ch.key)
+				entries[ch.key] = ch.value
+			}
+		}
+		c.Lock()
+		defer c.unlock()
+		return c.apply(entries, deleted)
+	}}
+}
+
+// Txn starts a transaction on the OrderedMap, changes are applied in the order they were staged
+func (m *OrderedMap[K, V]) Txn() *Txn[K, V] {
+	return &Txn[K, V]{apply: func(changes []change[K, V]) error {
+		m.Lock()
+		defer m.unlock()
+		return m.apply(changes)
+	}}
+}
+
+// Set stages setting key to value
+func (t *Txn[K, V]) Set(key K, value V) *Txn[K, V] {
+	t.changes = append(t.changes, change[K, V]{key: key, value: value})
+	return t
+}
+
+// Delete stages removing key
+func (t *Txn[K, V]) Delete(key K) *Txn[K, V] {
+	t.changes = append(t.changes, change[K, V]{key: key, del: true})
+	return t
+}
+
+// Len returns the number of staged operations
+func (t *Txn[K, V]) Len() int {
+	return len(t.changes)
+}
+
+// Commit applies the staged operations atomically, the Txn cannot be used afterwards
+func (t *Txn[K, V]) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	changes := t.changes
+	t.changes = nil
+	if len(changes) == 0 {
+		return nil
+	}
+	return t.apply(changes)
+}
+
+// Discard drops the staged operations, the Txn cannot be used afterwards
+func (t *Txn[K, V]) Discard() {
+	t.done = true
+	t.changes = nil
+}
@@ -0,0 +1,214 @@
+package kmap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WriteMode selects when WithWriter propagates changes
+type WriteMode uint8
+
+const (
+	// WriteThrough calls the writer inside Set, which fails without changing the map when the writer fails
+	WriteThrough WriteMode = iota
+	// WriteBehind queues the changes and calls the writer in the background, in batches, retrying failures
+	WriteBehind
+)
+
+// WriterOptions configures WithWriter, zero fields take the default values
+type WriterOptions struct {
+	Mode WriteMode
+	// BatchSize is the number of queued keys that triggers a write-behind flush, 100 by default
+	BatchSize int
+	// FlushInterval is the longest time a change waits in the write-behind queue, 1s by default
+	FlushInterval time.Duration
+	// MaxRetries is the number of times a failed write-behind write is retried, 3 by default, -1 for none
+	MaxRetries int
+	// RetryDelay is the wait before the first retry, doubled for each of the next ones, 100ms by default
+	RetryDelay time.Duration
+	// OnError receives the write-behind writes still failing after the retries, they are dropped
+	OnError func(err error)
+}
+
+// writer propagates the values set in a map, see WithWriter
+type writer[K comparable, V any] struct {
+	fn   func(ctx context.Context, key K, v V) error
+	opts WriterOptions
+	// log is the logger of the map
+	log *eventLog
+
+	mu sync.Mutex
+	// pending holds the last value of each queued key, order the keys in the order they were queued
+	pending map[K]V
+	order   []K
+
+	wake  chan struct{}
+	flush chan chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// WithWriter makes the SafeMap propagate every value set (by Set or any other method changing values) to fn,
+// typically a database or a remote store, so the map can front it as a cache. Deletes are not propagated.
+// With WriteThrough fn runs inside Set, holding the lock of the map. With WriteBehind the changes are queued,
+// several changes of a key only write its last value, and a background goroutine writes them in batches:
+// call FlushWrites to wait for the queue to be written and StopWriter to end the goroutine.
+// It should be called right after New, before the map is used.
+func (c *SafeMap[K, V]) WithWriter(fn func(ctx context.Context, key K, v V) error, opts ...WriterOptions) *SafeMap[K, V] {
+	var o WriterOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 3
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 100 * time.Millisecond
+	}
+	w := &writer[K, V]{fn: fn, opts: o, log: &c.log}
+	if o.Mode == WriteBehind {
+		w.pending = make(map[K]V)
+		w.wake = make(chan struct{}, 1)
+		w.flush = make(chan chan struct{})
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.run()
+	}
+	c.Lock()
+	c.writer = w
+	c.Unlock()
+	return c
+}
+
+// FlushWrites waits until the changes queued by a WriteBehind writer are written, or ctx is done
+func (c *SafeMap[K, V]) FlushWrites(ctx context.Context) error {
+	c.RLock()
+	w := c.writer
+	c.RUnlock()
+	if w == nil || w.opts.Mode != WriteBehind {
+		return nil
+	}
+	reply := make(chan struct{})
+	select {
+	case w.flush <- reply:
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopWriter writes the changes queued by a WriteBehind writer and ends its goroutine,
+// the values set afterwards are no longer propagated
+func (c *SafeMap[K, V]) StopWriter() {
+	c.Lock()
+	w := c.writer
+	c.writer = nil
+	c.Unlock()
+	if w != nil && w.opts.Mode == WriteBehind {
+		close(w.stop)
+		<-w.done
+	}
+}
+
+// write propagates value, the write lock of the map must be held
+func (w *writer[K, V]) write(key K, value V) error {
+	if w.opts.Mode == WriteThrough {
+		return w.fn(context.Background(), key, value)
+	}
+	w.mu.Lock()
+	if _, queued := w.pending[key]; !queued {
+		w.order = append(w.order, key)
+	}
+	w.pending[key] = value
+	full := len(w.order) >= w.opts.BatchSize
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run is the write-behind goroutine
+func (w *writer[K, V]) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.drain()
+		case <-w.wake:
+			w.drain()
+		case reply := <-w.flush:
+			w.drain()
+			close(reply)
+		case <-w.stop:
+			w.drain()
+			return
+		}
+	}
+}
+
+// drain writes the queued changes, a batch at a time, until the queue is empty
+func (w *writer[K, V]) drain() {
+	for {
+		w.mu.Lock()
+		n := len(w.order)
+		if n == 0 {
+			w.mu.Unlock()
+			return
+		}
+		if n > w.opts.BatchSize {
+			n = w.opts.BatchSize
+		}
+		batch := make([]Pair[K, V], n)
+		for i, k := range w.order[:n] {
+			batch[i] = Pair[K, V]{Key: k, Value: w.pending[k]}
+			delete(w.pending, k)
+		}
+		w.order = w.order[n:]
+		w.mu.Unlock()
+
+		for _, p := range batch {
+			w.writeWithRetry(p.Key, p.Value)
+		}
+	}
+}
+
+// writeWithRetry calls fn until it succeeds or the retries are exhausted, then reports the error to OnError
+func (w *writer[K, V]) writeWithRetry(key K, value V) {
+	delay := w.opts.RetryDelay
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = w.fn(context.Background(), key, value); err == nil {
+			return
+		}
+		if attempt >= w.opts.MaxRetries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	w.log.error("kmap: write-behind failed", "key", key, "attempts", w.opts.MaxRetries+1, "error", err)
+	if w.opts.OnError != nil {
+		w.opts.OnError(fmt.Errorf("kmap: writing key %v: %w", key, err))
+	}
+}
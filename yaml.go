@@ -0,0 +1,850 @@
+package kmap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Minimal YAML support for ExportYAML and ImportYAML.
+// Values are converted from and to their JSON form, so they follow the rules of encoding/json (tags, omitempty,
+// json.Marshaler...). The importer reads the subset of YAML found in configuration files: block mappings and
+// sequences, plain and quoted scalars, flow collections on a single line, literal and folded block scalars, comments.
+// Anchors, aliases, tags, complex keys, multi-line plain or quoted scalars and multiple documents are not supported.
+// Plain scalars are resolved with the YAML 1.2 core schema: null, true, 42, 0x2a, 1.5e3... are not strings.
+
+var ErrYAML = errors.New("invalid or unsupported yaml")
+
+// yamlKind is the kind of a yamlNode
+type yamlKind uint8
+
+const (
+	yamlScalar yamlKind = iota
+	yamlSeq
+	yamlMap
+)
+
+// yamlNode is a parsed YAML value, the zero value is null
+type yamlNode struct {
+	kind yamlKind
+	// value is the text of a scalar, quoted is set for strings whatever they look like
+	value  string
+	quoted bool
+	// keys are the keys of a mapping, items its values or the items of a sequence
+	keys  []string
+	items []*yamlNode
+}
+
+// ExportYAML writes the map to w as a YAML mapping sorted by key, so it can be reviewed and edited like any
+// configuration file and loaded back with ImportYAML. Keys are written like in snapshot files and values
+// in their JSON form (struct tags, json.Marshaler...), nested objects keeping the order of their fields.
+func (c *SafeMap[K, V]) ExportYAML(w io.Writer) error {
+	return writeYAML(w, c.Entries(), true)
+}
+
+// ImportYAML sets the entries of the YAML mapping read from r, see ExportYAML for the format and SetMany for the errors.
+// Nothing is set when the document is invalid or a value does not decode.
+func (c *SafeMap[K, V]) ImportYAML(r io.Reader) error {
+	pairs, err := readYAML[K, V](r)
+	if err != nil || len(pairs) == 0 {
+		return err
+	}
+	entries := make(map[K]V, len(pairs))
+	for _, p := range pairs {
+		entries[p.Key] = p.Value
+	}
+	return c.SetMany(entries)
+}
+
+// ExportYAML writes the map to w as a YAML mapping in order, see SafeMap.ExportYAML
+func (m *OrderedMap[K, V]) ExportYAML(w io.Writer) error {
+	return writeYAML(w, m.Entries(), false)
+}
+
+// ImportYAML sets the entries of the YAML mapping read from r, new keys are appended in the order of the document,
+// see SafeMap.ImportYAML and SetPairs
+func (m *OrderedMap[K, V]) ImportYAML(r io.Reader) error {
+	pairs, err := readYAML[K, V](r)
+	if err != nil {
+		return err
+	}
+	return m.SetPairs(pairs)
+}
+
+// writeYAML writes entries as a YAML mapping, sorted by their encoded key when sorted is set
+func writeYAML[K comparable, V any](w io.Writer, entries []Entry[K, V], sorted bool) error {
+	root := &yamlNode{kind: yamlMap, keys: make([]string, len(entries)), items: make([]*yamlNode, len(entries))}
+	for i, e := range entries {
+		key, err := encodeKey(e.Key)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(e.Value)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.UseNumber()
+		value, err := yamlFromJSON(dec)
+		if err != nil {
+			return err
+		}
+		root.keys[i], root.items[i] = key, value
+	}
+	if sorted {
+		sort.Sort(yamlByKey{root})
+	}
+
+	bw := bufio.NewWriter(w)
+	if len(entries) == 0 {
+		bw.WriteString("{}\n")
+	}
+	writeYAMLMap(bw, root, 0, true)
+	return bw.Flush()
+}
+
+// yamlByKey sorts the entries of a mapping by key
+type yamlByKey struct{ n *yamlNode }
+
+func (s yamlByKey) Len() int           { return len(s.n.keys) }
+func (s yamlByKey) Less(i, j int) bool { return s.n.keys[i] < s.n.keys[j] }
+func (s yamlByKey) Swap(i, j int) {
+	s.n.keys[i], s.n.keys[j] = s.n.keys[j], s.n.keys[i]
+	s.n.items[i], s.n.items[j] = s.n.items[j], s.n.items[i]
+}
+
+// yamlFromJSON reads the next JSON value of dec, objects keep the order of their keys
+func yamlFromJSON(dec *json.Decoder) (*yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yamlNode{kind: yamlSeq}
+		if t == '{' {
+			n.kind = yamlMap
+		}
+		for dec.More() {
+			if n.kind == yamlMap {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, key.(string))
+			}
+			item, err := yamlFromJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+		}
+		_, err := dec.Token()
+		return n, err
+	case string:
+		return &yamlNode{value: t, quoted: true}, nil
+	case json.Number:
+		return &yamlNode{value: t.String()}, nil
+	case bool:
+		return &yamlNode{value: strconv.FormatBool(t)}, nil
+	}
+	return &yamlNode{value: "null"}, nil
+}
+
+// writeYAMLMap writes the keys of n and their values, the first key is not indented when it follows a "- "
+func writeYAMLMap(w *bufio.Writer, n *yamlNode, indent int, indentFirst bool) {
+	for i, k := range n.keys {
+		if i > 0 || indentFirst {
+			w.WriteString(strings.Repeat(" ", indent))
+		}
+		w.WriteString(yamlString(k))
+		w.WriteByte(':')
+		writeYAMLValue(w, n.items[i], indent+2)
+	}
+}
+
+// writeYAMLValue writes n after a "key:" or a "-" already written, its children being indented by indent spaces
+func writeYAMLValue(w *bufio.Writer, n *yamlNode, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch {
+	case n.kind == yamlMap && len(n.keys) > 0:
+		w.WriteByte('\n')
+		writeYAMLMap(w, n, indent, true)
+	case n.kind == yamlSeq && len(n.items) > 0:
+		w.WriteByte('\n')
+		for _, item := range n.items {
+			w.WriteString(pad)
+			w.WriteByte('-')
+			if item.kind == yamlMap && len(item.keys) > 0 {
+				w.WriteByte(' ')
+				writeYAMLMap(w, item, indent+2, false)
+			} else {
+				writeYAMLValue(w, item, indent+2)
+			}
+		}
+	case n.kind == yamlMap:
+		w.WriteString(" {}\n")
+	case n.kind == yamlSeq:
+		w.WriteString(" []\n")
+	case n.quoted && yamlLiteral(n.value):
+		// Multi-line strings are written as literal blocks, the chomping indicator keeps their final line breaks
+		s := n.value
+		switch {
+		case !strings.HasSuffix(s, "\n"):
+			w.WriteString(" |-\n")
+		case strings.HasSuffix(s, "\n\n"):
+			w.WriteString(" |+\n")
+			s = s[:len(s)-1]
+		default:
+			w.WriteString(" |\n")
+			s = s[:len(s)-1]
+		}
+		for _, line := range strings.Split(s, "\n") {
+			if line != "" {
+				w.WriteString(pad)
+				w.WriteString(line)
+			}
+			w.WriteByte('\n')
+		}
+	case n.quoted:
+		w.WriteByte(' ')
+		w.WriteString(yamlString(n.value))
+		w.WriteByte('\n')
+	default:
+		w.WriteByte(' ')
+		w.WriteString(n.value)
+		w.WriteByte('\n')
+	}
+}
+
+// yamlString returns s as a plain scalar when it reads back as the same string, double-quoted otherwise
+func yamlString(s string) string {
+	if yamlPlain(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// yamlPlain reports whether s can be written as a plain scalar, read back as the same string by any YAML 1.1 or 1.2 parser
+func yamlPlain(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`.+~") {
+		return false
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	if _, ok := yamlResolve(s); ok {
+		return false
+	}
+	switch strings.ToLower(s) {
+	case "y", "n", "yes", "no", "on", "off":
+		return false
+	}
+	return true
+}
+
+// yamlLiteral reports whether s is written as a literal block: it has several lines, all printable,
+// and neither starts with a space nor holds lines made of blanks which would be read back as empty
+func yamlLiteral(s string) bool {
+	if !strings.Contains(s, "\n") || s[0] == ' ' || s[0] == '\n' {
+		return false
+	}
+	for _, line := range strings.Split(s, "\n") {
+		if line != "" && strings.TrimSpace(line) == "" {
+			return false
+		}
+		for _, r := range line {
+			if r != '\t' && !unicode.IsPrint(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// yamlResolve returns the JSON form of a plain scalar which is not a string under the YAML 1.2 core schema
+func yamlResolve(s string) (string, bool) {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return "null", true
+	case "true", "True", "TRUE":
+		return "true", true
+	case "false", "False", "FALSE":
+		return "false", true
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0o") {
+		base := 16
+		if s[1] == 'o' {
+			base = 8
+		}
+		if strings.HasPrefix(s[2:], "+") || strings.HasPrefix(s[2:], "-") {
+			return "", false
+		}
+		if n, err := strconv.ParseUint(s[2:], base, 64); err == nil {
+			return strconv.FormatUint(n, 10), true
+		}
+		return "", false
+	}
+
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 || digits == "" {
+		return "", false
+	}
+	if strings.Trim(digits, "0123456789") == "" {
+		// Integers keep all their digits, whatever their size
+		digits = strings.TrimLeft(digits, "0")
+		if digits == "" {
+			digits = "0"
+		}
+		if s[0] == '-' {
+			digits = "-" + digits
+		}
+		return digits, true
+	}
+	if strings.Trim(digits, "0123456789.eE+-") != "" || !strings.ContainsAny(digits, "0123456789") {
+		return "", false
+	}
+	if digits[0] != '.' && (digits[0] < '0' || digits[0] > '9') {
+		return "", false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), true
+}
+
+// readYAML reads a YAML mapping from r and decodes its entries
+func readYAML[K comparable, V any](r io.Reader) ([]Pair[K, V], error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("%w: not utf-8", ErrYAML)
+	}
+	root, err := parseYAML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if root.kind != yamlMap {
+		if v, _ := yamlResolve(root.value); root.kind == yamlScalar && !root.quoted && v == "null" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: the document is not a mapping", ErrYAML)
+	}
+	pairs := make([]Pair[K, V], len(root.keys))
+	for i, k := range root.keys {
+		if pairs[i].Key, err = decodeKey[K](k); err != nil {
+			return nil, err
+		}
+		data, err := root.items[i].appendJSON(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &pairs[i].Value); err != nil {
+			return nil, fmt.Errorf("key %q: %w", k, err)
+		}
+	}
+	return pairs, nil
+}
+
+// appendJSON appends the JSON form of n to dst
+func (n *yamlNode) appendJSON(dst []byte) ([]byte, error) {
+	var err error
+	switch n.kind {
+	case yamlSeq, yamlMap:
+		open, close := byte('['), byte(']')
+		if n.kind == yamlMap {
+			open, close = '{', '}'
+		}
+		dst = append(dst, open)
+		for i, item := range n.items {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if n.kind == yamlMap {
+				dst = appendJSONString(dst, n.keys[i])
+				dst = append(dst, ':')
+			}
+			if dst, err = item.appendJSON(dst); err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, close), nil
+	}
+	if !n.quoted {
+		if v, ok := yamlResolve(n.value); ok {
+			return append(dst, v...), nil
+		}
+	}
+	return appendJSONString(dst, n.value), nil
+}
+
+// yamlParser parses a block YAML document line by line
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+// parseYAML parses the first document of data, a document holding nothing but comments is null
+func parseYAML(data string) (*yamlNode, error) {
+	data = strings.TrimSuffix(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	p := &yamlParser{lines: strings.Split(data, "\n")}
+	// Skip the directives and the document start marker
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		text := strings.TrimSpace(stripYAMLComment(line))
+		if text == "" || strings.HasPrefix(line, "%") {
+			p.pos++
+			continue
+		}
+		if text == "---" {
+			p.pos++
+		}
+		break
+	}
+	indent, _, ok, err := p.peek()
+	if err != nil || !ok {
+		return &yamlNode{}, err
+	}
+	root, err := p.node(indent)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok, err := p.peek(); err != nil || ok {
+		if err == nil {
+			err = p.errorf("unexpected indentation")
+		}
+		return nil, err
+	}
+	return root, nil
+}
+
+// errorf returns an error about the current line
+func (p *yamlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrYAML, p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// peek moves to the next line holding a value, skipping blank lines and comments, and returns its indentation
+// and its text without comment. ok is false at the end of the document.
+func (p *yamlParser) peek() (indent int, text string, ok bool, err error) {
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if line == "---" || line == "..." || strings.HasPrefix(line, "--- ") {
+			// The end of the first document
+			p.lines = p.lines[:p.pos]
+			break
+		}
+		trimmed := strings.TrimLeft(line, " ")
+		text = strings.TrimRight(stripYAMLComment(trimmed), " \t")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if text[0] == '\t' {
+			return 0, "", false, p.errorf("tabs cannot indent")
+		}
+		return len(line) - len(trimmed), text, true, nil
+	}
+	return 0, "", false, nil
+}
+
+// node parses the value starting on the current line, whose indentation is indent
+func (p *yamlParser) node(indent int) (*yamlNode, error) {
+	_, text, _, _ := p.peek()
+	switch {
+	case text == "-" || strings.HasPrefix(text, "- "):
+		return p.seq(indent)
+	case text[0] == '|' || text[0] == '>':
+		return p.blockScalar(text, indent-1)
+	case text[0] == '?':
+		return nil, p.errorf("complex keys are not supported")
+	}
+	if _, _, ok, err := yamlMapEntry(text); err != nil {
+		return nil, p.errorf("%v", err)
+	} else if ok {
+		return p.mapping(indent)
+	}
+	n, err := parseYAMLFlow(text)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	p.pos++
+	return n, nil
+}
+
+// mapping parses the block mapping whose keys are indented by indent, a key present several times takes its last value
+func (p *yamlParser) mapping(indent int) (*yamlNode, error) {
+	n := &yamlNode{kind: yamlMap}
+	seen := make(map[string]int)
+	for {
+		i, text, ok, err := p.peek()
+		if err != nil || !ok || i < indent {
+			return n, err
+		}
+		if i > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		key, rest, ok, err := yamlMapEntry(text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if !ok {
+			return nil, p.errorf("expected a key")
+		}
+		value, err := p.mapValue(indent, rest)
+		if err != nil {
+			return nil, err
+		}
+		if j, ok := seen[key]; ok {
+			n.items[j] = value
+			continue
+		}
+		seen[key] = len(n.keys)
+		n.keys = append(n.keys, key)
+		n.items = append(n.items, value)
+	}
+}
+
+// mapValue parses the value of a key indented by indent, rest being the text following the key on its line
+func (p *yamlParser) mapValue(indent int, rest string) (*yamlNode, error) {
+	if rest == "" {
+		p.pos++
+		i, text, ok, err := p.peek()
+		switch {
+		case err != nil:
+			return nil, err
+		case ok && i > indent:
+			return p.node(i)
+		case ok && i == indent && (text == "-" || strings.HasPrefix(text, "- ")):
+			// A sequence may be indented like the key it belongs to
+			return p.seq(indent)
+		}
+		return &yamlNode{}, nil
+	}
+	if rest[0] == '|' || rest[0] == '>' {
+		return p.blockScalar(rest, indent)
+	}
+	n, err := parseYAMLFlow(rest)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	p.pos++
+	return n, nil
+}
+
+// seq parses the block sequence whose items are indented by indent
+func (p *yamlParser) seq(indent int) (*yamlNode, error) {
+	n := &yamlNode{kind: yamlSeq}
+	for {
+		i, text, ok, err := p.peek()
+		if err != nil || !ok || i < indent {
+			return n, err
+		}
+		if i > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		if text != "-" && !strings.HasPrefix(text, "- ") {
+			return n, nil
+		}
+		// The item is parsed as if the dash was a space, its content being indented by its column
+		line := p.lines[p.pos]
+		p.lines[p.pos] = line[:indent] + " " + line[indent+1:]
+		item := &yamlNode{}
+		if i, _, ok, err := p.peek(); err != nil {
+			return nil, err
+		} else if ok && i > indent {
+			if item, err = p.node(i); err != nil {
+				return nil, err
+			}
+		}
+		n.items = append(n.items, item)
+	}
+}
+
+// blockScalar parses a literal (|) or folded (>) block scalar, header being the text on its first line.
+// Its content must be indented by more than parent.
+func (p *yamlParser) blockScalar(header string, parent int) (*yamlNode, error) {
+	literal, chomp, indent := header[0] == '|', byte(0), -1
+	for _, c := range header[1:] {
+		switch {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = byte(c)
+		case c >= '1' && c <= '9' && indent < 0:
+			indent = parent + 1 + int(c-'1')
+		default:
+			return nil, p.errorf("invalid block scalar header %q", header)
+		}
+	}
+	p.pos++
+
+	var lines []string
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			if indent >= 0 && len(line) > indent {
+				line = line[indent:]
+			} else {
+				line = ""
+			}
+			lines = append(lines, line)
+			continue
+		}
+		lead := len(line) - len(strings.TrimLeft(line, " "))
+		if indent < 0 {
+			if lead <= parent {
+				break
+			}
+			indent = lead
+		}
+		if lead < indent {
+			break
+		}
+		lines = append(lines, line[indent:])
+	}
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var b strings.Builder
+	if literal {
+		b.WriteString(strings.Join(lines, "\n"))
+	} else {
+		// Line breaks between lines of text are folded into spaces, unless the lines are more indented
+		more := func(s string) bool { return s[0] == ' ' || s[0] == '\t' }
+		i := 0
+		for ; i < len(lines) && lines[i] == ""; i++ {
+			b.WriteByte('\n')
+		}
+		for i < len(lines) {
+			b.WriteString(lines[i])
+			j := i + 1
+			for j < len(lines) && lines[j] == "" {
+				j++
+			}
+			if j == len(lines) {
+				break
+			}
+			breaks := j - i - 1
+			if more(lines[i]) || more(lines[j]) {
+				breaks++
+			}
+			if breaks == 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(strings.Repeat("\n", breaks))
+			i = j
+		}
+	}
+	switch {
+	case chomp == '+':
+		b.WriteString(strings.Repeat("\n", trailing+1))
+	case chomp == 0 && len(lines) > 0:
+		b.WriteByte('\n')
+	}
+	return &yamlNode{value: b.String(), quoted: true}, nil
+}
+
+// stripYAMLComment removes the comment ending line, a # starting a comment when it follows a blank outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,", line[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlMapEntry splits the text of a line holding "key: value" or "key:", ok is false for other lines
+func yamlMapEntry(text string) (key, rest string, ok bool, err error) {
+	if text[0] == '"' || text[0] == '\'' {
+		f := &yamlFlow{s: text}
+		n, err := f.quoted()
+		if err != nil {
+			return "", "", false, err
+		}
+		f.skipSpaces()
+		if f.i == len(f.s) || f.s[f.i] != ':' || (f.i+1 < len(f.s) && f.s[f.i+1] != ' ' && f.s[f.i+1] != '\t') {
+			return "", "", false, nil
+		}
+		return n.value, strings.TrimSpace(f.s[f.i+1:]), true, nil
+	}
+	if strings.IndexByte("[{", text[0]) >= 0 {
+		return "", "", false, nil
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t') {
+			return strings.TrimRight(text[:i], " \t"), strings.TrimSpace(text[i+1:]), true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// yamlFlow parses a value written on a single line: a plain or quoted scalar, or a flow collection
+type yamlFlow struct {
+	s string
+	i int
+}
+
+// parseYAMLFlow parses s, the whole text of a value
+func parseYAMLFlow(s string) (*yamlNode, error) {
+	f := &yamlFlow{s: s}
+	n, err := f.value(false)
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpaces(); f.i != len(f.s) {
+		return nil, fmt.Errorf("unexpected %q after the value", f.s[f.i:])
+	}
+	return n, nil
+}
+
+func (f *yamlFlow) skipSpaces() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+// value parses the next value, inFlow is set inside a flow collection where plain scalars stop at , ] and }
+func (f *yamlFlow) value(inFlow bool) (*yamlNode, error) {
+	f.skipSpaces()
+	if f.i == len(f.s) {
+		return &yamlNode{}, nil
+	}
+	switch c := f.s[f.i]; c {
+	case '[', '{':
+		return f.collection()
+	case '"', '\'':
+		return f.quoted()
+	case '&', '*', '!':
+		return nil, errors.New("anchors, aliases and tags are not supported")
+	case '|', '>', '%', '@', '`':
+		return nil, fmt.Errorf("unexpected %q", c)
+	}
+	start := f.i
+	for ; f.i < len(f.s); f.i++ {
+		c := f.s[f.i]
+		if inFlow && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		if inFlow && c == ':' && (f.i+1 == len(f.s) || strings.IndexByte(" \t,]}", f.s[f.i+1]) >= 0) {
+			break
+		}
+	}
+	return &yamlNode{value: strings.TrimRight(f.s[start:f.i], " \t")}, nil
+}
+
+// collection parses a flow sequence [a, b] or a flow mapping {a: 1, b: 2}
+func (f *yamlFlow) collection() (*yamlNode, error) {
+	n := &yamlNode{kind: yamlSeq}
+	end := byte(']')
+	if f.s[f.i] == '{' {
+		n.kind, end = yamlMap, '}'
+	}
+	f.i++
+	for {
+		if f.skipSpaces(); f.i < len(f.s) && f.s[f.i] == end {
+			f.i++
+			return n, nil
+		}
+		item, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		if n.kind == yamlMap {
+			if item.kind != yamlScalar {
+				return nil, errors.New("complex keys are not supported")
+			}
+			n.keys = append(n.keys, item.value)
+			item = &yamlNode{}
+			if f.skipSpaces(); f.i < len(f.s) && f.s[f.i] == ':' {
+				f.i++
+				if item, err = f.value(true); err != nil {
+					return nil, err
+				}
+			}
+		}
+		n.items = append(n.items, item)
+		f.skipSpaces()
+		switch {
+		case f.i == len(f.s):
+			return nil, errors.New("flow collections must be written on a single line")
+		case f.s[f.i] == ',':
+			f.i++
+		case f.s[f.i] != end:
+			return nil, fmt.Errorf("unexpected %q in a flow collection", f.s[f.i])
+		}
+	}
+}
+
+// yamlEscapes are the single character escapes of double-quoted scalars
+var yamlEscapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f", 'r': "\r", 'e': "\x1b",
+	' ': " ", '"': "\"", '/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0", 'L': "\u2028", 'P': "\u2029",
+}
+
+// quoted parses a single or double-quoted scalar
+func (f *yamlFlow) quoted() (*yamlNode, error) {
+	q := f.s[f.i]
+	f.i++
+	var b strings.Builder
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		switch {
+		case q == '\'' && c == '\'' && f.i+1 < len(f.s) && f.s[f.i+1] == '\'':
+			b.WriteByte('\'')
+			f.i += 2
+		case c == q:
+			f.i++
+			return &yamlNode{value: b.String(), quoted: true}, nil
+		case q == '"' && c == '\\' && f.i+1 < len(f.s):
+			e := f.s[f.i+1]
+			f.i += 2
+			if s, ok := yamlEscapes[e]; ok {
+				b.WriteString(s)
+				continue
+			}
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+			if size == 0 || f.i+size > len(f.s) {
+				return nil, fmt.Errorf("invalid escape \\%c", e)
+			}
+			r, err := strconv.ParseUint(f.s[f.i:f.i+size], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid escape \\%c%s", e, f.s[f.i:f.i+size])
+			}
+			b.WriteRune(rune(r))
+			f.i += size
+		default:
+			b.WriteByte(c)
+			f.i++
+		}
+	}
+	return nil, errors.New("quoted scalars must end on their line")
+}